@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	invoiceService "github.com/PP-Groupe-6/invoice-microservice/invoice_microservice"
+)
+
+// Les commandes sont lancées avec le nom de la commande en premier argument :
+//
+//	invoice-microservice reconcile [-format json|csv] [-quarantine] [-release <client id>]
+//	invoice-microservice fec -issuer <client id> -from 2006-01-02 -to 2006-12-31 [-o <file>]
+//	invoice-microservice outbox [-attempts <n>] [-older <duration>] [-retry <outbox id>]
+var commands = map[string]func(info invoiceService.DbConnexionInfo, args []string) error{
+	"reconcile": reconcileCommand,
+	"fec":       fecCommand,
+	"outbox":    outboxCommand,
+}
+
+func runCommand(info invoiceService.DbConnexionInfo, args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+
+	if err := command(info, args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return true
+}
+
+func reconcileCommand(info invoiceService.DbConnexionInfo, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	format := flags.String("format", "json", "format of the report, json or csv")
+	quarantine := flags.Bool("quarantine", false, "quarantine the accounts with discrepancies")
+	release := flags.String("release", "", "lift the quarantine of the given account instead of reconciling")
+	flags.Parse(args)
+
+	reconciler := invoiceService.NewReconciler(info)
+
+	if *release != "" {
+		return reconciler.Release(context.Background(), *release)
+	}
+
+	report, err := reconciler.Run(context.Background(), *quarantine)
+	if err != nil {
+		return err
+	}
+
+	if *format == "csv" {
+		return report.WriteCSV(os.Stdout)
+	}
+	return report.WriteJSON(os.Stdout)
+}
+
+func fecCommand(info invoiceService.DbConnexionInfo, args []string) error {
+	flags := flag.NewFlagSet("fec", flag.ExitOnError)
+	issuer := flags.String("issuer", "", "client id of the issuer")
+	from := flags.String("from", "", "first day of the period, 2006-01-02")
+	to := flags.String("to", "", "last day of the period, 2006-01-02")
+	output := flags.String("o", "", "file to write, named after the issuer and the end of the period when it is a directory, standard output by default")
+	flags.Parse(args)
+
+	start, end, err := invoiceService.ParsePeriod(*from, *to)
+	if err != nil {
+		return err
+	}
+
+	lines, err := invoiceService.NewInvoiceService(info).GetFECEntries(context.Background(), *issuer, start, end)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return invoiceService.WriteFEC(os.Stdout, lines)
+	}
+
+	path := *output
+	if stat, err := os.Stat(path); err == nil && stat.IsDir() {
+		path = filepath.Join(path, invoiceService.FECFilename(*issuer, end))
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := invoiceService.WriteFEC(f, lines); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func outboxCommand(info invoiceService.DbConnexionInfo, args []string) error {
+	relay := invoiceService.NewOutboxRelay(info, nil)
+
+	flags := flag.NewFlagSet("outbox", flag.ExitOnError)
+	flags.IntVar(&relay.StuckAttempts, "attempts", relay.StuckAttempts, "list the events that failed at least this many times")
+	flags.DurationVar(&relay.StuckAfter, "older", relay.StuckAfter, "list the events waiting for longer than this")
+	retry := flags.Int64("retry", 0, "publish the given event on the next run of the relay instead of listing the stuck events")
+	flags.Parse(args)
+
+	if *retry != 0 {
+		return relay.Retry(context.Background(), *retry)
+	}
+
+	entries, err := relay.Stuck(context.Background())
+	if err != nil {
+		return err
+	}
+
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	return out.Encode(entries)
+}
@@ -6,7 +6,11 @@ require (
 	github.com/go-kit/kit v0.10.0
 	github.com/gorilla/mux v1.8.0
 	github.com/jmoiron/sqlx v1.3.3
+	github.com/jung-kurt/gofpdf v1.16.2
 	github.com/lib/pq v1.10.1
+	github.com/nats-io/nats-server/v2 v2.2.6
+	github.com/nats-io/nats.go v1.11.0
 	github.com/rs/cors v1.7.0
 	github.com/rs/xid v1.3.0
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871 // indirect
 )
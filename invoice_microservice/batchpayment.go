@@ -0,0 +1,196 @@
+package invoice_microservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Modes d'un paiement groupé
+const (
+	BATCH_ALL_OR_NOTHING = "ALL_OR_NOTHING"
+	BATCH_PRIORITY       = "PRIORITY"
+)
+
+// Résultat du paiement d'une facture du lot
+const (
+	BATCH_INVOICE_PAID    = "PAID"
+	BATCH_INVOICE_FAILED  = "FAILED"
+	BATCH_INVOICE_SKIPPED = "SKIPPED"
+)
+
+// État d'un paiement groupé
+const (
+	BATCH_PAID    = "PAID"
+	BATCH_PARTIAL = "PARTIAL"
+	BATCH_FAILED  = "FAILED"
+)
+
+const maxBatchPayment = 100
+
+var ErrInvalidBatch = errors.New("a batch payment needs between 1 and 100 distinct invoice IDs and a mode ALL_OR_NOTHING or PRIORITY")
+
+// BatchPaymentResult is the outcome of the payment of one invoice of the batch.
+type BatchPaymentResult struct {
+	InvoiceID string  `json:"invoice_id"`
+	Status    string  `json:"status"`
+	Amount    float64 `json:"amount"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// BatchPayment pays several invoices of a payer in a single transaction. In ALL_OR_NOTHING mode
+// the first failure cancels the whole batch, in PRIORITY mode the invoices are paid in the given
+// order until the balance runs out.
+type BatchPayment struct {
+	PayerID string               `json:"payer_id"`
+	Mode    string               `json:"mode"`
+	State   string               `json:"state"`
+	Total   float64              `json:"total"` // montant payé
+	Results []BatchPaymentResult `json:"results"`
+}
+
+// validate checks the batch before any payment, the mode defaults to ALL_OR_NOTHING.
+func (b *BatchPayment) validate(ids []string) error {
+	if b.Mode == "" {
+		b.Mode = BATCH_ALL_OR_NOTHING
+	}
+	if b.Mode != BATCH_ALL_OR_NOTHING && b.Mode != BATCH_PRIORITY {
+		return ErrInvalidBatch
+	}
+	if len(ids) == 0 || len(ids) > maxBatchPayment {
+		return ErrInvalidBatch
+	}
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if id == "" || seen[id] {
+			return ErrInvalidBatch
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// batchFailure returns true if err only concerns the invoice being paid : the transaction is still
+// usable and the batch can report it. Any other error aborts the batch.
+func batchFailure(err error) bool {
+	switch err {
+	case ErrNotFound, ErrNotPayer, ErrAlreadyPaid, ErrInsufficientBalance, ErrAccountQuarantined, ErrAccountNotFound, ErrSameAccount, ErrInvalidAmount:
+		return true
+	default:
+		return false
+	}
+}
+
+// add records the payment of an invoice and returns false when the next invoices must not be paid.
+func (b *BatchPayment) add(id string, amount float64, err error) bool {
+	if err == nil {
+		b.Results = append(b.Results, BatchPaymentResult{InvoiceID: id, Status: BATCH_INVOICE_PAID, Amount: amount})
+		b.Total = roundCents(b.Total + amount)
+		return true
+	}
+	b.Results = append(b.Results, BatchPaymentResult{InvoiceID: id, Status: BATCH_INVOICE_FAILED, Error: err.Error()})
+	// En mode priorité on continue, sauf quand il n'y a plus d'argent
+	return b.Mode == BATCH_PRIORITY && err != ErrInsufficientBalance
+}
+
+// finish reports the invoices that were not paid and sets the state of the batch. It returns true
+// if the payments must be committed.
+func (b *BatchPayment) finish(ids []string) bool {
+	for _, id := range ids[len(b.Results):] {
+		b.Results = append(b.Results, BatchPaymentResult{InvoiceID: id, Status: BATCH_INVOICE_SKIPPED})
+	}
+
+	paid := 0
+	for _, r := range b.Results {
+		if r.Status == BATCH_INVOICE_PAID {
+			paid++
+		}
+	}
+	switch {
+	case paid == len(ids):
+		b.State = BATCH_PAID
+	case paid > 0 && b.Mode == BATCH_PRIORITY:
+		b.State = BATCH_PARTIAL
+	default:
+		// Rien n'est payé : les paiements déjà faits sont annulés avec la transaction
+		b.State = BATCH_FAILED
+		b.Total = 0
+		for i := range b.Results {
+			if b.Results[i].Status == BATCH_INVOICE_PAID {
+				b.Results[i] = BatchPaymentResult{InvoiceID: b.Results[i].InvoiceID, Status: BATCH_INVOICE_SKIPPED}
+			}
+		}
+	}
+	return b.State != BATCH_FAILED
+}
+
+// PayInvoices pays the given invoices of the payer in a single transaction, in the given order.
+// Each invoice is paid entirely like with PayInvoice, installments included.
+func (s *invoiceService) PayInvoices(ctx context.Context, payerID string, ids []string, mode string) (BatchPayment, error) {
+	if payerID == "" {
+		return BatchPayment{}, ErrNotAnId
+	}
+	batch := BatchPayment{PayerID: payerID, Mode: mode, Results: make([]BatchPaymentResult, 0, len(ids))}
+	if err := batch.validate(ids); err != nil {
+		return BatchPayment{}, err
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return BatchPayment{}, err
+	}
+	defer tx.Rollback()
+
+	events := make([]Event, 0, len(ids))
+	for _, id := range ids {
+		invoice, paid, err := payBatchInvoice(tx, payerID, id)
+		if err != nil && !batchFailure(err) {
+			return BatchPayment{}, err
+		}
+		if err == nil {
+			events = append(events, paymentEvent(invoice, paid))
+		}
+		if !batch.add(id, paid, err) {
+			break
+		}
+	}
+
+	if !batch.finish(ids) {
+		return batch, nil
+	}
+	if err := enqueueEvents(tx, events...); err != nil {
+		return BatchPayment{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return BatchPayment{}, err
+	}
+	return batch, nil
+}
+
+// payBatchInvoice pays everything left on the invoice inside tx, after checking it belongs to the payer.
+func payBatchInvoice(tx *sqlx.Tx, payerID string, id string) (Invoice, float64, error) {
+	owner := ""
+	if err := tx.Get(&owner, "SELECT account_invoice_payer_id FROM invoice WHERE invoice_id=$1 FOR UPDATE", id); err != nil {
+		if err == sql.ErrNoRows {
+			return Invoice{}, 0, ErrNotFound
+		}
+		return Invoice{}, 0, err
+	}
+	if owner != payerID {
+		return Invoice{}, 0, ErrNotPayer
+	}
+
+	invoice, paid, err := payInvoiceAmount(tx, id, 0)
+	if err != nil {
+		return Invoice{}, 0, err
+	}
+	if _, err := tx.Exec("UPDATE installment SET installment_state = $1, installment_paid_date = now() WHERE invoice_id=$2 AND installment_state = $3", PAID, id, PENDING); err != nil {
+		return Invoice{}, 0, err
+	}
+	return invoice, paid, nil
+}
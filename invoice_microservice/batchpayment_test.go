@@ -0,0 +1,60 @@
+package invoice_microservice
+
+import (
+	"testing"
+)
+
+func batchStatuses(b BatchPayment) string {
+	s := ""
+	for _, r := range b.Results {
+		s += r.Status[:1]
+	}
+	return s
+}
+
+func TestBatchPayment(t *testing.T) {
+	ids := []string{"a", "b", "c", "d"}
+	cases := []struct {
+		mode     string
+		errs     []error
+		state    string
+		statuses string
+		total    float64
+	}{
+		{BATCH_ALL_OR_NOTHING, []error{nil, nil, nil, nil}, BATCH_PAID, "PPPP", 40},
+		{BATCH_ALL_OR_NOTHING, []error{nil, ErrInsufficientBalance}, BATCH_FAILED, "SFSS", 0},
+		{BATCH_ALL_OR_NOTHING, []error{ErrAlreadyPaid}, BATCH_FAILED, "FSSS", 0},
+		{BATCH_PRIORITY, []error{nil, ErrAlreadyPaid, nil, ErrInsufficientBalance}, BATCH_PARTIAL, "PFPF", 20},
+		{BATCH_PRIORITY, []error{nil, ErrInsufficientBalance}, BATCH_PARTIAL, "PFSS", 10},
+		{BATCH_PRIORITY, []error{ErrInsufficientBalance}, BATCH_FAILED, "FSSS", 0},
+	}
+	for _, c := range cases {
+		b := BatchPayment{Mode: c.mode}
+		for i, err := range c.errs {
+			amount := float64(0)
+			if err == nil {
+				amount = 10
+			}
+			if !b.add(ids[i], amount, err) {
+				break
+			}
+		}
+		commit := b.finish(ids)
+		if b.State != c.state || batchStatuses(b) != c.statuses || b.Total != c.total || commit != (c.state != BATCH_FAILED) {
+			t.Errorf("%s %v : expected %s %s %v, got %s %s %v", c.mode, c.errs, c.state, c.statuses, c.total, b.State, batchStatuses(b), b.Total)
+		}
+	}
+
+	if err := (&BatchPayment{}).validate(ids); err != nil {
+		t.Error(err)
+	}
+	invalid := []BatchPayment{{Mode: "SOME"}, {Mode: BATCH_PRIORITY}}
+	if err := invalid[0].validate(ids); err != ErrInvalidBatch {
+		t.Errorf("Expected an unknown mode to be invalid, got %v", err)
+	}
+	for _, ids := range [][]string{{}, {"a", "a"}, {"a", ""}, make([]string, maxBatchPayment+1)} {
+		if err := invalid[1].validate(ids); err != ErrInvalidBatch {
+			t.Errorf("Expected %v to be invalid, got %v", ids, err)
+		}
+	}
+}
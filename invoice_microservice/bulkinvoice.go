@@ -0,0 +1,404 @@
+package invoice_microservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/rs/xid"
+)
+
+// États d'une émission groupée
+const (
+	BULK_PENDING   = "PENDING"
+	BULK_RUNNING   = "RUNNING"
+	BULK_DONE      = "DONE"
+	BULK_CANCELLED = "CANCELLED"
+)
+
+// États d'une facture d'une émission groupée
+const (
+	BULK_ITEM_PENDING    = "PENDING"
+	BULK_ITEM_PROCESSING = "PROCESSING"
+	BULK_ITEM_CREATED    = "CREATED"
+	BULK_ITEM_FAILED     = "FAILED"
+	BULK_ITEM_CANCELLED  = "CANCELLED"
+)
+
+const maxBulkInvoices = 5000
+
+var (
+	ErrInvalidBulkJob  = errors.New("a bulk issuance needs either 1 to 5000 payer emails or a group, an amount and an expiration date (2006-01-02)")
+	ErrBulkJobNotFound = errors.New("bulk issuance not found")
+	ErrBulkJobFinished = errors.New("bulk issuance is already done or cancelled")
+	ErrBulkInterrupted = errors.New("issuance interrupted, the invoice may not have been created")
+)
+
+const bulkJobColumns = `j.job_id, j.issuer_id, j.group_id, j.amount, j.expiration_date::text AS expiration_date, j.tax_jurisdiction, j.job_state,
+	j.created_at, COALESCE(j.finished_at::text, '') AS finished_at,
+	COUNT(i.position) AS total,
+	COUNT(i.position) FILTER (WHERE i.item_state IN ('PENDING', 'PROCESSING')) AS pending,
+	COUNT(i.position) FILTER (WHERE i.item_state = 'CREATED') AS created,
+	COUNT(i.position) FILTER (WHERE i.item_state = 'FAILED') AS failed,
+	COUNT(i.position) FILTER (WHERE i.item_state = 'CANCELLED') AS cancelled`
+
+const bulkJobFrom = ` FROM bulk_invoice_job j LEFT JOIN bulk_invoice_item i ON i.job_id = j.job_id`
+
+const bulkJobGroupBy = ` GROUP BY j.job_id`
+
+// BulkInvoiceJob issues the same invoice to many payers, in the background. The counters give the
+// progress of the job.
+type BulkInvoiceJob struct {
+	ID              string  `json:"job_id" db:"job_id"`
+	IssuerID        string  `json:"issuer_id" db:"issuer_id"`
+	GroupID         string  `json:"group_id,omitempty" db:"group_id"`
+	Amount          float64 `json:"amount" db:"amount"`
+	ExpirationDate  string  `json:"expiration_date" db:"expiration_date"`
+	TaxJurisdiction string  `json:"tax_jurisdiction,omitempty" db:"tax_jurisdiction"`
+	State           string  `json:"state" db:"job_state"` // PENDING, RUNNING, DONE ou CANCELLED
+	CreatedAt       string  `json:"created_at" db:"created_at"`
+	FinishedAt      string  `json:"finished_at,omitempty" db:"finished_at"`
+	Total           int     `json:"total" db:"total"`
+	Pending         int     `json:"pending" db:"pending"`
+	Created         int     `json:"created" db:"created"`
+	Failed          int     `json:"failed" db:"failed"`
+	Cancelled       int     `json:"cancelled" db:"cancelled"`
+	Progress        int     `json:"progress" db:"-"` // pourcentage de factures traitées
+}
+
+// BulkInvoiceItem is the invoice of one payer of a bulk issuance.
+type BulkInvoiceItem struct {
+	JobID     string `json:"job_id" db:"job_id"`
+	Position  int    `json:"position" db:"position"`
+	Email     string `json:"payer_email" db:"payer_email"`
+	State     string `json:"state" db:"item_state"`
+	InvoiceID string `json:"invoice_id,omitempty" db:"invoice_id"`
+	Error     string `json:"error,omitempty" db:"item_error"`
+}
+
+// validate checks the job and the payer emails, already normalized.
+func (j BulkInvoiceJob) validate(emails []string) error {
+	if j.IssuerID == "" {
+		return ErrNotAnId
+	}
+	if len(emails) == 0 || len(emails) > maxBulkInvoices {
+		return ErrInvalidBulkJob
+	}
+	if roundCents(j.Amount) <= 0 {
+		return ErrInvalidAmount
+	}
+	if _, err := time.Parse("2006-01-02", j.ExpirationDate); err != nil {
+		return ErrInvalidBulkJob
+	}
+	return nil
+}
+
+// progress computes the percentage of invoices processed, created, failed or cancelled.
+func (j *BulkInvoiceJob) progress() {
+	j.Progress = 100
+	if j.Total > 0 {
+		j.Progress = (j.Total - j.Pending) * 100 / j.Total
+	}
+}
+
+// invoice returns the invoice issued to the payer.
+func (j BulkInvoiceJob) invoice(payerID string) Invoice {
+	return Invoice{
+		Amount:            roundCents(j.Amount),
+		State:             PENDING,
+		ExpirationDate:    j.ExpirationDate,
+		AccountPayerId:    payerID,
+		AccountReceiverId: j.IssuerID,
+		TaxJurisdiction:   j.TaxJurisdiction,
+	}
+}
+
+// CreateBulkInvoiceJob records a job issuing the invoice to each of the emails, or to the members
+// of the group when job.GroupID is given. The invoices are created by the BulkInvoicer.
+func (s *invoiceService) CreateBulkInvoiceJob(ctx context.Context, job BulkInvoiceJob, emails []string) (BulkInvoiceJob, error) {
+	if (len(emails) > 0) == (job.GroupID != "") {
+		return BulkInvoiceJob{}, ErrInvalidBulkJob
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return BulkInvoiceJob{}, err
+	}
+	defer tx.Rollback()
+
+	if job.GroupID != "" {
+		if emails, err = groupEmails(tx, job.IssuerID, job.GroupID); err != nil {
+			return BulkInvoiceJob{}, err
+		}
+	}
+	emails = normalizeEmails(emails)
+	if err := job.validate(emails); err != nil {
+		return BulkInvoiceJob{}, err
+	}
+	jurisdiction, err := s.taxJurisdiction(job.TaxJurisdiction)
+	if err != nil {
+		return BulkInvoiceJob{}, err
+	}
+
+	job.ID = xid.New().String()
+	_, err = tx.Exec("INSERT INTO bulk_invoice_job (job_id, issuer_id, group_id, amount, expiration_date, tax_jurisdiction, job_state) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		job.ID, job.IssuerID, job.GroupID, roundCents(job.Amount), job.ExpirationDate, jurisdiction.Code, BULK_PENDING)
+	if err != nil {
+		return BulkInvoiceJob{}, err
+	}
+	for n, mail := range emails {
+		if _, err := tx.Exec("INSERT INTO bulk_invoice_item (job_id, position, payer_email, item_state) VALUES ($1, $2, $3, $4)", job.ID, n, mail, BULK_ITEM_PENDING); err != nil {
+			return BulkInvoiceJob{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return BulkInvoiceJob{}, err
+	}
+	return s.GetBulkInvoiceJob(ctx, job.ID)
+}
+
+// GetBulkInvoiceJob returns the job with its progress.
+func (s *invoiceService) GetBulkInvoiceJob(ctx context.Context, id string) (BulkInvoiceJob, error) {
+	if id == "" {
+		return BulkInvoiceJob{}, ErrNotAnId
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	job := BulkInvoiceJob{}
+	if err := db.Get(&job, "SELECT "+bulkJobColumns+bulkJobFrom+" WHERE j.job_id=$1"+bulkJobGroupBy, id); err != nil {
+		if err == sql.ErrNoRows {
+			return BulkInvoiceJob{}, ErrBulkJobNotFound
+		}
+		return BulkInvoiceJob{}, err
+	}
+	job.progress()
+	return job, nil
+}
+
+// GetBulkInvoiceJobs returns the jobs of the given issuer, the most recent first.
+func (s *invoiceService) GetBulkInvoiceJobs(ctx context.Context, issuerID string) ([]BulkInvoiceJob, error) {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	jobs := make([]BulkInvoiceJob, 0)
+	if err := db.Select(&jobs, "SELECT "+bulkJobColumns+bulkJobFrom+" WHERE j.issuer_id=$1"+bulkJobGroupBy+" ORDER BY j.created_at DESC", issuerID); err != nil {
+		return nil, err
+	}
+	for n := range jobs {
+		jobs[n].progress()
+	}
+	return jobs, nil
+}
+
+// GetBulkInvoiceItems returns the invoices of the job, only the ones in the given state if state is not empty.
+func (s *invoiceService) GetBulkInvoiceItems(ctx context.Context, id string, state string) ([]BulkInvoiceItem, error) {
+	if _, err := s.GetBulkInvoiceJob(ctx, id); err != nil {
+		return nil, err
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	items := make([]BulkInvoiceItem, 0)
+	err := db.Select(&items, "SELECT job_id, position, payer_email, item_state, invoice_id, item_error FROM bulk_invoice_item WHERE job_id=$1 AND ($2::text = '' OR item_state = $2) ORDER BY position", id, state)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// CancelBulkInvoiceJob stops the job : the invoices not created yet are cancelled, the ones already
+// created are kept.
+func (s *invoiceService) CancelBulkInvoiceJob(ctx context.Context, id string) (BulkInvoiceJob, error) {
+	if id == "" {
+		return BulkInvoiceJob{}, ErrNotAnId
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return BulkInvoiceJob{}, err
+	}
+	defer tx.Rollback()
+
+	// Le job est verrouillé avant ses factures, dans le même ordre que le BulkInvoicer
+	state := ""
+	if err := tx.Get(&state, "SELECT job_state FROM bulk_invoice_job WHERE job_id=$1 FOR UPDATE", id); err != nil {
+		if err == sql.ErrNoRows {
+			return BulkInvoiceJob{}, ErrBulkJobNotFound
+		}
+		return BulkInvoiceJob{}, err
+	}
+	if state != BULK_PENDING && state != BULK_RUNNING {
+		return BulkInvoiceJob{}, ErrBulkJobFinished
+	}
+
+	if _, err := tx.Exec("UPDATE bulk_invoice_job SET job_state = $1, finished_at = now() WHERE job_id=$2", BULK_CANCELLED, id); err != nil {
+		return BulkInvoiceJob{}, err
+	}
+	if _, err := tx.Exec("UPDATE bulk_invoice_item SET item_state = $1 WHERE job_id=$2 AND item_state = $3", BULK_ITEM_CANCELLED, id, BULK_ITEM_PENDING); err != nil {
+		return BulkInvoiceJob{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return BulkInvoiceJob{}, err
+	}
+	return s.GetBulkInvoiceJob(ctx, id)
+}
+
+// BulkInvoicer creates the invoices of the bulk issuances, one payer at a time, through
+// GetIdFromMail and Create.
+type BulkInvoicer struct {
+	DbInfos DbConnexionInfo
+	Service InvoiceService
+	Timeout time.Duration // au-delà, une facture en cours est considérée comme interrompue
+}
+
+func NewBulkInvoicer(dbinfos DbConnexionInfo, s InvoiceService) *BulkInvoicer {
+	return &BulkInvoicer{
+		DbInfos: dbinfos,
+		Service: s,
+		Timeout: 10 * time.Minute,
+	}
+}
+
+// Run processes every job not finished yet and returns the number of invoices created.
+func (b *BulkInvoicer) Run(ctx context.Context, logger log.Logger) (int, error) {
+	db := GetDbConnexion(b.DbInfos)
+	// Une facture restée en cours (arrêt du service pendant Create) est signalée en échec
+	_, err := db.Exec("UPDATE bulk_invoice_item SET item_state = $1, item_error = $2 WHERE item_state = $3 AND claimed_at < $4",
+		BULK_ITEM_FAILED, ErrBulkInterrupted.Error(), BULK_ITEM_PROCESSING, time.Now().Add(-b.Timeout))
+	if err != nil {
+		db.Close()
+		return 0, err
+	}
+	ids := make([]string, 0)
+	err = db.Select(&ids, "SELECT job_id FROM bulk_invoice_job WHERE job_state IN ($1, $2) ORDER BY created_at", BULK_PENDING, BULK_RUNNING)
+	db.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for _, id := range ids {
+		for {
+			item, ok, err := b.issue(ctx, id)
+			if err != nil {
+				logger.Log("bulk_invoice", id, "err", err)
+				break
+			}
+			if !ok {
+				break
+			}
+			if item.State == BULK_ITEM_CREATED {
+				created++
+			}
+		}
+		if err := b.finish(id); err != nil {
+			logger.Log("bulk_invoice", id, "err", err)
+		}
+	}
+	return created, nil
+}
+
+// issue creates the invoice of the next payer of the job, it returns false when there is nothing
+// left to do or the job was cancelled. The payer is claimed before the invoice is created so it is
+// never billed twice.
+func (b *BulkInvoicer) issue(ctx context.Context, id string) (BulkInvoiceItem, bool, error) {
+	db := GetDbConnexion(b.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return BulkInvoiceItem{}, false, err
+	}
+	defer tx.Rollback()
+
+	job := BulkInvoiceJob{}
+	err = tx.Get(&job, "SELECT job_id, issuer_id, amount, expiration_date::text AS expiration_date, tax_jurisdiction, job_state FROM bulk_invoice_job WHERE job_id=$1 FOR UPDATE", id)
+	if err != nil {
+		return BulkInvoiceItem{}, false, err
+	}
+	if job.State != BULK_PENDING && job.State != BULK_RUNNING {
+		return BulkInvoiceItem{}, false, nil
+	}
+
+	item := BulkInvoiceItem{}
+	err = tx.Get(&item, "SELECT job_id, position, payer_email, item_state, invoice_id, item_error FROM bulk_invoice_item WHERE job_id=$1 AND item_state = $2 ORDER BY position LIMIT 1 FOR UPDATE SKIP LOCKED", id, BULK_ITEM_PENDING)
+	if err == sql.ErrNoRows {
+		return BulkInvoiceItem{}, false, nil
+	}
+	if err != nil {
+		return BulkInvoiceItem{}, false, err
+	}
+
+	if _, err := tx.Exec("UPDATE bulk_invoice_item SET item_state = $1, claimed_at = now() WHERE job_id=$2 AND position=$3", BULK_ITEM_PROCESSING, id, item.Position); err != nil {
+		return BulkInvoiceItem{}, false, err
+	}
+	if _, err := tx.Exec("UPDATE bulk_invoice_job SET job_state = $1 WHERE job_id=$2", BULK_RUNNING, id); err != nil {
+		return BulkInvoiceItem{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return BulkInvoiceItem{}, false, err
+	}
+
+	item.State = BULK_ITEM_CREATED
+	invoice, err := b.create(ctx, job, item.Email)
+	if err != nil {
+		item.State = BULK_ITEM_FAILED
+		item.Error = err.Error()
+	}
+	item.InvoiceID = invoice.ID
+	_, err = db.Exec("UPDATE bulk_invoice_item SET item_state = $1, invoice_id = $2, item_error = $3 WHERE job_id=$4 AND position=$5",
+		item.State, item.InvoiceID, item.Error, id, item.Position)
+	if err != nil {
+		return BulkInvoiceItem{}, false, err
+	}
+	return item, true, nil
+}
+
+func (b *BulkInvoicer) create(ctx context.Context, job BulkInvoiceJob, mail string) (Invoice, error) {
+	payerID, err := b.Service.GetIdFromMail(ctx, mail)
+	if err == sql.ErrNoRows || (err == nil && payerID == "") {
+		return Invoice{}, ErrUnknownPayer
+	}
+	if err != nil {
+		return Invoice{}, err
+	}
+	if payerID == job.IssuerID {
+		return Invoice{}, ErrSameAccount
+	}
+	return b.Service.Create(ctx, job.invoice(payerID))
+}
+
+// finish marks the job done once every invoice has been processed.
+func (b *BulkInvoicer) finish(id string) error {
+	db := GetDbConnexion(b.DbInfos)
+	defer db.Close()
+
+	_, err := db.Exec(`UPDATE bulk_invoice_job SET job_state = $1, finished_at = now() WHERE job_id=$2 AND job_state IN ($3, $4)
+		AND NOT EXISTS (SELECT 1 FROM bulk_invoice_item WHERE job_id=$2 AND item_state IN ($5, $6))`,
+		BULK_DONE, id, BULK_PENDING, BULK_RUNNING, BULK_ITEM_PENDING, BULK_ITEM_PROCESSING)
+	return err
+}
+
+func (b *BulkInvoicer) Schedule(ctx context.Context, interval time.Duration, logger log.Logger) {
+	RunEvery(ctx, interval, func(ctx context.Context) {
+		created, err := b.Run(ctx, logger)
+		if err != nil {
+			logger.Log("bulk_invoices", "failed", "err", err)
+			return
+		}
+		logger.Log("bulk_invoices", "created", "count", created)
+	})
+}
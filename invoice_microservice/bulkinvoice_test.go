@@ -0,0 +1,55 @@
+package invoice_microservice
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBulkInvoiceJob(t *testing.T) {
+	emails := normalizeEmails([]string{" paul@example.com", "anne@example.com", "", "Paul@example.com ", "marc@example.com"})
+	if strings.Join(emails, ",") != "paul@example.com,anne@example.com,marc@example.com" {
+		t.Errorf("Unexpected emails %v", emails)
+	}
+
+	job := BulkInvoiceJob{IssuerID: "asso", Amount: 25.004, ExpirationDate: "2021-09-30", TaxJurisdiction: "FR"}
+	if err := job.validate(emails); err != nil {
+		t.Fatal(err)
+	}
+	i := job.invoice("paul")
+	if i.Amount != 25 || i.State != PENDING || i.ExpirationDate != "2021-09-30" || i.AccountPayerId != "paul" || i.AccountReceiverId != "asso" || i.TaxJurisdiction != "FR" {
+		t.Errorf("Unexpected invoice %+v", i)
+	}
+
+	invalid := []struct {
+		job      BulkInvoiceJob
+		emails   []string
+		expected error
+	}{
+		{BulkInvoiceJob{Amount: 25, ExpirationDate: "2021-09-30"}, emails, ErrNotAnId},
+		{BulkInvoiceJob{IssuerID: "asso", Amount: 25, ExpirationDate: "2021-09-30"}, nil, ErrInvalidBulkJob},
+		{BulkInvoiceJob{IssuerID: "asso", Amount: 25, ExpirationDate: "2021-09-30"}, make([]string, maxBulkInvoices+1), ErrInvalidBulkJob},
+		{BulkInvoiceJob{IssuerID: "asso", Amount: 0.001, ExpirationDate: "2021-09-30"}, emails, ErrInvalidAmount},
+		{BulkInvoiceJob{IssuerID: "asso", Amount: 25, ExpirationDate: "30/09/2021"}, emails, ErrInvalidBulkJob},
+	}
+	for _, c := range invalid {
+		if err := c.job.validate(c.emails); err != c.expected {
+			t.Errorf("Expected %v for %+v, got %v", c.expected, c.job, err)
+		}
+	}
+
+	cases := []struct {
+		job      BulkInvoiceJob
+		expected int
+	}{
+		{BulkInvoiceJob{Total: 3, Pending: 3}, 0},
+		{BulkInvoiceJob{Total: 3, Pending: 2, Created: 1}, 33},
+		{BulkInvoiceJob{Total: 3, Pending: 0, Created: 1, Failed: 1, Cancelled: 1}, 100},
+		{BulkInvoiceJob{}, 100},
+	}
+	for _, c := range cases {
+		c.job.progress()
+		if c.job.Progress != c.expected {
+			t.Errorf("Expected %d%% for %+v, got %d%%", c.expected, c.job, c.job.Progress)
+		}
+	}
+}
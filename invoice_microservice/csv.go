@@ -0,0 +1,291 @@
+package invoice_microservice
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Aucune facture n'est créée si une ligne est invalide
+	IMPORT_ALL_OR_NOTHING = "all-or-nothing"
+	// Les lignes valides sont créées, les autres sont ignorées
+	IMPORT_BEST_EFFORT = "best-effort"
+)
+
+var (
+	ErrInvalidImportMode = errors.New("import mode must be all-or-nothing or best-effort")
+	ErrInvalidCSVRow     = errors.New("rows must have a payer email, an amount and an expiration date")
+	ErrInvalidExpDate    = errors.New("expiration date must be a date (2006-01-02)")
+	ErrUnknownPayer      = errors.New("no client with this email")
+	ErrImportAborted     = errors.New("import aborted, another row is invalid")
+)
+
+var csvExportHeader = []string{"invoice_id", "invoice_number", "state", "amount", "paid_amount", "remaining", "expiration_date", "payer_id", "receiver_id", "counterparty_name", "counterparty_mail"}
+
+// WalkInvoices calls fn for each invoice of the client, as they are read from the database, so the
+// invoices are never all held in memory.
+func (s *invoiceService) WalkInvoices(ctx context.Context, clientID string, fn func(Invoice) error) error {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	rows, err := db.QueryxContext(ctx, "SELECT * FROM invoice WHERE account_invoice_payer_id=$1 OR account_invoice_receiver_id=$1 ORDER BY invoice_expiration_date, invoice_id", clientID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i Invoice
+		if err := rows.StructScan(&i); err != nil {
+			return err
+		}
+		if err := fn(i); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// CreateResult is the outcome of one of the invoices given to CreateInvoices.
+type CreateResult struct {
+	Invoice Invoice
+	Err     error
+}
+
+// CreateInvoices creates the invoices in a single transaction when atomic is true : if one of them
+// fails none is created and the others get ErrImportAborted. Otherwise each invoice is created on its own.
+func (s *invoiceService) CreateInvoices(ctx context.Context, invoices []Invoice, atomic bool) ([]CreateResult, error) {
+	results := make([]CreateResult, len(invoices))
+
+	if !atomic {
+		for n, invoice := range invoices {
+			results[n].Invoice, results[n].Err = s.Create(ctx, invoice)
+		}
+		return results, nil
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for n, invoice := range invoices {
+		inserted, err := s.insertInvoice(tx, invoice, nil)
+		if err != nil {
+			for m := range results {
+				results[m] = CreateResult{Err: ErrImportAborted}
+			}
+			results[n].Err = err
+			return results, nil
+		}
+		results[n].Invoice = inserted
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for _, r := range results {
+		if err := s.applyMandate(ctx, r.Invoice); err != nil {
+			s.logger.Log("mandate", r.Invoice.ID, "err", err)
+		}
+	}
+	return results, nil
+}
+
+// WriteInvoicesCSV writes the invoices of the client the way the list endpoint filters them : the
+// ones it created when createdBy is true, the ones it received otherwise. Rows are flushed as they
+// are written.
+func WriteInvoicesCSV(ctx context.Context, s InvoiceService, w io.Writer, clientID string, createdBy bool) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(csvExportHeader); err != nil {
+		return err
+	}
+
+	accounts := make(map[string]AccountInfo)
+	err := s.WalkInvoices(ctx, clientID, func(i Invoice) error {
+		other := i.AccountReceiverId
+		if createdBy {
+			if i.AccountReceiverId != clientID {
+				return nil
+			}
+			other = i.AccountPayerId
+		} else if i.AccountPayerId != clientID {
+			return nil
+		}
+
+		account, ok := accounts[other]
+		if !ok {
+			var err error
+			if account, err = s.GetAccountInformation(ctx, other); err != nil {
+				return err
+			}
+			accounts[other] = account
+		}
+
+		err := out.Write([]string{
+			i.ID,
+			i.Number,
+			StateToString(i.State),
+			fmt.Sprint(i.Amount),
+			fmt.Sprint(i.PaidAmount),
+			fmt.Sprint(i.Remaining()),
+			i.ExpirationDate,
+			i.AccountPayerId,
+			i.AccountReceiverId,
+			csvText(strings.TrimSpace(account.Name + " " + account.Surname)),
+			csvText(account.Mail),
+		})
+		if err != nil {
+			return err
+		}
+		out.Flush()
+		return out.Error()
+	})
+	if err != nil {
+		return err
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// ImportRowResult is the outcome of a row of an imported CSV file, Row is its line in the file.
+type ImportRowResult struct {
+	Row       int    `json:"row"`
+	Created   bool   `json:"created"`
+	InvoiceID string `json:"invoice_id,omitempty"`
+	Number    string `json:"invoice_number,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type ImportReport struct {
+	Mode    string            `json:"mode"`
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	Results []ImportRowResult `json:"results"`
+}
+
+// ImportInvoicesCSV issues an invoice from issuerID for each row (payer email, amount, expiration date)
+// of the CSV file. A first row starting with payer_email is a header and is skipped. Every row is
+// checked, the payer through GetIdFromMail, before anything is created.
+func ImportInvoicesCSV(ctx context.Context, s InvoiceService, r io.Reader, issuerID string, mode string) (ImportReport, error) {
+	if mode == "" {
+		mode = IMPORT_ALL_OR_NOTHING
+	}
+	if mode != IMPORT_ALL_OR_NOTHING && mode != IMPORT_BEST_EFFORT {
+		return ImportReport{}, ErrInvalidImportMode
+	}
+	if issuerID == "" {
+		return ImportReport{}, ErrNotAnId
+	}
+
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	in.TrimLeadingSpace = true
+
+	report := ImportReport{Mode: mode, Results: make([]ImportRowResult, 0)}
+	invoices := make([]Invoice, 0)
+	valid := make([]int, 0) // index dans report.Results des lignes valides
+
+	for line := 1; ; line++ {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ImportReport{}, err
+		}
+		if line == 1 && len(record) > 0 && strings.EqualFold(strings.TrimSpace(record[0]), "payer_email") {
+			continue
+		}
+
+		invoice, err := parseImportRow(ctx, s, record, issuerID)
+		result := ImportRowResult{Row: line}
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			invoices = append(invoices, invoice)
+			valid = append(valid, len(report.Results))
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	invalid := len(report.Results) - len(valid)
+	if mode == IMPORT_ALL_OR_NOTHING && invalid > 0 {
+		for _, n := range valid {
+			report.Results[n].Error = ErrImportAborted.Error()
+		}
+		report.Failed = len(report.Results)
+		return report, nil
+	}
+
+	created, err := s.CreateInvoices(ctx, invoices, mode == IMPORT_ALL_OR_NOTHING)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	for n, c := range created {
+		result := &report.Results[valid[n]]
+		if c.Err != nil {
+			result.Error = c.Err.Error()
+			continue
+		}
+		result.Created = true
+		result.InvoiceID = c.Invoice.ID
+		result.Number = c.Invoice.Number
+		report.Created++
+	}
+	report.Failed = len(report.Results) - report.Created
+
+	return report, nil
+}
+
+func parseImportRow(ctx context.Context, s InvoiceService, record []string, issuerID string) (Invoice, error) {
+	if len(record) < 3 {
+		return Invoice{}, ErrInvalidCSVRow
+	}
+	mail, rawAmount, expDate := strings.TrimSpace(record[0]), strings.TrimSpace(record[1]), strings.TrimSpace(record[2])
+
+	// Les tableurs français écrivent les montants avec une virgule
+	amount, err := strconv.ParseFloat(strings.Replace(rawAmount, ",", ".", 1), 64)
+	if err != nil || roundCents(amount) <= 0 {
+		return Invoice{}, ErrInvalidAmount
+	}
+	if _, err := time.Parse("2006-01-02", expDate); err != nil {
+		return Invoice{}, ErrInvalidExpDate
+	}
+
+	payerID, err := s.GetIdFromMail(ctx, mail)
+	if err != nil || payerID == "" {
+		return Invoice{}, ErrUnknownPayer
+	}
+	if payerID == issuerID {
+		return Invoice{}, ErrSameAccount
+	}
+
+	return Invoice{
+		Amount:            roundCents(amount),
+		State:             PENDING,
+		ExpirationDate:    expDate,
+		AccountPayerId:    payerID,
+		AccountReceiverId: issuerID,
+	}, nil
+}
+
+// csvText neutralizes a value typed by a client : a cell starting with =, +, -, @, a tab or a carriage
+// return is read as a formula by spreadsheets, the leading quote makes them show it as text.
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
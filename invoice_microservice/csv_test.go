@@ -0,0 +1,132 @@
+package invoice_microservice
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// csvTestService only implements what the CSV import and export use.
+type csvTestService struct {
+	InvoiceService
+	clients  map[string]string // mail -> id
+	accounts map[string]AccountInfo
+	invoices []Invoice
+	created  []Invoice
+}
+
+func (s *csvTestService) GetIdFromMail(ctx context.Context, mail string) (string, error) {
+	id, ok := s.clients[mail]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return id, nil
+}
+
+func (s *csvTestService) GetAccountInformation(ctx context.Context, id string) (AccountInfo, error) {
+	if account, ok := s.accounts[id]; ok {
+		return account, nil
+	}
+	return AccountInfo{Name: "Client", Surname: id, Mail: id + "@example.com"}, nil
+}
+
+func (s *csvTestService) CreateInvoices(ctx context.Context, invoices []Invoice, atomic bool) ([]CreateResult, error) {
+	results := make([]CreateResult, len(invoices))
+	for n, i := range invoices {
+		i.ID = "inv" + string(rune('a'+len(s.created)))
+		s.created = append(s.created, i)
+		results[n].Invoice = i
+	}
+	return results, nil
+}
+
+func (s *csvTestService) WalkInvoices(ctx context.Context, clientID string, fn func(Invoice) error) error {
+	for _, i := range s.invoices {
+		if err := fn(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const importFile = `payer_email,amount,expiration_date
+paul@example.com,120.50,2021-05-01
+unknown@example.com,10,2021-05-01
+paul@example.com,"99,90",2021-06-01
+paul@example.com,-3,2021-06-01
+`
+
+func TestImportInvoicesCSV(t *testing.T) {
+	s := &csvTestService{clients: map[string]string{"paul@example.com": "paul", "anne@example.com": "anne"}}
+
+	report, err := ImportInvoicesCSV(context.Background(), s, strings.NewReader(importFile), "anne", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Created != 0 || report.Failed != 4 || len(s.created) != 0 {
+		t.Fatalf("An all-or-nothing import with invalid rows should create nothing : %+v", report)
+	}
+	if report.Results[1].Error != ErrUnknownPayer.Error() || report.Results[0].Error != ErrImportAborted.Error() || report.Results[3].Row != 5 {
+		t.Errorf("Unexpected results : %+v", report.Results)
+	}
+
+	report, err = ImportInvoicesCSV(context.Background(), s, strings.NewReader(importFile), "anne", IMPORT_BEST_EFFORT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Created != 2 || report.Failed != 2 {
+		t.Fatalf("Expected 2 invoices created and 2 rows failed : %+v", report)
+	}
+	if !report.Results[2].Created || report.Results[2].InvoiceID == "" || report.Results[3].Error != ErrInvalidAmount.Error() {
+		t.Errorf("Unexpected results : %+v", report.Results)
+	}
+	if s.created[1].Amount != 99.9 || s.created[1].AccountPayerId != "paul" || s.created[1].AccountReceiverId != "anne" {
+		t.Errorf("Unexpected invoice : %+v", s.created[1])
+	}
+
+	if _, err := ImportInvoicesCSV(context.Background(), s, strings.NewReader(importFile), "anne", "some"); err != ErrInvalidImportMode {
+		t.Errorf("Expected ErrInvalidImportMode, got %v", err)
+	}
+}
+
+func TestWriteInvoicesCSV(t *testing.T) {
+	s := &csvTestService{invoices: []Invoice{
+		{ID: "a", Number: "2021-000001", Amount: 10, State: PENDING, ExpirationDate: "2021-05-01", AccountPayerId: "paul", AccountReceiverId: "anne"},
+		{ID: "b", Amount: 20, PaidAmount: 5, State: PARTIALLY_PAID, ExpirationDate: "2021-05-02", AccountPayerId: "anne", AccountReceiverId: "paul"},
+	}}
+
+	var buf bytes.Buffer
+	if err := WriteInvoicesCSV(context.Background(), s, &buf, "anne", true); err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join(csvExportHeader, ",") + "\n" +
+		"a,2021-000001,Pending,10,0,10,2021-05-01,paul,anne,Client paul,paul@example.com\n"
+	if buf.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := WriteInvoicesCSV(context.Background(), s, &buf, "anne", false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "b,,Partially paid,20,5,15,") || strings.Contains(buf.String(), "\na,") {
+		t.Errorf("Received invoices expected, got\n%s", buf.String())
+	}
+
+	// Les noms et emails saisis par les clients ne doivent pas être interprétés comme des formules
+	s.accounts = map[string]AccountInfo{"paul": {Name: "=HYPERLINK(\"http://evil\")", Mail: "@SUM(A1)"}}
+	buf.Reset()
+	if err := WriteInvoicesCSV(context.Background(), s, &buf, "anne", true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `,paul,anne,"'=HYPERLINK(""http://evil"")",'@SUM(A1)`) {
+		t.Errorf("Expected the formulas to be quoted, got\n%s", buf.String())
+	}
+	for value, expected := range map[string]string{"+33 6": "'+33 6", "-1": "'-1", "Anne": "Anne", "": ""} {
+		if got := csvText(value); got != expected {
+			t.Errorf("csvText(%q) : expected %q, got %q", value, expected, got)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package invoice_microservice
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidDiscountTerms = errors.New("discount rate must be between 0 and 100 and the discount period cannot be negative")
+)
+
+// DiscountTerms offer the payer Rate percent off the invoice when it is paid within Days days of its creation.
+type DiscountTerms struct {
+	Rate float64 `json:"rate"` // en pourcentage
+	Days int     `json:"days"`
+}
+
+func (t DiscountTerms) validate() error {
+	if t.Rate < 0 || t.Rate >= 100 || t.Days < 0 {
+		return ErrInvalidDiscountTerms
+	}
+	return nil
+}
+
+// Apply sets the terms on the invoice, the discount deadline being Days days after from.
+func (t DiscountTerms) Apply(invoice Invoice, from time.Time) (Invoice, error) {
+	if err := t.validate(); err != nil {
+		return Invoice{}, err
+	}
+	if t.Rate == 0 {
+		return invoice, nil
+	}
+	invoice.DiscountRate = t.Rate
+	invoice.DiscountDeadline = from.AddDate(0, 0, t.Days).Format("2006-01-02")
+	return invoice, nil
+}
+
+// EarlyPaymentDiscount returns the discount granted if the invoice is paid in full at now, 0 once
+// the deadline has passed or a discount was already granted. The rate applies to what is left to pay,
+// the part already paid by installments or partial payments is not discounted.
+func (i Invoice) EarlyPaymentDiscount(now time.Time) float64 {
+	if i.DiscountRate <= 0 || i.DiscountDeadline == "" || i.DiscountAmount > 0 || !payable(i.State) {
+		return 0
+	}
+	// Le jour de la date limite est inclus
+	if now.Format("2006-01-02") > i.DiscountDeadline {
+		return 0
+	}
+	discount := roundCents(i.Remaining() * i.DiscountRate / 100)
+	if discount > i.Remaining() {
+		return i.Remaining()
+	}
+	return discount
+}
+
+// Payable returns the amount the payer has to pay at now to settle the invoice.
+func (i Invoice) Payable(now time.Time) float64 {
+	return roundCents(i.Remaining() - i.EarlyPaymentDiscount(now))
+}
@@ -0,0 +1,49 @@
+package invoice_microservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEarlyPaymentDiscount(t *testing.T) {
+	created := time.Date(2021, 4, 1, 15, 0, 0, 0, time.UTC)
+
+	invoice, err := DiscountTerms{Rate: 2, Days: 10}.Apply(Invoice{Amount: 1234.56, State: PENDING}, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoice.DiscountDeadline != "2021-04-11" {
+		t.Fatalf("Expected the deadline 10 days after creation, got %s", invoice.DiscountDeadline)
+	}
+
+	// 2% de 1234.56 = 24.6912 arrondi à 24.69
+	if d := invoice.EarlyPaymentDiscount(time.Date(2021, 4, 11, 23, 0, 0, 0, time.UTC)); d != 24.69 {
+		t.Errorf("Expected a discount of 24.69 on the deadline, got %v", d)
+	}
+	if p := invoice.Payable(created); p != 1209.87 {
+		t.Errorf("Expected 1209.87 to pay within the window, got %v", p)
+	}
+	if p := invoice.Payable(time.Date(2021, 4, 12, 0, 0, 0, 0, time.UTC)); p != 1234.56 {
+		t.Errorf("Expected the full amount after the deadline, got %v", p)
+	}
+
+	invoice.PaidAmount, invoice.DiscountAmount, invoice.State = 1209.87, 24.69, PAID
+	if invoice.Remaining() != 0 || invoice.EarlyPaymentDiscount(created) != 0 {
+		t.Errorf("A discounted invoice should be settled, remaining %v", invoice.Remaining())
+	}
+
+	// L'escompte porte sur ce qui reste à payer : 2% de 600
+	partial := Invoice{Amount: 1000, PaidAmount: 400, State: PARTIALLY_PAID, DiscountRate: 2, DiscountDeadline: "2021-04-11"}
+	if d := partial.EarlyPaymentDiscount(created); d != 12 || partial.Payable(created) != 588 {
+		t.Errorf("Expected a discount of 12 on the 600 left, got %v", d)
+	}
+	// 50% de 0.01 arrondi à 0.01 : l'escompte solde la facture
+	partial.PaidAmount, partial.DiscountRate = 999.99, 50
+	if d := partial.EarlyPaymentDiscount(created); d != 0.01 || partial.Payable(created) != 0 {
+		t.Errorf("Expected the discount to cover the cent left, got %v", d)
+	}
+
+	if _, err := (DiscountTerms{Rate: 100, Days: 10}).Apply(Invoice{}, created); err != ErrInvalidDiscountTerms {
+		t.Errorf("Expected ErrInvalidDiscountTerms, got %v", err)
+	}
+}
@@ -0,0 +1,733 @@
+package invoice_microservice
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Normes de facture électronique : EN 16931, syntaxes UBL 2.1 et CII (Factur-X)
+const (
+	EN16931Customization = "urn:cen.eu:en16931:2017"
+	CommercialInvoice    = "380"
+	InvoiceCurrency      = "EUR"
+
+	ublNamespace    = "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2"
+	ublCacNamespace = "urn:oasis:names:specification:ubl:schema:xsd:CommonAggregateComponents-2"
+	ublCbcNamespace = "urn:oasis:names:specification:ubl:schema:xsd:CommonBasicComponents-2"
+	ciiRsmNamespace = "urn:un:unece:uncefact:data:standard:CrossIndustryInvoice:100"
+	ciiRamNamespace = "urn:un:unece:uncefact:data:standard:ReusableAggregateBusinessInformationEntity:100"
+	ciiUdtNamespace = "urn:un:unece:uncefact:data:standard:UnqualifiedDataType:100"
+
+	// Quantité sans unité
+	unitCode = "C62"
+	// Adresse électronique de type email
+	emailScheme = "EM"
+)
+
+// eInvoice is the content shared by the UBL and CII syntaxes. Invoices without line items are
+// exported with a single line of their amount, late fees are charges not subject to VAT.
+type eInvoice struct {
+	ID        string
+	IssueDate time.Time
+	DueDate   time.Time
+	Country   string
+	Seller    AccountInfo
+	Buyer     AccountInfo
+	Lines     []LineItem
+	Taxes     []TaxBreakdown
+	Charges   []LateFee
+	LineTotal float64
+	Charge    float64
+	TaxBasis  float64
+	Tax       float64
+	Total     float64
+	Prepaid   float64
+	Payable   float64
+}
+
+func newEInvoice(doc InvoiceDocument) eInvoice {
+	e := eInvoice{
+		ID:        doc.Invoice.Reference(),
+		IssueDate: doc.Date,
+		DueDate:   parseDate(doc.Invoice.ExpirationDate),
+		Country:   doc.Invoice.TaxJurisdiction,
+		Seller:    doc.Issuer,
+		Buyer:     doc.Payer,
+		Lines:     doc.Items,
+		Taxes:     make([]TaxBreakdown, 0, len(doc.Taxes)+1),
+		Charges:   doc.LateFees,
+		Prepaid:   doc.Invoice.PaidAmount,
+	}
+	if e.Country == "" {
+		e.Country = DefaultTaxJurisdiction
+	}
+	if created := parseDate(doc.Invoice.CreatedAt); !created.IsZero() {
+		e.IssueDate = created
+	}
+
+	if len(e.Lines) == 0 {
+		amount := roundCents(doc.Invoice.Amount)
+		for _, fee := range doc.LateFees {
+			amount = roundCents(amount - fee.Amount)
+		}
+		e.Lines = []LineItem{{Position: 1, Description: "Facture " + doc.Invoice.Reference(), Quantity: 1, UnitPrice: amount, Net: amount, Total: amount}}
+		e.Taxes = append(e.Taxes, TaxBreakdown{Net: amount, Gross: amount})
+	} else {
+		e.Taxes = append(e.Taxes, doc.Taxes...)
+	}
+
+	for _, l := range e.Lines {
+		e.LineTotal = roundCents(e.LineTotal + l.Net)
+	}
+	for _, fee := range e.Charges {
+		e.Charge = roundCents(e.Charge + fee.Amount)
+	}
+	if e.Charge > 0 {
+		e.addZeroRated(e.Charge)
+	}
+	for _, t := range e.Taxes {
+		e.Tax = roundCents(e.Tax + t.Tax)
+	}
+	e.TaxBasis = roundCents(e.LineTotal + e.Charge)
+	e.Total = roundCents(e.TaxBasis + e.Tax)
+	// L'escompte n'est pas une remise du document, le montant dû est le total moins ce qui a été payé (BR-CO-16)
+	e.Payable = roundCents(e.Total - e.Prepaid)
+
+	return e
+}
+
+// addZeroRated adds amount to the subtotal at 0 %.
+func (e *eInvoice) addZeroRated(amount float64) {
+	for n := range e.Taxes {
+		if e.Taxes[n].Rate == 0 {
+			e.Taxes[n].Net = roundCents(e.Taxes[n].Net + amount)
+			e.Taxes[n].Gross = roundCents(e.Taxes[n].Gross + amount)
+			return
+		}
+	}
+	e.Taxes = append(e.Taxes, TaxBreakdown{Net: amount, Gross: amount})
+}
+
+// taxCategory returns the VAT category code of a rate : standard rate or zero rated.
+func taxCategory(rate float64) string {
+	if rate == 0 {
+		return "Z"
+	}
+	return "S"
+}
+
+// parseDate reads the date part of the expiration dates, written 2006-01-02 or RFC 3339.
+func parseDate(date string) time.Time {
+	if len(date) >= 10 {
+		if t, err := time.Parse("2006-01-02", date[:10]); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func formatAmount(amount float64) string {
+	return fmt.Sprintf("%.2f", amount)
+}
+
+type ublAmount struct {
+	Currency string `xml:"currencyID,attr"`
+	Value    string `xml:",chardata"`
+}
+
+func newUBLAmount(amount float64) ublAmount {
+	return ublAmount{InvoiceCurrency, formatAmount(amount)}
+}
+
+type ublEndpoint struct {
+	Scheme string `xml:"schemeID,attr"`
+	Value  string `xml:",chardata"`
+}
+
+type ublTaxCategory struct {
+	ID        string  `xml:"cbc:ID"`
+	Percent   float64 `xml:"cbc:Percent"`
+	TaxScheme string  `xml:"cac:TaxScheme>cbc:ID"`
+}
+
+type ublParty struct {
+	EndpointID       ublEndpoint `xml:"cbc:EndpointID"`
+	Name             string      `xml:"cac:PartyName>cbc:Name"`
+	Country          string      `xml:"cac:PostalAddress>cac:Country>cbc:IdentificationCode"`
+	RegistrationName string      `xml:"cac:PartyLegalEntity>cbc:RegistrationName"`
+	Telephone        string      `xml:"cac:Contact>cbc:Telephone,omitempty"`
+	Mail             string      `xml:"cac:Contact>cbc:ElectronicMail"`
+}
+
+type ublAllowanceCharge struct {
+	ChargeIndicator bool            `xml:"cbc:ChargeIndicator"`
+	Reason          string          `xml:"cbc:AllowanceChargeReason,omitempty"`
+	Multiplier      float64         `xml:"cbc:MultiplierFactorNumeric,omitempty"`
+	Amount          ublAmount       `xml:"cbc:Amount"`
+	BaseAmount      *ublAmount      `xml:"cbc:BaseAmount,omitempty"`
+	TaxCategory     *ublTaxCategory `xml:"cac:TaxCategory,omitempty"`
+}
+
+type ublTaxSubtotal struct {
+	TaxableAmount ublAmount      `xml:"cbc:TaxableAmount"`
+	TaxAmount     ublAmount      `xml:"cbc:TaxAmount"`
+	TaxCategory   ublTaxCategory `xml:"cac:TaxCategory"`
+}
+
+type ublLine struct {
+	ID                  int                  `xml:"cbc:ID"`
+	Quantity            ublQuantity          `xml:"cbc:InvoicedQuantity"`
+	LineExtensionAmount ublAmount            `xml:"cbc:LineExtensionAmount"`
+	AllowanceCharges    []ublAllowanceCharge `xml:"cac:AllowanceCharge"`
+	Name                string               `xml:"cac:Item>cbc:Name"`
+	TaxCategory         ublTaxCategory       `xml:"cac:Item>cac:ClassifiedTaxCategory"`
+	Price               ublAmount            `xml:"cac:Price>cbc:PriceAmount"`
+}
+
+type ublQuantity struct {
+	Unit  string  `xml:"unitCode,attr"`
+	Value float64 `xml:",chardata"`
+}
+
+type ublInvoice struct {
+	XMLName              xml.Name             `xml:"Invoice"`
+	Namespace            string               `xml:"xmlns,attr"`
+	CacNamespace         string               `xml:"xmlns:cac,attr"`
+	CbcNamespace         string               `xml:"xmlns:cbc,attr"`
+	CustomizationID      string               `xml:"cbc:CustomizationID"`
+	ID                   string               `xml:"cbc:ID"`
+	IssueDate            string               `xml:"cbc:IssueDate"`
+	DueDate              string               `xml:"cbc:DueDate,omitempty"`
+	InvoiceTypeCode      string               `xml:"cbc:InvoiceTypeCode"`
+	DocumentCurrencyCode string               `xml:"cbc:DocumentCurrencyCode"`
+	Supplier             ublParty             `xml:"cac:AccountingSupplierParty>cac:Party"`
+	Customer             ublParty             `xml:"cac:AccountingCustomerParty>cac:Party"`
+	AllowanceCharges     []ublAllowanceCharge `xml:"cac:AllowanceCharge"`
+	TaxAmount            ublAmount            `xml:"cac:TaxTotal>cbc:TaxAmount"`
+	TaxSubtotals         []ublTaxSubtotal     `xml:"cac:TaxTotal>cac:TaxSubtotal"`
+	LineExtensionAmount  ublAmount            `xml:"cac:LegalMonetaryTotal>cbc:LineExtensionAmount"`
+	TaxExclusiveAmount   ublAmount            `xml:"cac:LegalMonetaryTotal>cbc:TaxExclusiveAmount"`
+	TaxInclusiveAmount   ublAmount            `xml:"cac:LegalMonetaryTotal>cbc:TaxInclusiveAmount"`
+	ChargeTotalAmount    *ublAmount           `xml:"cac:LegalMonetaryTotal>cbc:ChargeTotalAmount,omitempty"`
+	PrepaidAmount        ublAmount            `xml:"cac:LegalMonetaryTotal>cbc:PrepaidAmount"`
+	PayableAmount        ublAmount            `xml:"cac:LegalMonetaryTotal>cbc:PayableAmount"`
+	Lines                []ublLine            `xml:"cac:InvoiceLine"`
+}
+
+func newUBLParty(account AccountInfo, country string) ublParty {
+	name := account.Name + " " + account.Surname
+	return ublParty{
+		EndpointID:       ublEndpoint{emailScheme, account.Mail},
+		Name:             name,
+		Country:          country,
+		RegistrationName: name,
+		Telephone:        account.Phone,
+		Mail:             account.Mail,
+	}
+}
+
+// WriteUBL writes the invoice as an UBL 2.1 invoice following EN 16931.
+func WriteUBL(w io.Writer, doc InvoiceDocument) error {
+	e := newEInvoice(doc)
+
+	ubl := ublInvoice{
+		Namespace:            ublNamespace,
+		CacNamespace:         ublCacNamespace,
+		CbcNamespace:         ublCbcNamespace,
+		CustomizationID:      EN16931Customization,
+		ID:                   e.ID,
+		IssueDate:            e.IssueDate.Format("2006-01-02"),
+		InvoiceTypeCode:      CommercialInvoice,
+		DocumentCurrencyCode: InvoiceCurrency,
+		Supplier:             newUBLParty(e.Seller, e.Country),
+		Customer:             newUBLParty(e.Buyer, e.Country),
+		TaxAmount:            newUBLAmount(e.Tax),
+		LineExtensionAmount:  newUBLAmount(e.LineTotal),
+		TaxExclusiveAmount:   newUBLAmount(e.TaxBasis),
+		TaxInclusiveAmount:   newUBLAmount(e.Total),
+		PrepaidAmount:        newUBLAmount(e.Prepaid),
+		PayableAmount:        newUBLAmount(e.Payable),
+	}
+	if !e.DueDate.IsZero() {
+		ubl.DueDate = e.DueDate.Format("2006-01-02")
+	}
+	if e.Charge > 0 {
+		total := newUBLAmount(e.Charge)
+		ubl.ChargeTotalAmount = &total
+	}
+
+	for _, fee := range e.Charges {
+		ubl.AllowanceCharges = append(ubl.AllowanceCharges, ublAllowanceCharge{
+			ChargeIndicator: true,
+			Reason:          "Pénalités de retard (" + fee.Type + ")",
+			Amount:          newUBLAmount(fee.Amount),
+			TaxCategory:     &ublTaxCategory{taxCategory(0), 0, "VAT"},
+		})
+	}
+	for _, t := range e.Taxes {
+		ubl.TaxSubtotals = append(ubl.TaxSubtotals, ublTaxSubtotal{
+			TaxableAmount: newUBLAmount(t.Net),
+			TaxAmount:     newUBLAmount(t.Tax),
+			TaxCategory:   ublTaxCategory{taxCategory(t.Rate), t.Rate, "VAT"},
+		})
+	}
+	for _, l := range e.Lines {
+		line := ublLine{
+			ID:                  l.Position,
+			Quantity:            ublQuantity{unitCode, l.Quantity},
+			LineExtensionAmount: newUBLAmount(l.Net),
+			Name:                l.Description,
+			TaxCategory:         ublTaxCategory{taxCategory(l.TaxRate), l.TaxRate, "VAT"},
+			Price:               ublAmount{InvoiceCurrency, fmt.Sprint(l.UnitPrice)},
+		}
+		if l.Discount > 0 {
+			base := roundCents(l.Quantity * l.UnitPrice)
+			baseAmount := newUBLAmount(base)
+			line.AllowanceCharges = append(line.AllowanceCharges, ublAllowanceCharge{
+				ChargeIndicator: false,
+				Reason:          "Remise",
+				Multiplier:      l.Discount,
+				Amount:          newUBLAmount(roundCents(base - l.Net)),
+				BaseAmount:      &baseAmount,
+			})
+		}
+		ubl.Lines = append(ubl.Lines, line)
+	}
+
+	return writeXML(w, ubl)
+}
+
+type ciiAmount struct {
+	Currency string `xml:"currencyID,attr,omitempty"`
+	Value    string `xml:",chardata"`
+}
+
+type ciiDate struct {
+	Format string `xml:"format,attr"`
+	Value  string `xml:",chardata"`
+}
+
+func newCIIDate(t time.Time) ciiDate {
+	return ciiDate{"102", t.Format("20060102")}
+}
+
+type ciiTradeTax struct {
+	CalculatedAmount *ciiAmount `xml:"ram:CalculatedAmount,omitempty"`
+	TypeCode         string     `xml:"ram:TypeCode"`
+	BasisAmount      *ciiAmount `xml:"ram:BasisAmount,omitempty"`
+	CategoryCode     string     `xml:"ram:CategoryCode"`
+	Rate             float64    `xml:"ram:RateApplicablePercent"`
+}
+
+type ciiURI struct {
+	Scheme string `xml:"schemeID,attr"`
+	Value  string `xml:",chardata"`
+}
+
+type ciiParty struct {
+	Name        string `xml:"ram:Name"`
+	ContactName string `xml:"ram:DefinedTradeContact>ram:PersonName"`
+	Telephone   string `xml:"ram:DefinedTradeContact>ram:TelephoneUniversalCommunication>ram:CompleteNumber,omitempty"`
+	Mail        string `xml:"ram:DefinedTradeContact>ram:EmailURIUniversalCommunication>ram:URIID"`
+	Country     string `xml:"ram:PostalTradeAddress>ram:CountryID"`
+	URI         ciiURI `xml:"ram:URIUniversalCommunication>ram:URIID"`
+}
+
+func newCIIParty(account AccountInfo, country string) ciiParty {
+	name := account.Name + " " + account.Surname
+	return ciiParty{
+		Name:        name,
+		ContactName: name,
+		Telephone:   account.Phone,
+		Mail:        account.Mail,
+		Country:     country,
+		URI:         ciiURI{emailScheme, account.Mail},
+	}
+}
+
+type ciiAllowanceCharge struct {
+	ChargeIndicator bool        `xml:"ram:ChargeIndicator>udt:Indicator"`
+	Percent         float64     `xml:"ram:CalculationPercent,omitempty"`
+	BasisAmount     string      `xml:"ram:BasisAmount,omitempty"`
+	Amount          string      `xml:"ram:ActualAmount"`
+	Reason          string      `xml:"ram:Reason,omitempty"`
+	Tax             ciiTradeTax `xml:"ram:CategoryTradeTax"`
+}
+
+type ciiLineAllowance struct {
+	ChargeIndicator bool   `xml:"ram:ChargeIndicator>udt:Indicator"`
+	Amount          string `xml:"ram:ActualAmount"`
+}
+
+type ciiLine struct {
+	LineID     int               `xml:"ram:AssociatedDocumentLineDocument>ram:LineID"`
+	Name       string            `xml:"ram:SpecifiedTradeProduct>ram:Name"`
+	GrossPrice string            `xml:"ram:SpecifiedLineTradeAgreement>ram:GrossPriceProductTradePrice>ram:ChargeAmount"`
+	Allowance  *ciiLineAllowance `xml:"ram:SpecifiedLineTradeAgreement>ram:GrossPriceProductTradePrice>ram:AppliedTradeAllowanceCharge,omitempty"`
+	NetPrice   string            `xml:"ram:SpecifiedLineTradeAgreement>ram:NetPriceProductTradePrice>ram:ChargeAmount"`
+	Quantity   ublQuantity       `xml:"ram:SpecifiedLineTradeDelivery>ram:BilledQuantity"`
+	Tax        ciiTradeTax       `xml:"ram:SpecifiedLineTradeSettlement>ram:ApplicableTradeTax"`
+	LineTotal  string            `xml:"ram:SpecifiedLineTradeSettlement>ram:SpecifiedTradeSettlementLineMonetarySummation>ram:LineTotalAmount"`
+}
+
+type ciiInvoice struct {
+	XMLName      xml.Name `xml:"rsm:CrossIndustryInvoice"`
+	RsmNamespace string   `xml:"xmlns:rsm,attr"`
+	RamNamespace string   `xml:"xmlns:ram,attr"`
+	UdtNamespace string   `xml:"xmlns:udt,attr"`
+	Guideline    string   `xml:"rsm:ExchangedDocumentContext>ram:GuidelineSpecifiedDocumentContextParameter>ram:ID"`
+	ID           string   `xml:"rsm:ExchangedDocument>ram:ID"`
+	TypeCode     string   `xml:"rsm:ExchangedDocument>ram:TypeCode"`
+	IssueDate    ciiDate  `xml:"rsm:ExchangedDocument>ram:IssueDateTime>udt:DateTimeString"`
+	Transaction  struct {
+		Lines      []ciiLine `xml:"ram:IncludedSupplyChainTradeLineItem"`
+		Seller     ciiParty  `xml:"ram:ApplicableHeaderTradeAgreement>ram:SellerTradeParty"`
+		Buyer      ciiParty  `xml:"ram:ApplicableHeaderTradeAgreement>ram:BuyerTradeParty"`
+		Delivery   struct{}  `xml:"ram:ApplicableHeaderTradeDelivery"`
+		Settlement struct {
+			Currency   string               `xml:"ram:InvoiceCurrencyCode"`
+			Taxes      []ciiTradeTax        `xml:"ram:ApplicableTradeTax"`
+			Charges    []ciiAllowanceCharge `xml:"ram:SpecifiedTradeAllowanceCharge"`
+			DueDate    *ciiDate             `xml:"ram:SpecifiedTradePaymentTerms>ram:DueDateDateTime>udt:DateTimeString,omitempty"`
+			LineTotal  string               `xml:"ram:SpecifiedTradeSettlementHeaderMonetarySummation>ram:LineTotalAmount"`
+			Charge     string               `xml:"ram:SpecifiedTradeSettlementHeaderMonetarySummation>ram:ChargeTotalAmount,omitempty"`
+			TaxBasis   string               `xml:"ram:SpecifiedTradeSettlementHeaderMonetarySummation>ram:TaxBasisTotalAmount"`
+			Tax        ciiAmount            `xml:"ram:SpecifiedTradeSettlementHeaderMonetarySummation>ram:TaxTotalAmount"`
+			Total      string               `xml:"ram:SpecifiedTradeSettlementHeaderMonetarySummation>ram:GrandTotalAmount"`
+			Prepaid    string               `xml:"ram:SpecifiedTradeSettlementHeaderMonetarySummation>ram:TotalPrepaidAmount"`
+			DuePayable string               `xml:"ram:SpecifiedTradeSettlementHeaderMonetarySummation>ram:DuePayableAmount"`
+		} `xml:"ram:ApplicableHeaderTradeSettlement"`
+	} `xml:"rsm:SupplyChainTradeTransaction"`
+}
+
+// WriteCII writes the invoice as a Cross Industry Invoice, the XML of the Factur-X EN 16931 profile.
+func WriteCII(w io.Writer, doc InvoiceDocument) error {
+	e := newEInvoice(doc)
+
+	cii := ciiInvoice{
+		RsmNamespace: ciiRsmNamespace,
+		RamNamespace: ciiRamNamespace,
+		UdtNamespace: ciiUdtNamespace,
+		Guideline:    EN16931Customization,
+		ID:           e.ID,
+		TypeCode:     CommercialInvoice,
+		IssueDate:    newCIIDate(e.IssueDate),
+	}
+
+	t := &cii.Transaction
+	for _, l := range e.Lines {
+		line := ciiLine{
+			LineID:     l.Position,
+			Name:       l.Description,
+			GrossPrice: fmt.Sprint(l.UnitPrice),
+			NetPrice:   fmt.Sprint(l.UnitPrice),
+			Quantity:   ublQuantity{unitCode, l.Quantity},
+			Tax:        ciiTradeTax{TypeCode: "VAT", CategoryCode: taxCategory(l.TaxRate), Rate: l.TaxRate},
+			LineTotal:  formatAmount(l.Net),
+		}
+		if l.Discount > 0 {
+			// Prix net = prix brut moins la remise
+			discount := l.UnitPrice * l.Discount / 100
+			line.NetPrice = fmt.Sprint(l.UnitPrice - discount)
+			line.Allowance = &ciiLineAllowance{false, fmt.Sprint(discount)}
+		}
+		t.Lines = append(t.Lines, line)
+	}
+
+	t.Seller = newCIIParty(e.Seller, e.Country)
+	t.Buyer = newCIIParty(e.Buyer, e.Country)
+
+	s := &t.Settlement
+	s.Currency = InvoiceCurrency
+	for _, tax := range e.Taxes {
+		s.Taxes = append(s.Taxes, ciiTradeTax{
+			CalculatedAmount: &ciiAmount{Value: formatAmount(tax.Tax)},
+			TypeCode:         "VAT",
+			BasisAmount:      &ciiAmount{Value: formatAmount(tax.Net)},
+			CategoryCode:     taxCategory(tax.Rate),
+			Rate:             tax.Rate,
+		})
+	}
+	for _, fee := range e.Charges {
+		s.Charges = append(s.Charges, ciiAllowanceCharge{
+			ChargeIndicator: true,
+			Amount:          formatAmount(fee.Amount),
+			Reason:          "Pénalités de retard (" + fee.Type + ")",
+			Tax:             ciiTradeTax{TypeCode: "VAT", CategoryCode: taxCategory(0)},
+		})
+	}
+	if !e.DueDate.IsZero() {
+		due := newCIIDate(e.DueDate)
+		s.DueDate = &due
+	}
+	s.LineTotal = formatAmount(e.LineTotal)
+	if e.Charge > 0 {
+		s.Charge = formatAmount(e.Charge)
+	}
+	s.TaxBasis = formatAmount(e.TaxBasis)
+	s.Tax = ciiAmount{InvoiceCurrency, formatAmount(e.Tax)}
+	s.Total = formatAmount(e.Total)
+	s.Prepaid = formatAmount(e.Prepaid)
+	s.DuePayable = formatAmount(e.Payable)
+
+	return writeXML(w, cii)
+}
+
+func writeXML(w io.Writer, document interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(document); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// UBLFieldError is returned by ImportUBL when a mandatory field is missing or invalid.
+type UBLFieldError struct {
+	Field string
+}
+
+func (e UBLFieldError) Error() string {
+	return "UBL invoice is missing or has an invalid " + e.Field
+}
+
+func (e UBLFieldError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+// ublDocument is read whatever the namespace prefixes chosen by the sender.
+type ublDocument struct {
+	XMLName              xml.Name
+	ID                   string               `xml:"ID"`
+	IssueDate            string               `xml:"IssueDate"`
+	DueDate              string               `xml:"DueDate"`
+	PaymentDueDate       string               `xml:"PaymentMeans>PaymentDueDate"`
+	DocumentCurrencyCode string               `xml:"DocumentCurrencyCode"`
+	Supplier             ublImportedParty     `xml:"AccountingSupplierParty>Party"`
+	Customer             ublImportedParty     `xml:"AccountingCustomerParty>Party"`
+	TaxInclusiveAmount   string               `xml:"LegalMonetaryTotal>TaxInclusiveAmount"`
+	Lines                []ublImportedLine    `xml:"InvoiceLine"`
+	AllowanceCharges     []ublImportedCharges `xml:"AllowanceCharge"`
+}
+
+type ublImportedParty struct {
+	EndpointID string `xml:"EndpointID"`
+	Mail       string `xml:"Contact>ElectronicMail"`
+}
+
+// mail returns the email of the party, from its contact or from its electronic address.
+func (p ublImportedParty) mail() string {
+	if p.Mail != "" {
+		return strings.TrimSpace(p.Mail)
+	}
+	return strings.TrimSpace(p.EndpointID)
+}
+
+type ublImportedCharges struct {
+	ChargeIndicator bool   `xml:"ChargeIndicator"`
+	Multiplier      string `xml:"MultiplierFactorNumeric"`
+	Amount          string `xml:"Amount"`
+	BaseAmount      string `xml:"BaseAmount"`
+}
+
+type ublImportedLine struct {
+	Quantity         string               `xml:"InvoicedQuantity"`
+	Name             string               `xml:"Item>Name"`
+	Description      string               `xml:"Item>Description"`
+	TaxPercent       string               `xml:"Item>ClassifiedTaxCategory>Percent"`
+	Price            string               `xml:"Price>PriceAmount"`
+	AllowanceCharges []ublImportedCharges `xml:"AllowanceCharge"`
+}
+
+func parseDecimal(field string, value string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0, UBLFieldError{field}
+	}
+	return f, nil
+}
+
+// lineItem maps an invoice line, a line allowance is read as a discount in percent.
+func (l ublImportedLine) lineItem(n int) (LineItem, error) {
+	field := fmt.Sprintf("InvoiceLine[%d]", n+1)
+	item := LineItem{Description: strings.TrimSpace(l.Name)}
+	if item.Description == "" {
+		item.Description = strings.TrimSpace(l.Description)
+	}
+	if item.Description == "" {
+		return LineItem{}, UBLFieldError{field + "/Item/Name"}
+	}
+
+	var err error
+	if item.Quantity, err = parseDecimal(field+"/InvoicedQuantity", l.Quantity); err != nil {
+		return LineItem{}, err
+	}
+	if item.UnitPrice, err = parseDecimal(field+"/Price/PriceAmount", l.Price); err != nil {
+		return LineItem{}, err
+	}
+	if item.TaxRate, err = parseDecimal(field+"/Item/ClassifiedTaxCategory/Percent", l.TaxPercent); err != nil {
+		return LineItem{}, err
+	}
+
+	for _, c := range l.AllowanceCharges {
+		if c.ChargeIndicator {
+			return LineItem{}, UBLFieldError{field + "/AllowanceCharge"}
+		}
+		if c.Multiplier != "" {
+			if item.Discount, err = parseDecimal(field+"/AllowanceCharge/MultiplierFactorNumeric", c.Multiplier); err != nil {
+				return LineItem{}, err
+			}
+			continue
+		}
+		amount, err := parseDecimal(field+"/AllowanceCharge/Amount", c.Amount)
+		if err != nil {
+			return LineItem{}, err
+		}
+		base := item.Quantity * item.UnitPrice
+		if base == 0 {
+			return LineItem{}, UBLFieldError{field + "/AllowanceCharge"}
+		}
+		item.Discount = amount / base * 100
+	}
+	return item, nil
+}
+
+// ImportUBL creates the invoice described by an UBL 2.1 invoice. The supplier is the issuer, it must
+// be the caller, and the customer the payer, both are found from their email. The amount is computed
+// from the lines and must match the total of the document. A document the supplier already imported
+// returns the invoice created the first time, and false.
+func (s *invoiceService) ImportUBL(ctx context.Context, callerID string, document []byte) (Invoice, bool, error) {
+	if callerID == "" {
+		return Invoice{}, false, ErrNotAnId
+	}
+
+	doc := ublDocument{}
+	if err := xml.Unmarshal(document, &doc); err != nil {
+		return Invoice{}, false, UBLFieldError{"XML document"}
+	}
+
+	if doc.XMLName.Local != "Invoice" {
+		return Invoice{}, false, UBLFieldError{"Invoice root element"}
+	}
+	if strings.TrimSpace(doc.ID) == "" {
+		return Invoice{}, false, UBLFieldError{"ID"}
+	}
+	if _, err := time.Parse("2006-01-02", strings.TrimSpace(doc.IssueDate)); err != nil {
+		return Invoice{}, false, UBLFieldError{"IssueDate"}
+	}
+	due := strings.TrimSpace(doc.DueDate)
+	if due == "" {
+		due = strings.TrimSpace(doc.PaymentDueDate)
+	}
+	if _, err := time.Parse("2006-01-02", due); err != nil {
+		return Invoice{}, false, UBLFieldError{"DueDate"}
+	}
+	if strings.TrimSpace(doc.DocumentCurrencyCode) != InvoiceCurrency {
+		return Invoice{}, false, UBLFieldError{"DocumentCurrencyCode"}
+	}
+	if len(doc.AllowanceCharges) > 0 {
+		return Invoice{}, false, UBLFieldError{"AllowanceCharge"}
+	}
+	if len(doc.Lines) == 0 {
+		return Invoice{}, false, UBLFieldError{"InvoiceLine"}
+	}
+	total, err := parseDecimal("LegalMonetaryTotal/TaxInclusiveAmount", doc.TaxInclusiveAmount)
+	if err != nil {
+		return Invoice{}, false, err
+	}
+
+	items := make([]LineItem, 0, len(doc.Lines))
+	for n, l := range doc.Lines {
+		item, err := l.lineItem(n)
+		if err != nil {
+			return Invoice{}, false, err
+		}
+		items = append(items, item)
+	}
+
+	issuerID, err := s.GetIdFromMail(ctx, doc.Supplier.mail())
+	if err != nil || issuerID == "" {
+		return Invoice{}, false, UBLFieldError{"AccountingSupplierParty email"}
+	}
+	payerID, err := s.GetIdFromMail(ctx, doc.Customer.mail())
+	if err != nil || payerID == "" {
+		return Invoice{}, false, UBLFieldError{"AccountingCustomerParty email"}
+	}
+	if issuerID == payerID {
+		return Invoice{}, false, ErrSameAccount
+	}
+
+	jurisdiction, err := s.taxJurisdiction("")
+	if err != nil {
+		return Invoice{}, false, err
+	}
+	computation, err := jurisdiction.Compute(items)
+	if err != nil {
+		return Invoice{}, false, err
+	}
+	if computation.Gross != roundCents(total) {
+		return Invoice{}, false, UBLFieldError{"LegalMonetaryTotal/TaxInclusiveAmount"}
+	}
+
+	// Seul le fournisseur du document peut l'importer
+	if issuerID != callerID {
+		return Invoice{}, false, ErrNotIssuer
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return Invoice{}, false, err
+	}
+	defer tx.Rollback()
+
+	invoice, err := s.insertInvoice(tx, Invoice{
+		State:             PENDING,
+		ExpirationDate:    due,
+		AccountPayerId:    payerID,
+		AccountReceiverId: issuerID,
+		TaxJurisdiction:   jurisdiction.Code,
+	}, items)
+	if err != nil {
+		return Invoice{}, false, err
+	}
+
+	// Un document déjà importé par le fournisseur n'est pas facturé une deuxième fois, la facture créée
+	// au premier import est renvoyée
+	externalID := strings.TrimSpace(doc.ID)
+	res, err := tx.Exec("INSERT INTO ubl_import (issuer_id, external_id, invoice_id) VALUES ($1, $2, $3) ON CONFLICT (issuer_id, external_id) DO NOTHING",
+		issuerID, externalID, invoice.ID)
+	if err != nil {
+		return Invoice{}, false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		existing := ""
+		if err := db.Get(&existing, "SELECT invoice_id FROM ubl_import WHERE issuer_id=$1 AND external_id=$2", issuerID, externalID); err != nil {
+			return Invoice{}, false, err
+		}
+		imported, err := s.Read(ctx, existing)
+		return imported, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Invoice{}, false, err
+	}
+
+	if err := s.applyMandate(ctx, invoice); err != nil {
+		s.logger.Log("mandate", invoice.ID, "err", err)
+	}
+	inserted, err := s.Read(ctx, invoice.ID)
+	return inserted, true, err
+}
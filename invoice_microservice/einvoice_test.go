@@ -0,0 +1,141 @@
+package invoice_microservice
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+func eInvoiceDocument(t *testing.T) InvoiceDocument {
+	computation, err := DefaultTaxJurisdictions()[0].Compute([]LineItem{
+		{Description: "Conseil", Quantity: 2, UnitPrice: 500, TaxRate: 20, Discount: 10},
+		{Description: "Livre", Quantity: 1, UnitPrice: 10, TaxRate: 5.5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return InvoiceDocument{
+		Invoice: Invoice{ID: "c1g2", Amount: computation.Gross + 40, PaidAmount: 100, State: PARTIALLY_PAID, ExpirationDate: "2021-04-29T00:00:00Z"},
+		Issuer:  AccountInfo{Name: "Jean", Surname: "Dupont", Mail: "jean@dupont.fr"},
+		Payer:   AccountInfo{Name: "Anne", Surname: "Martin", Mail: "anne@martin.fr"},
+		Items:   computation.Items,
+		Taxes:   computation.Breakdown,
+		LateFees: []LateFee{
+			{InvoiceID: "c1g2", Type: FIXED_FEE, Amount: 40},
+		},
+		Date: time.Date(2021, 4, 12, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestEInvoicePayable(t *testing.T) {
+	doc := eInvoiceDocument(t)
+	doc.Invoice.DiscountAmount = 20
+	e := newEInvoice(doc)
+	if e.Payable != roundCents(e.Total-e.Prepaid) || e.Payable != 1030.55 {
+		t.Errorf("Expected the amount due to be the total minus the prepaid amount, got %v", e.Payable)
+	}
+}
+
+func TestWriteUBL(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteUBL(&buf, eInvoiceDocument(t)); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, expected := range []string{
+		`<Invoice xmlns="urn:oasis:names:specification:ubl:schema:xsd:Invoice-2"`,
+		`<cbc:CustomizationID>urn:cen.eu:en16931:2017</cbc:CustomizationID>`,
+		`<cbc:IssueDate>2021-04-12</cbc:IssueDate>`,
+		`<cbc:DueDate>2021-04-29</cbc:DueDate>`,
+		`<cbc:EndpointID schemeID="EM">jean@dupont.fr</cbc:EndpointID>`,
+		// 2 x 500 - 10 % = 900, TVA 180 ; 10, TVA 0.55 ; pénalité de 40 hors TVA
+		`<cbc:TaxAmount currencyID="EUR">180.55</cbc:TaxAmount>`,
+		`<cbc:TaxExclusiveAmount currencyID="EUR">950.00</cbc:TaxExclusiveAmount>`,
+		`<cbc:TaxInclusiveAmount currencyID="EUR">1130.55</cbc:TaxInclusiveAmount>`,
+		`<cbc:ChargeTotalAmount currencyID="EUR">40.00</cbc:ChargeTotalAmount>`,
+		`<cbc:PayableAmount currencyID="EUR">1030.55</cbc:PayableAmount>`,
+		`<cbc:MultiplierFactorNumeric>10</cbc:MultiplierFactorNumeric>`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("%s not found in\n%s", expected, out)
+		}
+	}
+
+	// Le document exporté est relu par l'import
+	doc := ublDocument{}
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.XMLName.Local != "Invoice" || doc.ID != "c1g2" || doc.DueDate != "2021-04-29" || doc.Supplier.mail() != "jean@dupont.fr" || doc.Customer.mail() != "anne@martin.fr" {
+		t.Errorf("Unexpected document : %+v", doc)
+	}
+	item, err := doc.Lines[0].lineItem(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Description != "Conseil" || item.Quantity != 2 || item.UnitPrice != 500 || item.TaxRate != 20 || item.Discount != 10 {
+		t.Errorf("Unexpected line : %+v", item)
+	}
+}
+
+func TestWriteCII(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteCII(&buf, eInvoiceDocument(t)); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, expected := range []string{
+		`<rsm:CrossIndustryInvoice xmlns:rsm="urn:un:unece:uncefact:data:standard:CrossIndustryInvoice:100"`,
+		`<udt:DateTimeString format="102">20210412</udt:DateTimeString>`,
+		`<ram:NetPriceProductTradePrice>`,
+		`<ram:ChargeAmount>450</ram:ChargeAmount>`,
+		`<ram:URIID schemeID="EM">anne@martin.fr</ram:URIID>`,
+		`<ram:GrandTotalAmount>1130.55</ram:GrandTotalAmount>`,
+		`<ram:DuePayableAmount>1030.55</ram:DuePayableAmount>`,
+		`<udt:DateTimeString format="102">20210429</udt:DateTimeString>`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("%s not found in\n%s", expected, out)
+		}
+	}
+
+	// Le XML doit être bien formé
+	var v struct{}
+	if err := xml.Unmarshal(buf.Bytes(), &v); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFacturX(t *testing.T) {
+	r := DefaultPDFRenderer()
+	r.compress = false
+
+	var buf bytes.Buffer
+	if err := r.RenderFacturX(&buf, eInvoiceDocument(t)); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "/Filespec") || !strings.Contains(out, "/EmbeddedFiles") {
+		t.Error("The CII XML should be attached to the PDF")
+	}
+	// Le document n'est pas un PDF/A-3, il ne doit pas se déclarer conforme à Factur-X
+	if strings.Contains(out, "ConformanceLevel") || strings.Contains(out, "factur-x:pdfa") {
+		t.Error("The PDF should not claim Factur-X conformance")
+	}
+}
+
+func TestUBLImportedLine(t *testing.T) {
+	if _, err := (ublImportedLine{Name: "Conseil", Quantity: "x", Price: "10", TaxPercent: "20"}).lineItem(1); err != (UBLFieldError{"InvoiceLine[2]/InvoicedQuantity"}) {
+		t.Errorf("Expected an invalid quantity, got %v", err)
+	}
+
+	line := ublImportedLine{Name: "Conseil", Quantity: "4", Price: "25", TaxPercent: "20", AllowanceCharges: []ublImportedCharges{{Amount: "5", BaseAmount: "100"}}}
+	item, err := line.lineItem(0)
+	if err != nil || item.Discount != 5 {
+		t.Errorf("Expected a 5 %% discount, got %+v, %v", item, err)
+	}
+}
@@ -1,34 +1,202 @@
 package invoice_microservice
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"time"
 
 	"github.com/go-kit/kit/endpoint"
 )
 
 const (
-	PENDING = 0
-	PAID    = 1
-	EXPIRED = 2
+	PENDING            = 0
+	PAID               = 1
+	EXPIRED            = 2
+	REFUNDED           = 3
+	PARTIALLY_REFUNDED = 4
+	PARTIALLY_PAID     = 5
+	CANCELLED          = 6
 )
 
 type InvoiceEndpoints struct {
-	GetInvoiceListEndpoint  endpoint.Endpoint
-	AddEndpoint             endpoint.Endpoint
-	DeleteEndpoint          endpoint.Endpoint
-	InvoicePaiementEndpoint endpoint.Endpoint
+	GetInvoiceListEndpoint   endpoint.Endpoint
+	AddEndpoint              endpoint.Endpoint
+	DeleteEndpoint           endpoint.Endpoint
+	InvoicePaiementEndpoint  endpoint.Endpoint
+	GetLedgerEndpoint        endpoint.Endpoint
+	RefundEndpoint           endpoint.Endpoint
+	CancelInvoiceEndpoint    endpoint.Endpoint
+	GetCreditNotesEndpoint   endpoint.Endpoint
+	SetInstallmentsEndpoint  endpoint.Endpoint
+	GetInstallmentsEndpoint  endpoint.Endpoint
+	PayInstallmentEndpoint   endpoint.Endpoint
+	GetInvoiceEndpoint       endpoint.Endpoint
+	SetLateFeePolicyEndpoint endpoint.Endpoint
+	GetLateFeePolicyEndpoint endpoint.Endpoint
+	InvoicePDFEndpoint       endpoint.Endpoint
+	ReceiptPDFEndpoint       endpoint.Endpoint
+	ExportCSVEndpoint        endpoint.Endpoint
+	ImportCSVEndpoint        endpoint.Endpoint
+	UBLEndpoint              endpoint.Endpoint
+	CIIEndpoint              endpoint.Endpoint
+	FacturXEndpoint          endpoint.Endpoint
+	ImportUBLEndpoint        endpoint.Endpoint
+	FECEndpoint              endpoint.Endpoint
+	SetNumberingEndpoint     endpoint.Endpoint
+	GetNumberingEndpoint     endpoint.Endpoint
+	CreateWebhookEndpoint    endpoint.Endpoint
+	GetWebhooksEndpoint      endpoint.Endpoint
+	DeleteWebhookEndpoint    endpoint.Endpoint
+	DeliveriesEndpoint       endpoint.Endpoint
+	RedeliverEndpoint        endpoint.Endpoint
+	SetPreferenceEndpoint    endpoint.Endpoint
+	GetPreferenceEndpoint    endpoint.Endpoint
+	CreateRecurringEndpoint  endpoint.Endpoint
+	GetRecurringListEndpoint endpoint.Endpoint
+	GetRecurringEndpoint     endpoint.Endpoint
+	PauseRecurringEndpoint   endpoint.Endpoint
+	ResumeRecurringEndpoint  endpoint.Endpoint
+	CancelRecurringEndpoint  endpoint.Endpoint
+	RecurringRunsEndpoint    endpoint.Endpoint
+	SchedulePaymentEndpoint  endpoint.Endpoint
+	ListSchedulesEndpoint    endpoint.Endpoint
+	CancelPaymentEndpoint    endpoint.Endpoint
+	CreateMandateEndpoint    endpoint.Endpoint
+	GetMandatesEndpoint      endpoint.Endpoint
+	RevokeMandateEndpoint    endpoint.Endpoint
+	MandatePaymentsEndpoint  endpoint.Endpoint
+	BatchPaymentEndpoint     endpoint.Endpoint
+	CreateGroupEndpoint      endpoint.Endpoint
+	GetGroupsEndpoint        endpoint.Endpoint
+	CreateBulkJobEndpoint    endpoint.Endpoint
+	GetBulkJobsEndpoint      endpoint.Endpoint
+	GetBulkJobEndpoint       endpoint.Endpoint
+	BulkJobItemsEndpoint     endpoint.Endpoint
+	CancelBulkJobEndpoint    endpoint.Endpoint
 }
 
 func MakeInvoiceEndpoints(s InvoiceService) InvoiceEndpoints {
+	pdf := DefaultPDFRenderer()
 	return InvoiceEndpoints{
-		GetInvoiceListEndpoint:  MakeGetInvoiceListEndpoint(s),
-		AddEndpoint:             MakeAddEndpoint(s),
-		DeleteEndpoint:          MakeDeleteEndpoint(s),
-		InvoicePaiementEndpoint: MakeInvoicePaymentEndpoint(s),
+		GetInvoiceListEndpoint:   MakeGetInvoiceListEndpoint(s),
+		AddEndpoint:              MakeAddEndpoint(s),
+		DeleteEndpoint:           MakeDeleteEndpoint(s),
+		InvoicePaiementEndpoint:  MakeInvoicePaymentEndpoint(s),
+		GetLedgerEndpoint:        MakeGetLedgerEndpoint(s),
+		RefundEndpoint:           MakeRefundEndpoint(s),
+		CancelInvoiceEndpoint:    MakeCancelInvoiceEndpoint(s),
+		GetCreditNotesEndpoint:   MakeGetCreditNotesEndpoint(s),
+		SetInstallmentsEndpoint:  MakeSetInstallmentPlanEndpoint(s),
+		GetInstallmentsEndpoint:  MakeGetInstallmentsEndpoint(s),
+		PayInstallmentEndpoint:   MakeInstallmentPaymentEndpoint(s),
+		GetInvoiceEndpoint:       MakeGetInvoiceEndpoint(s),
+		SetLateFeePolicyEndpoint: MakeSetLateFeePolicyEndpoint(s),
+		GetLateFeePolicyEndpoint: MakeGetLateFeePolicyEndpoint(s),
+		InvoicePDFEndpoint:       MakeInvoicePDFEndpoint(s, pdf),
+		ReceiptPDFEndpoint:       MakeReceiptPDFEndpoint(s, pdf),
+		ExportCSVEndpoint:        MakeExportCSVEndpoint(s),
+		ImportCSVEndpoint:        MakeImportCSVEndpoint(s),
+		UBLEndpoint:              MakeEInvoiceEndpoint(s, "ubl.xml", "application/xml", WriteUBL),
+		CIIEndpoint:              MakeEInvoiceEndpoint(s, "cii.xml", "application/xml", WriteCII),
+		FacturXEndpoint:          MakeEInvoiceEndpoint(s, "factur-x.pdf", "application/pdf", pdf.RenderFacturX),
+		ImportUBLEndpoint:        MakeImportUBLEndpoint(s),
+		FECEndpoint:              MakeFECEndpoint(s),
+		SetNumberingEndpoint:     MakeSetNumberingPolicyEndpoint(s),
+		GetNumberingEndpoint:     MakeGetNumberingPolicyEndpoint(s),
+		CreateWebhookEndpoint:    MakeCreateWebhookEndpoint(s),
+		GetWebhooksEndpoint:      MakeGetWebhooksEndpoint(s),
+		DeleteWebhookEndpoint:    MakeDeleteWebhookEndpoint(s),
+		DeliveriesEndpoint:       MakeWebhookDeliveriesEndpoint(s),
+		RedeliverEndpoint:        MakeRedeliverWebhookEndpoint(s),
+		SetPreferenceEndpoint:    MakeSetNotificationPreferenceEndpoint(s),
+		GetPreferenceEndpoint:    MakeGetNotificationPreferenceEndpoint(s),
+		CreateRecurringEndpoint:  MakeCreateRecurringInvoiceEndpoint(s),
+		GetRecurringListEndpoint: MakeGetRecurringInvoicesEndpoint(s),
+		GetRecurringEndpoint:     MakeGetRecurringInvoiceEndpoint(s),
+		PauseRecurringEndpoint:   MakeSetRecurringStateEndpoint(s, RECURRING_PAUSED),
+		ResumeRecurringEndpoint:  MakeSetRecurringStateEndpoint(s, RECURRING_ACTIVE),
+		CancelRecurringEndpoint:  MakeSetRecurringStateEndpoint(s, RECURRING_CANCELLED),
+		RecurringRunsEndpoint:    MakeRecurringRunsEndpoint(s),
+		SchedulePaymentEndpoint:  MakeSchedulePaymentEndpoint(s),
+		ListSchedulesEndpoint:    MakeGetListSchedulesEndpoint(s),
+		CancelPaymentEndpoint:    MakeCancelScheduledPaymentEndpoint(s),
+		CreateMandateEndpoint:    MakeCreateMandateEndpoint(s),
+		GetMandatesEndpoint:      MakeGetMandatesEndpoint(s),
+		RevokeMandateEndpoint:    MakeRevokeMandateEndpoint(s),
+		MandatePaymentsEndpoint:  MakeMandatePaymentsEndpoint(s),
+		BatchPaymentEndpoint:     MakeBatchPaymentEndpoint(s),
+		CreateGroupEndpoint:      MakeCreatePayerGroupEndpoint(s),
+		GetGroupsEndpoint:        MakeGetPayerGroupsEndpoint(s),
+		CreateBulkJobEndpoint:    MakeCreateBulkInvoiceJobEndpoint(s),
+		GetBulkJobsEndpoint:      MakeGetBulkInvoiceJobsEndpoint(s),
+		GetBulkJobEndpoint:       MakeGetBulkInvoiceJobEndpoint(s),
+		BulkJobItemsEndpoint:     MakeBulkInvoiceItemsEndpoint(s),
+		CancelBulkJobEndpoint:    MakeCancelBulkInvoiceJobEndpoint(s),
 	}
 }
 
+// wrap applies the middleware to every endpoint.
+func (e InvoiceEndpoints) wrap(mw endpoint.Middleware) InvoiceEndpoints {
+	e.GetInvoiceListEndpoint = mw(e.GetInvoiceListEndpoint)
+	e.AddEndpoint = mw(e.AddEndpoint)
+	e.DeleteEndpoint = mw(e.DeleteEndpoint)
+	e.InvoicePaiementEndpoint = mw(e.InvoicePaiementEndpoint)
+	e.GetLedgerEndpoint = mw(e.GetLedgerEndpoint)
+	e.RefundEndpoint = mw(e.RefundEndpoint)
+	e.CancelInvoiceEndpoint = mw(e.CancelInvoiceEndpoint)
+	e.GetCreditNotesEndpoint = mw(e.GetCreditNotesEndpoint)
+	e.SetInstallmentsEndpoint = mw(e.SetInstallmentsEndpoint)
+	e.GetInstallmentsEndpoint = mw(e.GetInstallmentsEndpoint)
+	e.PayInstallmentEndpoint = mw(e.PayInstallmentEndpoint)
+	e.GetInvoiceEndpoint = mw(e.GetInvoiceEndpoint)
+	e.SetLateFeePolicyEndpoint = mw(e.SetLateFeePolicyEndpoint)
+	e.GetLateFeePolicyEndpoint = mw(e.GetLateFeePolicyEndpoint)
+	e.InvoicePDFEndpoint = mw(e.InvoicePDFEndpoint)
+	e.ReceiptPDFEndpoint = mw(e.ReceiptPDFEndpoint)
+	e.ExportCSVEndpoint = mw(e.ExportCSVEndpoint)
+	e.ImportCSVEndpoint = mw(e.ImportCSVEndpoint)
+	e.UBLEndpoint = mw(e.UBLEndpoint)
+	e.CIIEndpoint = mw(e.CIIEndpoint)
+	e.FacturXEndpoint = mw(e.FacturXEndpoint)
+	e.ImportUBLEndpoint = mw(e.ImportUBLEndpoint)
+	e.FECEndpoint = mw(e.FECEndpoint)
+	e.SetNumberingEndpoint = mw(e.SetNumberingEndpoint)
+	e.GetNumberingEndpoint = mw(e.GetNumberingEndpoint)
+	e.CreateWebhookEndpoint = mw(e.CreateWebhookEndpoint)
+	e.GetWebhooksEndpoint = mw(e.GetWebhooksEndpoint)
+	e.DeleteWebhookEndpoint = mw(e.DeleteWebhookEndpoint)
+	e.DeliveriesEndpoint = mw(e.DeliveriesEndpoint)
+	e.RedeliverEndpoint = mw(e.RedeliverEndpoint)
+	e.SetPreferenceEndpoint = mw(e.SetPreferenceEndpoint)
+	e.GetPreferenceEndpoint = mw(e.GetPreferenceEndpoint)
+	e.CreateRecurringEndpoint = mw(e.CreateRecurringEndpoint)
+	e.GetRecurringListEndpoint = mw(e.GetRecurringListEndpoint)
+	e.GetRecurringEndpoint = mw(e.GetRecurringEndpoint)
+	e.PauseRecurringEndpoint = mw(e.PauseRecurringEndpoint)
+	e.ResumeRecurringEndpoint = mw(e.ResumeRecurringEndpoint)
+	e.CancelRecurringEndpoint = mw(e.CancelRecurringEndpoint)
+	e.RecurringRunsEndpoint = mw(e.RecurringRunsEndpoint)
+	e.SchedulePaymentEndpoint = mw(e.SchedulePaymentEndpoint)
+	e.ListSchedulesEndpoint = mw(e.ListSchedulesEndpoint)
+	e.CancelPaymentEndpoint = mw(e.CancelPaymentEndpoint)
+	e.CreateMandateEndpoint = mw(e.CreateMandateEndpoint)
+	e.GetMandatesEndpoint = mw(e.GetMandatesEndpoint)
+	e.RevokeMandateEndpoint = mw(e.RevokeMandateEndpoint)
+	e.MandatePaymentsEndpoint = mw(e.MandatePaymentsEndpoint)
+	e.BatchPaymentEndpoint = mw(e.BatchPaymentEndpoint)
+	e.CreateGroupEndpoint = mw(e.CreateGroupEndpoint)
+	e.GetGroupsEndpoint = mw(e.GetGroupsEndpoint)
+	e.CreateBulkJobEndpoint = mw(e.CreateBulkJobEndpoint)
+	e.GetBulkJobsEndpoint = mw(e.GetBulkJobsEndpoint)
+	e.GetBulkJobEndpoint = mw(e.GetBulkJobEndpoint)
+	e.BulkJobItemsEndpoint = mw(e.BulkJobItemsEndpoint)
+	e.CancelBulkJobEndpoint = mw(e.CancelBulkJobEndpoint)
+	return e
+}
+
 // Si created by est à true on retourne les invoices créées par le client si il est à false on retourne celles reçues par le client
 type GetInvoiceListRequest struct {
 	ClientID  string
@@ -40,13 +208,51 @@ type GetInvoiceListResponse struct {
 }
 
 type InvoiceResponseFormat struct {
-	Name      string `json:"name"`
-	Mail      string `json:"mail"`
-	Phone     string `json:"phone"`
-	Amount    string `json:"amount"`
-	State     string `json:"state"`
-	ExpDate   string `json:"expDate"`
-	InvoiceID string `json:"InvoiceID"`
+	Name      string         `json:"name"`
+	Mail      string         `json:"mail"`
+	Phone     string         `json:"phone"`
+	Amount    string         `json:"amount"`
+	State     string         `json:"state"`
+	ExpDate   string         `json:"expDate"`
+	InvoiceID string         `json:"InvoiceID"`
+	Number    string         `json:"invoiceNumber"`
+	Paid      string         `json:"paid"`
+	Remaining string         `json:"remaining"`
+	Items     []LineItem     `json:"items"`
+	Taxes     []TaxBreakdown `json:"tax_breakdown"`
+	LateFees  []LateFee      `json:"late_fees"`
+	Payable   string         `json:"payable"`          // montant à payer aujourd'hui, escompte déduit
+	Deadline  string         `json:"discountDeadline"` // date limite de l'escompte, vide si aucun escompte ne s'applique
+}
+
+// formatInvoice builds the response for an invoice from its details and otherAccount, the account shown
+// to the client : the payer for the invoices it created, the receiver for the invoices it received.
+func formatInvoice(Invoice Invoice, details InvoiceDetails, otherAccount AccountInfo) InvoiceResponseFormat {
+	return InvoiceResponseFormat{
+		otherAccount.Name + " " + otherAccount.Surname,
+		otherAccount.Mail,
+		otherAccount.Phone,
+		fmt.Sprint(Invoice.Amount),
+		StateToString(Invoice.State),
+		Invoice.ExpirationDate,
+		Invoice.ID,
+		Invoice.Number,
+		fmt.Sprint(Invoice.PaidAmount),
+		fmt.Sprint(Invoice.Remaining()),
+		details.Items,
+		details.Taxes,
+		details.LateFees,
+		fmt.Sprint(Invoice.Payable(time.Now())),
+		discountDeadline(Invoice, time.Now()),
+	}
+}
+
+// discountDeadline returns the deadline of the early payment discount while it can still be granted.
+func discountDeadline(invoice Invoice, now time.Time) string {
+	if invoice.EarlyPaymentDiscount(now) == 0 {
+		return ""
+	}
+	return invoice.DiscountDeadline
 }
 
 func MakeGetInvoiceListEndpoint(s InvoiceService) endpoint.Endpoint {
@@ -54,57 +260,108 @@ func MakeGetInvoiceListEndpoint(s InvoiceService) endpoint.Endpoint {
 		req := request.(GetInvoiceListRequest)
 		InvoicesRet := []InvoiceResponseFormat{}
 		invoices, err := s.GetInvoiceList(ctx, req.ClientID)
-		for _, Invoice := range invoices {
-			// Si on veut les invoice créées et que l'utilisateur est le récepteur de l'invoice
-			if req.CreatedBy && Invoice.AccountReceiverId == req.ClientID {
-				otherAccount, err := s.GetAccountInformation(ctx, Invoice.AccountPayerId)
+		if err != nil {
+			return GetInvoiceListResponse{InvoicesRet}, err
+		}
 
-				if err != nil {
-					return GetInvoiceListResponse{InvoicesRet}, err
+		// Si on veut les invoice créées l'utilisateur doit être le récepteur de l'invoice, le payeur sinon.
+		// On affiche alors l'autre compte de l'invoice.
+		listed := make([]Invoice, 0, len(invoices))
+		invoiceIDs := make([]string, 0, len(invoices))
+		accountIDs := make([]string, 0, len(invoices))
+		seen := make(map[string]bool)
+		for _, Invoice := range invoices {
+			other := Invoice.AccountReceiverId
+			if req.CreatedBy {
+				if Invoice.AccountReceiverId != req.ClientID {
+					continue
 				}
+				other = Invoice.AccountPayerId
+			} else if Invoice.AccountPayerId != req.ClientID {
+				continue
+			}
 
-				InvoicesRet = append(InvoicesRet, InvoiceResponseFormat{
-					otherAccount.Name + " " + otherAccount.Surname,
-					otherAccount.Mail,
-					otherAccount.Phone,
-					fmt.Sprint(Invoice.Amount),
-					StateToString(Invoice.State),
-					Invoice.ExpirationDate,
-					Invoice.ID,
-				})
+			listed = append(listed, Invoice)
+			invoiceIDs = append(invoiceIDs, Invoice.ID)
+			if !seen[other] {
+				seen[other] = true
+				accountIDs = append(accountIDs, other)
 			}
-			// Si on veut les invoice reçues et que l'utilisateur et le payeur de l'invoice
-			if !req.CreatedBy && Invoice.AccountPayerId == req.ClientID {
-				otherAccount, err := s.GetAccountInformation(ctx, Invoice.AccountReceiverId)
+		}
 
-				if err != nil {
-					return GetInvoiceListResponse{InvoicesRet}, err
-				}
+		// Les comptes et les détails de toutes les invoices sont lus en une requête par table
+		accounts, err := s.GetAccountsInformation(ctx, accountIDs)
+		if err != nil {
+			return GetInvoiceListResponse{InvoicesRet}, err
+		}
+		details, err := s.GetInvoiceDetails(ctx, invoiceIDs)
+		if err != nil {
+			return GetInvoiceListResponse{InvoicesRet}, err
+		}
 
-				InvoicesRet = append(InvoicesRet, InvoiceResponseFormat{
-					otherAccount.Name + " " + otherAccount.Surname,
-					otherAccount.Mail,
-					otherAccount.Phone,
-					fmt.Sprint(Invoice.Amount),
-					StateToString(Invoice.State),
-					Invoice.ExpirationDate,
-					Invoice.ID,
-				})
+		for _, Invoice := range listed {
+			other := Invoice.AccountReceiverId
+			if req.CreatedBy {
+				other = Invoice.AccountPayerId
 			}
+			InvoicesRet = append(InvoicesRet, formatInvoice(Invoice, details[Invoice.ID], accounts[other]))
+		}
+		return GetInvoiceListResponse{InvoicesRet}, nil
+	}
+}
+
+type GetInvoiceRequest struct {
+	Iid string
+}
+
+type GetInvoiceResponse struct {
+	Invoice  Invoice        `json:"invoice"`
+	Items    []LineItem     `json:"items"`
+	Taxes    []TaxBreakdown `json:"tax_breakdown"`
+	LateFees []LateFee      `json:"late_fees"`
+}
+
+func MakeGetInvoiceEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetInvoiceRequest)
+
+		invoice, err := s.Read(ctx, req.Iid)
+		if err != nil {
+			return nil, ErrNotFound
+		}
+
+		items, err := s.GetLineItems(ctx, req.Iid)
+		if err != nil {
+			return nil, err
+		}
+
+		taxes, err := s.GetTaxBreakdown(ctx, req.Iid)
+		if err != nil {
+			return nil, err
+		}
+
+		fees, err := s.GetLateFees(ctx, req.Iid)
+		if err != nil {
+			return nil, err
 		}
-		return GetInvoiceListResponse{InvoicesRet}, err
+		return GetInvoiceResponse{invoice, items, taxes, fees}, nil
 	}
 }
 
 type AddRequest struct {
-	Uid         string  // Id du client créant la facture
-	EmailClient string  // email du client payeur
-	Amount      float32 // montant de la facture
-	ExpDate     string  // date d'expiration de la facture
+	Uid         string        // Id du client créant la facture
+	EmailClient string        // email du client payeur
+	Amount      float32       // montant de la facture, calculé à partir des lignes si elles sont renseignées
+	ExpDate     string        // date d'expiration de la facture
+	Items       []LineItem    // lignes de la facture
+	TaxCountry  string        // juridiction fiscale des lignes, FR par défaut
+	Discount    DiscountTerms // escompte pour paiement anticipé, optionnel
 }
 
 type AddResponse struct {
-	Created bool `json:"created"`
+	Created bool   `json:"created"`
+	ID      string `json:"invoice_id,omitempty"`
+	Number  string `json:"invoice_number,omitempty"`
 }
 
 func MakeAddEndpoint(s InvoiceService) endpoint.Endpoint {
@@ -118,18 +375,23 @@ func MakeAddEndpoint(s InvoiceService) endpoint.Endpoint {
 		}
 
 		i := Invoice{
-			"",
-			float64(req.Amount),
-			PENDING,
-			req.ExpDate,
-			id,
-			req.Uid,
+			Amount:            float64(req.Amount),
+			State:             PENDING,
+			ExpirationDate:    req.ExpDate,
+			AccountPayerId:    id,
+			AccountReceiverId: req.Uid,
+			TaxJurisdiction:   req.TaxCountry,
+		}
+
+		i, err = req.Discount.Apply(i, time.Now())
+		if err != nil {
+			return nil, err
 		}
 
-		_, err = s.Create(ctx, i)
+		i, err = s.Create(ctx, i, req.Items...)
 
 		if err == nil {
-			return AddResponse{true}, nil
+			return AddResponse{true, i.ID, i.Number}, nil
 		} else {
 			return nil, err
 		}
@@ -137,20 +399,136 @@ func MakeAddEndpoint(s InvoiceService) endpoint.Endpoint {
 }
 
 type InvoicePaymentRequest struct {
-	Iid string
+	Iid    string
+	Amount float64 // montant à payer, 0 pour payer tout ce qui reste
 }
 
 type InvoicePaymentResponse struct {
-	Paid bool `json:"paid"`
+	Paid      bool    `json:"paid"`
+	Remaining float64 `json:"remaining"`
 }
 
 func MakeInvoicePaymentEndpoint(s InvoiceService) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(InvoicePaymentRequest)
 
-		paid, err := s.PayInvoice(ctx, req.Iid)
+		if req.Amount == 0 {
+			paid, err := s.PayInvoice(ctx, req.Iid)
+			return InvoicePaymentResponse{paid, 0}, err
+		}
+
+		invoice, err := s.PayInvoicePartially(ctx, req.Iid, req.Amount)
+		if err != nil {
+			return InvoicePaymentResponse{false, 0}, err
+		}
+		return InvoicePaymentResponse{invoice.State == PAID, invoice.Remaining()}, nil
+	}
+}
+
+type SetInstallmentPlanRequest struct {
+	Iid          string
+	Uid          string // Id du client ayant émis la facture
+	Installments []Installment
+}
+
+type InstallmentsResponse struct {
+	Installments []Installment `json:"installments"`
+}
+
+func MakeSetInstallmentPlanEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(SetInstallmentPlanRequest)
+
+		plan, err := s.SetInstallmentPlan(ctx, req.Iid, req.Uid, req.Installments)
+
+		if err != nil {
+			return nil, err
+		}
+		return InstallmentsResponse{plan}, nil
+	}
+}
+
+type GetInstallmentsRequest struct {
+	Iid string
+}
+
+func MakeGetInstallmentsEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetInstallmentsRequest)
+
+		installments, err := s.GetInstallments(ctx, req.Iid)
+
+		if err != nil {
+			return nil, err
+		}
+		return InstallmentsResponse{installments}, nil
+	}
+}
+
+type InstallmentPaymentRequest struct {
+	InstallmentID string
+}
+
+type InstallmentPaymentResponse struct {
+	Paid        bool         `json:"paid"`
+	Installment *Installment `json:"installment,omitempty"`
+}
+
+func MakeInstallmentPaymentEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(InstallmentPaymentRequest)
+
+		installment, err := s.PayInstallment(ctx, req.InstallmentID)
+
+		if err != nil {
+			return InstallmentPaymentResponse{false, nil}, err
+		}
+		return InstallmentPaymentResponse{true, &installment}, nil
+	}
+}
+
+type RefundRequest struct {
+	Iid    string
+	Amount float64 // montant à rembourser, 0 pour rembourser tout ce qui reste
+	Reason string
+}
+
+type RefundResponse struct {
+	Refunded   bool        `json:"refunded"`
+	CreditNote *CreditNote `json:"credit_note,omitempty"`
+}
+
+func MakeRefundEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(RefundRequest)
+
+		note, err := s.RefundInvoice(ctx, req.Iid, req.Amount, req.Reason)
+
+		if err != nil {
+			return RefundResponse{false, nil}, err
+		}
+		return RefundResponse{true, &note}, nil
+	}
+}
+
+type GetCreditNotesRequest struct {
+	Iid string
+}
+
+type GetCreditNotesResponse struct {
+	CreditNotes []CreditNote `json:"credit_notes"`
+}
 
-		return InvoicePaymentResponse{paid}, err
+func MakeGetCreditNotesEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetCreditNotesRequest)
+
+		notes, err := s.GetCreditNotes(ctx, req.Iid)
+
+		if err != nil {
+			return nil, err
+		}
+		return GetCreditNotesResponse{notes}, nil
 	}
 }
 
@@ -176,6 +554,27 @@ func MakeDeleteEndpoint(s InvoiceService) endpoint.Endpoint {
 	}
 }
 
+type GetLedgerRequest struct {
+	ClientID string
+}
+
+type GetLedgerResponse struct {
+	Entries []LedgerEntry `json:"entries"`
+}
+
+func MakeGetLedgerEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetLedgerRequest)
+
+		entries, err := s.GetLedgerEntries(ctx, req.ClientID)
+
+		if err != nil {
+			return nil, err
+		}
+		return GetLedgerResponse{entries}, nil
+	}
+}
+
 func StateToString(stateID int) string {
 	switch stateID {
 	case PENDING:
@@ -184,6 +583,865 @@ func StateToString(stateID int) string {
 		return "Paid"
 	case EXPIRED:
 		return "Expired"
+	case REFUNDED:
+		return "Refunded"
+	case PARTIALLY_REFUNDED:
+		return "Partially refunded"
+	case PARTIALLY_PAID:
+		return "Partially paid"
+	case CANCELLED:
+		return "Cancelled"
 	}
 	return ""
 }
+
+type SetLateFeePolicyRequest struct {
+	Policy LateFeePolicy
+}
+
+type GetLateFeePolicyRequest struct {
+	Uid string
+}
+
+type LateFeePolicyResponse struct {
+	Policy LateFeePolicy `json:"late_fee_policy"`
+}
+
+func MakeSetLateFeePolicyEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(SetLateFeePolicyRequest)
+
+		policy, err := s.SetLateFeePolicy(ctx, req.Policy)
+
+		if err != nil {
+			return nil, err
+		}
+		return LateFeePolicyResponse{policy}, nil
+	}
+}
+
+func MakeGetLateFeePolicyEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetLateFeePolicyRequest)
+
+		policy, err := s.GetLateFeePolicy(ctx, req.Uid)
+
+		if err != nil {
+			return nil, err
+		}
+		return LateFeePolicyResponse{policy}, nil
+	}
+}
+
+type SetNumberingPolicyRequest struct {
+	Policy NumberingPolicy
+}
+
+type GetNumberingPolicyRequest struct {
+	Uid string
+}
+
+type NumberingPolicyResponse struct {
+	Policy NumberingPolicy `json:"numbering_policy"`
+}
+
+func MakeSetNumberingPolicyEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(SetNumberingPolicyRequest)
+
+		policy, err := s.SetNumberingPolicy(ctx, req.Policy)
+
+		if err != nil {
+			return nil, err
+		}
+		return NumberingPolicyResponse{policy}, nil
+	}
+}
+
+func MakeGetNumberingPolicyEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetNumberingPolicyRequest)
+
+		policy, err := s.GetNumberingPolicy(ctx, req.Uid)
+
+		if err != nil {
+			return nil, err
+		}
+		return NumberingPolicyResponse{policy}, nil
+	}
+}
+
+type SetNotificationPreferenceRequest struct {
+	Preference NotificationPreference
+}
+
+type GetNotificationPreferenceRequest struct {
+	Uid string
+}
+
+type NotificationPreferenceResponse struct {
+	Preference NotificationPreference `json:"notification_preference"`
+}
+
+func MakeSetNotificationPreferenceEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(SetNotificationPreferenceRequest)
+
+		preference, err := s.SetNotificationPreference(ctx, req.Preference)
+
+		if err != nil {
+			return nil, err
+		}
+		return NotificationPreferenceResponse{preference}, nil
+	}
+}
+
+func MakeGetNotificationPreferenceEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetNotificationPreferenceRequest)
+
+		preference, err := s.GetNotificationPreference(ctx, req.Uid)
+
+		if err != nil {
+			return nil, err
+		}
+		return NotificationPreferenceResponse{preference}, nil
+	}
+}
+
+type GetInvoiceDocumentRequest struct {
+	Iid string
+}
+
+// DocumentResponse is written as is by the transport instead of being encoded in JSON.
+type DocumentResponse struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+// invoiceDocument gathers what the PDF templates show about the invoice.
+func invoiceDocument(ctx context.Context, s InvoiceService, id string) (InvoiceDocument, error) {
+	invoice, err := s.Read(ctx, id)
+	if err != nil {
+		return InvoiceDocument{}, ErrNotFound
+	}
+
+	doc := InvoiceDocument{
+		Invoice: invoice,
+		State:   StateToString(invoice.State),
+		Date:    time.Now(),
+	}
+	if doc.Issuer, err = s.GetAccountInformation(ctx, invoice.AccountReceiverId); err != nil {
+		return InvoiceDocument{}, err
+	}
+	if doc.Payer, err = s.GetAccountInformation(ctx, invoice.AccountPayerId); err != nil {
+		return InvoiceDocument{}, err
+	}
+	if doc.Items, err = s.GetLineItems(ctx, id); err != nil {
+		return InvoiceDocument{}, err
+	}
+	if doc.Taxes, err = s.GetTaxBreakdown(ctx, id); err != nil {
+		return InvoiceDocument{}, err
+	}
+	if doc.LateFees, err = s.GetLateFees(ctx, id); err != nil {
+		return InvoiceDocument{}, err
+	}
+	return doc, nil
+}
+
+func MakeInvoicePDFEndpoint(s InvoiceService, renderer *PDFRenderer) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetInvoiceDocumentRequest)
+
+		doc, err := invoiceDocument(ctx, s, req.Iid)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if err := renderer.RenderInvoice(&buf, doc); err != nil {
+			return nil, err
+		}
+		return DocumentResponse{"facture-" + req.Iid + ".pdf", "application/pdf", buf.Bytes()}, nil
+	}
+}
+
+func MakeReceiptPDFEndpoint(s InvoiceService, renderer *PDFRenderer) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetInvoiceDocumentRequest)
+
+		doc, err := invoiceDocument(ctx, s, req.Iid)
+		if err != nil {
+			return nil, err
+		}
+		if doc.Invoice.PaidAmount == 0 {
+			return nil, ErrNoPayment
+		}
+
+		// Les paiements sont les débits du payeur pour cette facture
+		entries, err := s.GetLedgerEntries(ctx, doc.Invoice.AccountPayerId)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.InvoiceID == req.Iid && entry.Type == DEBIT {
+				doc.Payments = append(doc.Payments, entry)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := renderer.RenderReceipt(&buf, doc); err != nil {
+			return nil, err
+		}
+		return DocumentResponse{"recu-" + req.Iid + ".pdf", "application/pdf", buf.Bytes()}, nil
+	}
+}
+
+type ExportCSVRequest struct {
+	ClientID  string
+	CreatedBy bool
+}
+
+// CSVResponse is streamed by the transport, write is only called once the headers are sent.
+type CSVResponse struct {
+	Filename string
+	write    func(w io.Writer) error
+}
+
+func MakeExportCSVEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ExportCSVRequest)
+
+		return CSVResponse{
+			Filename: "factures-" + req.ClientID + ".csv",
+			write: func(w io.Writer) error {
+				return WriteInvoicesCSV(ctx, s, w, req.ClientID, req.CreatedBy)
+			},
+		}, nil
+	}
+}
+
+type ImportCSVRequest struct {
+	Uid  string // Id du client émettant les factures
+	Mode string // all-or-nothing (par défaut) ou best-effort
+	CSV  []byte
+}
+
+type ImportCSVResponse struct {
+	ImportReport
+}
+
+// StatusCode tells the caller nothing was created when an all-or-nothing import has an invalid row.
+func (r ImportCSVResponse) StatusCode() int {
+	if r.Mode == IMPORT_ALL_OR_NOTHING && r.Failed > 0 {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusOK
+}
+
+func MakeImportCSVEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ImportCSVRequest)
+
+		report, err := ImportInvoicesCSV(ctx, s, bytes.NewReader(req.CSV), req.Uid, req.Mode)
+
+		if err != nil {
+			return nil, err
+		}
+		return ImportCSVResponse{report}, nil
+	}
+}
+
+// MakeEInvoiceEndpoint returns the invoice written by write, the file is named facture-<id>-<suffix>.
+func MakeEInvoiceEndpoint(s InvoiceService, suffix string, contentType string, write func(io.Writer, InvoiceDocument) error) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetInvoiceDocumentRequest)
+
+		doc, err := invoiceDocument(ctx, s, req.Iid)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if err := write(&buf, doc); err != nil {
+			return nil, err
+		}
+		return DocumentResponse{"facture-" + req.Iid + "-" + suffix, contentType, buf.Bytes()}, nil
+	}
+}
+
+type ImportUBLRequest struct {
+	Uid      string // émetteur qui importe le document, doit en être le fournisseur
+	Document []byte
+}
+
+type ImportUBLResponse struct {
+	Created bool   `json:"created"`
+	ID      string `json:"invoice_id,omitempty"`
+	Number  string `json:"invoice_number,omitempty"`
+}
+
+func MakeImportUBLEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ImportUBLRequest)
+
+		invoice, created, err := s.ImportUBL(ctx, req.Uid, req.Document)
+
+		if err != nil {
+			return nil, err
+		}
+		return ImportUBLResponse{created, invoice.ID, invoice.Number}, nil
+	}
+}
+
+type FECRequest struct {
+	Uid  string // Id de l'émetteur
+	From string
+	To   string
+}
+
+func MakeFECEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(FECRequest)
+
+		from, to, err := ParsePeriod(req.From, req.To)
+		if err != nil {
+			return nil, err
+		}
+
+		lines, err := s.GetFECEntries(ctx, req.Uid, from, to)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if err := WriteFEC(&buf, lines); err != nil {
+			return nil, err
+		}
+		return DocumentResponse{FECFilename(req.Uid, to), "text/tab-separated-values; charset=utf-8", buf.Bytes()}, nil
+	}
+}
+
+type CreateWebhookRequest struct {
+	Webhook WebhookSubscription
+}
+
+type WebhookResponse struct {
+	Webhook WebhookSubscription `json:"webhook"`
+}
+
+func MakeCreateWebhookEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CreateWebhookRequest)
+
+		webhook, err := s.CreateWebhook(ctx, req.Webhook)
+
+		if err != nil {
+			return nil, err
+		}
+		return WebhookResponse{webhook}, nil
+	}
+}
+
+type GetWebhooksRequest struct {
+	Uid string
+}
+
+type GetWebhooksResponse struct {
+	Webhooks []WebhookSubscription `json:"webhooks"`
+}
+
+func MakeGetWebhooksEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetWebhooksRequest)
+
+		webhooks, err := s.GetWebhooks(ctx, req.Uid)
+
+		if err != nil {
+			return nil, err
+		}
+		return GetWebhooksResponse{webhooks}, nil
+	}
+}
+
+type WebhookRequest struct {
+	WebhookID string
+}
+
+type DeleteWebhookResponse struct {
+	Deleted bool `json:"deleted"`
+}
+
+func MakeDeleteWebhookEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(WebhookRequest)
+
+		if err := s.DeleteWebhook(ctx, req.WebhookID); err != nil {
+			return nil, err
+		}
+		return DeleteWebhookResponse{true}, nil
+	}
+}
+
+type WebhookDeliveriesResponse struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+func MakeWebhookDeliveriesEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(WebhookRequest)
+
+		deliveries, err := s.GetWebhookDeliveries(ctx, req.WebhookID)
+
+		if err != nil {
+			return nil, err
+		}
+		return WebhookDeliveriesResponse{deliveries}, nil
+	}
+}
+
+type RedeliverWebhookRequest struct {
+	DeliveryID string
+}
+
+type RedeliverWebhookResponse struct {
+	Delivery WebhookDelivery `json:"delivery"`
+}
+
+func MakeRedeliverWebhookEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(RedeliverWebhookRequest)
+
+		delivery, err := s.RedeliverWebhook(ctx, req.DeliveryID)
+
+		if err != nil {
+			return nil, err
+		}
+		return RedeliverWebhookResponse{delivery}, nil
+	}
+}
+
+type CreateRecurringInvoiceRequest struct {
+	EmailClient string // email du client payeur
+	Recurring   RecurringInvoice
+}
+
+type RecurringInvoiceResponse struct {
+	Recurring RecurringInvoice `json:"recurring_invoice"`
+}
+
+func MakeCreateRecurringInvoiceEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CreateRecurringInvoiceRequest)
+
+		id, err := s.GetIdFromMail(ctx, req.EmailClient)
+
+		if err != nil {
+			return nil, err
+		}
+
+		req.Recurring.PayerID = id
+		recurring, err := s.CreateRecurringInvoice(ctx, req.Recurring)
+
+		if err != nil {
+			return nil, err
+		}
+		return RecurringInvoiceResponse{recurring}, nil
+	}
+}
+
+type GetRecurringInvoicesRequest struct {
+	Uid string
+}
+
+type GetRecurringInvoicesResponse struct {
+	Recurring []RecurringInvoice `json:"recurring_invoices"`
+}
+
+func MakeGetRecurringInvoicesEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetRecurringInvoicesRequest)
+
+		recurring, err := s.GetRecurringInvoices(ctx, req.Uid)
+
+		if err != nil {
+			return nil, err
+		}
+		return GetRecurringInvoicesResponse{recurring}, nil
+	}
+}
+
+type RecurringInvoiceRequest struct {
+	RecurringID string
+}
+
+func MakeGetRecurringInvoiceEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(RecurringInvoiceRequest)
+
+		recurring, err := s.GetRecurringInvoice(ctx, req.RecurringID)
+
+		if err != nil {
+			return nil, err
+		}
+		return RecurringInvoiceResponse{recurring}, nil
+	}
+}
+
+// MakeSetRecurringStateEndpoint returns the endpoint pausing, resuming or cancelling a recurring invoice.
+func MakeSetRecurringStateEndpoint(s InvoiceService, state string) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(RecurringInvoiceRequest)
+
+		recurring, err := s.SetRecurringInvoiceState(ctx, req.RecurringID, state)
+
+		if err != nil {
+			return nil, err
+		}
+		return RecurringInvoiceResponse{recurring}, nil
+	}
+}
+
+type RecurringRunsResponse struct {
+	Runs []RecurringRun `json:"runs"`
+}
+
+func MakeRecurringRunsEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(RecurringInvoiceRequest)
+
+		runs, err := s.GetRecurringRuns(ctx, req.RecurringID)
+
+		if err != nil {
+			return nil, err
+		}
+		return RecurringRunsResponse{runs}, nil
+	}
+}
+
+type SchedulePaymentRequest struct {
+	Iid  string
+	Uid  string // Id du payeur
+	Date string // date du paiement, date d'expiration de la facture si vide
+}
+
+type ScheduledPaymentResponse struct {
+	Payment ScheduledPayment `json:"scheduled_payment"`
+}
+
+func MakeSchedulePaymentEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(SchedulePaymentRequest)
+
+		payment, err := s.SchedulePayment(ctx, req.Iid, req.Uid, req.Date)
+
+		if err != nil {
+			return nil, err
+		}
+		return ScheduledPaymentResponse{payment}, nil
+	}
+}
+
+type GetScheduledPaymentsRequest struct {
+	Uid string
+}
+
+type GetScheduledPaymentsResponse struct {
+	Payments []ScheduledPayment `json:"scheduled_payments"`
+}
+
+func MakeGetListSchedulesEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetScheduledPaymentsRequest)
+
+		payments, err := s.GetScheduledPayments(ctx, req.Uid)
+
+		if err != nil {
+			return nil, err
+		}
+		return GetScheduledPaymentsResponse{payments}, nil
+	}
+}
+
+type CancelScheduledPaymentRequest struct {
+	PaymentID string
+}
+
+func MakeCancelScheduledPaymentEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CancelScheduledPaymentRequest)
+
+		payment, err := s.CancelScheduledPayment(ctx, req.PaymentID)
+
+		if err != nil {
+			return nil, err
+		}
+		return ScheduledPaymentResponse{payment}, nil
+	}
+}
+
+type CreateMandateRequest struct {
+	EmailIssuer string // email de l'émetteur autorisé
+	Mandate     Mandate
+}
+
+type MandateResponse struct {
+	Mandate Mandate `json:"mandate"`
+}
+
+func MakeCreateMandateEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CreateMandateRequest)
+
+		id, err := s.GetIdFromMail(ctx, req.EmailIssuer)
+
+		if err != nil {
+			return nil, err
+		}
+
+		req.Mandate.IssuerID = id
+		mandate, err := s.CreateMandate(ctx, req.Mandate)
+
+		if err != nil {
+			return nil, err
+		}
+		return MandateResponse{mandate}, nil
+	}
+}
+
+type GetMandatesRequest struct {
+	Uid string
+}
+
+type GetMandatesResponse struct {
+	Mandates []Mandate `json:"mandates"`
+}
+
+func MakeGetMandatesEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetMandatesRequest)
+
+		mandates, err := s.GetMandates(ctx, req.Uid)
+
+		if err != nil {
+			return nil, err
+		}
+		return GetMandatesResponse{mandates}, nil
+	}
+}
+
+type MandateRequest struct {
+	MandateID string
+}
+
+func MakeRevokeMandateEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(MandateRequest)
+
+		mandate, err := s.RevokeMandate(ctx, req.MandateID)
+
+		if err != nil {
+			return nil, err
+		}
+		return MandateResponse{mandate}, nil
+	}
+}
+
+type MandatePaymentsResponse struct {
+	Payments []MandatePayment `json:"payments"`
+}
+
+func MakeMandatePaymentsEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(MandateRequest)
+
+		payments, err := s.GetMandatePayments(ctx, req.MandateID)
+
+		if err != nil {
+			return nil, err
+		}
+		return MandatePaymentsResponse{payments}, nil
+	}
+}
+
+type BatchPaymentRequest struct {
+	Uid      string   // Id du payeur
+	Invoices []string // factures à payer, par ordre de priorité
+	Mode     string   // ALL_OR_NOTHING par défaut, ou PRIORITY
+}
+
+type BatchPaymentResponse struct {
+	Batch BatchPayment `json:"batch"`
+}
+
+func MakeBatchPaymentEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(BatchPaymentRequest)
+
+		batch, err := s.PayInvoices(ctx, req.Uid, req.Invoices, req.Mode)
+
+		if err != nil {
+			return nil, err
+		}
+		return BatchPaymentResponse{batch}, nil
+	}
+}
+
+type CreatePayerGroupRequest struct {
+	Group PayerGroup
+}
+
+type PayerGroupResponse struct {
+	Group PayerGroup `json:"group"`
+}
+
+func MakeCreatePayerGroupEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CreatePayerGroupRequest)
+
+		group, err := s.CreatePayerGroup(ctx, req.Group)
+
+		if err != nil {
+			return nil, err
+		}
+		return PayerGroupResponse{group}, nil
+	}
+}
+
+type GetPayerGroupsRequest struct {
+	Uid string
+}
+
+type GetPayerGroupsResponse struct {
+	Groups []PayerGroup `json:"groups"`
+}
+
+func MakeGetPayerGroupsEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetPayerGroupsRequest)
+
+		groups, err := s.GetPayerGroups(ctx, req.Uid)
+
+		if err != nil {
+			return nil, err
+		}
+		return GetPayerGroupsResponse{groups}, nil
+	}
+}
+
+type CreateBulkJobRequest struct {
+	Uid    string   // Id de l'émetteur
+	Emails []string // emails des payeurs, vide si Job.GroupID est donné
+	Job    BulkInvoiceJob
+}
+
+type BulkInvoiceJobResponse struct {
+	Job BulkInvoiceJob `json:"job"`
+}
+
+func MakeCreateBulkInvoiceJobEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CreateBulkJobRequest)
+
+		req.Job.IssuerID = req.Uid
+		job, err := s.CreateBulkInvoiceJob(ctx, req.Job, req.Emails)
+
+		if err != nil {
+			return nil, err
+		}
+		return BulkInvoiceJobResponse{job}, nil
+	}
+}
+
+type GetBulkInvoiceJobsRequest struct {
+	Uid string
+}
+
+type GetBulkInvoiceJobsResponse struct {
+	Jobs []BulkInvoiceJob `json:"jobs"`
+}
+
+func MakeGetBulkInvoiceJobsEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetBulkInvoiceJobsRequest)
+
+		jobs, err := s.GetBulkInvoiceJobs(ctx, req.Uid)
+
+		if err != nil {
+			return nil, err
+		}
+		return GetBulkInvoiceJobsResponse{jobs}, nil
+	}
+}
+
+type BulkInvoiceJobRequest struct {
+	JobID string
+	State string // filtre des factures par état, optionnel
+}
+
+func MakeGetBulkInvoiceJobEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(BulkInvoiceJobRequest)
+
+		job, err := s.GetBulkInvoiceJob(ctx, req.JobID)
+
+		if err != nil {
+			return nil, err
+		}
+		return BulkInvoiceJobResponse{job}, nil
+	}
+}
+
+type BulkInvoiceItemsResponse struct {
+	Items []BulkInvoiceItem `json:"items"`
+}
+
+func MakeBulkInvoiceItemsEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(BulkInvoiceJobRequest)
+
+		items, err := s.GetBulkInvoiceItems(ctx, req.JobID, req.State)
+
+		if err != nil {
+			return nil, err
+		}
+		return BulkInvoiceItemsResponse{items}, nil
+	}
+}
+
+func MakeCancelBulkInvoiceJobEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(BulkInvoiceJobRequest)
+
+		job, err := s.CancelBulkInvoiceJob(ctx, req.JobID)
+
+		if err != nil {
+			return nil, err
+		}
+		return BulkInvoiceJobResponse{job}, nil
+	}
+}
+
+type CancelInvoiceRequest struct {
+	Iid    string
+	Reason string
+}
+
+type CancelInvoiceResponse struct {
+	Cancelled  bool        `json:"cancelled"`
+	CreditNote *CreditNote `json:"credit_note,omitempty"`
+}
+
+func MakeCancelInvoiceEndpoint(s InvoiceService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CancelInvoiceRequest)
+
+		note, err := s.CancelInvoice(ctx, req.Iid, req.Reason)
+
+		if err != nil {
+			return CancelInvoiceResponse{false, nil}, err
+		}
+		return CancelInvoiceResponse{true, &note}, nil
+	}
+}
@@ -0,0 +1,143 @@
+package invoice_microservice
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/rs/xid"
+)
+
+// Version du schéma des événements, à incrémenter à chaque changement incompatible
+const EventSchemaVersion = 1
+
+// Types des événements du cycle de vie des factures
+const (
+	InvoiceCreated       = "InvoiceCreated"
+	InvoiceUpdated       = "InvoiceUpdated"
+	InvoicePaid          = "InvoicePaid"
+	InvoicePartiallyPaid = "InvoicePartiallyPaid"
+	InvoiceRefunded      = "InvoiceRefunded"
+	InvoiceExpired       = "InvoiceExpired"
+	InvoiceDeleted       = "InvoiceDeleted"
+	InvoiceCancelled     = "InvoiceCancelled"
+)
+
+// EventSchema is the JSON schema of the events of the current version.
+//
+//go:embed events/invoice-event.v1.json
+var EventSchema []byte
+
+// Event is written in the outbox with the change it describes, and published by the OutboxRelay.
+type Event struct {
+	ID            string       `json:"id"`
+	Type          string       `json:"type"`
+	SchemaVersion int          `json:"schema_version"`
+	OccurredAt    time.Time    `json:"occurred_at"`
+	Invoice       EventInvoice `json:"invoice"`
+	Amount        float64      `json:"amount,omitempty"` // montant payé ou remboursé
+}
+
+// EventInvoice is the state of the invoice after the change.
+type EventInvoice struct {
+	ID             string  `json:"id"`
+	Number         string  `json:"number"`
+	State          string  `json:"state"`
+	Amount         float64 `json:"amount"`
+	PaidAmount     float64 `json:"paid_amount"`
+	Remaining      float64 `json:"remaining"`
+	ExpirationDate string  `json:"expiration_date"`
+	PayerID        string  `json:"payer_id"`
+	ReceiverID     string  `json:"receiver_id"`
+}
+
+func NewEvent(eventType string, invoice Invoice, amount float64) Event {
+	return Event{
+		ID:            xid.New().String(),
+		Type:          eventType,
+		SchemaVersion: EventSchemaVersion,
+		OccurredAt:    time.Now().UTC(),
+		Invoice: EventInvoice{
+			ID:             invoice.ID,
+			Number:         invoice.Number,
+			State:          StateToString(invoice.State),
+			Amount:         invoice.Amount,
+			PaidAmount:     invoice.PaidAmount,
+			Remaining:      invoice.Remaining(),
+			ExpirationDate: invoice.ExpirationDate,
+			PayerID:        invoice.AccountPayerId,
+			ReceiverID:     invoice.AccountReceiverId,
+		},
+		Amount: amount,
+	}
+}
+
+// paymentEvent returns InvoicePaid once the invoice is settled, InvoicePartiallyPaid before.
+func paymentEvent(invoice Invoice, amount float64) Event {
+	if invoice.State == PAID {
+		return NewEvent(InvoicePaid, invoice, amount)
+	}
+	return NewEvent(InvoicePartiallyPaid, invoice, amount)
+}
+
+// Publisher sends the events to the other services.
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// Publishers sends each event to every publisher, in order, and stops at the first error.
+type Publishers []Publisher
+
+func (ps Publishers) Publish(ctx context.Context, event Event) error {
+	for _, p := range ps {
+		if err := p.Publish(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LogPublisher writes the events in the logs.
+type LogPublisher struct {
+	logger log.Logger
+}
+
+func NewLogPublisher(logger log.Logger) *LogPublisher {
+	return &LogPublisher{logger: logger}
+}
+
+func (p *LogPublisher) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return p.logger.Log("event", event.Type, "invoice", event.Invoice.ID, "payload", string(payload))
+}
+
+// InProcessPublisher calls its subscribers synchronously, in the order they subscribed.
+type InProcessPublisher struct {
+	mtx         sync.RWMutex
+	subscribers []func(context.Context, Event)
+}
+
+func NewInProcessPublisher() *InProcessPublisher {
+	return &InProcessPublisher{}
+}
+
+func (p *InProcessPublisher) Subscribe(fn func(context.Context, Event)) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.subscribers = append(p.subscribers, fn)
+}
+
+func (p *InProcessPublisher) Publish(ctx context.Context, event Event) error {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	for _, fn := range p.subscribers {
+		fn(ctx, event)
+	}
+	return nil
+}
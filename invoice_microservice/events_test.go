@@ -0,0 +1,104 @@
+package invoice_microservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+// assertMatchesSchema checks the required properties of the schema, and of its invoice object.
+func assertMatchesSchema(t *testing.T, payload []byte) {
+	var schema struct {
+		Required   []string
+		Properties struct {
+			SchemaVersion struct {
+				Const int
+			} `json:"schema_version"`
+			Type struct {
+				Enum []string
+			}
+			Invoice struct {
+				Required []string
+			}
+		}
+	}
+	if err := json.Unmarshal(EventSchema, &schema); err != nil {
+		t.Fatal(err)
+	}
+	if schema.Properties.SchemaVersion.Const != EventSchemaVersion {
+		t.Fatalf("Schema is for version %d, events are version %d", schema.Properties.SchemaVersion.Const, EventSchemaVersion)
+	}
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range schema.Required {
+		if _, ok := event[key]; !ok {
+			t.Errorf("Event misses %s : %s", key, payload)
+		}
+	}
+	invoice, _ := event["invoice"].(map[string]interface{})
+	for _, key := range schema.Properties.Invoice.Required {
+		if _, ok := invoice[key]; !ok {
+			t.Errorf("Invoice of the event misses %s : %s", key, payload)
+		}
+	}
+	known := false
+	for _, eventType := range schema.Properties.Type.Enum {
+		known = known || eventType == event["type"]
+	}
+	if !known {
+		t.Errorf("Type %v is not in the schema", event["type"])
+	}
+}
+
+func TestEventSchema(t *testing.T) {
+	invoice := Invoice{ID: "c1g2", Number: "2021-000001", Amount: 100, PaidAmount: 40, State: PARTIALLY_PAID, ExpirationDate: "2021-05-01", AccountPayerId: "paul", AccountReceiverId: "anne"}
+
+	event := paymentEvent(invoice, 40)
+	if event.Type != InvoicePartiallyPaid || event.Invoice.Remaining != 60 || event.Invoice.State != "Partially paid" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	invoice.PaidAmount, invoice.State = 100, PAID
+	if e := paymentEvent(invoice, 60); e.Type != InvoicePaid || e.Amount != 60 {
+		t.Errorf("Expected InvoicePaid, got %+v", e)
+	}
+
+	for _, eventType := range []string{InvoiceCreated, InvoiceUpdated, InvoicePaid, InvoicePartiallyPaid, InvoiceRefunded, InvoiceExpired, InvoiceDeleted, InvoiceCancelled} {
+		payload, err := json.Marshal(NewEvent(eventType, Invoice{ID: "c1g2"}, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertMatchesSchema(t, payload)
+	}
+}
+
+func TestPublishers(t *testing.T) {
+	received := make([]string, 0)
+	p := NewInProcessPublisher()
+	p.Subscribe(func(_ context.Context, e Event) { received = append(received, "first "+e.Type) })
+	p.Subscribe(func(_ context.Context, e Event) { received = append(received, "second "+e.Type) })
+
+	for _, e := range []Event{NewEvent(InvoiceCreated, Invoice{ID: "a"}, 0), NewEvent(InvoiceDeleted, Invoice{ID: "a"}, 0)} {
+		if err := p.Publish(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if strings.Join(received, ",") != "first InvoiceCreated,second InvoiceCreated,first InvoiceDeleted,second InvoiceDeleted" {
+		t.Errorf("Unexpected deliveries %v", received)
+	}
+
+	var buf bytes.Buffer
+	if err := NewLogPublisher(log.NewLogfmtLogger(&buf)).Publish(context.Background(), NewEvent(InvoiceExpired, Invoice{ID: "a"}, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "event=InvoiceExpired invoice=a") {
+		t.Errorf("Unexpected log %s", buf.String())
+	}
+}
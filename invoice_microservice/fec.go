@@ -0,0 +1,402 @@
+package invoice_microservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Journaux et comptes du plan comptable général utilisés dans le FEC
+const (
+	SalesJournal   = "VE"
+	BankJournal    = "BQ"
+	VariousJournal = "OD"
+
+	CustomerAccount   = "411000"
+	ServicesAccount   = "706000"
+	VATAccount        = "445710"
+	LateFeeAccount    = "763000"
+	CreditNoteAccount = "709000"
+	DiscountAccount   = "665000"
+	BankAccount       = "512000"
+)
+
+var (
+	ErrInvalidPeriod = errors.New("period must be two dates (2006-01-02), the first one before the second")
+)
+
+var fecJournals = map[string]string{
+	SalesJournal:   "Ventes",
+	BankJournal:    "Banque",
+	VariousJournal: "Opérations diverses",
+}
+
+var fecAccounts = map[string]string{
+	CustomerAccount:   "Clients",
+	ServicesAccount:   "Prestations de services",
+	VATAccount:        "TVA collectée",
+	LateFeeAccount:    "Revenus des autres créances",
+	CreditNoteAccount: "Rabais, remises et ristournes accordés",
+	DiscountAccount:   "Escomptes accordés",
+	BankAccount:       "Banque",
+}
+
+// Colonnes du fichier des écritures comptables, dans l'ordre de l'article A47 A-1 du LPF
+var fecHeader = []string{"JournalCode", "JournalLib", "EcritureNum", "EcritureDate", "CompteNum", "CompteLib", "CompAuxNum", "CompAuxLib", "PieceRef", "PieceDate", "EcritureLib", "Debit", "Credit", "EcritureLet", "DateLet", "ValidDate", "Montantdevise", "Idevise"}
+
+// FECLine is a line of the Fichier des Écritures Comptables, the lines of an entry share its number.
+type FECLine struct {
+	JournalCode  string
+	EcritureNum  string
+	EcritureDate time.Time
+	CompteNum    string
+	CompAuxNum   string
+	CompAuxLib   string
+	PieceRef     string
+	PieceDate    time.Time
+	EcritureLib  string
+	Debit        float64
+	Credit       float64
+}
+
+// fecEntry is a balanced accounting entry before it gets its number.
+type fecEntry struct {
+	journal string
+	date    time.Time
+	piece   string
+	pieceAt time.Time
+	label   string
+	lines   []FECLine
+}
+
+func (e *fecEntry) debit(account string, amount float64, aux AccountRef) {
+	e.lines = append(e.lines, FECLine{CompteNum: account, CompAuxNum: aux.ID, CompAuxLib: aux.Name, Debit: roundCents(amount)})
+}
+
+func (e *fecEntry) credit(account string, amount float64, aux AccountRef) {
+	e.lines = append(e.lines, FECLine{CompteNum: account, CompAuxNum: aux.ID, CompAuxLib: aux.Name, Credit: roundCents(amount)})
+}
+
+// AccountRef is the auxiliary account of a customer.
+type AccountRef struct {
+	ID   string
+	Name string
+}
+
+type fecInvoice struct {
+	ID        string    `db:"invoice_id"`
+	Number    string    `db:"invoice_number"`
+	Amount    float64   `db:"invoice_amount"` // montant facturé à la création, sans les pénalités ajoutées ensuite
+	PayerID   string    `db:"account_invoice_payer_id"`
+	CreatedAt time.Time `db:"created_at"`
+	Taxes     []TaxBreakdown
+}
+
+type fecMovement struct {
+	InvoiceID string    `db:"invoice_id"`
+	Number    string    `db:"invoice_number"`
+	PayerID   string    `db:"account_invoice_payer_id"`
+	Reference string    `db:"reference"`
+	Amount    float64   `db:"amount"`
+	Date      time.Time `db:"date"`
+	InvoiceAt time.Time `db:"invoice_created_at"`
+	Cancel    bool      `db:"cancellation"` // avoir d'annulation d'une facture impayée, sans remboursement
+}
+
+// fecData is what the entries of an issuer are built from.
+type fecData struct {
+	Invoices    []fecInvoice
+	Payments    []fecMovement
+	CreditNotes []fecMovement
+	Discounts   []fecMovement
+	LateFees    []fecMovement
+	Customers   map[string]AccountRef
+	// Ventilation de TVA des factures des avoirs et escomptes, qui peuvent avoir été émises avant la période
+	Taxes map[string][]TaxBreakdown
+}
+
+// splitVAT splits amount, taxes included, between its net and its VAT in the proportions of the tax
+// breakdown of the invoice. An invoice without breakdown has no VAT.
+func splitVAT(amount float64, taxes []TaxBreakdown) (float64, float64) {
+	gross, tax := float64(0.0), float64(0.0)
+	for _, t := range taxes {
+		gross += t.Net + t.Tax
+		tax += t.Tax
+	}
+	if gross == 0 || tax == 0 {
+		return amount, 0
+	}
+	vat := roundCents(amount * tax / gross)
+	return roundCents(amount - vat), vat
+}
+
+// buildFEC turns the invoices, late fees, payments, credit notes and discounts of the period into
+// numbered entries, in chronological order with a sequence per journal.
+func buildFEC(data fecData) []FECLine {
+	entries := make([]fecEntry, 0)
+
+	for _, i := range data.Invoices {
+		customer := data.Customers[i.PayerID]
+		piece := invoiceReference(i.ID, i.Number)
+		e := fecEntry{journal: SalesJournal, date: i.CreatedAt, piece: piece, pieceAt: i.CreatedAt, label: "Facture " + piece}
+		e.debit(CustomerAccount, i.Amount, customer)
+		if len(i.Taxes) == 0 {
+			e.credit(ServicesAccount, i.Amount, AccountRef{})
+		}
+		for _, t := range i.Taxes {
+			e.credit(ServicesAccount, t.Net, AccountRef{})
+			if t.Tax != 0 {
+				e.credit(VATAccount, t.Tax, AccountRef{})
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	// Les pénalités sont facturées le jour où elles sont ajoutées, pas à la création de la facture
+	for _, f := range data.LateFees {
+		customer := data.Customers[f.PayerID]
+		piece := invoiceReference(f.InvoiceID, f.Number)
+		e := fecEntry{journal: SalesJournal, date: f.Date, piece: piece, pieceAt: f.InvoiceAt, label: "Pénalités de retard facture " + piece}
+		e.debit(CustomerAccount, f.Amount, customer)
+		e.credit(LateFeeAccount, f.Amount, AccountRef{})
+		entries = append(entries, e)
+	}
+
+	for _, p := range data.Payments {
+		customer := data.Customers[p.PayerID]
+		piece := invoiceReference(p.InvoiceID, p.Number)
+		e := fecEntry{journal: BankJournal, date: p.Date, piece: piece, pieceAt: p.InvoiceAt, label: "Paiement facture " + piece}
+		e.debit(BankAccount, p.Amount, AccountRef{})
+		e.credit(CustomerAccount, p.Amount, customer)
+		entries = append(entries, e)
+	}
+
+	for _, c := range data.CreditNotes {
+		customer := data.Customers[c.PayerID]
+		// L'avoir annule la vente et la TVA collectée, le remboursement est un décaissement
+		e := fecEntry{journal: SalesJournal, date: c.Date, piece: c.Reference, pieceAt: c.Date, label: "Avoir facture " + invoiceReference(c.InvoiceID, c.Number)}
+		net, vat := splitVAT(c.Amount, data.Taxes[c.InvoiceID])
+		e.debit(CreditNoteAccount, net, AccountRef{})
+		if vat != 0 {
+			e.debit(VATAccount, vat, AccountRef{})
+		}
+		e.credit(CustomerAccount, c.Amount, customer)
+		entries = append(entries, e)
+		if c.Cancel {
+			continue
+		}
+
+		e = fecEntry{journal: BankJournal, date: c.Date, piece: c.Reference, pieceAt: c.Date, label: "Remboursement facture " + invoiceReference(c.InvoiceID, c.Number)}
+		e.debit(CustomerAccount, c.Amount, customer)
+		e.credit(BankAccount, c.Amount, AccountRef{})
+		entries = append(entries, e)
+	}
+
+	for _, d := range data.Discounts {
+		customer := data.Customers[d.PayerID]
+		piece := invoiceReference(d.InvoiceID, d.Number)
+		e := fecEntry{journal: VariousJournal, date: d.Date, piece: piece, pieceAt: d.InvoiceAt, label: "Escompte facture " + piece}
+		net, vat := splitVAT(d.Amount, data.Taxes[d.InvoiceID])
+		e.debit(DiscountAccount, net, AccountRef{})
+		if vat != 0 {
+			e.debit(VATAccount, vat, AccountRef{})
+		}
+		e.credit(CustomerAccount, d.Amount, customer)
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(a, b int) bool {
+		return entries[a].date.Before(entries[b].date)
+	})
+
+	lines := make([]FECLine, 0)
+	sequences := make(map[string]int)
+	for _, e := range entries {
+		sequences[e.journal]++
+		num := fmt.Sprintf("%s%06d", e.journal, sequences[e.journal])
+		for _, l := range e.lines {
+			l.JournalCode = e.journal
+			l.EcritureNum = num
+			l.EcritureDate = e.date
+			l.PieceRef = e.piece
+			l.PieceDate = e.pieceAt
+			l.EcritureLib = e.label
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// GetFECEntries returns the accounting entries of the issuer between from and to, both included.
+func (s *invoiceService) GetFECEntries(ctx context.Context, issuerID string, from time.Time, to time.Time) ([]FECLine, error) {
+	if issuerID == "" {
+		return nil, ErrNotAnId
+	}
+	if to.Before(from) {
+		return nil, ErrInvalidPeriod
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	data := fecData{Customers: make(map[string]AccountRef), Taxes: make(map[string][]TaxBreakdown)}
+
+	// Le montant de la facture comprend les pénalités ajoutées depuis, la vente est passée au montant d'origine
+	err := db.Select(&data.Invoices, `SELECT i.invoice_id, i.invoice_number, i.account_invoice_payer_id, i.invoice_created_at::date AS created_at,
+			i.invoice_amount - COALESCE((SELECT SUM(f.fee_amount) FROM invoice_late_fee f WHERE f.invoice_id = i.invoice_id), 0) AS invoice_amount
+		FROM invoice i WHERE i.account_invoice_receiver_id=$1 AND i.invoice_created_at::date BETWEEN $2 AND $3
+		ORDER BY i.invoice_created_at, i.invoice_id`, issuerID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	// Une écriture par facture et par jour où des pénalités ont été ajoutées
+	err = db.Select(&data.LateFees, `SELECT f.invoice_id, i.invoice_number, i.account_invoice_payer_id, i.invoice_id AS reference, SUM(f.fee_amount) AS amount,
+			f.fee_date::date AS date, i.invoice_created_at::date AS invoice_created_at
+		FROM invoice_late_fee f JOIN invoice i ON i.invoice_id = f.invoice_id
+		WHERE i.account_invoice_receiver_id=$1 AND f.fee_date::date BETWEEN $2 AND $3
+		GROUP BY f.invoice_id, i.invoice_number, i.account_invoice_payer_id, f.fee_date::date, i.invoice_created_at::date
+		ORDER BY f.fee_date::date, f.invoice_id`, issuerID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// Les paiements reçus sont les crédits de l'émetteur sur ses factures
+	err = db.Select(&data.Payments, `SELECT l.invoice_id, i.invoice_number, i.account_invoice_payer_id, l.transaction_id AS reference, l.entry_amount AS amount,
+			l.entry_date::date AS date, i.invoice_created_at::date AS invoice_created_at
+		FROM ledger_entry l JOIN invoice i ON i.invoice_id = l.invoice_id
+		WHERE l.client_id=$1 AND i.account_invoice_receiver_id=$1 AND l.entry_type=$2 AND l.entry_date::date BETWEEN $3 AND $4
+		ORDER BY l.entry_date, l.entry_id`, issuerID, CREDIT, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Select(&data.CreditNotes, `SELECT c.invoice_id, i.invoice_number, i.account_invoice_payer_id, c.credit_note_id AS reference, c.credit_note_amount AS amount,
+			c.credit_note_date::date AS date, i.invoice_created_at::date AS invoice_created_at, c.transaction_id = '' AS cancellation
+		FROM credit_note c JOIN invoice i ON i.invoice_id = c.invoice_id
+		WHERE i.account_invoice_receiver_id=$1 AND c.credit_note_date::date BETWEEN $2 AND $3
+		ORDER BY c.credit_note_date, c.credit_note_id`, issuerID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// L'escompte est accordé au paiement qui solde la facture, le dernier
+	err = db.Select(&data.Discounts, `SELECT i.invoice_id, i.invoice_number, i.account_invoice_payer_id, i.invoice_id AS reference, i.invoice_discount_amount AS amount,
+			MAX(l.entry_date)::date AS date, i.invoice_created_at::date AS invoice_created_at
+		FROM invoice i JOIN ledger_entry l ON l.invoice_id = i.invoice_id AND l.client_id = i.account_invoice_receiver_id AND l.entry_type=$2
+		WHERE i.account_invoice_receiver_id=$1 AND i.invoice_discount_amount > 0
+		GROUP BY i.invoice_id, i.invoice_number, i.account_invoice_payer_id, i.invoice_discount_amount, i.invoice_created_at
+		HAVING MAX(l.entry_date)::date BETWEEN $3 AND $4`, issuerID, CREDIT, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, movements := range [][]fecMovement{data.Payments, data.CreditNotes, data.Discounts, data.LateFees} {
+		for _, m := range movements {
+			data.Customers[m.PayerID] = AccountRef{ID: m.PayerID}
+		}
+	}
+
+	ids := make([]string, 0, len(data.Invoices)+len(data.CreditNotes)+len(data.Discounts))
+	for _, i := range data.Invoices {
+		ids = append(ids, i.ID)
+	}
+	for _, movements := range [][]fecMovement{data.CreditNotes, data.Discounts} {
+		for _, m := range movements {
+			ids = append(ids, m.InvoiceID)
+		}
+	}
+	details, err := s.GetInvoiceDetails(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for id, d := range details {
+		data.Taxes[id] = d.Taxes
+	}
+	for n, i := range data.Invoices {
+		data.Invoices[n].Taxes = data.Taxes[i.ID]
+	}
+	for _, i := range data.Invoices {
+		data.Customers[i.PayerID] = AccountRef{ID: i.PayerID}
+	}
+	for id := range data.Customers {
+		account, err := s.GetAccountInformation(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		data.Customers[id] = AccountRef{ID: id, Name: strings.TrimSpace(account.Name + " " + account.Surname)}
+	}
+
+	return buildFEC(data), nil
+}
+
+// fecAmount writes an amount with a comma as the decimal separator.
+func fecAmount(amount float64) string {
+	return strings.Replace(fmt.Sprintf("%.2f", amount), ".", ",", 1)
+}
+
+func fecDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("20060102")
+}
+
+// fecText removes the tabs and line breaks that would break the columns of the file.
+func fecText(s string) string {
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(s)
+}
+
+// WriteFEC writes the lines as a tab separated FEC file.
+func WriteFEC(w io.Writer, lines []FECLine) error {
+	if _, err := io.WriteString(w, strings.Join(fecHeader, "\t")+"\r\n"); err != nil {
+		return err
+	}
+	for _, l := range lines {
+		record := []string{
+			l.JournalCode,
+			fecJournals[l.JournalCode],
+			l.EcritureNum,
+			fecDate(l.EcritureDate),
+			l.CompteNum,
+			fecAccounts[l.CompteNum],
+			l.CompAuxNum,
+			fecText(l.CompAuxLib),
+			fecText(l.PieceRef),
+			fecDate(l.PieceDate),
+			fecText(l.EcritureLib),
+			fecAmount(l.Debit),
+			fecAmount(l.Credit),
+			"",
+			"",
+			fecDate(l.EcritureDate),
+			"",
+			"",
+		}
+		if _, err := io.WriteString(w, strings.Join(record, "\t")+"\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FECFilename returns the name expected by the tax administration, the issuer ID standing for the SIREN.
+func FECFilename(issuerID string, to time.Time) string {
+	return issuerID + "FEC" + to.Format("20060102") + ".txt"
+}
+
+// ParsePeriod reads the dates of a period, written 2006-01-02.
+func ParsePeriod(from string, to string) (time.Time, time.Time, error) {
+	start, err := time.Parse("2006-01-02", from)
+	if err != nil {
+		return time.Time{}, time.Time{}, ErrInvalidPeriod
+	}
+	end, err := time.Parse("2006-01-02", to)
+	if err != nil || end.Before(start) {
+		return time.Time{}, time.Time{}, ErrInvalidPeriod
+	}
+	return start, end, nil
+}
@@ -0,0 +1,133 @@
+package invoice_microservice
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildFEC(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2021, 3, d, 0, 0, 0, 0, time.UTC) }
+	customer := AccountRef{ID: "payer", Name: "Jean Dupont"}
+
+	lines := buildFEC(fecData{
+		Invoices: []fecInvoice{
+			{ID: "a", Amount: 120, PayerID: "payer", CreatedAt: day(2), Taxes: []TaxBreakdown{{Rate: 20, Net: 100, Tax: 20}}},
+			{ID: "b", Amount: 50, PayerID: "payer", CreatedAt: day(1)},
+		},
+		Payments:    []fecMovement{{InvoiceID: "b", PayerID: "payer", Amount: 49, Date: day(5), InvoiceAt: day(1)}},
+		Discounts:   []fecMovement{{InvoiceID: "b", PayerID: "payer", Amount: 1, Date: day(5), InvoiceAt: day(1)}},
+		CreditNotes: []fecMovement{{InvoiceID: "a", PayerID: "payer", Reference: "cn", Amount: 10, Date: day(6)}},
+		LateFees:    []fecMovement{{InvoiceID: "a", PayerID: "payer", Amount: 40, Date: day(4), InvoiceAt: day(2)}},
+		Customers:   map[string]AccountRef{"payer": customer},
+		Taxes:       map[string][]TaxBreakdown{"a": {{Rate: 20, Net: 100, Tax: 20}}},
+	})
+
+	debit, credit := make(map[string]float64), make(map[string]float64)
+	for _, l := range lines {
+		debit[l.EcritureNum] = roundCents(debit[l.EcritureNum] + l.Debit)
+		credit[l.EcritureNum] = roundCents(credit[l.EcritureNum] + l.Credit)
+		if l.CompteNum == CustomerAccount && l.CompAuxNum != customer.ID {
+			t.Errorf("Expected the customer account of %s to have the auxiliary account of the payer", l.EcritureNum)
+		}
+	}
+	for num := range debit {
+		if debit[num] != credit[num] {
+			t.Errorf("Entry %s is not balanced : %v debit, %v credit", num, debit[num], credit[num])
+		}
+	}
+
+	// L'ordre est chronologique et la numérotation suit chaque journal
+	expected := []string{"VE000001", "VE000002", "VE000003", "BQ000001", "OD000001", "VE000004", "BQ000002"}
+	nums := make([]string, 0)
+	for _, l := range lines {
+		if len(nums) == 0 || nums[len(nums)-1] != l.EcritureNum {
+			nums = append(nums, l.EcritureNum)
+		}
+	}
+	if strings.Join(nums, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected entries %v, got %v", expected, nums)
+	}
+
+	if l := lines[0]; l.PieceRef != "b" || l.JournalCode != SalesJournal || l.Debit != 50 {
+		t.Errorf("Expected the first entry to be the sale of b, got %+v", l)
+	}
+	if credit["VE000002"] != 120 || lines[len(lines)-1].PieceRef != "cn" {
+		t.Errorf("Unexpected entries %+v", lines)
+	}
+
+	// Les pénalités sont une vente distincte, à leur date
+	for _, l := range lines {
+		if l.CompteNum == LateFeeAccount && (l.EcritureNum != "VE000003" || !l.EcritureDate.Equal(day(4)) || l.Credit != 40 || l.PieceRef != "a") {
+			t.Errorf("Expected the late fees to be booked on their own on the 4th, got %+v", l)
+		}
+	}
+	if credit["VE000003"] != 40 {
+		t.Errorf("Expected a late fee entry of 40, got %v", credit["VE000003"])
+	}
+
+	// L'avoir reprend la TVA de la facture dans ses proportions
+	for _, l := range lines {
+		if l.EcritureNum != "VE000004" {
+			continue
+		}
+		if l.CompteNum == CreditNoteAccount && l.Debit != 8.33 || l.CompteNum == VATAccount && l.Debit != 1.67 {
+			t.Errorf("Expected the credit note to be split between 8.33 net and 1.67 VAT, got %+v", l)
+		}
+	}
+	// b n'a pas de TVA, l'escompte est passé en entier en charge
+	for _, l := range lines {
+		if l.EcritureNum == "OD000001" && l.CompteNum == VATAccount {
+			t.Errorf("Expected no VAT on the discount of an invoice without tax, got %+v", l)
+		}
+	}
+}
+
+func TestSplitVAT(t *testing.T) {
+	taxes := []TaxBreakdown{{Rate: 20, Net: 100, Tax: 20}, {Rate: 5.5, Net: 100, Tax: 5.5}}
+	if net, vat := splitVAT(22.55, taxes); net != 20 || vat != 2.55 {
+		t.Errorf("Expected 20 net and 2.55 VAT, got %v and %v", net, vat)
+	}
+	if net, vat := splitVAT(10, nil); net != 10 || vat != 0 {
+		t.Errorf("Expected no VAT without breakdown, got %v and %v", net, vat)
+	}
+}
+
+func TestWriteFEC(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteFEC(&buf, []FECLine{{
+		JournalCode:  SalesJournal,
+		EcritureNum:  "VE000001",
+		EcritureDate: time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC),
+		CompteNum:    CustomerAccount,
+		CompAuxNum:   "payer",
+		CompAuxLib:   "Jean\tDupont",
+		PieceRef:     "a",
+		PieceDate:    time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC),
+		EcritureLib:  "Facture a",
+		Debit:        1234.5,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+	if len(rows) != 2 || rows[0] != strings.Join(fecHeader, "\t") {
+		t.Fatalf("Expected a header and a line, got %q", buf.String())
+	}
+	fields := strings.Split(rows[1], "\t")
+	if len(fields) != len(fecHeader) {
+		t.Fatalf("Expected %d columns, got %d", len(fecHeader), len(fields))
+	}
+	if fields[1] != "Ventes" || fields[3] != "20210302" || fields[5] != "Clients" || fields[7] != "Jean Dupont" || fields[11] != "1234,50" || fields[12] != "0,00" {
+		t.Errorf("Unexpected line %q", fields)
+	}
+
+	if FECFilename("123456789", time.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC)) != "123456789FEC20211231.txt" {
+		t.Error("Unexpected file name")
+	}
+	if _, _, err := ParsePeriod("2021-12-31", "2021-01-01"); err != ErrInvalidPeriod {
+		t.Errorf("Expected ErrInvalidPeriod, got %v", err)
+	}
+}
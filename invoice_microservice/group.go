@@ -0,0 +1,129 @@
+package invoice_microservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/xid"
+)
+
+var (
+	ErrGroupNotFound = errors.New("payer group not found")
+	ErrInvalidGroup  = errors.New("a payer group needs a name and at least one email")
+)
+
+// PayerGroup is a list of payers, members of an association or pupils of a school, that an issuer
+// bills together.
+type PayerGroup struct {
+	ID        string   `json:"group_id" db:"group_id"`
+	OwnerID   string   `json:"owner_id" db:"owner_id"`
+	Name      string   `json:"name" db:"group_name"`
+	Emails    []string `json:"emails" db:"-"`
+	CreatedAt string   `json:"created_at,omitempty" db:"created_at"`
+}
+
+// normalizeEmails trims the emails and drops the empty ones and the duplicates, keeping their order.
+func normalizeEmails(emails []string) []string {
+	res := make([]string, 0, len(emails))
+	seen := make(map[string]bool, len(emails))
+	for _, mail := range emails {
+		mail = strings.TrimSpace(mail)
+		key := strings.ToLower(mail)
+		if mail == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		res = append(res, mail)
+	}
+	return res
+}
+
+func (s *invoiceService) CreatePayerGroup(ctx context.Context, group PayerGroup) (PayerGroup, error) {
+	if group.OwnerID == "" {
+		return PayerGroup{}, ErrNotAnId
+	}
+	group.Name = strings.TrimSpace(group.Name)
+	group.Emails = normalizeEmails(group.Emails)
+	if group.Name == "" || len(group.Emails) == 0 {
+		return PayerGroup{}, ErrInvalidGroup
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return PayerGroup{}, err
+	}
+	defer tx.Rollback()
+
+	group.ID = xid.New().String()
+	if _, err := tx.Exec("INSERT INTO payer_group (group_id, owner_id, group_name) VALUES ($1, $2, $3)", group.ID, group.OwnerID, group.Name); err != nil {
+		return PayerGroup{}, err
+	}
+	for n, mail := range group.Emails {
+		if _, err := tx.Exec("INSERT INTO payer_group_member (group_id, position, mail_adress) VALUES ($1, $2, $3)", group.ID, n, mail); err != nil {
+			return PayerGroup{}, err
+		}
+	}
+	if err := tx.Get(&group.CreatedAt, "SELECT created_at FROM payer_group WHERE group_id=$1", group.ID); err != nil {
+		return PayerGroup{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return PayerGroup{}, err
+	}
+	return group, nil
+}
+
+// GetPayerGroups returns the groups of the given issuer with their members.
+func (s *invoiceService) GetPayerGroups(ctx context.Context, ownerID string) ([]PayerGroup, error) {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	groups := make([]PayerGroup, 0)
+	if err := db.Select(&groups, "SELECT group_id, owner_id, group_name, created_at FROM payer_group WHERE owner_id=$1 ORDER BY created_at", ownerID); err != nil {
+		return nil, err
+	}
+
+	members := []struct {
+		GroupID string `db:"group_id"`
+		Mail    string `db:"mail_adress"`
+	}{}
+	err := db.Select(&members, `SELECT m.group_id, m.mail_adress FROM payer_group_member m
+		JOIN payer_group g ON g.group_id = m.group_id WHERE g.owner_id=$1 ORDER BY m.group_id, m.position`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	emails := make(map[string][]string)
+	for _, m := range members {
+		emails[m.GroupID] = append(emails[m.GroupID], m.Mail)
+	}
+	for n := range groups {
+		groups[n].Emails = emails[groups[n].ID]
+	}
+	return groups, nil
+}
+
+// groupEmails returns the emails of the members of a group of the owner.
+func groupEmails(tx *sqlx.Tx, ownerID string, groupID string) ([]string, error) {
+	owner := ""
+	if err := tx.Get(&owner, "SELECT owner_id FROM payer_group WHERE group_id=$1", groupID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrGroupNotFound
+		}
+		return nil, err
+	}
+	if owner != ownerID {
+		return nil, ErrGroupNotFound
+	}
+
+	emails := make([]string, 0)
+	if err := tx.Select(&emails, "SELECT mail_adress FROM payer_group_member WHERE group_id=$1 ORDER BY position", groupID); err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
@@ -0,0 +1,119 @@
+package invoice_microservice
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rs/cors"
+)
+
+var (
+	ErrCORSCredentialsWildcard = errors.New("CORS credentials cannot be allowed for every origin")
+	ErrInvalidCORSOrigin       = errors.New("CORS origins must be * or http(s)://host[:port]")
+)
+
+type CORSConfig struct {
+	// Origines autorisées à appeler le service depuis un navigateur, aucune par défaut
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	// Durée en secondes pendant laquelle le navigateur peut garder la réponse au preflight
+	MaxAge int
+	Debug  bool
+}
+
+func DefaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedMethods: []string{"GET", "POST", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"Accept", "Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization"},
+		MaxAge:         600,
+	}
+}
+
+// ParseCORSOrigins reads a comma separated list of origins, as given in INVOICE_CORS_ALLOWED_ORIGINS.
+func ParseCORSOrigins(s string) []string {
+	origins := make([]string, 0)
+	for _, origin := range strings.Split(s, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// Validate rejects the malformed origins and the policies a browser would refuse anyway.
+func (c CORSConfig) Validate() error {
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				return ErrCORSCredentialsWildcard
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			return ErrInvalidCORSOrigin
+		}
+	}
+	return nil
+}
+
+type SecurityHeadersConfig struct {
+	// Durée en secondes de Strict-Transport-Security, 0 pour ne pas envoyer l'en-tête
+	HSTSMaxAge            int
+	HSTSIncludeSubdomains bool
+	NoSniff               bool
+	FrameDeny             bool
+}
+
+func DefaultSecurityHeadersConfig() SecurityHeadersConfig {
+	return SecurityHeadersConfig{
+		HSTSMaxAge:            31536000,
+		HSTSIncludeSubdomains: true,
+		NoSniff:               true,
+		FrameDeny:             true,
+	}
+}
+
+// corsHandler answers the CORS requests of the allowed origins. Without any origin no CORS header is
+// sent and browsers refuse the cross-origin calls (an empty list means every origin for rs/cors).
+func corsHandler(config CORSConfig, next http.Handler) http.Handler {
+	if len(config.AllowedOrigins) == 0 {
+		return next
+	}
+	return cors.New(cors.Options{
+		AllowedOrigins:   config.AllowedOrigins,
+		AllowedMethods:   config.AllowedMethods,
+		AllowedHeaders:   config.AllowedHeaders,
+		AllowCredentials: config.AllowCredentials,
+		MaxAge:           config.MaxAge,
+		Debug:            config.Debug,
+	}).Handler(next)
+}
+
+func securityHeadersHandler(config SecurityHeadersConfig, next http.Handler) http.Handler {
+	hsts := ""
+	if config.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(config.HSTSMaxAge)
+		if config.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hsts != "" {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+		if config.NoSniff {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+		}
+		if config.FrameDeny {
+			w.Header().Set("X-Frame-Options", "DENY")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,87 @@
+package invoice_microservice
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestCORSPolicy(t *testing.T) {
+	cors := DefaultCORSConfig()
+	cors.AllowedOrigins = []string{"https://prix-banque.fr"}
+	h := MakeHTTPHandler(NewInvoiceService(DbConnexionInfo{}), log.NewNopLogger(), WithCORS(cors))
+
+	req := httptest.NewRequest("OPTIONS", "/invoices/", nil)
+	req.Header.Set("Origin", "https://prix-banque.fr")
+	req.Header.Set("Access-Control-Request-Method", "DELETE")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://prix-banque.fr" {
+		t.Errorf("Allowed origin should have been echoed, got : " + got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "DELETE" {
+		t.Errorf("DELETE should be allowed, got : " + got)
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Errorf("Security headers are missing")
+	}
+	if w.Header().Get("Strict-Transport-Security") == "" {
+		t.Errorf("HSTS header is missing")
+	}
+
+	req = httptest.NewRequest("OPTIONS", "/invoices/", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Origin is not allowed, got : " + got)
+	}
+}
+
+func TestCORSDefaultPolicy(t *testing.T) {
+	h := MakeHTTPHandler(NewInvoiceService(DbConnexionInfo{}), log.NewNopLogger())
+
+	req := httptest.NewRequest("OPTIONS", "/invoices/", nil)
+	req.Header.Set("Origin", "https://prix-banque.fr")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("No origin is allowed by default, got : " + got)
+	}
+}
+
+func TestParseCORSOrigins(t *testing.T) {
+	origins := ParseCORSOrigins(" https://prix-banque.fr, ,http://localhost:3000,")
+	if len(origins) != 2 || origins[0] != "https://prix-banque.fr" || origins[1] != "http://localhost:3000" {
+		t.Errorf("Unexpected origins %q", origins)
+	}
+	if len(ParseCORSOrigins("")) != 0 {
+		t.Errorf("Expected no origin")
+	}
+
+	for _, origin := range []string{"prix-banque.fr", "ftp://prix-banque.fr", "https://prix-banque.fr/app", "https://"} {
+		if err := (CORSConfig{AllowedOrigins: []string{origin}}).Validate(); err != ErrInvalidCORSOrigin {
+			t.Errorf("Expected %q to be refused, got %v", origin, err)
+		}
+	}
+}
+
+func TestCORSConfigValidate(t *testing.T) {
+	cors := DefaultCORSConfig()
+	cors.AllowedOrigins = []string{"*"}
+	cors.AllowCredentials = true
+	if cors.Validate() != ErrCORSCredentialsWildcard {
+		t.Errorf("Credentials with a wildcard origin should have been refused")
+	}
+
+	cors.AllowedOrigins = []string{"https://prix-banque.fr"}
+	if cors.Validate() != nil {
+		t.Errorf("Valid policy, should not have raised an error")
+	}
+}
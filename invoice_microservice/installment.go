@@ -0,0 +1,225 @@
+package invoice_microservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/rs/xid"
+)
+
+var (
+	ErrNotIssuer               = errors.New("only the issuer of the invoice can perform this operation")
+	ErrInstallmentPlanExists   = errors.New("invoice already has an installment plan")
+	ErrInstallmentsDontAddUp   = errors.New("installments must add up to the amount left to pay")
+	ErrInstallmentNotFound     = errors.New("installment not found")
+	ErrInstallmentAlreadyPaid  = errors.New("installment is already paid")
+	ErrInvalidInstallmentDates = errors.New("installment due dates must be valid dates in ascending order")
+)
+
+type Installment struct {
+	ID        string  `json:"installment_id" db:"installment_id"`
+	InvoiceID string  `json:"invoice_id" db:"invoice_id"`
+	Number    int     `json:"installment_number" db:"installment_number"`
+	DueDate   string  `json:"installment_due_date" db:"installment_due_date"`
+	Amount    float64 `json:"installment_amount" db:"installment_amount"`
+	State     int     `json:"installment_state" db:"installment_state"`
+	PaidDate  string  `json:"installment_paid_date,omitempty" db:"installment_paid_date"`
+}
+
+const installmentColumns = "installment_id, invoice_id, installment_number, installment_due_date::text AS installment_due_date, installment_amount, installment_state, COALESCE(installment_paid_date::text, '') AS installment_paid_date"
+
+// SetInstallmentPlan splits what is left to pay on the invoice into installments. Only the issuer
+// of the invoice can offer a plan, the due dates are dates (2006-01-02) in ascending order.
+func (s *invoiceService) SetInstallmentPlan(ctx context.Context, invoiceID string, issuerID string, installments []Installment) ([]Installment, error) {
+	if invoiceID == "" {
+		return nil, ErrNotAnId
+	}
+	if len(installments) == 0 {
+		return nil, ErrNoTransfer
+	}
+
+	total := float64(0.0)
+	previous := time.Time{}
+	for _, i := range installments {
+		due, err := time.Parse("2006-01-02", i.DueDate)
+		if err != nil || !due.After(previous) {
+			return nil, ErrInvalidInstallmentDates
+		}
+		previous = due
+		if roundCents(i.Amount) <= 0 {
+			return nil, ErrInvalidAmount
+		}
+		total += roundCents(i.Amount)
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	invoice := Invoice{}
+	if err := tx.Get(&invoice, "SELECT * FROM invoice WHERE invoice_id=$1 FOR UPDATE", invoiceID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if invoice.AccountReceiverId != issuerID {
+		return nil, ErrNotIssuer
+	}
+	if !payable(invoice.State) {
+		return nil, ErrAlreadyPaid
+	}
+	if roundCents(total) != invoice.Remaining() {
+		return nil, ErrInstallmentsDontAddUp
+	}
+
+	existing := 0
+	if err := tx.Get(&existing, "SELECT COUNT(*) FROM installment WHERE invoice_id=$1", invoiceID); err != nil {
+		return nil, err
+	}
+	if existing > 0 {
+		return nil, ErrInstallmentPlanExists
+	}
+
+	plan := make([]Installment, 0, len(installments))
+	for n, i := range installments {
+		installment := Installment{
+			ID:        xid.New().String(),
+			InvoiceID: invoiceID,
+			Number:    n + 1,
+			DueDate:   i.DueDate,
+			Amount:    roundCents(i.Amount),
+			State:     PENDING,
+		}
+		_, err := tx.Exec("INSERT INTO installment (installment_id, invoice_id, installment_number, installment_due_date, installment_amount, installment_state) VALUES ($1, $2, $3, $4, $5, $6)",
+			installment.ID, installment.InvoiceID, installment.Number, installment.DueDate, installment.Amount, installment.State)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, installment)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+func (s *invoiceService) GetInstallments(ctx context.Context, invoiceID string) ([]Installment, error) {
+	if invoiceID == "" {
+		return nil, ErrNotAnId
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	installments := make([]Installment, 0)
+	err := db.Select(&installments, "SELECT "+installmentColumns+" FROM installment WHERE invoice_id=$1 ORDER BY installment_number", invoiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return installments, nil
+}
+
+// PayInstallment collects a single installment from the payer.
+func (s *invoiceService) PayInstallment(ctx context.Context, installmentID string) (Installment, error) {
+	if installmentID == "" {
+		return Installment{}, ErrNotAnId
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return Installment{}, err
+	}
+	defer tx.Rollback()
+
+	installment := Installment{}
+	if err := tx.Get(&installment, "SELECT "+installmentColumns+" FROM installment WHERE installment_id=$1 FOR UPDATE", installmentID); err != nil {
+		if err == sql.ErrNoRows {
+			return Installment{}, ErrInstallmentNotFound
+		}
+		return Installment{}, err
+	}
+	if installment.State != PENDING {
+		return Installment{}, ErrInstallmentAlreadyPaid
+	}
+
+	invoice, paid, err := payInvoiceAmount(tx, installment.InvoiceID, installment.Amount)
+	if err != nil {
+		return Installment{}, err
+	}
+
+	installment.State = PAID
+	if err := tx.Get(&installment.PaidDate, "UPDATE installment SET installment_state = $1, installment_paid_date = now() WHERE installment_id=$2 RETURNING installment_paid_date::text", PAID, installmentID); err != nil {
+		return Installment{}, err
+	}
+
+	if err := enqueueEvents(tx, paymentEvent(invoice, paid)); err != nil {
+		return Installment{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Installment{}, err
+	}
+
+	return installment, nil
+}
+
+// InstallmentCollector collects the installments that reached their due date.
+type InstallmentCollector struct {
+	DbInfos DbConnexionInfo
+	Service InvoiceService
+}
+
+func NewInstallmentCollector(dbinfos DbConnexionInfo, s InvoiceService) *InstallmentCollector {
+	return &InstallmentCollector{
+		DbInfos: dbinfos,
+		Service: s,
+	}
+}
+
+// Collect pays every due installment, each one in its own transaction so an installment the payer
+// cannot cover does not block the others. It returns the number of installments collected.
+func (c *InstallmentCollector) Collect(ctx context.Context, logger log.Logger) (int, error) {
+	db := GetDbConnexion(c.DbInfos)
+	ids := make([]string, 0)
+	err := db.Select(&ids, "SELECT installment_id FROM installment WHERE installment_state = $1 AND installment_due_date <= CURRENT_DATE ORDER BY installment_due_date, installment_number", PENDING)
+	db.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	collected := 0
+	for _, id := range ids {
+		if _, err := c.Service.PayInstallment(ctx, id); err != nil {
+			logger.Log("installment", id, "err", err)
+			continue
+		}
+		collected++
+	}
+	return collected, nil
+}
+
+func (c *InstallmentCollector) Schedule(ctx context.Context, interval time.Duration, logger log.Logger) {
+	RunEvery(ctx, interval, func(ctx context.Context) {
+		collected, err := c.Collect(ctx, logger)
+		if err != nil {
+			logger.Log("installments", "failed", "err", err)
+			return
+		}
+		logger.Log("installments", "collected", "count", collected)
+	})
+}
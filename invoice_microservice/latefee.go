@@ -0,0 +1,263 @@
+package invoice_microservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// Indemnité forfaitaire pour frais de recouvrement due en France par un professionnel payant en retard
+	LegalRecoveryIndemnity = 40.0
+
+	FIXED_FEE = "FIXED_FEE"
+	INTEREST  = "INTEREST"
+)
+
+var (
+	ErrInvalidLateFeePolicy = errors.New("late fee policy amounts and rates cannot be negative")
+	ErrNoLateFeePolicy      = errors.New("issuer has no late fee policy")
+)
+
+// LateFeePolicy is set by an issuer to charge the payers of its overdue invoices. The interest runs
+// every day from the expiration date on what is left to pay, the fees of an invoice never exceed MaxFee.
+type LateFeePolicy struct {
+	IssuerID           string  `json:"issuer_id" db:"issuer_id"`
+	FixedFee           float64 `json:"fixed_fee" db:"fixed_fee"`
+	AnnualInterestRate float64 `json:"annual_interest_rate" db:"annual_interest_rate"` // en pourcentage
+	MaxFee             float64 `json:"max_fee" db:"max_fee"`                           // 0 pour ne pas plafonner
+	GraceDays          int     `json:"grace_days" db:"grace_days"`
+}
+
+func (p LateFeePolicy) validate() error {
+	if p.FixedFee < 0 || p.AnnualInterestRate < 0 || p.MaxFee < 0 || p.GraceDays < 0 {
+		return ErrInvalidLateFeePolicy
+	}
+	return nil
+}
+
+// accrue returns the fees to add to an invoice already charged the given fees, whose interest ran
+// until interestDays : the fixed fee once, and the interest on the principal still due since then.
+// Fees already charged are never lowered.
+func (p LateFeePolicy) accrue(principal float64, daysLate int, charged float64, fixedCharged bool, interestDays int) (float64, float64) {
+	if daysLate <= p.GraceDays || principal <= 0 {
+		return 0, 0
+	}
+
+	fixed := float64(0)
+	if !fixedCharged {
+		fixed = roundCents(p.FixedFee)
+	}
+	interest := float64(0)
+	if daysLate > interestDays {
+		interest = roundCents(principal * p.AnnualInterestRate / 100 * float64(daysLate-interestDays) / 365)
+	}
+
+	if p.MaxFee > 0 {
+		room := roundCents(p.MaxFee - charged)
+		if room < 0 {
+			room = 0
+		}
+		if fixed > room {
+			fixed = room
+		}
+		if fixed+interest > room {
+			interest = roundCents(room - fixed)
+		}
+	}
+	return fixed, interest
+}
+
+// addLateFees returns the invoice with the fees added to its amount. An invoice whose payments
+// already cover everything, fees included, is paid.
+func addLateFees(invoice Invoice, fixed float64, interest float64) Invoice {
+	invoice.Amount = roundCents(invoice.Amount + fixed + interest)
+	if invoice.Remaining() <= 0 {
+		invoice.State = PAID
+	}
+	return invoice
+}
+
+// LateFee is one of the fees added to the amount of an overdue invoice.
+type LateFee struct {
+	InvoiceID string  `json:"invoice_id" db:"invoice_id"`
+	Type      string  `json:"fee_type" db:"fee_type"`
+	Amount    float64 `json:"fee_amount" db:"fee_amount"`
+	DaysLate  int     `json:"days_late" db:"days_late"`
+	Date      string  `json:"fee_date" db:"fee_date"`
+}
+
+func (s *invoiceService) SetLateFeePolicy(ctx context.Context, policy LateFeePolicy) (LateFeePolicy, error) {
+	if policy.IssuerID == "" {
+		return LateFeePolicy{}, ErrNotAnId
+	}
+	if err := policy.validate(); err != nil {
+		return LateFeePolicy{}, err
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO late_fee_policy (issuer_id, fixed_fee, annual_interest_rate, max_fee, grace_days) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (issuer_id) DO UPDATE SET fixed_fee = EXCLUDED.fixed_fee, annual_interest_rate = EXCLUDED.annual_interest_rate, max_fee = EXCLUDED.max_fee, grace_days = EXCLUDED.grace_days`,
+		policy.IssuerID, policy.FixedFee, policy.AnnualInterestRate, policy.MaxFee, policy.GraceDays)
+	if err != nil {
+		return LateFeePolicy{}, err
+	}
+
+	return policy, nil
+}
+
+func (s *invoiceService) GetLateFeePolicy(ctx context.Context, issuerID string) (LateFeePolicy, error) {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	policy := LateFeePolicy{}
+	err := db.Get(&policy, "SELECT * FROM late_fee_policy WHERE issuer_id=$1", issuerID)
+	if err == sql.ErrNoRows {
+		return LateFeePolicy{}, ErrNoLateFeePolicy
+	}
+	if err != nil {
+		return LateFeePolicy{}, err
+	}
+
+	return policy, nil
+}
+
+func (s *invoiceService) GetLateFees(ctx context.Context, invoiceID string) ([]LateFee, error) {
+	if invoiceID == "" {
+		return nil, ErrNotAnId
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	fees := make([]LateFee, 0)
+	// Les intérêts sont ajoutés à chaque échéance, ils sont rendus en un seul montant
+	err := db.Select(&fees, `SELECT invoice_id, fee_type, SUM(fee_amount) AS fee_amount, MAX(days_late) AS days_late, MAX(fee_date)::text AS fee_date
+		FROM invoice_late_fee WHERE invoice_id=$1 GROUP BY invoice_id, fee_type ORDER BY fee_type`, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return fees, nil
+}
+
+// LateFeeApplier adds the late fees of their issuer's policy to the overdue invoices.
+type LateFeeApplier struct {
+	DbInfos DbConnexionInfo
+}
+
+func NewLateFeeApplier(dbinfos DbConnexionInfo) *LateFeeApplier {
+	return &LateFeeApplier{
+		DbInfos: dbinfos,
+	}
+}
+
+// Apply adds the fees accrued since the last run to every overdue invoice whose issuer has a policy,
+// and returns the number of invoices whose amount changed. Each invoice is updated in its own transaction.
+func (a *LateFeeApplier) Apply(ctx context.Context, logger log.Logger) (int, error) {
+	db := GetDbConnexion(a.DbInfos)
+	defer db.Close()
+
+	ids := make([]string, 0)
+	err := db.Select(&ids, `SELECT i.invoice_id FROM invoice i JOIN late_fee_policy p ON p.issuer_id = i.account_invoice_receiver_id
+		WHERE i.invoice_state IN ($1, $2, $3) AND i.invoice_expiration_date::date < CURRENT_DATE`, PENDING, EXPIRED, PARTIALLY_PAID)
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, id := range ids {
+		changed, err := a.applyToInvoice(ctx, id)
+		if err != nil {
+			logger.Log("latefee", id, "err", err)
+			continue
+		}
+		if changed {
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+func (a *LateFeeApplier) applyToInvoice(ctx context.Context, id string) (bool, error) {
+	db := GetDbConnexion(a.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// La facture est verrouillée pour ne pas modifier son montant pendant un paiement
+	row := struct {
+		Invoice
+		DaysLate     int     `db:"days_late"`
+		Fees         float64 `db:"fees"`
+		FixedCharged bool    `db:"fixed_charged"`
+		InterestDays int     `db:"interest_days"`
+		LateFeePolicy
+	}{}
+	err = tx.Get(&row, `SELECT i.*, CURRENT_DATE - i.invoice_expiration_date::date AS days_late,
+			COALESCE((SELECT SUM(fee_amount) FROM invoice_late_fee f WHERE f.invoice_id = i.invoice_id), 0) AS fees,
+			EXISTS (SELECT 1 FROM invoice_late_fee f WHERE f.invoice_id = i.invoice_id AND f.fee_type = $2) AS fixed_charged,
+			COALESCE((SELECT MAX(days_late) FROM invoice_late_fee f WHERE f.invoice_id = i.invoice_id AND f.fee_type = $3), 0) AS interest_days, p.*
+		FROM invoice i JOIN late_fee_policy p ON p.issuer_id = i.account_invoice_receiver_id
+		WHERE i.invoice_id=$1 FOR UPDATE OF i`, id, FIXED_FEE, INTEREST)
+	if err != nil {
+		return false, err
+	}
+	if !payable(row.State) {
+		return false, nil
+	}
+
+	// Les intérêts courent sur le montant de la facture hors pénalités restant à payer à chaque date
+	principal := roundCents(row.Amount - row.Fees - row.PaidAmount)
+	fixed, interest := row.LateFeePolicy.accrue(principal, row.DaysLate, row.Fees, row.FixedCharged, row.InterestDays)
+
+	// Chaque pénalité est ajoutée à sa date, les précédentes ne sont jamais modifiées
+	for _, fee := range []struct {
+		feeType string
+		amount  float64
+	}{{FIXED_FEE, fixed}, {INTEREST, interest}} {
+		if fee.amount <= 0 {
+			continue
+		}
+		_, err := tx.Exec("INSERT INTO invoice_late_fee (invoice_id, fee_type, fee_amount, days_late, fee_date) VALUES ($1, $2, $3, $4, now())",
+			id, fee.feeType, fee.amount, row.DaysLate)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	invoice := addLateFees(row.Invoice, fixed, interest)
+	if invoice.Amount == row.Amount && invoice.State == row.State {
+		return false, nil
+	}
+	if _, err := tx.Exec("UPDATE invoice SET invoice_amount = $1, invoice_state = $2 WHERE invoice_id=$3", invoice.Amount, invoice.State, id); err != nil {
+		return false, err
+	}
+	if invoice.State == PAID {
+		if err := enqueueEvents(tx, paymentEvent(invoice, 0)); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+func (a *LateFeeApplier) Schedule(ctx context.Context, interval time.Duration, logger log.Logger) {
+	RunEvery(ctx, interval, func(ctx context.Context) {
+		updated, err := a.Apply(ctx, logger)
+		if err != nil {
+			logger.Log("latefees", "failed", "err", err)
+			return
+		}
+		logger.Log("latefees", "applied", "invoices", updated)
+	})
+}
@@ -0,0 +1,52 @@
+package invoice_microservice
+
+import "testing"
+
+func TestLateFeeAccrue(t *testing.T) {
+	policy := LateFeePolicy{FixedFee: LegalRecoveryIndemnity, AnnualInterestRate: 12, GraceDays: 5}
+
+	tests := []struct {
+		name         string
+		policy       LateFeePolicy
+		principal    float64
+		daysLate     int
+		charged      float64
+		fixedCharged bool
+		interestDays int
+		fixed        float64
+		interest     float64
+	}{
+		{"grace period", policy, 1000, 5, 0, false, 0, 0, 0},
+		{"nothing left to pay", policy, 0, 30, 0, false, 0, 0, 0},
+		// 1000 x 12% x 30 / 365 = 9.863 arrondi à 9.86
+		{"interest", policy, 1000, 30, 0, false, 0, 40, 9.86},
+		{"capped interest", LateFeePolicy{FixedFee: 40, AnnualInterestRate: 12, MaxFee: 45}, 1000, 30, 0, false, 0, 40, 5},
+		{"capped fixed fee", LateFeePolicy{FixedFee: 40, AnnualInterestRate: 12, MaxFee: 25}, 1000, 30, 0, false, 0, 25, 0},
+		// 500 x 12% x 10 / 365 = 1.644 : seuls les 10 jours depuis la dernière échéance sont ajoutés
+		{"interest since last accrual", policy, 500, 40, 49.86, true, 30, 0, 1.64},
+		{"principal paid, fees unpaid", policy, 0, 40, 49.86, true, 30, 0, 0},
+		{"cap already reached", LateFeePolicy{FixedFee: 40, AnnualInterestRate: 12, MaxFee: 45}, 1000, 40, 45, true, 30, 0, 0},
+		{"fee charged before the cap", LateFeePolicy{FixedFee: 40, AnnualInterestRate: 12, MaxFee: 30}, 1000, 40, 40, true, 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		fixed, interest := tt.policy.accrue(tt.principal, tt.daysLate, tt.charged, tt.fixedCharged, tt.interestDays)
+		if fixed != tt.fixed || interest != tt.interest {
+			t.Errorf("%s: expected %v and %v, got %v and %v", tt.name, tt.fixed, tt.interest, fixed, interest)
+		}
+	}
+
+	// Le principal a été payé mais pas les 49.86 de pénalités : rien n'est ajouté et la facture reste due
+	invoice := addLateFees(Invoice{Amount: 1049.86, PaidAmount: 1000, State: PARTIALLY_PAID}, 0, 0)
+	if invoice.Amount != 1049.86 || invoice.State != PARTIALLY_PAID || invoice.Remaining() != 49.86 {
+		t.Errorf("Unexpected invoice %+v", invoice)
+	}
+	invoice = addLateFees(Invoice{Amount: 1049.86, PaidAmount: 1049.86, State: PARTIALLY_PAID}, 0, 0)
+	if invoice.State != PAID {
+		t.Errorf("An invoice whose fees are paid should be paid, got %+v", invoice)
+	}
+
+	if (LateFeePolicy{IssuerID: "a", AnnualInterestRate: -1}).validate() != ErrInvalidLateFeePolicy {
+		t.Error("A negative rate should be rejected")
+	}
+}
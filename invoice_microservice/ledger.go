@@ -0,0 +1,124 @@
+package invoice_microservice
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/xid"
+)
+
+const (
+	DEBIT  = "DEBIT"
+	CREDIT = "CREDIT"
+)
+
+var (
+	ErrInvalidAmount = errors.New("amount must be strictly positive")
+	ErrSameAccount   = errors.New("payer and receiver accounts must be different")
+)
+
+// LedgerEntry is one side of a balance movement. Every movement writes a DEBIT on the account
+// the money leaves and a CREDIT of the same amount on the account it goes to, both sharing
+// the same TransactionID.
+type LedgerEntry struct {
+	ID            string  `json:"entry_id" db:"entry_id"`
+	TransactionID string  `json:"transaction_id" db:"transaction_id"`
+	ClientID      string  `json:"client_id" db:"client_id"`
+	InvoiceID     string  `json:"invoice_id,omitempty" db:"invoice_id"`
+	Type          string  `json:"entry_type" db:"entry_type"`
+	Amount        float64 `json:"entry_amount" db:"entry_amount"`
+	Label         string  `json:"entry_label" db:"entry_label"`
+	Date          string  `json:"entry_date" db:"entry_date"`
+}
+
+// postTransfer moves amount from one account to the other inside tx : it writes the balanced
+// ledger entries and applies them to the balances. Both rows are locked, always in the same order
+// to avoid deadlocks, so two concurrent payments cannot both spend the same money.
+func postTransfer(tx *sqlx.Tx, fromID string, toID string, amount float64, invoiceID string, label string) (string, error) {
+	amount = roundCents(amount)
+	if amount <= 0 {
+		return "", ErrInvalidAmount
+	}
+	if fromID == toID {
+		return "", ErrSameAccount
+	}
+
+	accounts := []struct {
+		ID      string  `db:"client_id"`
+		Balance float64 `db:"account_amount"`
+	}{}
+	err := tx.Select(&accounts, "SELECT client_id, account_amount FROM account WHERE client_id IN ($1, $2) ORDER BY client_id FOR UPDATE", fromID, toID)
+	if err != nil {
+		return "", err
+	}
+	if len(accounts) != 2 {
+		return "", ErrAccountNotFound
+	}
+
+	quarantined := 0
+	if err := tx.Get(&quarantined, "SELECT COUNT(*) FROM account_quarantine WHERE client_id IN ($1, $2)", fromID, toID); err != nil {
+		return "", err
+	}
+	if quarantined > 0 {
+		return "", ErrAccountQuarantined
+	}
+
+	fromBalance := accounts[0].Balance
+	if accounts[1].ID == fromID {
+		fromBalance = accounts[1].Balance
+	}
+	if fromBalance < amount {
+		return "", ErrInsufficientBalance
+	}
+
+	transactionID := xid.New().String()
+	postings := []struct {
+		clientID  string
+		entryType string
+		delta     float64
+	}{
+		{fromID, DEBIT, -amount},
+		{toID, CREDIT, amount},
+	}
+
+	for _, p := range postings {
+		res, err := tx.Exec("UPDATE account SET account_amount = account_amount + $1 WHERE client_id=$2", p.delta, p.clientID)
+		if err != nil {
+			return "", err
+		}
+		if rows, _ := res.RowsAffected(); rows != 1 {
+			return "", ErrAccountNotFound
+		}
+
+		_, err = tx.Exec("INSERT INTO ledger_entry (entry_id, transaction_id, client_id, invoice_id, entry_type, entry_amount, entry_label) VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7)",
+			xid.New().String(), transactionID, p.clientID, invoiceID, p.entryType, amount, label)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return transactionID, nil
+}
+
+// roundCents rounds the amount to the cent, half away from zero.
+func roundCents(amount float64) float64 {
+	return ratToFloat(roundRatCents(decimal(amount)))
+}
+
+func (s *invoiceService) GetLedgerEntries(ctx context.Context, clientID string) ([]LedgerEntry, error) {
+	if clientID == "" {
+		return nil, ErrNotAnId
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	entries := make([]LedgerEntry, 0)
+	err := db.Select(&entries, "SELECT entry_id, transaction_id, client_id, COALESCE(invoice_id, '') AS invoice_id, entry_type, entry_amount, entry_label, entry_date FROM ledger_entry WHERE client_id=$1 ORDER BY entry_date, entry_id", clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,80 @@
+package invoice_microservice
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/xid"
+)
+
+var (
+	ErrInvalidLineItem = errors.New("line items need a description, a positive quantity, a unit price and rates between 0 and 100")
+)
+
+type LineItem struct {
+	ID          string  `json:"item_id,omitempty" db:"item_id"`
+	InvoiceID   string  `json:"invoice_id,omitempty" db:"invoice_id"`
+	Position    int     `json:"position" db:"item_position"`
+	Description string  `json:"description" db:"item_description"`
+	Quantity    float64 `json:"quantity" db:"item_quantity"`
+	UnitPrice   float64 `json:"unit_price" db:"item_unit_price"`
+	TaxRate     float64 `json:"tax_rate" db:"item_tax_rate"` // en pourcentage
+	Discount    float64 `json:"discount" db:"item_discount"` // remise en pourcentage
+	Net         float64 `json:"net_amount" db:"item_net_amount"`
+	Tax         float64 `json:"tax_amount" db:"item_tax_amount"`
+	Total       float64 `json:"total" db:"item_total"` // montant TTC de la ligne
+}
+
+func (i LineItem) validate() error {
+	if strings.TrimSpace(i.Description) == "" || i.Quantity <= 0 || i.UnitPrice < 0 ||
+		i.TaxRate < 0 || i.TaxRate > 100 || i.Discount < 0 || i.Discount > 100 {
+		return ErrInvalidLineItem
+	}
+	return nil
+}
+
+// saveTaxComputation writes the items of the invoice and its tax breakdown inside tx, replacing the previous ones.
+func saveTaxComputation(tx *sqlx.Tx, invoiceID string, computation TaxComputation) error {
+	if _, err := tx.Exec("DELETE FROM invoice_line_item WHERE invoice_id=$1", invoiceID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM invoice_tax_breakdown WHERE invoice_id=$1", invoiceID); err != nil {
+		return err
+	}
+
+	for _, item := range computation.Items {
+		_, err := tx.Exec("INSERT INTO invoice_line_item (item_id, invoice_id, item_position, item_description, item_quantity, item_unit_price, item_tax_rate, item_discount, item_net_amount, item_tax_amount, item_total) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
+			xid.New().String(), invoiceID, item.Position, item.Description, item.Quantity, item.UnitPrice, item.TaxRate, item.Discount, item.Net, item.Tax, item.Total)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, b := range computation.Breakdown {
+		_, err := tx.Exec("INSERT INTO invoice_tax_breakdown (invoice_id, tax_rate, net_amount, tax_amount, gross_amount) VALUES ($1, $2, $3, $4, $5)",
+			invoiceID, b.Rate, b.Net, b.Tax, b.Gross)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *invoiceService) GetLineItems(ctx context.Context, invoiceID string) ([]LineItem, error) {
+	if invoiceID == "" {
+		return nil, ErrNotAnId
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	items := make([]LineItem, 0)
+	err := db.Select(&items, "SELECT * FROM invoice_line_item WHERE invoice_id=$1 ORDER BY item_position", invoiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
@@ -0,0 +1,46 @@
+package invoice_microservice
+
+import "testing"
+
+func TestComputeLineItems(t *testing.T) {
+	computation, err := DefaultTaxJurisdictions()[0].Compute([]LineItem{
+		{Description: "Loyer", Quantity: 1, UnitPrice: 650},
+		{Description: "Ménage", Quantity: 3, UnitPrice: 33.33, TaxRate: 20, Discount: 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := computation.Items
+
+	if items[0].Total != 650 || items[0].Position != 1 {
+		t.Errorf("Expected first line of 650 at position 1, got %v at %d", items[0].Total, items[0].Position)
+	}
+	// 3 x 33.33 = 99.99, -10% = 89.99, +20% = 107.99
+	if items[1].Total != 107.99 || items[1].Position != 2 {
+		t.Errorf("Expected second line of 107.99 at position 2, got %v at %d", items[1].Total, items[1].Position)
+	}
+	if computation.Gross != 757.99 {
+		t.Errorf("Expected a total of 757.99, got %v", computation.Gross)
+	}
+}
+
+func TestLineItemValidate(t *testing.T) {
+	invalid := []LineItem{
+		{Description: "Loyer", Quantity: 0, UnitPrice: 650},
+		{Quantity: 1, UnitPrice: 650},
+		{Description: "Loyer", Quantity: 1, UnitPrice: -1},
+		{Description: "Loyer", Quantity: 1, UnitPrice: 650, Discount: 120},
+	}
+	for _, item := range invalid {
+		if err := item.validate(); err != ErrInvalidLineItem {
+			t.Errorf("Expected %+v to be refused, got %v", item, err)
+		}
+	}
+
+	if _, err := DefaultTaxJurisdictions()[0].Compute(invalid[:1]); err != ErrInvalidLineItem {
+		t.Errorf("Passed a line without quantity, should have raised an error")
+	}
+	if err := (LineItem{Description: "Loyer", Quantity: 1, UnitPrice: 650}).validate(); err != nil {
+		t.Errorf("Expected a valid line, got %v", err)
+	}
+}
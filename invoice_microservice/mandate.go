@@ -0,0 +1,345 @@
+package invoice_microservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/xid"
+)
+
+// Moment du paiement des factures couvertes par un mandat
+const (
+	MANDATE_PAY_ON_ISSUE = "ISSUE"
+	MANDATE_PAY_ON_DUE   = "DUE"
+)
+
+// États d'un mandat
+const (
+	MANDATE_ACTIVE  = "ACTIVE"
+	MANDATE_REVOKED = "REVOKED"
+)
+
+// Décisions prises pour une facture couverte par un mandat
+const (
+	MANDATE_PAID      = "PAID"
+	MANDATE_SCHEDULED = "SCHEDULED" // paiement programmé à la date d'expiration
+	MANDATE_REJECTED  = "REJECTED"  // au-delà des plafonds du mandat
+	MANDATE_FAILED    = "FAILED"
+)
+
+var (
+	ErrInvalidMandate        = errors.New("mandate needs strictly positive limits, a monthly limit above the invoice limit and a valid period")
+	ErrMandateNotFound       = errors.New("mandate not found")
+	ErrMandateExists         = errors.New("payer already has an active mandate for this issuer")
+	ErrMandateInvoiceLimit   = errors.New("invoice exceeds the per-invoice limit of the mandate")
+	ErrMandateMonthlyLimit   = errors.New("payment exceeds the monthly limit of the mandate")
+	ErrMandateAlreadyRevoked = errors.New("mandate is already revoked")
+)
+
+const mandateColumns = `mandate_id, issuer_id, payer_id, max_per_invoice, max_per_month, pay_on, valid_from::text AS valid_from,
+	COALESCE(valid_until::text, '') AS valid_until, mandate_state, created_at`
+
+// Mandate lets an issuer be paid automatically by the payer, up to a maximum amount per invoice and
+// per calendar month, between its validity dates.
+type Mandate struct {
+	ID            string  `json:"mandate_id" db:"mandate_id"`
+	IssuerID      string  `json:"issuer_id" db:"issuer_id"`
+	PayerID       string  `json:"payer_id" db:"payer_id"`
+	MaxPerInvoice float64 `json:"max_per_invoice" db:"max_per_invoice"`
+	MaxPerMonth   float64 `json:"max_per_month" db:"max_per_month"`
+	PayOn         string  `json:"pay_on" db:"pay_on"`                     // ISSUE ou DUE
+	ValidFrom     string  `json:"valid_from" db:"valid_from"`             // aujourd'hui par défaut
+	ValidUntil    string  `json:"valid_until,omitempty" db:"valid_until"` // optionnelle, incluse
+	State         string  `json:"state,omitempty" db:"mandate_state"`
+	CreatedAt     string  `json:"created_at,omitempty" db:"created_at"`
+}
+
+// MandatePayment traces what a mandate did for an invoice.
+type MandatePayment struct {
+	ID                 string  `json:"mandate_payment_id" db:"mandate_payment_id"`
+	MandateID          string  `json:"mandate_id" db:"mandate_id"`
+	InvoiceID          string  `json:"invoice_id" db:"invoice_id"`
+	Amount             float64 `json:"amount" db:"amount"`
+	Decision           string  `json:"decision" db:"decision"`
+	Reason             string  `json:"reason,omitempty" db:"reason"`
+	PaymentDate        string  `json:"payment_date" db:"payment_date"`
+	ScheduledPaymentID string  `json:"scheduled_payment_id,omitempty" db:"scheduled_payment_id"`
+	ScheduledState     string  `json:"scheduled_payment_state,omitempty" db:"scheduled_payment_state"`
+	CreatedAt          string  `json:"created_at" db:"created_at"`
+}
+
+func (m Mandate) validate() error {
+	if m.IssuerID == "" || m.PayerID == "" {
+		return ErrNotAnId
+	}
+	if m.IssuerID == m.PayerID {
+		return ErrSameAccount
+	}
+	if roundCents(m.MaxPerInvoice) <= 0 || roundCents(m.MaxPerMonth) < roundCents(m.MaxPerInvoice) {
+		return ErrInvalidMandate
+	}
+	if m.PayOn != MANDATE_PAY_ON_ISSUE && m.PayOn != MANDATE_PAY_ON_DUE {
+		return ErrInvalidMandate
+	}
+	from, err := time.Parse("2006-01-02", m.ValidFrom)
+	if err != nil {
+		return ErrInvalidMandate
+	}
+	if m.ValidUntil != "" {
+		until, err := time.Parse("2006-01-02", m.ValidUntil)
+		if err != nil || until.Before(from) {
+			return ErrInvalidMandate
+		}
+	}
+	return nil
+}
+
+// covers returns true if the mandate is valid on the given day.
+func (m Mandate) covers(day time.Time) bool {
+	day = day.UTC().Truncate(24 * time.Hour)
+	if m.State != MANDATE_ACTIVE {
+		return false
+	}
+	if from, err := time.Parse("2006-01-02", m.ValidFrom); err != nil || day.Before(from) {
+		return false
+	}
+	if until, err := time.Parse("2006-01-02", m.ValidUntil); err == nil && day.After(until) {
+		return false
+	}
+	return true
+}
+
+// check returns the limit the payment would exceed, given what the mandate already paid or scheduled that month.
+func (m Mandate) check(amount float64, month float64) error {
+	if roundCents(amount) > roundCents(m.MaxPerInvoice) {
+		return ErrMandateInvoiceLimit
+	}
+	if roundCents(month+amount) > roundCents(m.MaxPerMonth) {
+		return ErrMandateMonthlyLimit
+	}
+	return nil
+}
+
+// CreateMandate saves the mandate given by the payer to the issuer.
+func (s *invoiceService) CreateMandate(ctx context.Context, m Mandate) (Mandate, error) {
+	if m.ValidFrom == "" {
+		m.ValidFrom = time.Now().UTC().Format("2006-01-02")
+	}
+	m.MaxPerInvoice, m.MaxPerMonth = roundCents(m.MaxPerInvoice), roundCents(m.MaxPerMonth)
+	if err := m.validate(); err != nil {
+		return Mandate{}, err
+	}
+	m.ID = xid.New().String()
+	m.State = MANDATE_ACTIVE
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	var until interface{}
+	if m.ValidUntil != "" {
+		until = m.ValidUntil
+	}
+	res, err := db.Exec(`INSERT INTO mandate (mandate_id, issuer_id, payer_id, max_per_invoice, max_per_month, pay_on, valid_from, valid_until, mandate_state)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (issuer_id, payer_id) WHERE mandate_state = 'ACTIVE' DO NOTHING`,
+		m.ID, m.IssuerID, m.PayerID, m.MaxPerInvoice, m.MaxPerMonth, m.PayOn, m.ValidFrom, until, m.State)
+	if err != nil {
+		return Mandate{}, err
+	}
+	if inserted, _ := res.RowsAffected(); inserted == 0 {
+		return Mandate{}, ErrMandateExists
+	}
+
+	if err := db.Get(&m, "SELECT "+mandateColumns+" FROM mandate WHERE mandate_id=$1", m.ID); err != nil {
+		return Mandate{}, err
+	}
+	return m, nil
+}
+
+// GetMandates returns the mandates given or received by the client.
+func (s *invoiceService) GetMandates(ctx context.Context, clientID string) ([]Mandate, error) {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	mandates := make([]Mandate, 0)
+	err := db.Select(&mandates, "SELECT "+mandateColumns+" FROM mandate WHERE payer_id=$1 OR issuer_id=$1 ORDER BY created_at DESC", clientID)
+	if err != nil {
+		return nil, err
+	}
+	return mandates, nil
+}
+
+// RevokeMandate ends the mandate and cancels the payments it scheduled that were not made yet.
+func (s *invoiceService) RevokeMandate(ctx context.Context, id string) (Mandate, error) {
+	if id == "" {
+		return Mandate{}, ErrNotAnId
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return Mandate{}, err
+	}
+	defer tx.Rollback()
+
+	m := Mandate{}
+	if err := tx.Get(&m, "SELECT "+mandateColumns+" FROM mandate WHERE mandate_id=$1 FOR UPDATE", id); err != nil {
+		if err == sql.ErrNoRows {
+			return Mandate{}, ErrMandateNotFound
+		}
+		return Mandate{}, err
+	}
+	if m.State == MANDATE_REVOKED {
+		return Mandate{}, ErrMandateAlreadyRevoked
+	}
+
+	if _, err := tx.Exec("UPDATE mandate SET mandate_state = $1 WHERE mandate_id=$2", MANDATE_REVOKED, id); err != nil {
+		return Mandate{}, err
+	}
+	_, err = tx.Exec(`UPDATE scheduled_payment SET scheduled_payment_state = $1, last_error = $2 WHERE scheduled_payment_state = $3
+		AND scheduled_payment_id IN (SELECT scheduled_payment_id FROM mandate_payment WHERE mandate_id=$4)`,
+		SCHEDULED_PAYMENT_CANCELLED, "mandate revoked", SCHEDULED_PAYMENT_SCHEDULED, id)
+	if err != nil {
+		return Mandate{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Mandate{}, err
+	}
+	m.State = MANDATE_REVOKED
+	return m, nil
+}
+
+// GetMandatePayments returns what the mandate did for each invoice it covered, the most recent first.
+func (s *invoiceService) GetMandatePayments(ctx context.Context, mandateID string) ([]MandatePayment, error) {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	exists := 0
+	if err := db.Get(&exists, "SELECT COUNT(*) FROM mandate WHERE mandate_id=$1", mandateID); err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, ErrMandateNotFound
+	}
+
+	payments := make([]MandatePayment, 0)
+	err := db.Select(&payments, `SELECT mp.mandate_payment_id, mp.mandate_id, mp.invoice_id, mp.amount, mp.decision, mp.reason, mp.payment_date::text AS payment_date,
+		mp.scheduled_payment_id, COALESCE(sp.scheduled_payment_state, '') AS scheduled_payment_state, mp.created_at
+		FROM mandate_payment mp LEFT JOIN scheduled_payment sp ON sp.scheduled_payment_id = mp.scheduled_payment_id
+		WHERE mp.mandate_id=$1 ORDER BY mp.created_at DESC`, mandateID)
+	if err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+// applyMandate pays the new invoice, or schedules its payment on its expiration date, if the payer
+// gave a mandate to the issuer and the invoice is within its limits. The outcome is traced in
+// mandate_payment, the caller logs the error returned so it does not fail the creation of the invoice.
+func (s *invoiceService) applyMandate(ctx context.Context, invoice Invoice) error {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Le mandat reste verrouillé pour que deux factures ne dépassent pas ensemble le plafond mensuel
+	m := Mandate{}
+	err = tx.Get(&m, "SELECT "+mandateColumns+" FROM mandate WHERE issuer_id=$1 AND payer_id=$2 AND mandate_state = $3 FOR UPDATE", invoice.AccountReceiverId, invoice.AccountPayerId, MANDATE_ACTIVE)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	day := now
+	if m.PayOn == MANDATE_PAY_ON_DUE {
+		// Une facture déjà échue est payée tout de suite
+		if due, err := time.Parse("2006-01-02", dateOnly(invoice.ExpirationDate)); err == nil && due.After(now) {
+			day = due
+		}
+	}
+	if !m.covers(day) {
+		return nil
+	}
+
+	later := day.After(now)
+	payment := MandatePayment{
+		ID:          xid.New().String(),
+		MandateID:   m.ID,
+		InvoiceID:   invoice.ID,
+		Amount:      invoice.Payable(now),
+		PaymentDate: day.Format("2006-01-02"),
+	}
+	if later {
+		payment.Amount = invoice.Remaining()
+	}
+	if err := s.decideMandatePayment(tx, m, invoice, &payment, later); err != nil {
+		// La décision est annulée avec la transaction, seule la trace de l'échec est gardée
+		tx.Rollback()
+		payment.Decision, payment.Reason, payment.ScheduledPaymentID = MANDATE_FAILED, err.Error(), ""
+		if err := insertMandatePayment(db, payment); err != nil {
+			return err
+		}
+		return err
+	}
+	if err := insertMandatePayment(tx, payment); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// decideMandatePayment pays or schedules the invoice inside tx, or rejects it if it exceeds the limits.
+func (s *invoiceService) decideMandatePayment(tx *sqlx.Tx, m Mandate, invoice Invoice, payment *MandatePayment, later bool) error {
+	month := float64(0.0)
+	err := tx.Get(&month, `SELECT COALESCE(SUM(mp.amount), 0) FROM mandate_payment mp
+		LEFT JOIN scheduled_payment sp ON sp.scheduled_payment_id = mp.scheduled_payment_id
+		WHERE mp.mandate_id=$1 AND date_trunc('month', mp.payment_date) = date_trunc('month', $2::date)
+		AND (mp.decision = $3 OR (mp.decision = $4 AND sp.scheduled_payment_state IN ($5, $6)))`,
+		m.ID, payment.PaymentDate, MANDATE_PAID, MANDATE_SCHEDULED, SCHEDULED_PAYMENT_SCHEDULED, SCHEDULED_PAYMENT_PAID)
+	if err != nil {
+		return err
+	}
+	if err := m.check(payment.Amount, month); err != nil {
+		payment.Decision, payment.Reason = MANDATE_REJECTED, err.Error()
+		return nil
+	}
+
+	if later {
+		payment.ScheduledPaymentID = xid.New().String()
+		payment.Decision = MANDATE_SCHEDULED
+		// Le paiement programmé ne paiera pas plus que le montant accepté par le mandat
+		return insertScheduledPayment(tx, payment.ScheduledPaymentID, invoice.ID, invoice.AccountPayerId, payment.PaymentDate, payment.Amount)
+	}
+
+	paid, amount, err := payInvoiceAmount(tx, invoice.ID, 0)
+	if err != nil {
+		return err
+	}
+	payment.Decision, payment.Amount = MANDATE_PAID, amount
+	return enqueueEvents(tx, paymentEvent(paid, amount))
+}
+
+func insertMandatePayment(db sqlx.Execer, p MandatePayment) error {
+	_, err := db.Exec(`INSERT INTO mandate_payment (mandate_payment_id, mandate_id, invoice_id, amount, decision, reason, payment_date, scheduled_payment_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, p.ID, p.MandateID, p.InvoiceID, p.Amount, p.Decision, p.Reason, p.PaymentDate, p.ScheduledPaymentID)
+	return err
+}
+
+// dateOnly returns the date part of a date read from the database.
+func dateOnly(date string) string {
+	if len(date) > 10 {
+		return date[:10]
+	}
+	return date
+}
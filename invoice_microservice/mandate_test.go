@@ -0,0 +1,51 @@
+package invoice_microservice
+
+import (
+	"testing"
+)
+
+func TestMandateLimits(t *testing.T) {
+	m := Mandate{IssuerID: "edf", PayerID: "paul", MaxPerInvoice: 100, MaxPerMonth: 150, PayOn: MANDATE_PAY_ON_ISSUE, ValidFrom: "2021-01-01", ValidUntil: "2021-12-31", State: MANDATE_ACTIVE}
+	if err := m.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		amount   float64
+		month    float64
+		expected error
+	}{
+		{100, 0, nil},
+		{100.01, 0, ErrMandateInvoiceLimit},
+		{50, 100, nil},
+		{50.01, 100, ErrMandateMonthlyLimit},
+	}
+	for _, c := range cases {
+		if err := m.check(c.amount, c.month); err != c.expected {
+			t.Errorf("Expected %v for %v with %v already paid this month, got %v", c.expected, c.amount, c.month, err)
+		}
+	}
+
+	for day, covered := range map[string]bool{"2020-12-31": false, "2021-01-01": true, "2021-12-31": true, "2022-01-01": false} {
+		if m.covers(date(day)) != covered {
+			t.Errorf("Expected the mandate to cover %s : %v", day, covered)
+		}
+	}
+	m.State = MANDATE_REVOKED
+	if m.covers(date("2021-06-01")) {
+		t.Error("Expected a revoked mandate to cover nothing")
+	}
+
+	invalid := []Mandate{
+		{IssuerID: "edf", PayerID: "edf", MaxPerInvoice: 100, MaxPerMonth: 150, PayOn: MANDATE_PAY_ON_DUE, ValidFrom: "2021-01-01"},
+		{IssuerID: "edf", PayerID: "paul", MaxPerInvoice: 0, MaxPerMonth: 150, PayOn: MANDATE_PAY_ON_DUE, ValidFrom: "2021-01-01"},
+		{IssuerID: "edf", PayerID: "paul", MaxPerInvoice: 200, MaxPerMonth: 150, PayOn: MANDATE_PAY_ON_DUE, ValidFrom: "2021-01-01"},
+		{IssuerID: "edf", PayerID: "paul", MaxPerInvoice: 100, MaxPerMonth: 150, PayOn: "LATER", ValidFrom: "2021-01-01"},
+		{IssuerID: "edf", PayerID: "paul", MaxPerInvoice: 100, MaxPerMonth: 150, PayOn: MANDATE_PAY_ON_DUE, ValidFrom: "2021-01-01", ValidUntil: "2020-12-31"},
+	}
+	for _, m := range invalid {
+		if err := m.validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", m)
+		}
+	}
+}
@@ -12,6 +12,13 @@ type Invoice struct {
 	ExpirationDate    string  `json:"invoice_expiration_date,omitempty" db:"invoice_expiration_date"`
 	AccountPayerId    string  `json:"invoice_payer_id,omitempty" db:"account_invoice_payer_id"`
 	AccountReceiverId string  `json:"invoice_receveiver_id,omitempty" db:"account_invoice_receiver_id"`
+	PaidAmount        float64 `json:"invoice_paid_amount,omitempty" db:"invoice_paid_amount"`
+	TaxJurisdiction   string  `json:"invoice_tax_jurisdiction,omitempty" db:"invoice_tax_jurisdiction"`
+	DiscountRate      float64 `json:"invoice_discount_rate,omitempty" db:"invoice_discount_rate"`
+	DiscountDeadline  string  `json:"invoice_discount_deadline,omitempty" db:"invoice_discount_deadline"`
+	DiscountAmount    float64 `json:"invoice_discount_amount,omitempty" db:"invoice_discount_amount"` // escompte accordé au paiement
+	CreatedAt         string  `json:"invoice_created_at,omitempty" db:"invoice_created_at"`
+	Number            string  `json:"invoice_number,omitempty" db:"invoice_number"` // numéro séquentiel de l'émetteur
 }
 
 type AccountInfo struct {
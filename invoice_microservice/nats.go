@@ -0,0 +1,65 @@
+package invoice_microservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Préfixe par défaut des sujets NATS, l'événement InvoicePaid est publié sur invoices.v1.InvoicePaid
+const DefaultNATSSubjectPrefix = "invoices"
+
+// Délai laissé au serveur pour confirmer la réception d'un événement
+const DefaultNATSFlushTimeout = 5 * time.Second
+
+// NATSPublisher publishes each event on the subject <prefix>.v<schema version>.<event type>.
+type NATSPublisher struct {
+	conn         *nats.Conn
+	prefix       string
+	FlushTimeout time.Duration
+}
+
+func NewNATSPublisher(conn *nats.Conn, prefix string) *NATSPublisher {
+	if prefix == "" {
+		prefix = DefaultNATSSubjectPrefix
+	}
+	return &NATSPublisher{conn: conn, prefix: prefix, FlushTimeout: DefaultNATSFlushTimeout}
+}
+
+// ConnectNATS connects to the NATS server at url, the connection is reestablished by the client
+// when it is lost.
+func ConnectNATS(url string, prefix string) (*NATSPublisher, error) {
+	conn, err := nats.Connect(url, nats.Name("invoice-microservice"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return NewNATSPublisher(conn, prefix), nil
+}
+
+func (p *NATSPublisher) Subject(event Event) string {
+	return fmt.Sprintf("%s.v%d.%s", p.prefix, event.SchemaVersion, event.Type)
+}
+
+// Publish returns once the server has received the event. While the connection is lost the client
+// only buffers the messages, so the event is not considered published until the buffer is flushed.
+func (p *NATSPublisher) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := p.conn.Publish(p.Subject(event), payload); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.FlushTimeout)
+	defer cancel()
+	return p.conn.FlushWithContext(ctx)
+}
+
+// Close sends the events still buffered and closes the connection.
+func (p *NATSPublisher) Close() error {
+	return p.conn.Drain()
+}
@@ -0,0 +1,72 @@
+package invoice_microservice
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// startNATSServer runs an in-process NATS server and returns its URL with the messages published
+// on the invoice subjects.
+func startNATSServer(t *testing.T) (string, <-chan *nats.Msg) {
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+
+	messages := make(chan *nats.Msg, 16)
+	if _, err := conn.ChanSubscribe("invoices.>", messages); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return s.ClientURL(), messages
+}
+
+func TestNATSPublisher(t *testing.T) {
+	url, messages := startNATSServer(t)
+
+	p, err := ConnectNATS(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	event := NewEvent(InvoicePaid, Invoice{ID: "c1g2", Amount: 100, PaidAmount: 100, State: PAID}, 100)
+	if err := p.Publish(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-messages:
+		if m.Subject != "invoices.v1.InvoicePaid" {
+			t.Errorf("Unexpected subject %s", m.Subject)
+		}
+		var received Event
+		if err := json.Unmarshal(m.Data, &received); err != nil {
+			t.Fatal(err)
+		}
+		if received.ID != event.ID || received.Invoice.ID != "c1g2" || received.Amount != 100 {
+			t.Errorf("Unexpected event %+v", received)
+		}
+		assertMatchesSchema(t, m.Data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No message received")
+	}
+}
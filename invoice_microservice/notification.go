@@ -0,0 +1,475 @@
+package invoice_microservice
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/rs/xid"
+)
+
+// Types de notifications envoyées aux payeurs
+const (
+	NOTIFY_ISSUED   = "ISSUED"
+	NOTIFY_REMINDER = "REMINDER"
+	NOTIFY_PAYMENT  = "PAYMENT"
+	NOTIFY_EXPIRED  = "EXPIRED"
+
+	NOTIFY_PAYMENT_FAILED = "PAYMENT_FAILED" // échec d'un paiement programmé
+)
+
+// États d'une notification
+const (
+	NOTIFICATION_PENDING = "PENDING"
+	NOTIFICATION_SENT    = "SENT"
+	NOTIFICATION_FAILED  = "FAILED"
+)
+
+const (
+	LanguageFR = "fr"
+	LanguageEN = "en"
+
+	notificationColumns = "notification_id, client_id, invoice_id, kind, recipient, subject, body, attempts"
+)
+
+var (
+	ErrUnknownLanguage = errors.New("language must be fr or en")
+)
+
+// Notification is an email to send.
+type Notification struct {
+	ID        string `db:"notification_id"`
+	ClientID  string `db:"client_id"`
+	InvoiceID string `db:"invoice_id"`
+	Kind      string `db:"kind"`
+	To        string `db:"recipient"`
+	Subject   string `db:"subject"`
+	Body      string `db:"body"`
+	Attempts  int    `db:"attempts"`
+}
+
+// Notifier sends the notifications.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// NotificationPreference is the language of the emails a client receives, a client can also stop them.
+type NotificationPreference struct {
+	ClientID string `json:"client_id" db:"client_id"`
+	Language string `json:"language" db:"language"`
+	Disabled bool   `json:"disabled" db:"disabled"`
+}
+
+func (p NotificationPreference) validate() error {
+	if p.Language != LanguageFR && p.Language != LanguageEN {
+		return ErrUnknownLanguage
+	}
+	return nil
+}
+
+func (s *invoiceService) SetNotificationPreference(ctx context.Context, preference NotificationPreference) (NotificationPreference, error) {
+	if preference.ClientID == "" {
+		return NotificationPreference{}, ErrNotAnId
+	}
+	if err := preference.validate(); err != nil {
+		return NotificationPreference{}, err
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	_, err := db.Exec(`INSERT INTO notification_preference (client_id, language, disabled) VALUES ($1, $2, $3)
+		ON CONFLICT (client_id) DO UPDATE SET language = EXCLUDED.language, disabled = EXCLUDED.disabled`,
+		preference.ClientID, preference.Language, preference.Disabled)
+	if err != nil {
+		return NotificationPreference{}, err
+	}
+	return preference, nil
+}
+
+// GetNotificationPreference returns the preference of the client, French emails if it did not set one.
+func (s *invoiceService) GetNotificationPreference(ctx context.Context, clientID string) (NotificationPreference, error) {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	preference := NotificationPreference{}
+	err := db.Get(&preference, "SELECT client_id, language, disabled FROM notification_preference WHERE client_id=$1", clientID)
+	if err == sql.ErrNoRows {
+		return NotificationPreference{ClientID: clientID, Language: LanguageFR}, nil
+	}
+	if err != nil {
+		return NotificationPreference{}, err
+	}
+	return preference, nil
+}
+
+// EmailData is given to the templates.
+type EmailData struct {
+	Invoice      Invoice
+	Reference    string
+	Payer        AccountInfo
+	Issuer       AccountInfo
+	Amount       float64 // montant payé pour PAYMENT
+	ReminderDays int
+	Reason       string // raison de l'échec d'un paiement programmé
+	NextAttempt  string // prochain essai du paiement programmé, vide s'il n'y en a plus
+}
+
+// EmailTemplate is the subject and the body of an email, both executed with an EmailData.
+type EmailTemplate struct {
+	Subject *template.Template
+	Body    *template.Template
+}
+
+var emailFuncs = template.FuncMap{
+	"money": func(amount float64) string {
+		return strings.Replace(fmt.Sprintf("%.2f €", amount), ".", ",", 1)
+	},
+	"name": func(a AccountInfo) string {
+		return strings.TrimSpace(a.Name + " " + a.Surname)
+	},
+}
+
+func NewEmailTemplate(subject string, body string) (EmailTemplate, error) {
+	s, err := template.New("subject").Funcs(emailFuncs).Parse(subject)
+	if err != nil {
+		return EmailTemplate{}, err
+	}
+	b, err := template.New("body").Funcs(emailFuncs).Parse(body)
+	if err != nil {
+		return EmailTemplate{}, err
+	}
+	return EmailTemplate{Subject: s, Body: b}, nil
+}
+
+func mustEmailTemplate(subject string, body string) EmailTemplate {
+	t, err := NewEmailTemplate(subject, body)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// DefaultEmailTemplates returns the French and English templates, by language then by kind.
+func DefaultEmailTemplates() map[string]map[string]EmailTemplate {
+	return map[string]map[string]EmailTemplate{
+		LanguageFR: {
+			NOTIFY_ISSUED: mustEmailTemplate("Nouvelle facture {{.Reference}} de {{name .Issuer}}", `Bonjour {{name .Payer}},
+
+{{name .Issuer}} vous a envoyé la facture {{.Reference}} d'un montant de {{money .Invoice.Amount}}, à payer avant le {{.Invoice.ExpirationDate}}.
+{{if .Invoice.DiscountDeadline}}
+Un escompte de {{.Invoice.DiscountRate}} % s'applique si elle est payée avant le {{.Invoice.DiscountDeadline}}.
+{{end}}
+Cordialement,
+Le service de facturation
+`),
+			NOTIFY_REMINDER: mustEmailTemplate("Rappel : la facture {{.Reference}} arrive à échéance", `Bonjour {{name .Payer}},
+
+La facture {{.Reference}} de {{name .Issuer}} arrive à échéance dans {{.ReminderDays}} jour(s), le {{.Invoice.ExpirationDate}}. Il reste {{money .Invoice.Remaining}} à payer.
+
+Cordialement,
+Le service de facturation
+`),
+			NOTIFY_PAYMENT: mustEmailTemplate("Paiement de la facture {{.Reference}}", `Bonjour {{name .Payer}},
+
+Votre paiement de {{money .Amount}} pour la facture {{.Reference}} de {{name .Issuer}} a bien été reçu.
+{{if .Invoice.Remaining}}Il reste {{money .Invoice.Remaining}} à payer avant le {{.Invoice.ExpirationDate}}.{{else}}La facture est entièrement payée.{{end}}
+
+Cordialement,
+Le service de facturation
+`),
+			NOTIFY_EXPIRED: mustEmailTemplate("La facture {{.Reference}} est échue", `Bonjour {{name .Payer}},
+
+La facture {{.Reference}} de {{name .Issuer}} n'a pas été payée avant le {{.Invoice.ExpirationDate}}. Il reste {{money .Invoice.Remaining}} à payer.
+
+Cordialement,
+Le service de facturation
+`),
+			NOTIFY_PAYMENT_FAILED: mustEmailTemplate("Échec du paiement programmé de la facture {{.Reference}}", `Bonjour {{name .Payer}},
+
+Le paiement programmé de la facture {{.Reference}} de {{name .Issuer}} n'a pas pu être effectué : {{.Reason}}.
+{{if .NextAttempt}}Un nouvel essai aura lieu le {{.NextAttempt}}.{{else}}Il n'y aura pas de nouvel essai, il reste {{money .Invoice.Remaining}} à payer avant le {{.Invoice.ExpirationDate}}.{{end}}
+
+Cordialement,
+Le service de facturation
+`),
+		},
+		LanguageEN: {
+			NOTIFY_ISSUED: mustEmailTemplate("New invoice {{.Reference}} from {{name .Issuer}}", `Hello {{name .Payer}},
+
+{{name .Issuer}} sent you the invoice {{.Reference}} for {{money .Invoice.Amount}}, due by {{.Invoice.ExpirationDate}}.
+{{if .Invoice.DiscountDeadline}}
+A {{.Invoice.DiscountRate}}% discount applies if it is paid by {{.Invoice.DiscountDeadline}}.
+{{end}}
+Regards,
+The invoicing service
+`),
+			NOTIFY_REMINDER: mustEmailTemplate("Reminder: invoice {{.Reference}} is due soon", `Hello {{name .Payer}},
+
+The invoice {{.Reference}} from {{name .Issuer}} is due in {{.ReminderDays}} day(s), on {{.Invoice.ExpirationDate}}. {{money .Invoice.Remaining}} is left to pay.
+
+Regards,
+The invoicing service
+`),
+			NOTIFY_PAYMENT: mustEmailTemplate("Payment of invoice {{.Reference}}", `Hello {{name .Payer}},
+
+Your payment of {{money .Amount}} for the invoice {{.Reference}} from {{name .Issuer}} has been received.
+{{if .Invoice.Remaining}}{{money .Invoice.Remaining}} is left to pay by {{.Invoice.ExpirationDate}}.{{else}}The invoice is fully paid.{{end}}
+
+Regards,
+The invoicing service
+`),
+			NOTIFY_EXPIRED: mustEmailTemplate("Invoice {{.Reference}} is overdue", `Hello {{name .Payer}},
+
+The invoice {{.Reference}} from {{name .Issuer}} was not paid by {{.Invoice.ExpirationDate}}. {{money .Invoice.Remaining}} is left to pay.
+
+Regards,
+The invoicing service
+`),
+			NOTIFY_PAYMENT_FAILED: mustEmailTemplate("Scheduled payment of invoice {{.Reference}} failed", `Hello {{name .Payer}},
+
+The scheduled payment of the invoice {{.Reference}} from {{name .Issuer}} could not be made: {{.Reason}}.
+{{if .NextAttempt}}It will be attempted again on {{.NextAttempt}}.{{else}}It will not be attempted again, {{money .Invoice.Remaining}} is left to pay by {{.Invoice.ExpirationDate}}.{{end}}
+
+Regards,
+The invoicing service
+`),
+		},
+	}
+}
+
+// Notifications emails the payers when an invoice is issued, paid or expired, and a few days before
+// it expires. The emails are queued then sent by Send, with retries.
+type Notifications struct {
+	DbInfos   DbConnexionInfo
+	Service   InvoiceService
+	Notifier  Notifier
+	Templates map[string]map[string]EmailTemplate
+	// Le rappel est envoyé ReminderDays jours avant la date d'expiration
+	ReminderDays int
+	MaxAttempts  int
+	BatchSize    int
+	// Une notification réservée par un worker n'est pas envoyée par un autre avant ce délai
+	Lease time.Duration
+}
+
+func NewNotifications(dbinfos DbConnexionInfo, s InvoiceService, notifier Notifier) *Notifications {
+	return &Notifications{
+		DbInfos:      dbinfos,
+		Service:      s,
+		Notifier:     notifier,
+		Templates:    DefaultEmailTemplates(),
+		ReminderDays: 3,
+		MaxAttempts:  5,
+		BatchSize:    50,
+		Lease:        time.Minute,
+	}
+}
+
+// render returns the subject and the body of the email, in English if the templates of the language are missing.
+func (n *Notifications) render(language string, kind string, data EmailData) (string, string, error) {
+	templates, ok := n.Templates[language]
+	if !ok {
+		templates = n.Templates[LanguageEN]
+	}
+	t, ok := templates[kind]
+	if !ok {
+		return "", "", fmt.Errorf("no %s template for %s", language, kind)
+	}
+
+	var subject, body bytes.Buffer
+	if err := t.Subject.Execute(&subject, data); err != nil {
+		return "", "", err
+	}
+	if err := t.Body.Execute(&body, data); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(subject.String()), body.String(), nil
+}
+
+// enqueue renders the email to the payer of the invoice and queues it, key identifies the
+// notification so it is only queued once.
+func (n *Notifications) enqueue(ctx context.Context, kind string, data EmailData, key string) error {
+	invoice := data.Invoice
+	preference, err := n.Service.GetNotificationPreference(ctx, invoice.AccountPayerId)
+	if err != nil {
+		return err
+	}
+	if preference.Disabled {
+		return nil
+	}
+
+	db := GetDbConnexion(n.DbInfos)
+	defer db.Close()
+
+	// Le payeur et l'émetteur sont lus avec une seule requête, enqueue est appelée pour chaque événement relayé
+	accounts := []struct {
+		ID string `db:"client_id"`
+		AccountInfo
+	}{}
+	err = db.Select(&accounts, "SELECT client_id, name, surname, mail_adress, phone_number, account_amount FROM account WHERE client_id IN ($1, $2)",
+		invoice.AccountPayerId, invoice.AccountReceiverId)
+	if err != nil {
+		return err
+	}
+	var payer, issuer AccountInfo
+	for _, a := range accounts {
+		if a.ID == invoice.AccountPayerId {
+			payer = a.AccountInfo
+		}
+		if a.ID == invoice.AccountReceiverId {
+			issuer = a.AccountInfo
+		}
+	}
+	// Un compte supprimé ou sans email ne doit pas bloquer le relais de l'outbox
+	if payer.Mail == "" {
+		return nil
+	}
+
+	data.Reference = invoice.Reference()
+	data.Payer = payer
+	data.Issuer = issuer
+	data.ReminderDays = n.ReminderDays
+	subject, body, err := n.render(preference.Language, kind, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO notification (notification_id, notification_key, client_id, invoice_id, kind, recipient, subject, body, notification_state)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (notification_key) DO NOTHING`,
+		xid.New().String(), key, invoice.AccountPayerId, invoice.ID, kind, payer.Mail, subject, body, NOTIFICATION_PENDING)
+	return err
+}
+
+// Publish queues the email matching the event, Notifications is given to the OutboxRelay.
+func (n *Notifications) Publish(ctx context.Context, event Event) error {
+	kind := ""
+	switch event.Type {
+	case InvoiceCreated:
+		kind = NOTIFY_ISSUED
+	case InvoicePaid, InvoicePartiallyPaid:
+		kind = NOTIFY_PAYMENT
+	case InvoiceExpired:
+		kind = NOTIFY_EXPIRED
+	default:
+		return nil
+	}
+
+	invoice := Invoice{
+		ID:                event.Invoice.ID,
+		Number:            event.Invoice.Number,
+		Amount:            event.Invoice.Amount,
+		PaidAmount:        event.Invoice.PaidAmount,
+		DiscountAmount:    roundCents(event.Invoice.Amount - event.Invoice.PaidAmount - event.Invoice.Remaining),
+		ExpirationDate:    event.Invoice.ExpirationDate,
+		AccountPayerId:    event.Invoice.PayerID,
+		AccountReceiverId: event.Invoice.ReceiverID,
+	}
+	// Le détail de l'escompte n'est pas dans l'événement
+	if kind == NOTIFY_ISSUED {
+		if current, err := n.Service.Read(ctx, invoice.ID); err == nil {
+			invoice = current
+		}
+	}
+	return n.enqueue(ctx, kind, EmailData{Invoice: invoice, Amount: event.Amount}, kind+":"+event.ID)
+}
+
+// ScheduledPaymentFailed tells the payer that the scheduled payment of the invoice failed, and when
+// it will be attempted again.
+func (n *Notifications) ScheduledPaymentFailed(ctx context.Context, payment ScheduledPayment, invoice Invoice) error {
+	data := EmailData{Invoice: invoice, Reason: payment.LastError, NextAttempt: payment.NextAttempt}
+	return n.enqueue(ctx, NOTIFY_PAYMENT_FAILED, data, fmt.Sprintf("%s:%s:%d", NOTIFY_PAYMENT_FAILED, payment.ID, payment.Attempts))
+}
+
+// Remind queues a reminder for the invoices left to pay that expire in ReminderDays days, and
+// returns the number of invoices concerned.
+func (n *Notifications) Remind(ctx context.Context) (int, error) {
+	db := GetDbConnexion(n.DbInfos)
+	invoices := make([]Invoice, 0)
+	err := db.Select(&invoices, "SELECT * FROM invoice WHERE invoice_state IN ($1, $2) AND invoice_expiration_date::date = CURRENT_DATE + $3::integer",
+		PENDING, PARTIALLY_PAID, n.ReminderDays)
+	db.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, i := range invoices {
+		if err := n.enqueue(ctx, NOTIFY_REMINDER, EmailData{Invoice: i}, NOTIFY_REMINDER+":"+i.ID+":"+i.ExpirationDate); err != nil {
+			return 0, err
+		}
+	}
+	return len(invoices), nil
+}
+
+// Send sends the queued notifications that are due and returns the number sent. A notification that
+// cannot be sent is retried with an exponential backoff, until MaxAttempts. The notifications are
+// reserved for Lease before being sent, as the webhook deliveries are, so no transaction stays open
+// while the emails are sent and the outcome of each one is saved on its own.
+func (n *Notifications) Send(ctx context.Context) (int, error) {
+	db := GetDbConnexion(n.DbInfos)
+	defer db.Close()
+
+	pending := make([]Notification, 0)
+	err := db.Select(&pending, `UPDATE notification SET next_attempt_at = $3 WHERE notification_id IN (
+			SELECT notification_id FROM notification WHERE notification_state = $1 AND next_attempt_at <= now()
+			ORDER BY created_at LIMIT $2 FOR UPDATE SKIP LOCKED)
+		RETURNING `+notificationColumns, NOTIFICATION_PENDING, n.BatchSize, time.Now().Add(n.Lease))
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, notification := range pending {
+		notification.Attempts++
+		if err := n.Notifier.Notify(ctx, notification); err != nil {
+			state := NOTIFICATION_PENDING
+			if notification.Attempts >= n.MaxAttempts {
+				state = NOTIFICATION_FAILED
+			}
+			_, err = db.Exec("UPDATE notification SET notification_state = $1, attempts = $2, last_error = $3, next_attempt_at = $4 WHERE notification_id=$5",
+				state, notification.Attempts, err.Error(), time.Now().Add(retryBackoff(notification.Attempts)), notification.ID)
+			if err != nil {
+				return sent, err
+			}
+			continue
+		}
+
+		_, err := db.Exec("UPDATE notification SET notification_state = $1, attempts = $2, last_error = '', sent_at = now() WHERE notification_id=$3", NOTIFICATION_SENT, notification.Attempts, notification.ID)
+		if err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// Schedule sends the queued notifications every interval and queues the reminders once a day, until ctx is done.
+func (n *Notifications) Schedule(ctx context.Context, interval time.Duration, logger log.Logger) {
+	lastReminder := ""
+	RunEvery(ctx, interval, func(ctx context.Context) {
+		if today := time.Now().Format("2006-01-02"); today != lastReminder {
+			reminded, err := n.Remind(ctx)
+			if err != nil {
+				logger.Log("notifications", "failed", "err", err)
+			} else {
+				lastReminder = today
+				logger.Log("notifications", "reminders", "invoices", reminded)
+			}
+		}
+
+		sent, err := n.Send(ctx)
+		if err != nil {
+			logger.Log("notifications", "failed", "err", err)
+			return
+		}
+		if sent > 0 {
+			logger.Log("notifications", "sent", "count", sent)
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package invoice_microservice
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+type smtpMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+// startSMTPServer answers the commands used by net/smtp and sends the received messages on the channel.
+func startSMTPServer(t *testing.T) (string, <-chan smtpMessage) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	messages := make(chan smtpMessage, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, messages)
+		}
+	}()
+	return l.Addr().String(), messages
+}
+
+func serveSMTP(conn net.Conn, messages chan<- smtpMessage) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost ESMTP")
+
+	msg := smtpMessage{}
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			c.PrintfLine("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			msg.From = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			c.PrintfLine("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			msg.To = append(msg.To, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			c.PrintfLine("250 OK")
+		case command == "DATA":
+			c.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(c.DotReader())
+			if err != nil {
+				return
+			}
+			msg.Data = string(data)
+			messages <- msg
+			msg = smtpMessage{}
+			c.PrintfLine("250 OK")
+		case command == "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	addr, messages := startSMTPServer(t)
+	n := NewSMTPNotifier(addr, "factures@example.com", "", "")
+
+	err := n.Notify(context.Background(), Notification{To: "paul@example.com", Subject: "Facture échue", Body: "Il reste 10,00 € à payer.\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-messages
+	if msg.From != "factures@example.com" || len(msg.To) != 1 || msg.To[0] != "paul@example.com" {
+		t.Errorf("Unexpected envelope %+v", msg)
+	}
+	headers, err := textproto.NewReader(bufio.NewReader(strings.NewReader(msg.Data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers.Get("Subject") != "=?utf-8?q?Facture_=C3=A9chue?=" || headers.Get("To") != "paul@example.com" || headers.Get("Message-Id") == "" {
+		t.Errorf("Unexpected headers %v", headers)
+	}
+	body, _ := io.ReadAll(quotedprintable.NewReader(strings.NewReader(msg.Data[strings.Index(msg.Data, "\n\n")+2:])))
+	if string(body) != "Il reste 10,00 € à payer.\n" {
+		t.Errorf("Unexpected body %q", body)
+	}
+}
+
+func TestSMTPNotifierTimeout(t *testing.T) {
+	// Le serveur accepte la connexion mais ne répond jamais
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	n := NewSMTPNotifier(l.Addr().String(), "factures@example.com", "", "")
+	n.Timeout = 100 * time.Millisecond
+	start := time.Now()
+	if err := n.Notify(context.Background(), Notification{To: "paul@example.com"}); err == nil {
+		t.Errorf("Expected a silent server to fail the email")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the email to give up after the timeout, took %v", elapsed)
+	}
+}
+
+func TestNotificationTemplates(t *testing.T) {
+	n := NewNotifications(DbConnexionInfo{}, nil, nil)
+	data := EmailData{
+		Invoice:      Invoice{ID: "c1g2", Number: "F2021-000042", Amount: 120, PaidAmount: 20, ExpirationDate: "2021-05-01"},
+		Reference:    "F2021-000042",
+		Payer:        AccountInfo{Name: "Paul", Surname: "Martin"},
+		Issuer:       AccountInfo{Name: "Anne", Surname: "Durand"},
+		Amount:       20,
+		ReminderDays: 3,
+		Reason:       "solde insuffisant",
+		NextAttempt:  "2021-04-29",
+	}
+
+	cases := []struct {
+		language string
+		kind     string
+		subject  string
+		body     string
+	}{
+		{LanguageFR, NOTIFY_ISSUED, "Nouvelle facture F2021-000042 de Anne Durand", "d'un montant de 120,00 €, à payer avant le 2021-05-01"},
+		{LanguageFR, NOTIFY_REMINDER, "Rappel : la facture F2021-000042 arrive à échéance", "dans 3 jour(s), le 2021-05-01. Il reste 100,00 €"},
+		{LanguageFR, NOTIFY_PAYMENT, "Paiement de la facture F2021-000042", "Il reste 100,00 € à payer"},
+		{LanguageFR, NOTIFY_EXPIRED, "La facture F2021-000042 est échue", "Bonjour Paul Martin"},
+		{LanguageEN, NOTIFY_ISSUED, "New invoice F2021-000042 from Anne Durand", "for 120,00 €, due by 2021-05-01"},
+		{LanguageEN, NOTIFY_REMINDER, "Reminder: invoice F2021-000042 is due soon", "is due in 3 day(s)"},
+		{LanguageEN, NOTIFY_PAYMENT, "Payment of invoice F2021-000042", "Your payment of 20,00 €"},
+		{LanguageEN, NOTIFY_EXPIRED, "Invoice F2021-000042 is overdue", "was not paid by 2021-05-01"},
+		{LanguageFR, NOTIFY_PAYMENT_FAILED, "Échec du paiement programmé de la facture F2021-000042", "n'a pas pu être effectué : solde insuffisant.\nUn nouvel essai aura lieu le 2021-04-29."},
+		{LanguageEN, NOTIFY_PAYMENT_FAILED, "Scheduled payment of invoice F2021-000042 failed", "could not be made: solde insuffisant.\nIt will be attempted again on 2021-04-29."},
+		{"de", NOTIFY_EXPIRED, "Invoice F2021-000042 is overdue", "Hello Paul Martin"},
+	}
+	for _, c := range cases {
+		subject, body, err := n.render(c.language, c.kind, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subject != c.subject || !strings.Contains(body, c.body) {
+			t.Errorf("Unexpected %s %s email %q : %s", c.language, c.kind, subject, body)
+		}
+	}
+
+	data.Invoice.PaidAmount = 120
+	if _, body, _ := n.render(LanguageFR, NOTIFY_PAYMENT, data); !strings.Contains(body, "La facture est entièrement payée.") {
+		t.Errorf("Expected the invoice to be paid : %s", body)
+	}
+	data.NextAttempt = ""
+	if _, body, _ := n.render(LanguageEN, NOTIFY_PAYMENT_FAILED, data); !strings.Contains(body, "It will not be attempted again") {
+		t.Errorf("Expected no new attempt : %s", body)
+	}
+	if _, _, err := n.render(LanguageFR, "SENT", data); err == nil {
+		t.Error("Expected an unknown kind to fail")
+	}
+	if err := (NotificationPreference{Language: "de"}).validate(); err != ErrUnknownLanguage {
+		t.Errorf("Expected ErrUnknownLanguage, got %v", err)
+	}
+}
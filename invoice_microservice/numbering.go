@@ -0,0 +1,188 @@
+package invoice_microservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Champs remplacés dans le format des numéros de facture
+const (
+	NumberPrefix    = "{PREFIX}"
+	NumberYear      = "{YYYY}"
+	NumberShortYear = "{YY}"
+	NumberSequence  = "{SEQ}"
+
+	DefaultNumberFormat  = NumberPrefix + NumberYear + "-" + NumberSequence
+	DefaultNumberPadding = 6
+
+	maxNumberPadding = 12
+)
+
+var (
+	ErrInvalidNumberingPolicy = errors.New("number format must contain {SEQ}, and {YYYY} or {YY} when the sequence is reset every year")
+	ErrNumberingPolicyInUse   = errors.New("the yearly reset and the year of the number format cannot be changed once invoices are numbered")
+)
+
+// NumberingPolicy describes how the invoices of an issuer are numbered. The sequence has no gap : a
+// number is only used once the invoice is created, and the sequence starts again at 1 every year
+// when YearlyReset is set.
+type NumberingPolicy struct {
+	IssuerID    string `json:"issuer_id" db:"issuer_id"`
+	Prefix      string `json:"prefix" db:"prefix"`
+	Format      string `json:"format" db:"format"`
+	Padding     int    `json:"padding" db:"padding"` // nombre minimum de chiffres de la séquence
+	YearlyReset bool   `json:"yearly_reset" db:"yearly_reset"`
+}
+
+// DefaultNumberingPolicy numbers the invoices 2026-000123, the policy of the issuers that did not set one.
+func DefaultNumberingPolicy(issuerID string) NumberingPolicy {
+	return NumberingPolicy{
+		IssuerID:    issuerID,
+		Format:      DefaultNumberFormat,
+		Padding:     DefaultNumberPadding,
+		YearlyReset: true,
+	}
+}
+
+func (p NumberingPolicy) validate() error {
+	if !strings.Contains(p.Format, NumberSequence) || p.Padding < 0 || p.Padding > maxNumberPadding {
+		return ErrInvalidNumberingPolicy
+	}
+	if p.YearlyReset && !p.hasYear() {
+		return ErrInvalidNumberingPolicy
+	}
+	return nil
+}
+
+// Number formats the n-th number of the sequence of year.
+func (p NumberingPolicy) Number(year int, n int) string {
+	return strings.NewReplacer(
+		NumberPrefix, p.Prefix,
+		NumberYear, fmt.Sprintf("%04d", year),
+		NumberShortYear, fmt.Sprintf("%02d", year%100),
+		NumberSequence, fmt.Sprintf("%0*d", p.Padding, n),
+	).Replace(p.Format)
+}
+
+func (p NumberingPolicy) hasYear() bool {
+	return strings.Contains(p.Format, NumberYear) || strings.Contains(p.Format, NumberShortYear)
+}
+
+// sequenceYear is the year the sequence of the policy is kept for, 0 when it is never reset.
+func (p NumberingPolicy) sequenceYear(now time.Time) int {
+	if !p.YearlyReset {
+		return 0
+	}
+	return now.Year()
+}
+
+// SetNumberingPolicy sets the policy of the issuer. Once the issuer has numbered invoices the
+// sequence cannot be switched between yearly and single, nor the year removed from the format,
+// since the new sequence would start again at 1 and give the numbers already used.
+func (s *invoiceService) SetNumberingPolicy(ctx context.Context, policy NumberingPolicy) (NumberingPolicy, error) {
+	if policy.IssuerID == "" {
+		return NumberingPolicy{}, ErrNotAnId
+	}
+	if policy.Format == "" {
+		policy.Format = DefaultNumberFormat
+	}
+	if err := policy.validate(); err != nil {
+		return NumberingPolicy{}, err
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return NumberingPolicy{}, err
+	}
+	defer tx.Rollback()
+
+	// La politique en place reste verrouillée jusqu'à la fin de la transaction
+	current := DefaultNumberingPolicy(policy.IssuerID)
+	err = tx.Get(&current, "SELECT * FROM numbering_policy WHERE issuer_id=$1 FOR UPDATE", policy.IssuerID)
+	if err != nil && err != sql.ErrNoRows {
+		return NumberingPolicy{}, err
+	}
+	if policy.YearlyReset != current.YearlyReset || current.hasYear() && !policy.hasYear() {
+		numbered := false
+		if err := tx.Get(&numbered, "SELECT EXISTS (SELECT 1 FROM invoice_sequence WHERE issuer_id=$1)", policy.IssuerID); err != nil {
+			return NumberingPolicy{}, err
+		}
+		if numbered {
+			return NumberingPolicy{}, ErrNumberingPolicyInUse
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO numbering_policy (issuer_id, prefix, format, padding, yearly_reset) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (issuer_id) DO UPDATE SET prefix = EXCLUDED.prefix, format = EXCLUDED.format, padding = EXCLUDED.padding, yearly_reset = EXCLUDED.yearly_reset`,
+		policy.IssuerID, policy.Prefix, policy.Format, policy.Padding, policy.YearlyReset)
+	if err != nil {
+		return NumberingPolicy{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return NumberingPolicy{}, err
+	}
+
+	return policy, nil
+}
+
+// GetNumberingPolicy returns the policy of the issuer, the default one if it did not set one.
+func (s *invoiceService) GetNumberingPolicy(ctx context.Context, issuerID string) (NumberingPolicy, error) {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	return numberingPolicy(db, issuerID)
+}
+
+func numberingPolicy(q sqlx.Queryer, issuerID string) (NumberingPolicy, error) {
+	policy := NumberingPolicy{}
+	err := sqlx.Get(q, &policy, "SELECT * FROM numbering_policy WHERE issuer_id=$1", issuerID)
+	if err == sql.ErrNoRows {
+		return DefaultNumberingPolicy(issuerID), nil
+	}
+	if err != nil {
+		return NumberingPolicy{}, err
+	}
+	return policy, nil
+}
+
+// allocateInvoiceNumber takes the next number of the issuer inside tx. The row of the sequence stays
+// locked until tx ends, so concurrent creations wait for each other, and the number is given back to
+// the sequence if tx is rolled back.
+func allocateInvoiceNumber(tx *sqlx.Tx, issuerID string, now time.Time) (string, error) {
+	policy, err := numberingPolicy(tx, issuerID)
+	if err != nil {
+		return "", err
+	}
+
+	year := policy.sequenceYear(now)
+	var n int
+	err = tx.Get(&n, `INSERT INTO invoice_sequence (issuer_id, sequence_year, last_number) VALUES ($1, $2, 1)
+		ON CONFLICT (issuer_id, sequence_year) DO UPDATE SET last_number = invoice_sequence.last_number + 1
+		RETURNING last_number`, issuerID, year)
+	if err != nil {
+		return "", err
+	}
+
+	return policy.Number(now.Year(), n), nil
+}
+
+// Reference is the number of the invoice, or its ID for the invoices created before the numbering.
+func (i Invoice) Reference() string {
+	return invoiceReference(i.ID, i.Number)
+}
+
+func invoiceReference(id string, number string) string {
+	if number == "" {
+		return id
+	}
+	return number
+}
@@ -0,0 +1,110 @@
+package invoice_microservice
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNumberingPolicy(t *testing.T) {
+	policy := DefaultNumberingPolicy("issuer")
+	if n := policy.Number(2026, 123); n != "2026-000123" {
+		t.Errorf("Expected 2026-000123, got %s", n)
+	}
+
+	policy = NumberingPolicy{Prefix: "FA", Format: "{PREFIX}-{YY}/{SEQ}", Padding: 4, YearlyReset: true}
+	if n := policy.Number(2026, 7); n != "FA-26/0007" {
+		t.Errorf("Expected FA-26/0007, got %s", n)
+	}
+	// La séquence dépasse le nombre de chiffres demandé sans être tronquée
+	if n := policy.Number(2026, 123456); n != "FA-26/123456" {
+		t.Errorf("Expected FA-26/123456, got %s", n)
+	}
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if y := policy.sequenceYear(now); y != 2026 {
+		t.Errorf("Expected the sequence of 2026, got %d", y)
+	}
+	policy.YearlyReset = false
+	if y := policy.sequenceYear(now); y != 0 {
+		t.Errorf("Expected a single sequence, got %d", y)
+	}
+
+	invalid := []NumberingPolicy{
+		{Format: "{YYYY}", Padding: 6, YearlyReset: true},
+		{Format: "F-{SEQ}", Padding: 6, YearlyReset: true},
+		{Format: "{YYYY}-{SEQ}", Padding: -1},
+	}
+	for _, p := range invalid {
+		if err := p.validate(); err != ErrInvalidNumberingPolicy {
+			t.Errorf("Expected %+v to be invalid, got %v", p, err)
+		}
+	}
+	if err := (NumberingPolicy{Format: "F-{SEQ}"}).validate(); err != nil {
+		t.Errorf("Expected a sequence without yearly reset to be valid, got %v", err)
+	}
+
+	if r := (Invoice{ID: "c1g2"}).Reference(); r != "c1g2" {
+		t.Errorf("Expected the ID of an invoice without number, got %s", r)
+	}
+	if r := (Invoice{ID: "c1g2", Number: "2026-000001"}).Reference(); r != "2026-000001" {
+		t.Errorf("Expected the number, got %s", r)
+	}
+}
+
+func TestNumberingConcurrentCreations(t *testing.T) {
+	d := newMoneyTestData(t, 0)
+	t.Cleanup(func() {
+		d.db.Exec("DELETE FROM numbering_policy WHERE issuer_id = $1", d.receiver)
+	})
+
+	policy := NumberingPolicy{IssuerID: d.receiver, Prefix: "T", Format: "{PREFIX}{YYYY}-{SEQ}", Padding: 3, YearlyReset: true}
+	if _, err := d.s.SetNumberingPolicy(context.TODO(), policy); err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 10
+	var wg sync.WaitGroup
+	numbers := make([]string, count)
+	errs := make([]error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			invoice, err := d.s.Create(context.TODO(), Invoice{
+				Amount:            10,
+				State:             PENDING,
+				ExpirationDate:    time.Now().AddDate(0, 1, 0).Format("2006-01-02"),
+				AccountPayerId:    d.payer,
+				AccountReceiverId: d.receiver,
+			})
+			numbers[i], errs[i] = invoice.Number, err
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(numbers)
+	for i, n := range numbers {
+		if expected := policy.Number(time.Now().Year(), i+1); n != expected {
+			t.Errorf("Expected the numbers to follow each other without gap, got %s instead of %s", n, expected)
+		}
+	}
+
+	// Une séquence unique repartirait de 1 et redonnerait les numéros déjà émis
+	single := policy
+	single.YearlyReset = false
+	if _, err := d.s.SetNumberingPolicy(context.TODO(), single); err != ErrNumberingPolicyInUse {
+		t.Errorf("Switched a numbered issuer to a single sequence, should have raised ErrNumberingPolicyInUse, got %v", err)
+	}
+	policy.Prefix = "U"
+	if _, err := d.s.SetNumberingPolicy(context.TODO(), policy); err != nil {
+		t.Errorf("Expected the prefix to be changed, got %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package invoice_microservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	outboxColumns = "outbox_id, event_id, event_type, invoice_id, payload, created_at, attempts, last_error, next_attempt_at"
+
+	// Clé du verrou consultatif pris par le relais, un seul relais publie à la fois
+	outboxLock = 4300001
+
+	retryMinBackoff = 10 * time.Second
+	retryMaxBackoff = time.Hour
+)
+
+var (
+	ErrOutboxEntryNotFound = errors.New("no unsent outbox entry with this id")
+)
+
+// OutboxEntry is an event written in the same transaction as the change it describes, waiting to
+// be published by the relay.
+type OutboxEntry struct {
+	ID            int64     `json:"outbox_id" db:"outbox_id"`
+	EventID       string    `json:"event_id" db:"event_id"`
+	EventType     string    `json:"event_type" db:"event_type"`
+	InvoiceID     string    `json:"invoice_id" db:"invoice_id"`
+	Payload       string    `json:"payload" db:"payload"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+	Attempts      int       `json:"attempts" db:"attempts"`
+	LastError     string    `json:"last_error" db:"last_error"`
+	NextAttemptAt time.Time `json:"next_attempt_at" db:"next_attempt_at"`
+}
+
+// enqueueEvents writes the events in the outbox inside tx, they are only published if tx is committed.
+func enqueueEvents(tx *sqlx.Tx, events ...Event) error {
+	for _, e := range events {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO event_outbox (event_id, event_type, invoice_id, payload) VALUES ($1, $2, $3, $4)", e.ID, e.Type, e.Invoice.ID, string(payload))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryBackoff returns the delay before the next attempt after the given number of failed attempts.
+func retryBackoff(attempts int) time.Duration {
+	delay := retryMinBackoff
+	for n := 1; n < attempts && delay < retryMaxBackoff; n++ {
+		delay *= 2
+	}
+	if delay > retryMaxBackoff {
+		delay = retryMaxBackoff
+	}
+	return delay
+}
+
+// OutboxRelay publishes the events of the outbox in the order they were written.
+type OutboxRelay struct {
+	DbInfos   DbConnexionInfo
+	Publisher Publisher
+	BatchSize int
+	// Durée de conservation des événements publiés
+	Retention time.Duration
+	// Un événement est bloqué après StuckAttempts échecs, ou s'il attend depuis plus de StuckAfter
+	StuckAttempts int
+	StuckAfter    time.Duration
+	// Durée maximale d'un passage, le verrou et la transaction ne restent pas ouverts au-delà
+	RelayTimeout time.Duration
+}
+
+func NewOutboxRelay(dbinfos DbConnexionInfo, publisher Publisher) *OutboxRelay {
+	return &OutboxRelay{
+		DbInfos:       dbinfos,
+		Publisher:     publisher,
+		BatchSize:     100,
+		Retention:     7 * 24 * time.Hour,
+		StuckAttempts: 5,
+		StuckAfter:    15 * time.Minute,
+		RelayTimeout:  30 * time.Second,
+	}
+}
+
+// Relay publishes the pending events and marks them sent, it returns the number of events published.
+// An event that cannot be published is retried later with an exponential backoff, and the events
+// written after it wait for it so they are never delivered out of order. The delivery is at least
+// once : an event is published again if it cannot be marked sent, the consumers ignore duplicates
+// with the ID of the event. A run stops publishing after RelayTimeout, the remaining events are
+// published by the next run.
+func (r *OutboxRelay) Relay(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.RelayTimeout)
+	defer cancel()
+
+	db := GetDbConnexion(r.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Si le relais est bloqué au-delà du délai, Postgres ferme la transaction et libère le verrou
+	if _, err := tx.Exec(fmt.Sprintf("SET LOCAL idle_in_transaction_session_timeout = %d", (r.RelayTimeout + 10*time.Second).Milliseconds())); err != nil {
+		return 0, err
+	}
+
+	locked := false
+	if err := tx.Get(&locked, "SELECT pg_try_advisory_xact_lock($1)", outboxLock); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	entries := make([]OutboxEntry, 0)
+	err = tx.Select(&entries, "SELECT "+outboxColumns+" FROM event_outbox WHERE sent_at IS NULL ORDER BY outbox_id LIMIT $1", r.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, e := range entries {
+		if e.NextAttemptAt.After(time.Now()) || ctx.Err() != nil {
+			break
+		}
+
+		if err := r.deliver(ctx, e); err != nil {
+			// Le passage a duré trop longtemps, l'événement sera publié par le suivant sans compter un échec
+			if ctx.Err() != nil {
+				break
+			}
+			_, err = tx.Exec("UPDATE event_outbox SET attempts = attempts + 1, last_error = $1, next_attempt_at = $2 WHERE outbox_id=$3",
+				err.Error(), time.Now().Add(retryBackoff(e.Attempts+1)), e.ID)
+			if err != nil {
+				return 0, err
+			}
+			break
+		}
+
+		if _, err := tx.Exec("UPDATE event_outbox SET sent_at = now(), attempts = attempts + 1, last_error = '' WHERE outbox_id=$1", e.ID); err != nil {
+			return 0, err
+		}
+		sent++
+	}
+
+	if _, err := tx.Exec("DELETE FROM event_outbox WHERE sent_at < $1", time.Now().Add(-r.Retention)); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return sent, nil
+}
+
+func (r *OutboxRelay) deliver(ctx context.Context, e OutboxEntry) error {
+	var event Event
+	if err := json.Unmarshal([]byte(e.Payload), &event); err != nil {
+		return err
+	}
+	return r.Publisher.Publish(ctx, event)
+}
+
+// Stuck returns the unsent events that failed StuckAttempts times or were written more than
+// StuckAfter ago, oldest first.
+func (r *OutboxRelay) Stuck(ctx context.Context) ([]OutboxEntry, error) {
+	db := GetDbConnexion(r.DbInfos)
+	defer db.Close()
+
+	entries := make([]OutboxEntry, 0)
+	err := db.Select(&entries, "SELECT "+outboxColumns+" FROM event_outbox WHERE sent_at IS NULL AND (attempts >= $1 OR created_at < $2) ORDER BY outbox_id",
+		r.StuckAttempts, time.Now().Add(-r.StuckAfter))
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Retry makes the relay publish the event on its next run, without waiting for the backoff.
+func (r *OutboxRelay) Retry(ctx context.Context, id int64) error {
+	db := GetDbConnexion(r.DbInfos)
+	defer db.Close()
+
+	res, err := db.Exec("UPDATE event_outbox SET next_attempt_at = now() WHERE outbox_id=$1 AND sent_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		if err != nil {
+			return err
+		}
+		return ErrOutboxEntryNotFound
+	}
+	return nil
+}
+
+// Schedule relays the events every interval until ctx is done, a run publishes every pending event.
+func (r *OutboxRelay) Schedule(ctx context.Context, interval time.Duration, logger log.Logger) {
+	RunEvery(ctx, interval, func(ctx context.Context) {
+		for {
+			sent, err := r.Relay(ctx)
+			if err != nil {
+				logger.Log("outbox", "failed", "err", err)
+				return
+			}
+			if sent > 0 {
+				logger.Log("outbox", "relayed", "events", sent)
+			}
+			if sent < r.BatchSize {
+				return
+			}
+		}
+	})
+}
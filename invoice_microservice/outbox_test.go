@@ -0,0 +1,47 @@
+package invoice_microservice
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	expected := map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		4:  80 * time.Second,
+		10: time.Hour,
+		50: time.Hour,
+	}
+	for attempts, delay := range expected {
+		if d := retryBackoff(attempts); d != delay {
+			t.Errorf("Expected %v after %d attempts, got %v", delay, attempts, d)
+		}
+	}
+}
+
+func TestOutboxDeliver(t *testing.T) {
+	event := NewEvent(InvoicePaid, Invoice{ID: "c1g2", Amount: 10, PaidAmount: 10, State: PAID}, 10)
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make([]Event, 0)
+	p := NewInProcessPublisher()
+	p.Subscribe(func(_ context.Context, e Event) { received = append(received, e) })
+
+	relay := NewOutboxRelay(DbConnexionInfo{}, p)
+	if err := relay.deliver(context.Background(), OutboxEntry{ID: 1, EventID: event.ID, Payload: string(payload)}); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || received[0].ID != event.ID || received[0].Invoice.ID != "c1g2" || !received[0].OccurredAt.Equal(event.OccurredAt) {
+		t.Errorf("Expected the event of the entry, got %+v", received)
+	}
+
+	if err := relay.deliver(context.Background(), OutboxEntry{ID: 2, Payload: "{"}); err == nil {
+		t.Error("Expected an invalid payload to fail")
+	}
+}
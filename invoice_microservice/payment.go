@@ -0,0 +1,124 @@
+package invoice_microservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrPaymentTooLarge   = errors.New("payment exceeds the amount left to pay on the invoice")
+	ErrPayByInstallments = errors.New("invoice has an installment plan, its installments must be paid one by one")
+)
+
+// payable returns true if a payment can still be made on an invoice in the given state.
+func payable(state int) bool {
+	return state == PENDING || state == EXPIRED || state == PARTIALLY_PAID
+}
+
+// payInvoiceAmount pays amount on the invoice inside tx, a zero amount pays everything left minus the
+// early payment discount if the invoice is paid before the discount deadline. It returns the invoice
+// and the amount paid, 0 when the discount settles the invoice on its own.
+// The invoice row stays locked until the end of the transaction so concurrent payments of the
+// same invoice are serialized and cannot pay it twice.
+func payInvoiceAmount(tx *sqlx.Tx, id string, amount float64) (Invoice, float64, error) {
+	invoice := Invoice{}
+	if err := tx.Get(&invoice, "SELECT * FROM invoice WHERE invoice_id=$1 FOR UPDATE", id); err != nil {
+		if err == sql.ErrNoRows {
+			return Invoice{}, 0, ErrNotFound
+		}
+		return Invoice{}, 0, err
+	}
+	if !payable(invoice.State) {
+		return Invoice{}, 0, ErrAlreadyPaid
+	}
+
+	left := invoice.Remaining()
+	discount := float64(0.0)
+	if amount == 0 {
+		discount = invoice.EarlyPaymentDiscount(time.Now())
+		amount = roundCents(left - discount)
+	}
+	amount = roundCents(amount)
+	if amount > left {
+		return Invoice{}, 0, ErrPaymentTooLarge
+	}
+
+	label := "Paiement facture " + invoice.ID
+	if discount > 0 {
+		label += fmt.Sprintf(" (escompte %v %%)", invoice.DiscountRate)
+	}
+
+	// Le débit du payeur et le crédit du receveur sont écrits dans le grand livre. Quand l'escompte
+	// couvre tout ce qui reste il n'y a rien à transférer, la facture est soldée par l'escompte.
+	if amount > 0 || discount == 0 {
+		if _, err := postTransfer(tx, invoice.AccountPayerId, invoice.AccountReceiverId, amount, invoice.ID, label); err != nil {
+			return Invoice{}, 0, err
+		}
+	}
+
+	invoice.PaidAmount = roundCents(invoice.PaidAmount + amount)
+	invoice.DiscountAmount = discount
+	invoice.State = PARTIALLY_PAID
+	if invoice.Remaining() == 0 {
+		invoice.State = PAID
+	}
+
+	_, err := tx.Exec("UPDATE invoice SET invoice_paid_amount = $1, invoice_discount_amount = $2, invoice_state = $3 WHERE invoice_id=$4", invoice.PaidAmount, invoice.DiscountAmount, invoice.State, invoice.ID)
+	if err != nil {
+		return Invoice{}, 0, err
+	}
+
+	return invoice, amount, nil
+}
+
+// PayInvoicePartially pays a portion of the invoice, the invoice stays PARTIALLY_PAID until the
+// payments cover its whole amount.
+func (s *invoiceService) PayInvoicePartially(ctx context.Context, id string, amount float64) (Invoice, error) {
+	if id == "" {
+		return Invoice{}, ErrNotAnId
+	}
+	if amount <= 0 {
+		return Invoice{}, ErrInvalidAmount
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return Invoice{}, err
+	}
+	defer tx.Rollback()
+
+	installments := 0
+	if err := tx.Get(&installments, "SELECT COUNT(*) FROM installment WHERE invoice_id=$1", id); err != nil {
+		return Invoice{}, err
+	}
+	if installments > 0 {
+		return Invoice{}, ErrPayByInstallments
+	}
+
+	invoice, amount, err := payInvoiceAmount(tx, id, amount)
+	if err != nil {
+		return Invoice{}, err
+	}
+	if err := enqueueEvents(tx, paymentEvent(invoice, amount)); err != nil {
+		return Invoice{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Invoice{}, err
+	}
+
+	return invoice, nil
+}
+
+// Remaining returns the amount left to pay on the invoice.
+func (i Invoice) Remaining() float64 {
+	return roundCents(i.Amount - i.PaidAmount - i.DiscountAmount)
+}
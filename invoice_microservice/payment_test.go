@@ -0,0 +1,342 @@
+package invoice_microservice
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/xid"
+)
+
+// moneyTestData holds two accounts created for the test, they are removed with everything
+// written for them once the test is over.
+type moneyTestData struct {
+	TestData
+	db       *sqlx.DB
+	payer    string
+	receiver string
+}
+
+// newMoneyTestData creates a payer with payerBalance and a receiver without money. The test is
+// skipped when the test database cannot be reached.
+func newMoneyTestData(t *testing.T, payerBalance float64) moneyTestData {
+	testData := NewTestData()
+	info := testData.s.(*invoiceService).DbInfos
+
+	db, err := sqlx.Connect("postgres", "port="+info.DbPort+" user="+info.Username+" password="+info.Password+" dbname="+info.DbName+" sslmode=disable")
+	if err != nil {
+		t.Skip("test database unavailable : " + err.Error())
+	}
+	if err := CreateSchema(info); err != nil {
+		t.Fatal(err)
+	}
+
+	data := moneyTestData{testData, db, xid.New().String(), xid.New().String()}
+	for _, a := range []struct {
+		id      string
+		balance float64
+	}{{data.payer, payerBalance}, {data.receiver, 0}} {
+		_, err := db.Exec("INSERT INTO account (client_id, name, surname, mail_adress, phone_number, account_amount) VALUES ($1, 'Test', $1, $1 || '@example.com', '', $2)", a.id, a.balance)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Cleanup(func() {
+		invoices := "(SELECT invoice_id FROM invoice WHERE account_invoice_payer_id = $1)"
+		for _, table := range []string{"ledger_entry", "credit_note", "installment", "invoice_line_item", "invoice_tax_breakdown", "event_outbox"} {
+			db.Exec("DELETE FROM "+table+" WHERE invoice_id IN "+invoices, data.payer)
+		}
+		db.Exec("DELETE FROM invoice WHERE account_invoice_payer_id = $1", data.payer)
+		db.Exec("DELETE FROM invoice_sequence WHERE issuer_id = $1", data.receiver)
+		db.Exec("DELETE FROM account WHERE client_id IN ($1, $2)", data.payer, data.receiver)
+		db.Close()
+	})
+	return data
+}
+
+func (d moneyTestData) createInvoice(t *testing.T, amount float64) Invoice {
+	invoice, err := d.s.Create(context.TODO(), Invoice{
+		Amount:            amount,
+		State:             PENDING,
+		ExpirationDate:    time.Now().AddDate(0, 1, 0).Format("2006-01-02"),
+		AccountPayerId:    d.payer,
+		AccountReceiverId: d.receiver,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return invoice
+}
+
+func (d moneyTestData) balance(t *testing.T, clientID string) float64 {
+	balance := float64(0.0)
+	if err := d.db.Get(&balance, "SELECT account_amount FROM account WHERE client_id=$1", clientID); err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+// checkLedger checks that the ledger of every account sums up to the movements of its balance.
+func (d moneyTestData) checkLedger(t *testing.T, payerMoved float64, receiverMoved float64) {
+	for clientID, moved := range map[string]float64{d.payer: payerMoved, d.receiver: receiverMoved} {
+		total := float64(0.0)
+		err := d.db.Get(&total, "SELECT COALESCE(SUM(CASE WHEN entry_type = 'CREDIT' THEN entry_amount ELSE -entry_amount END), 0) FROM ledger_entry WHERE client_id=$1", clientID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if roundCents(total) != moved {
+			t.Errorf("Expected the ledger of %s to sum up to %v, got %v", clientID, moved, total)
+		}
+	}
+
+	unbalanced := 0
+	err := d.db.Get(&unbalanced, `SELECT COUNT(*) FROM (SELECT transaction_id FROM ledger_entry WHERE client_id IN ($1, $2)
+		GROUP BY transaction_id HAVING SUM(CASE WHEN entry_type = 'CREDIT' THEN entry_amount ELSE -entry_amount END) <> 0) t`, d.payer, d.receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unbalanced != 0 {
+		t.Errorf("Expected every transaction to be balanced, %d are not", unbalanced)
+	}
+}
+
+func TestPartialPayments(t *testing.T) {
+	d := newMoneyTestData(t, 100)
+	invoice := d.createInvoice(t, 80)
+
+	paid, err := d.s.PayInvoicePartially(context.TODO(), invoice.ID, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paid.State != PARTIALLY_PAID || paid.PaidAmount != 30 || paid.Remaining() != 50 {
+		t.Errorf("Expected 50 left to pay on a partially paid invoice, got %+v", paid)
+	}
+
+	if _, err := d.s.PayInvoicePartially(context.TODO(), invoice.ID, 50.01); err != ErrPaymentTooLarge {
+		t.Errorf("Paid more than what is left, should have raised ErrPaymentTooLarge, got %v", err)
+	}
+
+	if ok, err := d.s.PayInvoice(context.TODO(), invoice.ID); !ok || err != nil {
+		t.Fatalf("Expected the rest of the invoice to be paid, got %v", err)
+	}
+	if read, _ := d.s.Read(context.TODO(), invoice.ID); read.State != PAID || read.PaidAmount != 80 {
+		t.Errorf("Expected a paid invoice, got %+v", read)
+	}
+	if _, err := d.s.PayInvoicePartially(context.TODO(), invoice.ID, 1); err != ErrAlreadyPaid {
+		t.Errorf("Paid a paid invoice, should have raised ErrAlreadyPaid, got %v", err)
+	}
+
+	if d.balance(t, d.payer) != 20 || d.balance(t, d.receiver) != 80 {
+		t.Errorf("Expected balances of 20 and 80, got %v and %v", d.balance(t, d.payer), d.balance(t, d.receiver))
+	}
+	d.checkLedger(t, -80, 80)
+}
+
+func TestInsufficientBalance(t *testing.T) {
+	d := newMoneyTestData(t, 10)
+	invoice := d.createInvoice(t, 50)
+
+	_, err := d.s.PayInvoicePartially(context.TODO(), invoice.ID, 20)
+	if err != ErrInsufficientBalance {
+		t.Fatalf("Paid more than the balance, should have raised ErrInsufficientBalance, got %v", err)
+	}
+	if codeFrom(err) != http.StatusPaymentRequired {
+		t.Errorf("Expected a 402 for an insufficient balance, got %d", codeFrom(err))
+	}
+
+	if read, _ := d.s.Read(context.TODO(), invoice.ID); read.State != PENDING || read.PaidAmount != 0 {
+		t.Errorf("The refused payment should have left the invoice untouched, got %+v", read)
+	}
+	if d.balance(t, d.payer) != 10 {
+		t.Errorf("The refused payment should have left the balance untouched, got %v", d.balance(t, d.payer))
+	}
+	d.checkLedger(t, 0, 0)
+}
+
+func TestRefunds(t *testing.T) {
+	d := newMoneyTestData(t, 100)
+	invoice := d.createInvoice(t, 60)
+
+	if _, err := d.s.RefundInvoice(context.TODO(), invoice.ID, 0, "Erreur"); err != ErrNotRefundable {
+		t.Errorf("Refunded an unpaid invoice, should have raised ErrNotRefundable, got %v", err)
+	}
+	if _, err := d.s.PayInvoice(context.TODO(), invoice.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	note, err := d.s.RefundInvoice(context.TODO(), invoice.ID, 25, "Geste commercial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Amount != 25 || note.TransactionID == "" || note.Date == "" {
+		t.Errorf("Unexpected credit note %+v", note)
+	}
+	if read, _ := d.s.Read(context.TODO(), invoice.ID); read.State != PARTIALLY_REFUNDED {
+		t.Errorf("Expected a partially refunded invoice, got %+v", read)
+	}
+
+	if _, err := d.s.RefundInvoice(context.TODO(), invoice.ID, 35.01, ""); err != ErrRefundTooLarge {
+		t.Errorf("Refunded more than what was paid, should have raised ErrRefundTooLarge, got %v", err)
+	}
+
+	if _, err := d.s.RefundInvoice(context.TODO(), invoice.ID, 0, "Annulation"); err != nil {
+		t.Fatal(err)
+	}
+	if read, _ := d.s.Read(context.TODO(), invoice.ID); read.State != REFUNDED {
+		t.Errorf("Expected a refunded invoice, got %+v", read)
+	}
+	notes, err := d.s.GetCreditNotes(context.TODO(), invoice.ID)
+	if err != nil || len(notes) != 2 || notes[0].Amount+notes[1].Amount != 60 {
+		t.Errorf("Expected two credit notes for 60, got %+v %v", notes, err)
+	}
+
+	if d.balance(t, d.payer) != 100 || d.balance(t, d.receiver) != 0 {
+		t.Errorf("Expected the payment to be given back, got %v and %v", d.balance(t, d.payer), d.balance(t, d.receiver))
+	}
+	d.checkLedger(t, 0, 0)
+}
+
+func TestInstallments(t *testing.T) {
+	d := newMoneyTestData(t, 100)
+	invoice := d.createInvoice(t, 90)
+	first := time.Now().AddDate(0, 1, 0)
+
+	plan := []Installment{
+		{DueDate: first.Format("2006-01-02"), Amount: 30},
+		{DueDate: first.AddDate(0, 1, 0).Format("2006-01-02"), Amount: 60},
+	}
+	if _, err := d.s.SetInstallmentPlan(context.TODO(), invoice.ID, d.payer, plan); err != ErrNotIssuer {
+		t.Errorf("The payer set the plan, should have raised ErrNotIssuer, got %v", err)
+	}
+	if _, err := d.s.SetInstallmentPlan(context.TODO(), invoice.ID, d.receiver, plan[:1]); err != ErrInstallmentsDontAddUp {
+		t.Errorf("Installments do not cover the invoice, should have raised ErrInstallmentsDontAddUp, got %v", err)
+	}
+	installments, err := d.s.SetInstallmentPlan(context.TODO(), invoice.ID, d.receiver, plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.s.PayInvoicePartially(context.TODO(), invoice.ID, 10); err != ErrPayByInstallments {
+		t.Errorf("Paid an invoice split in installments, should have raised ErrPayByInstallments, got %v", err)
+	}
+
+	paid, err := d.s.PayInstallment(context.TODO(), installments[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paid.State != PAID || paid.PaidDate == "" {
+		t.Errorf("Expected a paid installment, got %+v", paid)
+	}
+	if _, err := d.s.PayInstallment(context.TODO(), installments[0].ID); err != ErrInstallmentAlreadyPaid {
+		t.Errorf("Paid an installment twice, should have raised ErrInstallmentAlreadyPaid, got %v", err)
+	}
+	if read, _ := d.s.Read(context.TODO(), invoice.ID); read.State != PARTIALLY_PAID || read.Remaining() != 60 {
+		t.Errorf("Expected 60 left to pay, got %+v", read)
+	}
+
+	// Le paiement complet solde aussi les échéances restantes
+	if _, err := d.s.PayInvoice(context.TODO(), invoice.ID); err != nil {
+		t.Fatal(err)
+	}
+	left, err := d.s.GetInstallments(context.TODO(), invoice.ID)
+	if err != nil || left[1].State != PAID {
+		t.Errorf("Expected the second installment to be paid, got %+v %v", left, err)
+	}
+
+	if d.balance(t, d.payer) != 10 || d.balance(t, d.receiver) != 90 {
+		t.Errorf("Expected balances of 10 and 90, got %v and %v", d.balance(t, d.payer), d.balance(t, d.receiver))
+	}
+	d.checkLedger(t, -90, 90)
+}
+
+func TestRefundPartiallyPaid(t *testing.T) {
+	d := newMoneyTestData(t, 100)
+	invoice := d.createInvoice(t, 80)
+
+	if _, err := d.s.PayInvoicePartially(context.TODO(), invoice.ID, 30); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.s.RefundInvoice(context.TODO(), invoice.ID, 30.01, ""); err != ErrRefundTooLarge {
+		t.Errorf("Refunded more than what was paid, should have raised ErrRefundTooLarge, got %v", err)
+	}
+
+	note, err := d.s.RefundInvoice(context.TODO(), invoice.ID, 0, "Commande annulée")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Amount != 30 {
+		t.Errorf("Expected the 30 paid to be refunded, got %+v", note)
+	}
+	if read, _ := d.s.Read(context.TODO(), invoice.ID); read.State != REFUNDED {
+		t.Errorf("Expected a refunded invoice, got %+v", read)
+	}
+	if _, err := d.s.PayInvoicePartially(context.TODO(), invoice.ID, 10); err != ErrAlreadyPaid {
+		t.Errorf("Paid a refunded invoice, should have raised ErrAlreadyPaid, got %v", err)
+	}
+
+	// Les 50 restant à payer sont annulés par un avoir sans transaction
+	notes, err := d.s.GetCreditNotes(context.TODO(), invoice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled := float64(0.0)
+	for _, n := range notes {
+		if n.TransactionID == "" {
+			cancelled += n.Amount
+		}
+	}
+	if len(notes) != 2 || cancelled != 50 {
+		t.Errorf("Expected a refund and the cancellation of the 50 left to pay, got %+v", notes)
+	}
+
+	if d.balance(t, d.payer) != 100 || d.balance(t, d.receiver) != 0 {
+		t.Errorf("Expected the payment to be given back, got %v and %v", d.balance(t, d.payer), d.balance(t, d.receiver))
+	}
+	d.checkLedger(t, 0, 0)
+}
+
+func TestDiscountSettlesInvoice(t *testing.T) {
+	d := newMoneyTestData(t, 100)
+	invoice, err := d.s.Create(context.TODO(), Invoice{
+		Amount:            50,
+		State:             PENDING,
+		ExpirationDate:    time.Now().AddDate(0, 1, 0).Format("2006-01-02"),
+		AccountPayerId:    d.payer,
+		AccountReceiverId: d.receiver,
+		DiscountRate:      50,
+		DiscountDeadline:  time.Now().AddDate(0, 0, 10).Format("2006-01-02"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.s.PayInvoicePartially(context.TODO(), invoice.ID, 49.99); err != nil {
+		t.Fatal(err)
+	}
+	// L'escompte de 50% sur le centime restant est arrondi à un centime, il n'y a plus rien à payer
+	if ok, err := d.s.PayInvoice(context.TODO(), invoice.ID); !ok || err != nil {
+		t.Fatalf("Expected the discount to settle the invoice, got %v", err)
+	}
+	read, _ := d.s.Read(context.TODO(), invoice.ID)
+	if read.State != PAID || read.PaidAmount != 49.99 || read.DiscountAmount != 0.01 {
+		t.Errorf("Expected an invoice settled by its discount, got %+v", read)
+	}
+	d.checkLedger(t, -49.99, 49.99)
+}
+
+func TestUpdateNumberedInvoice(t *testing.T) {
+	d := newMoneyTestData(t, 100)
+	invoice := d.createInvoice(t, 80)
+
+	changed := invoice
+	changed.Amount = 60
+	if _, err := d.s.Update(context.TODO(), invoice.ID, changed); err != ErrNotEditable {
+		t.Errorf("Changed a numbered invoice, should have raised ErrNotEditable, got %v", err)
+	}
+	if read, _ := d.s.Read(context.TODO(), invoice.ID); read.Amount != 80 {
+		t.Errorf("Expected the invoice to be left unchanged, got %+v", read)
+	}
+}
@@ -0,0 +1,188 @@
+package invoice_microservice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+var (
+	ErrNoPayment = errors.New("no payment was made on this invoice")
+)
+
+// PDFTemplate describes a document. Body is executed with an InvoiceDocument, each line it produces
+// is written on the document, lines starting with "## " are written as headings.
+type PDFTemplate struct {
+	Title  string
+	Body   *template.Template
+	Footer string
+}
+
+var pdfFuncs = template.FuncMap{
+	"money": func(amount float64) string {
+		return strings.Replace(fmt.Sprintf("%.2f €", amount), ".", ",", 1)
+	},
+	"date": func(t time.Time) string {
+		return t.Format("02/01/2006")
+	},
+}
+
+// NewPDFTemplate parses body, the functions money and date are available in the template.
+func NewPDFTemplate(title string, body string, footer string) (PDFTemplate, error) {
+	t, err := template.New(title).Funcs(pdfFuncs).Parse(body)
+	if err != nil {
+		return PDFTemplate{}, err
+	}
+	return PDFTemplate{Title: title, Body: t, Footer: footer}, nil
+}
+
+// InvoiceDocument holds everything a template can show.
+type InvoiceDocument struct {
+	Invoice  Invoice
+	State    string
+	Issuer   AccountInfo
+	Payer    AccountInfo
+	Items    []LineItem
+	Taxes    []TaxBreakdown
+	LateFees []LateFee
+	Payments []LedgerEntry
+	Date     time.Time
+}
+
+const defaultInvoiceBody = `## Émetteur
+{{.Issuer.Name}} {{.Issuer.Surname}}
+{{.Issuer.Mail}}
+{{.Issuer.Phone}}
+## Destinataire
+{{.Payer.Name}} {{.Payer.Surname}}
+{{.Payer.Mail}}
+{{.Payer.Phone}}
+## Facture {{.Invoice.Reference}}
+{{if .Invoice.Number}}Référence interne : {{.Invoice.ID}}
+{{end}}Date : {{date .Date}}
+État : {{.State}}
+Date d'échéance : {{.Invoice.ExpirationDate}}
+{{range .Items}}{{.Position}}. {{.Description}} : {{.Quantity}} x {{money .UnitPrice}}{{if .Discount}}, remise {{.Discount}} %{{end}}, TVA {{.TaxRate}} % : {{money .Total}}
+{{end}}{{range .Taxes}}TVA {{.Rate}} % sur {{money .Net}} : {{money .Tax}}
+{{end}}{{range .LateFees}}Pénalité de retard ({{.Type}}, {{.DaysLate}} jours) : {{money .Amount}}
+{{end}}Montant : {{money .Invoice.Amount}}
+Déjà payé : {{money .Invoice.PaidAmount}}
+Reste à payer : {{money .Invoice.Remaining}}
+{{if .Invoice.DiscountDeadline}}Escompte de {{.Invoice.DiscountRate}} % pour un paiement complet avant le {{.Invoice.DiscountDeadline}}
+{{end}}`
+
+const defaultReceiptBody = `## Reçu de paiement
+Facture {{.Invoice.Reference}}
+Date : {{date .Date}}
+## Payé par
+{{.Payer.Name}} {{.Payer.Surname}}
+{{.Payer.Mail}}
+## Payé à
+{{.Issuer.Name}} {{.Issuer.Surname}}
+{{.Issuer.Mail}}
+## Paiements
+{{range .Payments}}{{.Date}} : {{money .Amount}} (transaction {{.TransactionID}})
+{{end}}{{if .Invoice.DiscountAmount}}Escompte accordé : {{money .Invoice.DiscountAmount}}
+{{end}}Montant de la facture : {{money .Invoice.Amount}}
+Total payé : {{money .Invoice.PaidAmount}}
+État : {{.State}}
+`
+
+// PDFRenderer renders invoices and payment receipts.
+type PDFRenderer struct {
+	Invoice PDFTemplate
+	Receipt PDFTemplate
+	// Les tests désactivent la compression pour lire le texte du document
+	compress bool
+}
+
+func NewPDFRenderer(invoice PDFTemplate, receipt PDFTemplate) *PDFRenderer {
+	return &PDFRenderer{
+		Invoice:  invoice,
+		Receipt:  receipt,
+		compress: true,
+	}
+}
+
+func DefaultPDFRenderer() *PDFRenderer {
+	invoice, err := NewPDFTemplate("Facture", defaultInvoiceBody, "Document généré par le service de facturation")
+	if err != nil {
+		panic(err)
+	}
+	receipt, err := NewPDFTemplate("Reçu", defaultReceiptBody, "Document généré par le service de facturation")
+	if err != nil {
+		panic(err)
+	}
+	return NewPDFRenderer(invoice, receipt)
+}
+
+func (r *PDFRenderer) RenderInvoice(w io.Writer, doc InvoiceDocument) error {
+	return r.render(w, r.Invoice, doc, nil)
+}
+
+func (r *PDFRenderer) RenderReceipt(w io.Writer, doc InvoiceDocument) error {
+	return r.render(w, r.Receipt, doc, nil)
+}
+
+// RenderFacturX renders the invoice with its CII XML attached as factur-x.xml. gofpdf cannot write
+// a PDF/A-3 and the attachment has no AFRelationship, so the document does not claim to be Factur-X.
+func (r *PDFRenderer) RenderFacturX(w io.Writer, doc InvoiceDocument) error {
+	var cii bytes.Buffer
+	if err := WriteCII(&cii, doc); err != nil {
+		return err
+	}
+
+	return r.render(w, r.Invoice, doc, func(pdf *gofpdf.Fpdf) {
+		pdf.SetAttachments([]gofpdf.Attachment{{
+			Content:     cii.Bytes(),
+			Filename:    "factur-x.xml",
+			Description: "CII invoice",
+		}})
+	})
+}
+
+// render writes the document, setup is called on the PDF before the first page when it is not nil.
+func (r *PDFRenderer) render(w io.Writer, t PDFTemplate, doc InvoiceDocument, setup func(*gofpdf.Fpdf)) error {
+	var body bytes.Buffer
+	if err := t.Body.Execute(&body, doc); err != nil {
+		return err
+	}
+
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetCompression(r.compress)
+	if setup != nil {
+		setup(pdf)
+	}
+	pdf.SetTitle(t.Title, true)
+	// Les polices standard sont encodées en cp1252, qui couvre les accents et le signe euro
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-15)
+		pdf.SetFont("Helvetica", "I", 8)
+		pdf.CellFormat(0, 10, tr(t.Footer), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.CellFormat(0, 12, tr(t.Title), "", 1, "L", false, 0, "")
+
+	for _, line := range strings.Split(strings.TrimRight(body.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "## ") {
+			pdf.Ln(3)
+			pdf.SetFont("Helvetica", "B", 12)
+			pdf.MultiCell(0, 7, tr(strings.TrimPrefix(line, "## ")), "", "L", false)
+			continue
+		}
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.MultiCell(0, 5, tr(line), "", "L", false)
+	}
+
+	return pdf.Output(w)
+}
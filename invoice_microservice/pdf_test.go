@@ -0,0 +1,109 @@
+package invoice_microservice
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var pdfText = regexp.MustCompile(`\(((?:\\.|[^\\)])*)\) ?Tj`)
+
+// pdfStrings returns the text shown on an uncompressed PDF document, decoded from cp1252.
+func pdfStrings(content []byte) []string {
+	strs := make([]string, 0)
+	for _, m := range pdfText.FindAllSubmatch(content, -1) {
+		var sb strings.Builder
+		escaped := false
+		for _, b := range m[1] {
+			if b == '\\' && !escaped {
+				escaped = true
+				continue
+			}
+			escaped = false
+			switch {
+			case b == 0x80:
+				sb.WriteRune('€')
+			default:
+				// Les caractères accentués de cp1252 ont le même code qu'en latin-1
+				sb.WriteRune(rune(b))
+			}
+		}
+		strs = append(strs, sb.String())
+	}
+	return strs
+}
+
+func testDocument() InvoiceDocument {
+	return InvoiceDocument{
+		Invoice: Invoice{ID: "c1g2", Amount: 1234.5, PaidAmount: 1000, State: PARTIALLY_PAID, ExpirationDate: "2021-04-29"},
+		State:   StateToString(PARTIALLY_PAID),
+		Issuer:  AccountInfo{Name: "Jean", Surname: "Dupont", Mail: "jean@dupont.fr"},
+		Payer:   AccountInfo{Name: "Hélène", Surname: "Martin (SARL)", Mail: "helene@martin.fr"},
+		Items:   []LineItem{{Position: 1, Description: "Conseil", Quantity: 2, UnitPrice: 514.38, TaxRate: 20, Total: 1234.51}},
+		Payments: []LedgerEntry{
+			{TransactionID: "t1", Type: DEBIT, Amount: 1000, Date: "2021-04-10"},
+		},
+		Date: time.Date(2021, 4, 12, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func assertContains(t *testing.T, strs []string, expected ...string) {
+	t.Helper()
+	for _, e := range expected {
+		found := false
+		for _, s := range strs {
+			if strings.Contains(s, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("%q not found in %q", e, strs)
+		}
+	}
+}
+
+func TestInvoicePDF(t *testing.T) {
+	r := DefaultPDFRenderer()
+	r.compress = false
+
+	var buf bytes.Buffer
+	if err := r.RenderInvoice(&buf, testDocument()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("%PDF-")) {
+		t.Fatal("Not a PDF document")
+	}
+
+	assertContains(t, pdfStrings(buf.Bytes()),
+		"Facture", "Jean Dupont", "jean@dupont.fr", "Hélène Martin (SARL)",
+		"Date : 12/04/2021", "État : Partially paid", "Date d'échéance : 2021-04-29",
+		"1. Conseil : 2 x 514,38 €, TVA 20 % : 1234,51 €",
+		"Montant : 1234,50 €", "Reste à payer : 234,50 €",
+	)
+
+	var receipt bytes.Buffer
+	if err := r.RenderReceipt(&receipt, testDocument()); err != nil {
+		t.Fatal(err)
+	}
+	assertContains(t, pdfStrings(receipt.Bytes()),
+		"Reçu de paiement", "Facture c1g2", "2021-04-10 : 1000,00 € (transaction t1)", "Total payé : 1000,00 €",
+	)
+}
+
+func TestCustomPDFTemplate(t *testing.T) {
+	tmpl, err := NewPDFTemplate("Invoice", "Amount due: {{money .Invoice.Remaining}}\n", "Thank you")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewPDFRenderer(tmpl, tmpl)
+	r.compress = false
+
+	var buf bytes.Buffer
+	if err := r.RenderInvoice(&buf, testDocument()); err != nil {
+		t.Fatal(err)
+	}
+	assertContains(t, pdfStrings(buf.Bytes()), "Invoice", "Amount due: 234,50 €", "Thank you")
+}
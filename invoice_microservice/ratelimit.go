@@ -0,0 +1,335 @@
+package invoice_microservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	// ErrRateLimited is returned when a client or an IP has exhausted its token bucket.
+	ErrRateLimited = errors.New("too many requests")
+)
+
+// RateLimit describes a token bucket : Burst tokens at most, refilled at Rate tokens per second.
+// A zero Rate or Burst disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// RateLimitRule applies two buckets to an operation, one keyed by client ID and one keyed by IP.
+type RateLimitRule struct {
+	PerClient RateLimit
+	PerIP     RateLimit
+}
+
+type RateLimitConfig struct {
+	Create RateLimitRule
+	Pay    RateLimitRule
+	List   RateLimitRule
+	// Si TrustForwardedFor est à true l'IP du client est lue dans X-Forwarded-For (service derrière un proxy)
+	TrustForwardedFor bool
+}
+
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Create: RateLimitRule{
+			PerClient: RateLimit{Rate: 1, Burst: 20},
+			PerIP:     RateLimit{Rate: 2, Burst: 40},
+		},
+		Pay: RateLimitRule{
+			PerClient: RateLimit{Rate: 1, Burst: 10},
+			PerIP:     RateLimit{Rate: 2, Burst: 20},
+		},
+		List: RateLimitRule{
+			PerClient: RateLimit{Rate: 5, Burst: 50},
+			PerIP:     RateLimit{Rate: 10, Burst: 100},
+		},
+	}
+}
+
+var errInvalidRateLimit = errors.New("invalid rate limit, expected rate/burst")
+
+// ParseRateLimit reads a limit written "rate/burst", for instance "2/40" for 40 requests at most
+// refilled at 2 per second. "0/0" disables the limit.
+func ParseRateLimit(s string) (RateLimit, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return RateLimit{}, errInvalidRateLimit
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return RateLimit{}, errInvalidRateLimit
+	}
+	burst, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || burst < 0 {
+		return RateLimit{}, errInvalidRateLimit
+	}
+	return RateLimit{Rate: rate, Burst: burst}, nil
+}
+
+// LoadEnv overrides the limits with the INVOICE_RATELIMIT_<CREATE|PAY|LIST>_<CLIENT|IP> variables
+// and INVOICE_RATELIMIT_TRUST_FORWARDED_FOR read with getenv. Unset variables keep their limit.
+func (c *RateLimitConfig) LoadEnv(getenv func(string) string) error {
+	rules := map[string]*RateLimitRule{"CREATE": &c.Create, "PAY": &c.Pay, "LIST": &c.List}
+	for name, rule := range rules {
+		limits := map[string]*RateLimit{"CLIENT": &rule.PerClient, "IP": &rule.PerIP}
+		for scope, limit := range limits {
+			key := "INVOICE_RATELIMIT_" + name + "_" + scope
+			v := getenv(key)
+			if v == "" {
+				continue
+			}
+			l, err := ParseRateLimit(v)
+			if err != nil {
+				return fmt.Errorf("%s : %w", key, err)
+			}
+			*limit = l
+		}
+	}
+
+	if v := getenv("INVOICE_RATELIMIT_TRUST_FORWARDED_FOR"); v != "" {
+		trust, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("INVOICE_RATELIMIT_TRUST_FORWARDED_FOR : %w", err)
+		}
+		c.TrustForwardedFor = trust
+	}
+	return nil
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // délai avant qu'un jeton soit disponible
+	Reset      time.Duration // délai avant que le bucket soit plein
+}
+
+// RateLimitStore holds the token buckets. The in-memory store is enough for a single instance,
+// a shared implementation (Redis, database...) can be plugged in when running several replicas.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok || b.limit != limit {
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now, limit: limit}
+		s.buckets[key] = b
+	}
+
+	// On remplit le bucket en fonction du temps écoulé depuis le dernier appel
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	res := RateLimitResult{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = secondsToDuration((1 - b.tokens) / limit.Rate)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = secondsToDuration((float64(limit.Burst) - b.tokens) / limit.Rate)
+
+	return res, nil
+}
+
+// sweep drops the buckets that are full again, they carry no state anymore.
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	for key, b := range s.buckets {
+		refill := now.Sub(b.last).Seconds() * b.limit.Rate
+		if b.tokens+refill >= float64(b.limit.Burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// RateLimitError carries the state of the exhausted bucket so the transport can expose it.
+type RateLimitError struct {
+	Result RateLimitResult
+}
+
+func (e RateLimitError) Error() string {
+	return ErrRateLimited.Error()
+}
+
+func (e RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+func (e RateLimitError) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+func (e RateLimitError) Headers() http.Header {
+	h := http.Header{}
+	h.Set("Retry-After", strconv.Itoa(int(math.Ceil(e.Result.RetryAfter.Seconds()))))
+	h.Set("X-RateLimit-Limit", strconv.Itoa(e.Result.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(e.Result.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(e.Result.Reset.Seconds()))))
+	return h
+}
+
+// clientIdentifier is implemented by the requests that carry the ID of the calling client.
+type clientIdentifier interface {
+	clientID() string
+}
+
+func (r GetInvoiceListRequest) clientID() string { return r.ClientID }
+func (r AddRequest) clientID() string            { return r.Uid }
+func (r ImportCSVRequest) clientID() string      { return r.Uid }
+func (r ImportUBLRequest) clientID() string      { return r.Uid }
+func (r BatchPaymentRequest) clientID() string   { return r.Uid }
+func (r CreateBulkJobRequest) clientID() string  { return r.Uid }
+
+// clientResolver returns the ID of the client a request is made for, "" when it is unknown.
+type clientResolver func(ctx context.Context, request interface{}) string
+
+func requestClientID(_ context.Context, request interface{}) string {
+	if c, ok := request.(clientIdentifier); ok {
+		return c.clientID()
+	}
+	return ""
+}
+
+// payerClientID resolves the payer of the invoice paid by an InvoicePaymentRequest, the request
+// does not carry it. The other requests fall back on the client ID they carry.
+func payerClientID(s InvoiceService) clientResolver {
+	return func(ctx context.Context, request interface{}) string {
+		req, ok := request.(InvoicePaymentRequest)
+		if !ok {
+			return requestClientID(ctx, request)
+		}
+		if req.Iid == "" {
+			return ""
+		}
+		invoice, err := s.Read(ctx, req.Iid)
+		if err != nil {
+			return ""
+		}
+		return invoice.AccountPayerId
+	}
+}
+
+// RateLimitMiddleware limits an endpoint per client ID and per IP. Errors of the store are logged
+// and the request goes through, a broken store must not take the service down.
+func RateLimitMiddleware(store RateLimitStore, logger log.Logger, operation string, rule RateLimitRule) endpoint.Middleware {
+	return rateLimitMiddleware(store, logger, operation, rule, requestClientID)
+}
+
+func rateLimitMiddleware(store RateLimitStore, logger log.Logger, operation string, rule RateLimitRule, clientOf clientResolver) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if ip, ok := ctx.Value(remoteIPContextKey).(string); ok && ip != "" && rule.PerIP.enabled() {
+				if err := takeToken(ctx, store, logger, operation+":ip:"+ip, rule.PerIP); err != nil {
+					return nil, err
+				}
+			}
+
+			// Le client n'est cherché qu'une fois l'IP acceptée, le payeur d'une facture est lu en base
+			if rule.PerClient.enabled() {
+				if client := clientOf(ctx, request); client != "" {
+					if err := takeToken(ctx, store, logger, operation+":client:"+client, rule.PerClient); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			return next(ctx, request)
+		}
+	}
+}
+
+func takeToken(ctx context.Context, store RateLimitStore, logger log.Logger, key string, limit RateLimit) error {
+	res, err := store.Take(ctx, key, limit)
+	if err != nil {
+		logger.Log("ratelimit", key, "err", err)
+		return nil
+	}
+	if !res.Allowed {
+		return RateLimitError{res}
+	}
+	return nil
+}
+
+func (e InvoiceEndpoints) withRateLimits(s InvoiceService, store RateLimitStore, logger log.Logger, config RateLimitConfig) InvoiceEndpoints {
+	e.AddEndpoint = RateLimitMiddleware(store, logger, "create", config.Create)(e.AddEndpoint)
+	e.ImportCSVEndpoint = RateLimitMiddleware(store, logger, "create", config.Create)(e.ImportCSVEndpoint)
+	e.ImportUBLEndpoint = RateLimitMiddleware(store, logger, "create", config.Create)(e.ImportUBLEndpoint)
+	e.CreateBulkJobEndpoint = RateLimitMiddleware(store, logger, "create", config.Create)(e.CreateBulkJobEndpoint)
+	e.InvoicePaiementEndpoint = rateLimitMiddleware(store, logger, "pay", config.Pay, payerClientID(s))(e.InvoicePaiementEndpoint)
+	e.PayInstallmentEndpoint = RateLimitMiddleware(store, logger, "pay", config.Pay)(e.PayInstallmentEndpoint)
+	e.BatchPaymentEndpoint = RateLimitMiddleware(store, logger, "pay", config.Pay)(e.BatchPaymentEndpoint)
+	e.GetInvoiceListEndpoint = RateLimitMiddleware(store, logger, "list", config.List)(e.GetInvoiceListEndpoint)
+	return e
+}
+
+// remoteIP returns the IP of the client. Behind a proxy it is the rightmost entry of X-Forwarded-For,
+// the one added by the proxy : the entries on its left are sent by the client and can be forged.
+func remoteIP(r *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			entries := strings.Split(fwd[len(fwd)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
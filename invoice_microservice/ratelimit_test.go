@@ -0,0 +1,155 @@
+package invoice_microservice
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := time.Date(2021, 4, 29, 0, 0, 0, 0, time.UTC)
+	store := &memoryRateLimitStore{
+		buckets: make(map[string]*tokenBucket),
+		now:     func() time.Time { return now },
+	}
+	limit := RateLimit{Rate: 1, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		res, _ := store.Take(context.TODO(), "key", limit)
+		if !res.Allowed {
+			t.Errorf("Bucket not empty yet, request %d should have been allowed", i)
+		}
+	}
+
+	res, _ := store.Take(context.TODO(), "key", limit)
+	if res.Allowed {
+		t.Errorf("Bucket is empty, request should have been refused")
+	}
+	if res.RetryAfter != time.Second {
+		t.Errorf("Expected to retry after 1s, got %v", res.RetryAfter)
+	}
+
+	now = now.Add(time.Second)
+	if res, _ := store.Take(context.TODO(), "key", limit); !res.Allowed {
+		t.Errorf("Bucket refilled, request should have been allowed")
+	}
+
+	if res, _ := store.Take(context.TODO(), "other", limit); !res.Allowed {
+		t.Errorf("Buckets are per key, request should have been allowed")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	rule := RateLimitRule{PerClient: RateLimit{Rate: 0.001, Burst: 1}}
+	e := RateLimitMiddleware(store, log.NewNopLogger(), "create", rule)(func(ctx context.Context, request interface{}) (interface{}, error) {
+		return AddResponse{Created: true}, nil
+	})
+
+	if _, err := e(context.TODO(), AddRequest{Uid: "client"}); err != nil {
+		t.Errorf("First request should have been allowed : " + err.Error())
+	}
+
+	_, err := e(context.TODO(), AddRequest{Uid: "client"})
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Second request should have been rate limited")
+	}
+	if codeFrom(err) != http.StatusTooManyRequests {
+		t.Errorf("Rate limited requests should be answered with a 429")
+	}
+	if err.(RateLimitError).Headers().Get("Retry-After") == "" {
+		t.Errorf("Rate limited responses should carry a Retry-After header")
+	}
+
+	if _, err := e(context.TODO(), AddRequest{Uid: "other client"}); err != nil {
+		t.Errorf("Limits are per client, request should have been allowed")
+	}
+}
+
+// payerTestService only implements the read of the invoice paid.
+type payerTestService struct {
+	InvoiceService
+	payers map[string]string // invoice -> payer
+	reads  *int
+}
+
+func (s payerTestService) Read(ctx context.Context, id string) (Invoice, error) {
+	*s.reads++
+	return Invoice{ID: id, AccountPayerId: s.payers[id]}, nil
+}
+
+func TestRateLimitPayer(t *testing.T) {
+	reads := 0
+	s := payerTestService{payers: map[string]string{"a": "paul", "b": "paul", "c": "jean"}, reads: &reads}
+	rule := RateLimitRule{PerClient: RateLimit{Rate: 0.001, Burst: 1}, PerIP: RateLimit{Rate: 0.001, Burst: 3}}
+	e := rateLimitMiddleware(NewMemoryRateLimitStore(), log.NewNopLogger(), "pay", rule, payerClientID(s))(func(ctx context.Context, request interface{}) (interface{}, error) {
+		return InvoicePaymentResponse{Paid: true}, nil
+	})
+	ctx := context.WithValue(context.TODO(), remoteIPContextKey, "192.0.2.1")
+
+	if _, err := e(ctx, InvoicePaymentRequest{Iid: "a"}); err != nil {
+		t.Errorf("First payment should have been allowed : %v", err)
+	}
+	// Les deux factures ont le même payeur
+	if _, err := e(ctx, InvoicePaymentRequest{Iid: "b"}); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Payments are limited per payer, request should have been rate limited")
+	}
+	if _, err := e(ctx, InvoicePaymentRequest{Iid: "c"}); err != nil {
+		t.Errorf("Another payer from the same IP should have been allowed : %v", err)
+	}
+
+	// Une requête refusée pour son IP ne lit pas la facture
+	if _, err := e(ctx, InvoicePaymentRequest{Iid: "c"}); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Payments are limited per IP, request should have been rate limited")
+	}
+	if reads != 3 {
+		t.Errorf("Expected the payer to be read only for the requests allowed for their IP, got %d reads", reads)
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/invoices", nil)
+	r.RemoteAddr = "10.0.0.2:41234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+
+	if ip := remoteIP(r, false); ip != "10.0.0.2" {
+		t.Errorf("Expected the address of the connection, got %s", ip)
+	}
+	// L'entrée de gauche est envoyée par le client, celle de droite par le proxy
+	if ip := remoteIP(r, true); ip != "198.51.100.7" {
+		t.Errorf("Expected the entry added by the proxy, got %s", ip)
+	}
+}
+
+func TestRateLimitConfigLoadEnv(t *testing.T) {
+	env := map[string]string{
+		"INVOICE_RATELIMIT_PAY_CLIENT":          "0.5/5",
+		"INVOICE_RATELIMIT_LIST_IP":             "0/0",
+		"INVOICE_RATELIMIT_TRUST_FORWARDED_FOR": "true",
+	}
+	config := DefaultRateLimitConfig()
+	if err := config.LoadEnv(func(key string) string { return env[key] }); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if config.Pay.PerClient != (RateLimit{Rate: 0.5, Burst: 5}) {
+		t.Errorf("Expected the payment limit to be replaced, got %+v", config.Pay.PerClient)
+	}
+	if config.List.PerIP.enabled() {
+		t.Errorf("Expected the list limit per IP to be disabled")
+	}
+	if config.Create != DefaultRateLimitConfig().Create || !config.TrustForwardedFor {
+		t.Errorf("Unexpected config %+v", config)
+	}
+
+	for _, v := range []string{"10", "a/5", "1/-2", "-1/5"} {
+		if _, err := ParseRateLimit(v); err == nil {
+			t.Errorf("Expected %q to be refused", v)
+		}
+	}
+}
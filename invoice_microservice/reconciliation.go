@@ -0,0 +1,310 @@
+package invoice_microservice
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/xid"
+)
+
+const (
+	// Le solde ne correspond pas au solde du dernier point de contrôle plus les écritures postées depuis,
+	// sur un compte qui a aussi un écart sur ses factures : le mouvement ne peut pas être attribué au service des comptes
+	BALANCE_DRIFT = "BALANCE_DRIFT"
+	// Les débits et crédits d'une transaction du grand livre ne s'équilibrent pas
+	UNBALANCED_TRANSACTION = "UNBALANCED_TRANSACTION"
+	// La facture est payée mais aucun mouvement n'a été enregistré
+	PAID_WITHOUT_LEDGER = "PAID_WITHOUT_LEDGER"
+	// Des mouvements existent pour une facture qui n'est pas payée
+	LEDGER_WITHOUT_PAYMENT = "LEDGER_WITHOUT_PAYMENT"
+	// Le montant débité au payeur ne correspond pas au montant de la facture
+	INVOICE_AMOUNT_MISMATCH = "INVOICE_AMOUNT_MISMATCH"
+
+	// Solde d'un compte vu pour la première fois, repris en écriture d'ouverture
+	OPENING_BALANCE = "OPENING_BALANCE"
+	// Dépôt ou retrait fait par le service des comptes, hors du grand livre
+	EXTERNAL_MOVEMENT = "EXTERNAL_MOVEMENT"
+)
+
+// Comptes de contrepartie des écritures passées par la réconciliation
+const (
+	openingBalanceAccount   = "OPENING_BALANCE"
+	externalMovementAccount = "EXTERNAL_MOVEMENT"
+)
+
+var (
+	ErrAccountQuarantined = errors.New("account is quarantined pending reconciliation")
+)
+
+type Discrepancy struct {
+	ClientID      string  `json:"client_id"`
+	Kind          string  `json:"kind"`
+	InvoiceID     string  `json:"invoice_id,omitempty"`
+	TransactionID string  `json:"transaction_id,omitempty"`
+	Expected      float64 `json:"expected"`
+	Actual        float64 `json:"actual"`
+}
+
+type ReconciliationReport struct {
+	RunAt           string `json:"run_at"`
+	AccountsChecked int    `json:"accounts_checked"`
+	// Comptes sans point de contrôle, vérifiés avec toutes leurs écritures depuis l'ouverture du grand livre
+	AccountsBaselined int           `json:"accounts_baselined"`
+	Discrepancies     []Discrepancy `json:"discrepancies"`
+	// Mouvements de solde faits hors du service, passés au grand livre par la réconciliation. Ce ne sont pas des écarts.
+	Movements   []Discrepancy `json:"movements"`
+	Quarantined []string      `json:"quarantined"`
+}
+
+func (r ReconciliationReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (r ReconciliationReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"client_id", "kind", "invoice_id", "transaction_id", "expected", "actual"})
+	for _, d := range r.Discrepancies {
+		cw.Write([]string{d.ClientID, d.Kind, d.InvoiceID, d.TransactionID, fmt.Sprintf("%.2f", d.Expected), fmt.Sprintf("%.2f", d.Actual)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Reconciler recomputes the balances expected from the ledger and the paid invoices and reports
+// the accounts whose balance drifted, for example after a payment that failed halfway.
+type Reconciler struct {
+	DbInfos DbConnexionInfo
+}
+
+func NewReconciler(dbinfos DbConnexionInfo) *Reconciler {
+	return &Reconciler{
+		DbInfos: dbinfos,
+	}
+}
+
+// Run checks every account. The whole check runs on a single snapshot of the database so the
+// payments posted meanwhile do not show up as discrepancies.
+// The balance of an account moves outside the ledger when the accounts service makes a deposit or
+// a withdrawal, or before the account is seen for the first time. That difference is posted to the
+// ledger, as an opening balance for a new account and as an external movement otherwise, so only the
+// accounts that also have a discrepancy on their invoices report it as a BALANCE_DRIFT.
+// Accounts without discrepancy get a new checkpoint, the others are quarantined when asked to.
+func (r *Reconciler) Run(ctx context.Context, quarantine bool) (ReconciliationReport, error) {
+	report := ReconciliationReport{
+		RunAt:         time.Now().UTC().Format(time.RFC3339),
+		Discrepancies: make([]Discrepancy, 0),
+		Movements:     make([]Discrepancy, 0),
+		Quarantined:   make([]string, 0),
+	}
+
+	db := GetDbConnexion(r.DbInfos)
+	defer db.Close()
+
+	tx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	accounts := []struct {
+		ClientID string  `db:"client_id"`
+		Balance  float64 `db:"account_amount"`
+		// Somme des écritures du compte, crédits moins débits
+		LedgerTotal float64 `db:"ledger_total"`
+		Checkpoint  bool    `db:"has_checkpoint"`
+		Expected    float64 `db:"expected_balance"`
+	}{}
+	err = tx.Select(&accounts, `SELECT a.client_id, a.account_amount,
+			COALESCE(l.ledger_total, 0) AS ledger_total,
+			c.client_id IS NOT NULL AS has_checkpoint,
+			COALESCE(c.balance - c.ledger_total, 0) + COALESCE(l.ledger_total, 0) AS expected_balance
+		FROM account a
+		LEFT JOIN (SELECT client_id, SUM(CASE WHEN entry_type = 'CREDIT' THEN entry_amount ELSE -entry_amount END) AS ledger_total
+			FROM ledger_entry GROUP BY client_id) l ON l.client_id = a.client_id
+		LEFT JOIN reconciliation_checkpoint c ON c.client_id = a.client_id`)
+	if err != nil {
+		return report, err
+	}
+
+	unbalanced := []struct {
+		TransactionID string  `db:"transaction_id"`
+		ClientID      string  `db:"client_id"`
+		Net           float64 `db:"net"`
+	}{}
+	err = tx.Select(&unbalanced, `SELECT l.transaction_id, l.client_id, t.net FROM ledger_entry l
+		JOIN (SELECT transaction_id, SUM(CASE WHEN entry_type = 'CREDIT' THEN entry_amount ELSE -entry_amount END) AS net
+			FROM ledger_entry GROUP BY transaction_id) t ON t.transaction_id = l.transaction_id
+		WHERE t.net <> 0`)
+	if err != nil {
+		return report, err
+	}
+	for _, u := range unbalanced {
+		report.Discrepancies = append(report.Discrepancies, Discrepancy{ClientID: u.ClientID, Kind: UNBALANCED_TRANSACTION, TransactionID: u.TransactionID, Actual: u.Net})
+	}
+
+	// Montant net débité au payeur pour chaque facture ayant des écritures ou un montant payé,
+	// il doit correspondre au montant payé moins les remboursements
+	invoices := []struct {
+		InvoiceID  string  `db:"invoice_id"`
+		PayerID    string  `db:"account_invoice_payer_id"`
+		ReceiverID string  `db:"account_invoice_receiver_id"`
+		PaidAmount float64 `db:"invoice_paid_amount"`
+		Refunded   float64 `db:"refunded"`
+		Entries    int     `db:"entries"`
+		Paid       float64 `db:"paid"`
+	}{}
+	err = tx.Select(&invoices, `SELECT i.invoice_id, i.account_invoice_payer_id, i.account_invoice_receiver_id, i.invoice_paid_amount,
+			COALESCE((SELECT SUM(credit_note_amount) FROM credit_note c WHERE c.invoice_id = i.invoice_id AND c.transaction_id <> ''), 0) AS refunded,
+			COUNT(l.entry_id) AS entries,
+			COALESCE(SUM(CASE WHEN l.client_id = i.account_invoice_payer_id AND l.entry_type = 'DEBIT' THEN l.entry_amount
+				WHEN l.client_id = i.account_invoice_payer_id THEN -l.entry_amount ELSE 0 END), 0) AS paid
+		FROM invoice i LEFT JOIN ledger_entry l ON l.invoice_id = i.invoice_id
+		GROUP BY i.invoice_id, i.account_invoice_payer_id, i.account_invoice_receiver_id, i.invoice_paid_amount
+		HAVING i.invoice_paid_amount > 0 OR COUNT(l.entry_id) > 0`)
+	if err != nil {
+		return report, err
+	}
+	for _, i := range invoices {
+		expected := roundCents(i.PaidAmount - i.Refunded)
+		kind := ""
+		switch {
+		case i.PaidAmount > 0 && i.Entries == 0:
+			kind = PAID_WITHOUT_LEDGER
+		case i.PaidAmount == 0 && roundCents(i.Paid) != 0:
+			kind = LEDGER_WITHOUT_PAYMENT
+		case roundCents(i.Paid) != expected:
+			kind = INVOICE_AMOUNT_MISMATCH
+		}
+		if kind == "" {
+			continue
+		}
+		for _, clientID := range []string{i.PayerID, i.ReceiverID} {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{ClientID: clientID, Kind: kind, InvoiceID: i.InvoiceID, Expected: expected, Actual: i.Paid})
+		}
+	}
+
+	affected := make(map[string]bool)
+	for _, d := range report.Discrepancies {
+		affected[d.ClientID] = true
+	}
+
+	for _, a := range accounts {
+		report.AccountsChecked++
+		if !a.Checkpoint {
+			report.AccountsBaselined++
+		}
+
+		ledgerTotal := a.LedgerTotal
+		if moved := roundCents(a.Balance - a.Expected); moved != 0 {
+			if affected[a.ClientID] {
+				report.Discrepancies = append(report.Discrepancies, Discrepancy{ClientID: a.ClientID, Kind: BALANCE_DRIFT, Expected: a.Expected, Actual: a.Balance})
+				continue
+			}
+
+			movement := Discrepancy{ClientID: a.ClientID, Kind: EXTERNAL_MOVEMENT, Expected: a.Expected, Actual: a.Balance}
+			counterpart, label := externalMovementAccount, "Mouvement hors service des factures"
+			if !a.Checkpoint {
+				movement.Kind, counterpart, label = OPENING_BALANCE, openingBalanceAccount, "Solde d'ouverture"
+			}
+			if err := postMovement(tx, a.ClientID, counterpart, moved, label); err != nil {
+				return report, err
+			}
+			report.Movements = append(report.Movements, movement)
+			ledgerTotal = roundCents(ledgerTotal + moved)
+		}
+		if affected[a.ClientID] {
+			continue
+		}
+
+		_, err := tx.Exec(`INSERT INTO reconciliation_checkpoint (client_id, balance, ledger_total, checkpoint_date) VALUES ($1, $2, $3, now())
+			ON CONFLICT (client_id) DO UPDATE SET balance = EXCLUDED.balance, ledger_total = EXCLUDED.ledger_total, checkpoint_date = EXCLUDED.checkpoint_date`,
+			a.ClientID, a.Balance, ledgerTotal)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	sort.SliceStable(report.Discrepancies, func(a, b int) bool {
+		return report.Discrepancies[a].ClientID < report.Discrepancies[b].ClientID
+	})
+
+	if quarantine {
+		for clientID := range affected {
+			res, err := tx.Exec("INSERT INTO account_quarantine (client_id, quarantine_reason) VALUES ($1, $2) ON CONFLICT (client_id) DO NOTHING", clientID, "reconciliation "+report.RunAt)
+			if err != nil {
+				return report, err
+			}
+			if rows, _ := res.RowsAffected(); rows == 1 {
+				report.Quarantined = append(report.Quarantined, clientID)
+			}
+		}
+		sort.Strings(report.Quarantined)
+	}
+
+	return report, tx.Commit()
+}
+
+// postMovement writes inside tx the entries of a balance movement made outside the ledger : amount
+// is credited to the account when positive, debited otherwise, against counterpart. The balances are
+// already up to date, they are not changed.
+func postMovement(tx *sqlx.Tx, clientID string, counterpart string, amount float64, label string) error {
+	entryType, counterType := CREDIT, DEBIT
+	if amount < 0 {
+		entryType, counterType = DEBIT, CREDIT
+	}
+
+	transactionID := xid.New().String()
+	for _, e := range []struct {
+		clientID  string
+		entryType string
+	}{{clientID, entryType}, {counterpart, counterType}} {
+		_, err := tx.Exec("INSERT INTO ledger_entry (entry_id, transaction_id, client_id, entry_type, entry_amount, entry_label) VALUES ($1, $2, $3, $4, $5, $6)",
+			xid.New().String(), transactionID, e.clientID, e.entryType, math.Abs(amount), label)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release lifts the quarantine of an account once its balance has been corrected.
+func (r *Reconciler) Release(ctx context.Context, clientID string) error {
+	db := GetDbConnexion(r.DbInfos)
+	defer db.Close()
+
+	res, err := db.ExecContext(ctx, "DELETE FROM account_quarantine WHERE client_id=$1", clientID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows != 1 {
+		return ErrAccountNotFound
+	}
+	return nil
+}
+
+// Schedule runs the reconciliation every interval until ctx is done and logs the discrepancies found.
+func (r *Reconciler) Schedule(ctx context.Context, interval time.Duration, quarantine bool, logger log.Logger) {
+	RunEvery(ctx, interval, func(ctx context.Context) {
+		report, err := r.Run(ctx, quarantine)
+		if err != nil {
+			logger.Log("reconciliation", "failed", "err", err)
+			return
+		}
+		logger.Log("reconciliation", "done", "accounts", report.AccountsChecked, "movements", len(report.Movements), "discrepancies", len(report.Discrepancies), "quarantined", len(report.Quarantined))
+		for _, d := range report.Discrepancies {
+			logger.Log("reconciliation", "discrepancy", "client_id", d.ClientID, "kind", d.Kind, "invoice_id", d.InvoiceID, "transaction_id", d.TransactionID, "expected", d.Expected, "actual", d.Actual)
+		}
+	})
+}
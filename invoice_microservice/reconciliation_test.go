@@ -0,0 +1,94 @@
+package invoice_microservice
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestReconciliationReportCSV(t *testing.T) {
+	report := ReconciliationReport{
+		Discrepancies: []Discrepancy{
+			{ClientID: "payer", Kind: BALANCE_DRIFT, Expected: 100, Actual: 33.34},
+			{ClientID: "payer", Kind: INVOICE_AMOUNT_MISMATCH, InvoiceID: "invoice", Expected: 666.66, Actual: 0},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "client_id,kind,invoice_id,transaction_id,expected,actual\n" +
+		"payer,BALANCE_DRIFT,,,100.00,33.34\n" +
+		"payer,INVOICE_AMOUNT_MISMATCH,invoice,,666.66,0.00\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected CSV report : " + buf.String())
+	}
+}
+
+func TestReconciliationExternalDeposit(t *testing.T) {
+	d := newMoneyTestData(t, 100)
+	reconciler := NewReconciler(d.s.(*invoiceService).DbInfos)
+	t.Cleanup(func() {
+		d.db.Exec(`DELETE FROM ledger_entry WHERE transaction_id IN (SELECT transaction_id FROM ledger_entry WHERE client_id IN ($1, $2) AND invoice_id IS NULL)`, d.payer, d.receiver)
+		d.db.Exec("DELETE FROM reconciliation_checkpoint WHERE client_id IN ($1, $2)", d.payer, d.receiver)
+		d.db.Exec("DELETE FROM account_quarantine WHERE client_id IN ($1, $2)", d.payer, d.receiver)
+	})
+
+	invoice := d.createInvoice(t, 30)
+	if _, err := d.s.PayInvoice(context.TODO(), invoice.ID); err != nil {
+		t.Fatal(err)
+	}
+	report, err := reconciler.Run(context.TODO(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReconciled(t, report, d.payer, OPENING_BALANCE, 70)
+
+	// Dépôt fait par le service des comptes, sans écriture
+	if _, err := d.db.Exec("UPDATE account SET account_amount = account_amount + 50 WHERE client_id = $1", d.payer); err != nil {
+		t.Fatal(err)
+	}
+	report, err = reconciler.Run(context.TODO(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReconciled(t, report, d.payer, EXTERNAL_MOVEMENT, 120)
+	d.checkLedger(t, 120, 30)
+
+	report, err = reconciler.Run(context.TODO(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range report.Movements {
+		if m.ClientID == d.payer || m.ClientID == d.receiver {
+			t.Errorf("Expected the deposit to be posted once, got %+v", m)
+		}
+	}
+}
+
+// checkReconciled checks that the payer has no discrepancy, is not quarantined and that its
+// balance moved outside the ledger up to balance was posted as a movement of kind.
+func checkReconciled(t *testing.T, report ReconciliationReport, payer string, kind string, balance float64) {
+	t.Helper()
+	for _, d := range report.Discrepancies {
+		if d.ClientID == payer {
+			t.Errorf("Expected no discrepancy on the payer, got %+v", d)
+		}
+	}
+	for _, clientID := range report.Quarantined {
+		if clientID == payer {
+			t.Errorf("Expected the payer not to be quarantined")
+		}
+	}
+	for _, m := range report.Movements {
+		if m.ClientID == payer {
+			if m.Kind != kind || m.Actual != balance {
+				t.Errorf("Expected a %s movement up to %v, got %+v", kind, balance, m)
+			}
+			return
+		}
+	}
+	t.Errorf("Expected a %s movement on the payer", kind)
+}
@@ -0,0 +1,236 @@
+package invoice_microservice
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidRecurrence = errors.New("invalid recurrence rule")
+)
+
+var rruleWeekdays = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// Nombre maximal de périodes parcourues pour trouver une occurrence
+const maxRecurrencePeriods = 100000
+
+// Recurrence is the subset of the RFC 5545 RRULE used by the recurring invoices : FREQ (DAILY,
+// WEEKLY, MONTHLY or YEARLY), INTERVAL, BYDAY without ordinal, BYMONTHDAY, COUNT and UNTIL. The
+// occurrences are dates, the first period is the one of the start date.
+type Recurrence struct {
+	Freq       string
+	Interval   int
+	ByDay      []time.Weekday
+	ByMonthDay []int
+	Count      int
+	Until      time.Time // pas de limite si zéro
+}
+
+// ParseRRule parses a rule such as "FREQ=MONTHLY;BYMONTHDAY=1", with or without the "RRULE:" prefix.
+func ParseRRule(rule string) (Recurrence, error) {
+	r := Recurrence{Interval: 1}
+	rule = strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:")
+	if rule == "" {
+		return Recurrence{}, ErrInvalidRecurrence
+	}
+
+	for _, part := range strings.Split(rule, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return Recurrence{}, ErrInvalidRecurrence
+		}
+		key, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+
+		var err error
+		switch key {
+		case "FREQ":
+			r.Freq = value
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(value)
+		case "COUNT":
+			r.Count, err = strconv.Atoi(value)
+			if r.Count <= 0 {
+				err = ErrInvalidRecurrence
+			}
+		case "UNTIL":
+			if len(value) > 8 {
+				value = value[:8]
+			}
+			r.Until, err = time.Parse("20060102", value)
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				weekday, ok := rruleWeekdays[day]
+				if !ok {
+					return Recurrence{}, ErrInvalidRecurrence
+				}
+				r.ByDay = append(r.ByDay, weekday)
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(day)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return Recurrence{}, ErrInvalidRecurrence
+				}
+				r.ByMonthDay = append(r.ByMonthDay, n)
+			}
+		default:
+			return Recurrence{}, ErrInvalidRecurrence
+		}
+		if err != nil {
+			return Recurrence{}, ErrInvalidRecurrence
+		}
+	}
+
+	if err := r.validate(); err != nil {
+		return Recurrence{}, err
+	}
+	return r, nil
+}
+
+func (r Recurrence) validate() error {
+	switch r.Freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+	default:
+		return ErrInvalidRecurrence
+	}
+	if r.Interval <= 0 || r.Count < 0 || (r.Count > 0 && !r.Until.IsZero()) {
+		return ErrInvalidRecurrence
+	}
+	if len(r.ByMonthDay) > 0 && r.Freq != "MONTHLY" {
+		return ErrInvalidRecurrence
+	}
+	if len(r.ByDay) > 0 && r.Freq == "YEARLY" {
+		return ErrInvalidRecurrence
+	}
+	return nil
+}
+
+// String returns the rule in the RRULE format.
+func (r Recurrence) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, 0, len(r.ByDay))
+		for _, weekday := range r.ByDay {
+			days = append(days, strings.ToUpper(weekday.String()[:2]))
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		days := make([]string, 0, len(r.ByMonthDay))
+		for _, day := range r.ByMonthDay {
+			days = append(days, strconv.Itoa(day))
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.Format("20060102"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// period returns the dates of the k-th period of the recurrence, in order.
+func (r Recurrence) period(start time.Time, k int) []time.Time {
+	dates := make([]time.Time, 0)
+	matchesDay := func(d time.Time) bool {
+		if len(r.ByDay) == 0 {
+			return true
+		}
+		for _, weekday := range r.ByDay {
+			if d.Weekday() == weekday {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch r.Freq {
+	case "DAILY":
+		if d := start.AddDate(0, 0, k*r.Interval); matchesDay(d) {
+			dates = append(dates, d)
+		}
+	case "WEEKLY":
+		monday := start.AddDate(0, 0, -((int(start.Weekday())+6)%7)+7*k*r.Interval)
+		for i := 0; i < 7; i++ {
+			d := monday.AddDate(0, 0, i)
+			if (len(r.ByDay) == 0 && d.Weekday() == start.Weekday()) || (len(r.ByDay) > 0 && matchesDay(d)) {
+				dates = append(dates, d)
+			}
+		}
+	case "MONTHLY":
+		first := time.Date(start.Year(), start.Month()+time.Month(k*r.Interval), 1, 0, 0, 0, 0, time.UTC)
+		days := first.AddDate(0, 1, -1).Day()
+		if len(r.ByMonthDay) == 0 && len(r.ByDay) == 0 {
+			if start.Day() <= days {
+				dates = append(dates, first.AddDate(0, 0, start.Day()-1))
+			}
+			break
+		}
+		for day := 1; day <= days; day++ {
+			d := first.AddDate(0, 0, day-1)
+			if !matchesDay(d) {
+				continue
+			}
+			if len(r.ByMonthDay) == 0 {
+				dates = append(dates, d)
+				continue
+			}
+			for _, n := range r.ByMonthDay {
+				if n == day || days+n+1 == day {
+					dates = append(dates, d)
+					break
+				}
+			}
+		}
+	case "YEARLY":
+		d := time.Date(start.Year()+k*r.Interval, start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+		// Le 29 février n'a pas lieu les années non bissextiles
+		if d.Day() == start.Day() {
+			dates = append(dates, d)
+		}
+	}
+
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+	return dates
+}
+
+// After returns the first occurrence strictly after the given date of the recurrence starting at
+// start, and false when the recurrence has no more occurrences.
+func (r Recurrence) After(start time.Time, after time.Time) (time.Time, bool) {
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	count := 0
+	for k := 0; k < maxRecurrencePeriods; k++ {
+		for _, d := range r.period(start, k) {
+			if d.Before(start) {
+				continue
+			}
+			if !r.Until.IsZero() && d.After(r.Until) {
+				return time.Time{}, false
+			}
+			count++
+			if r.Count > 0 && count > r.Count {
+				return time.Time{}, false
+			}
+			if d.After(after) {
+				return d, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,106 @@
+package invoice_microservice
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	d, _ := time.Parse("2006-01-02", s)
+	return d
+}
+
+// occurrences returns the n first occurrences of the recurrence.
+func occurrences(r Recurrence, start string, n int) []string {
+	dates := make([]string, 0, n)
+	after := time.Time{}
+	for len(dates) < n {
+		d, ok := r.After(date(start), after)
+		if !ok {
+			break
+		}
+		dates = append(dates, d.Format("2006-01-02"))
+		after = d
+	}
+	return dates
+}
+
+func TestRecurrence(t *testing.T) {
+	cases := []struct {
+		rule     string
+		start    string
+		expected string
+	}{
+		{"FREQ=MONTHLY;BYMONTHDAY=5", "2021-01-10", "2021-02-05,2021-03-05,2021-04-05"},
+		{"FREQ=MONTHLY;BYMONTHDAY=-1", "2021-01-01", "2021-01-31,2021-02-28,2021-03-31"},
+		{"FREQ=MONTHLY", "2021-01-31", "2021-01-31,2021-03-31,2021-05-31"},
+		{"RRULE:FREQ=WEEKLY;BYDAY=MO,TH", "2021-04-14", "2021-04-15,2021-04-19,2021-04-22"},
+		{"FREQ=WEEKLY;INTERVAL=2", "2021-04-14", "2021-04-14,2021-04-28,2021-05-12"},
+		{"FREQ=MONTHLY;INTERVAL=3;BYMONTHDAY=1;UNTIL=20210801", "2021-01-01", "2021-01-01,2021-04-01,2021-07-01"},
+		{"FREQ=YEARLY", "2020-02-29", "2020-02-29,2024-02-29,2028-02-29"},
+	}
+	for _, c := range cases {
+		r, err := ParseRRule(c.rule)
+		if err != nil {
+			t.Fatalf("%s : %v", c.rule, err)
+		}
+		if got := strings.Join(occurrences(r, c.start, 3), ","); got != c.expected {
+			t.Errorf("%s from %s : expected %s, got %s", c.rule, c.start, c.expected, got)
+		}
+	}
+
+	// COUNT compte les occurrences depuis le début
+	r, _ := ParseRRule("FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR;COUNT=3")
+	if got := strings.Join(occurrences(r, "2021-04-16", 5), ","); got != "2021-04-16,2021-04-19,2021-04-20" {
+		t.Errorf("Expected 3 working days, got %s", got)
+	}
+
+	for _, rule := range []string{"", "FREQ=HOURLY", "FREQ=MONTHLY;BYDAY=1MO", "FREQ=WEEKLY;BYMONTHDAY=1", "FREQ=DAILY;COUNT=2;UNTIL=20210101", "FREQ=DAILY;INTERVAL=0", "FREQ=DAILY;BYSETPOS=1"} {
+		if _, err := ParseRRule(rule); err != ErrInvalidRecurrence {
+			t.Errorf("Expected %q to be invalid, got %v", rule, err)
+		}
+	}
+
+	if s := (Recurrence{Freq: "WEEKLY", Interval: 2, ByDay: []time.Weekday{time.Monday}, Until: date("2021-12-31")}).String(); s != "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO;UNTIL=20211231" {
+		t.Errorf("Unexpected rule %s", s)
+	}
+}
+
+func TestRecurringInvoiceSchedule(t *testing.T) {
+	r := RecurringInvoice{Amount: 650, IssuerID: "anne", PayerID: "paul", Frequency: RECURRING_MONTHLY, DayOfMonth: 1, StartDate: "2021-01-15", EndDate: "2021-04-01", DueDays: 10}
+
+	dates := make([]string, 0)
+	after := time.Time{}
+	for {
+		d, ok, err := r.next(after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		dates = append(dates, d.Format("2006-01-02"))
+		after = d
+	}
+	if strings.Join(dates, ",") != "2021-02-01,2021-03-01,2021-04-01" {
+		t.Errorf("Unexpected occurrences %v", dates)
+	}
+
+	i := r.invoice(date("2021-02-01"))
+	if i.Amount != 650 || i.ExpirationDate != "2021-02-11" || i.AccountPayerId != "paul" || i.AccountReceiverId != "anne" || i.State != PENDING {
+		t.Errorf("Unexpected invoice %+v", i)
+	}
+
+	invalid := []RecurringInvoice{
+		{Frequency: RECURRING_MONTHLY, DayOfMonth: 31, StartDate: "2021-01-01"},
+		{Frequency: RECURRING_WEEKLY, Weekday: "XX", StartDate: "2021-01-01"},
+		{Frequency: "YEARLY", StartDate: "2021-01-01"},
+		{Frequency: RECURRING_WEEKLY, Weekday: "fr", StartDate: "2021-01-01", EndDate: "2020-01-01"},
+	}
+	for _, r := range invalid {
+		if _, _, err := r.next(time.Time{}); err != ErrInvalidRecurrence {
+			t.Errorf("Expected %+v to be invalid, got %v", r, err)
+		}
+	}
+}
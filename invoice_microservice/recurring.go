@@ -0,0 +1,430 @@
+package invoice_microservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/rs/xid"
+)
+
+// Rythmes des factures récurrentes
+const (
+	RECURRING_MONTHLY = "MONTHLY"
+	RECURRING_WEEKLY  = "WEEKLY"
+	RECURRING_RRULE   = "RRULE"
+)
+
+// États d'une facture récurrente
+const (
+	RECURRING_ACTIVE    = "ACTIVE"
+	RECURRING_PAUSED    = "PAUSED"
+	RECURRING_CANCELLED = "CANCELLED"
+	RECURRING_ENDED     = "ENDED" // plus aucune occurrence
+)
+
+var (
+	ErrRecurringNotFound    = errors.New("recurring invoice not found")
+	ErrRecurringInactive    = errors.New("recurring invoice is cancelled or ended")
+	ErrRecurringInterrupted = errors.New("issuance interrupted, the invoice may not have been created")
+)
+
+const recurringColumns = `recurring_id, issuer_id, payer_id, amount, tax_jurisdiction, frequency, day_of_month, weekday, rrule,
+	start_date::text AS start_date, COALESCE(end_date::text, '') AS end_date, due_days, recurring_state,
+	COALESCE(next_date::text, '') AS next_date, created_at`
+
+// RecurringInvoice issues an invoice of the same amount to the payer at each occurrence of its
+// schedule, between its start date and its optional end date.
+type RecurringInvoice struct {
+	ID              string  `json:"recurring_id" db:"recurring_id"`
+	IssuerID        string  `json:"issuer_id" db:"issuer_id"`
+	PayerID         string  `json:"payer_id" db:"payer_id"`
+	Amount          float64 `json:"amount" db:"amount"`
+	TaxJurisdiction string  `json:"tax_jurisdiction,omitempty" db:"tax_jurisdiction"`
+	Frequency       string  `json:"frequency" db:"frequency"`                 // MONTHLY, WEEKLY ou RRULE
+	DayOfMonth      int     `json:"day_of_month,omitempty" db:"day_of_month"` // MONTHLY : 1 à 28, -1 pour le dernier jour
+	Weekday         string  `json:"weekday,omitempty" db:"weekday"`           // WEEKLY : MO, TU, ... SU
+	RRule           string  `json:"rrule,omitempty" db:"rrule"`               // RRULE, calculée pour les autres rythmes
+	StartDate       string  `json:"start_date" db:"start_date"`               // 2006-01-02
+	EndDate         string  `json:"end_date,omitempty" db:"end_date"`         // optionnelle, incluse
+	DueDays         int     `json:"due_days" db:"due_days"`                   // délai de paiement de chaque facture
+	State           string  `json:"state,omitempty" db:"recurring_state"`     // ACTIVE, PAUSED, CANCELLED ou ENDED
+	NextDate        string  `json:"next_date,omitempty" db:"next_date"`       // prochaine facture
+	CreatedAt       string  `json:"created_at,omitempty" db:"created_at"`
+}
+
+// RecurringRun is an invoice issued, or that could not be issued, by a recurring invoice.
+type RecurringRun struct {
+	RecurringID    string `json:"recurring_id" db:"recurring_id"`
+	OccurrenceDate string `json:"occurrence_date" db:"occurrence_date"`
+	InvoiceID      string `json:"invoice_id,omitempty" db:"invoice_id"`
+	Error          string `json:"error,omitempty" db:"run_error"`
+	CreatedAt      string `json:"created_at" db:"created_at"`
+}
+
+// recurrence returns the schedule of the recurring invoice, bounded by its end date.
+func (r RecurringInvoice) recurrence() (Recurrence, error) {
+	var rec Recurrence
+	switch r.Frequency {
+	case RECURRING_MONTHLY:
+		if r.DayOfMonth != -1 && (r.DayOfMonth < 1 || r.DayOfMonth > 28) {
+			return Recurrence{}, ErrInvalidRecurrence
+		}
+		rec = Recurrence{Freq: "MONTHLY", Interval: 1, ByMonthDay: []int{r.DayOfMonth}}
+	case RECURRING_WEEKLY:
+		weekday, ok := rruleWeekdays[strings.ToUpper(r.Weekday)]
+		if !ok {
+			return Recurrence{}, ErrInvalidRecurrence
+		}
+		rec = Recurrence{Freq: "WEEKLY", Interval: 1, ByDay: []time.Weekday{weekday}}
+	case RECURRING_RRULE:
+		var err error
+		if rec, err = ParseRRule(r.RRule); err != nil {
+			return Recurrence{}, err
+		}
+	default:
+		return Recurrence{}, ErrInvalidRecurrence
+	}
+
+	if r.EndDate != "" {
+		end, err := time.Parse("2006-01-02", r.EndDate)
+		if err != nil {
+			return Recurrence{}, ErrInvalidRecurrence
+		}
+		if rec.Count == 0 && (rec.Until.IsZero() || end.Before(rec.Until)) {
+			rec.Until = end
+		}
+	}
+	return rec, nil
+}
+
+// next returns the first occurrence of the recurring invoice after the given date.
+func (r RecurringInvoice) next(after time.Time) (time.Time, bool, error) {
+	rec, err := r.recurrence()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	start, err := time.Parse("2006-01-02", r.StartDate)
+	if err != nil {
+		return time.Time{}, false, ErrInvalidRecurrence
+	}
+	if r.EndDate != "" {
+		if end, err := time.Parse("2006-01-02", r.EndDate); err != nil || end.Before(start) {
+			return time.Time{}, false, ErrInvalidRecurrence
+		}
+	}
+	d, ok := rec.After(start, after)
+	return d, ok, nil
+}
+
+// invoice returns the invoice issued at the given occurrence.
+func (r RecurringInvoice) invoice(occurrence time.Time) Invoice {
+	return Invoice{
+		Amount:            r.Amount,
+		State:             PENDING,
+		ExpirationDate:    occurrence.AddDate(0, 0, r.DueDays).Format("2006-01-02"),
+		AccountPayerId:    r.PayerID,
+		AccountReceiverId: r.IssuerID,
+		TaxJurisdiction:   r.TaxJurisdiction,
+	}
+}
+
+// CreateRecurringInvoice saves the recurring invoice, its first invoice is issued on its first occurrence.
+func (s *invoiceService) CreateRecurringInvoice(ctx context.Context, r RecurringInvoice) (RecurringInvoice, error) {
+	r.Amount = roundCents(r.Amount)
+	if r.Amount <= 0 {
+		return RecurringInvoice{}, ErrInvalidAmount
+	}
+	if r.IssuerID == "" || r.PayerID == "" {
+		return RecurringInvoice{}, ErrNotAnId
+	}
+	if r.IssuerID == r.PayerID {
+		return RecurringInvoice{}, ErrSameAccount
+	}
+	if r.DueDays < 0 {
+		return RecurringInvoice{}, ErrInvalidRecurrence
+	}
+	if _, err := s.taxJurisdiction(r.TaxJurisdiction); err != nil {
+		return RecurringInvoice{}, err
+	}
+
+	rec, err := r.recurrence()
+	if err != nil {
+		return RecurringInvoice{}, err
+	}
+	if r.Frequency != RECURRING_RRULE {
+		r.RRule = rec.String()
+	}
+	// Les occurrences passées ne sont pas facturées
+	first, ok, err := r.next(time.Now().UTC().AddDate(0, 0, -1))
+	if err != nil {
+		return RecurringInvoice{}, err
+	}
+	if !ok {
+		return RecurringInvoice{}, ErrInvalidRecurrence
+	}
+
+	r.ID = xid.New().String()
+	r.State = RECURRING_ACTIVE
+	r.NextDate = first.Format("2006-01-02")
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	var endDate interface{}
+	if r.EndDate != "" {
+		endDate = r.EndDate
+	}
+	_, err = db.Exec(`INSERT INTO recurring_invoice (recurring_id, issuer_id, payer_id, amount, tax_jurisdiction, frequency, day_of_month, weekday, rrule, start_date, end_date, due_days, recurring_state, next_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		r.ID, r.IssuerID, r.PayerID, r.Amount, r.TaxJurisdiction, r.Frequency, r.DayOfMonth, strings.ToUpper(r.Weekday), r.RRule, r.StartDate, endDate, r.DueDays, r.State, r.NextDate)
+	if err != nil {
+		return RecurringInvoice{}, err
+	}
+
+	return s.GetRecurringInvoice(ctx, r.ID)
+}
+
+func (s *invoiceService) GetRecurringInvoice(ctx context.Context, id string) (RecurringInvoice, error) {
+	if id == "" {
+		return RecurringInvoice{}, ErrNotAnId
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	r := RecurringInvoice{}
+	err := db.Get(&r, "SELECT "+recurringColumns+" FROM recurring_invoice WHERE recurring_id=$1", id)
+	if err == sql.ErrNoRows {
+		return RecurringInvoice{}, ErrRecurringNotFound
+	}
+	if err != nil {
+		return RecurringInvoice{}, err
+	}
+	return r, nil
+}
+
+// GetRecurringInvoices returns the recurring invoices of the given issuer.
+func (s *invoiceService) GetRecurringInvoices(ctx context.Context, issuerID string) ([]RecurringInvoice, error) {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	recurring := make([]RecurringInvoice, 0)
+	err := db.Select(&recurring, "SELECT "+recurringColumns+" FROM recurring_invoice WHERE issuer_id=$1 ORDER BY created_at", issuerID)
+	if err != nil {
+		return nil, err
+	}
+	return recurring, nil
+}
+
+// SetRecurringInvoiceState pauses (PAUSED), resumes (ACTIVE) or cancels (CANCELLED) the recurring
+// invoice. The occurrences missed during a pause are not issued on resume.
+func (s *invoiceService) SetRecurringInvoiceState(ctx context.Context, id string, state string) (RecurringInvoice, error) {
+	if id == "" {
+		return RecurringInvoice{}, ErrNotAnId
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return RecurringInvoice{}, err
+	}
+	defer tx.Rollback()
+
+	r := RecurringInvoice{}
+	if err := tx.Get(&r, "SELECT "+recurringColumns+" FROM recurring_invoice WHERE recurring_id=$1 FOR UPDATE", id); err != nil {
+		if err == sql.ErrNoRows {
+			return RecurringInvoice{}, ErrRecurringNotFound
+		}
+		return RecurringInvoice{}, err
+	}
+
+	switch state {
+	case RECURRING_PAUSED:
+		if r.State != RECURRING_ACTIVE && r.State != RECURRING_PAUSED {
+			return RecurringInvoice{}, ErrRecurringInactive
+		}
+		_, err = tx.Exec("UPDATE recurring_invoice SET recurring_state = $1 WHERE recurring_id=$2", RECURRING_PAUSED, id)
+	case RECURRING_ACTIVE:
+		if r.State != RECURRING_ACTIVE && r.State != RECURRING_PAUSED {
+			return RecurringInvoice{}, ErrRecurringInactive
+		}
+		after := time.Now().UTC().AddDate(0, 0, -1)
+		if next, err := time.Parse("2006-01-02", r.NextDate); err == nil && next.AddDate(0, 0, -1).After(after) {
+			after = next.AddDate(0, 0, -1)
+		}
+		next, ok, err := r.next(after)
+		if err != nil {
+			return RecurringInvoice{}, err
+		}
+		if ok {
+			_, err = tx.Exec("UPDATE recurring_invoice SET recurring_state = $1, next_date = $2 WHERE recurring_id=$3", RECURRING_ACTIVE, next.Format("2006-01-02"), id)
+		} else {
+			_, err = tx.Exec("UPDATE recurring_invoice SET recurring_state = $1, next_date = NULL WHERE recurring_id=$2", RECURRING_ENDED, id)
+		}
+		if err != nil {
+			return RecurringInvoice{}, err
+		}
+	case RECURRING_CANCELLED:
+		_, err = tx.Exec("UPDATE recurring_invoice SET recurring_state = $1, next_date = NULL WHERE recurring_id=$2", RECURRING_CANCELLED, id)
+	default:
+		return RecurringInvoice{}, ErrInvalidRecurrence
+	}
+	if err != nil {
+		return RecurringInvoice{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return RecurringInvoice{}, err
+	}
+	return s.GetRecurringInvoice(ctx, id)
+}
+
+// GetRecurringRuns returns the invoices issued by the recurring invoice, the most recent first.
+func (s *invoiceService) GetRecurringRuns(ctx context.Context, id string) ([]RecurringRun, error) {
+	if _, err := s.GetRecurringInvoice(ctx, id); err != nil {
+		return nil, err
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	runs := make([]RecurringRun, 0)
+	err := db.Select(&runs, "SELECT recurring_id, occurrence_date::text AS occurrence_date, invoice_id, run_error, created_at FROM recurring_invoice_run WHERE recurring_id=$1 ORDER BY occurrence_date DESC", id)
+	if err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// RecurringIssuer issues the invoices of the recurring invoices whose next occurrence is due.
+type RecurringIssuer struct {
+	DbInfos DbConnexionInfo
+	Service InvoiceService
+	Timeout time.Duration // au-delà, une occurrence réservée sans résultat est considérée comme interrompue
+}
+
+func NewRecurringIssuer(dbinfos DbConnexionInfo, s InvoiceService) *RecurringIssuer {
+	return &RecurringIssuer{
+		DbInfos: dbinfos,
+		Service: s,
+		Timeout: 10 * time.Minute,
+	}
+}
+
+// Issue issues every due occurrence, including the ones missed while the issuer was not running,
+// and returns the number of invoices issued.
+func (g *RecurringIssuer) Issue(ctx context.Context, logger log.Logger) (int, error) {
+	db := GetDbConnexion(g.DbInfos)
+	// Une occurrence restée réservée (arrêt du service pendant Create) est signalée en échec dans l'historique,
+	// les occurrences réservées avant l'ajout de claimed_at le sont depuis leur création
+	_, err := db.Exec("UPDATE recurring_invoice_run SET run_error = $1 WHERE invoice_id = '' AND run_error = '' AND COALESCE(claimed_at, created_at) < $2",
+		ErrRecurringInterrupted.Error(), time.Now().Add(-g.Timeout))
+	if err != nil {
+		db.Close()
+		return 0, err
+	}
+	ids := make([]string, 0)
+	err = db.Select(&ids, "SELECT recurring_id FROM recurring_invoice WHERE recurring_state = $1 AND next_date <= CURRENT_DATE ORDER BY next_date", RECURRING_ACTIVE)
+	db.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	issued := 0
+	for _, id := range ids {
+		for {
+			run, ok, err := g.issue(ctx, id)
+			if err != nil {
+				logger.Log("recurring", id, "err", err)
+				break
+			}
+			if !ok {
+				break
+			}
+			if run.Error != "" {
+				logger.Log("recurring", id, "occurrence", run.OccurrenceDate, "err", run.Error)
+				continue
+			}
+			issued++
+		}
+	}
+	return issued, nil
+}
+
+// issue issues the next occurrence of the recurring invoice if it is due, it returns false when
+// there is nothing to issue. The occurrence is claimed and the schedule moved forward before the
+// invoice is created, so an occurrence is never billed twice ; a failure is kept in the history, and
+// a claim left without outcome is marked interrupted by Issue after Timeout.
+func (g *RecurringIssuer) issue(ctx context.Context, id string) (RecurringRun, bool, error) {
+	db := GetDbConnexion(g.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return RecurringRun{}, false, err
+	}
+	defer tx.Rollback()
+
+	r := RecurringInvoice{}
+	err = tx.Get(&r, "SELECT "+recurringColumns+" FROM recurring_invoice WHERE recurring_id=$1 AND recurring_state = $2 AND next_date <= CURRENT_DATE FOR UPDATE SKIP LOCKED", id, RECURRING_ACTIVE)
+	if err == sql.ErrNoRows {
+		return RecurringRun{}, false, nil
+	}
+	if err != nil {
+		return RecurringRun{}, false, err
+	}
+
+	occurrence, err := time.Parse("2006-01-02", r.NextDate)
+	if err != nil {
+		return RecurringRun{}, false, err
+	}
+	next, ok, err := r.next(occurrence)
+	if err != nil {
+		return RecurringRun{}, false, err
+	}
+	if ok {
+		_, err = tx.Exec("UPDATE recurring_invoice SET next_date = $1 WHERE recurring_id=$2", next.Format("2006-01-02"), id)
+	} else {
+		_, err = tx.Exec("UPDATE recurring_invoice SET recurring_state = $1, next_date = NULL WHERE recurring_id=$2", RECURRING_ENDED, id)
+	}
+	if err != nil {
+		return RecurringRun{}, false, err
+	}
+
+	run := RecurringRun{RecurringID: id, OccurrenceDate: r.NextDate}
+	_, err = tx.Exec("INSERT INTO recurring_invoice_run (recurring_id, occurrence_date, claimed_at) VALUES ($1, $2, now())", id, r.NextDate)
+	if err != nil {
+		return RecurringRun{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return RecurringRun{}, false, err
+	}
+
+	invoice, err := g.Service.Create(ctx, r.invoice(occurrence))
+	if err != nil {
+		run.Error = err.Error()
+	}
+	run.InvoiceID = invoice.ID
+	_, err = db.Exec("UPDATE recurring_invoice_run SET invoice_id = $1, run_error = $2 WHERE recurring_id=$3 AND occurrence_date=$4", run.InvoiceID, run.Error, id, r.NextDate)
+	if err != nil {
+		return RecurringRun{}, false, err
+	}
+	return run, true, nil
+}
+
+func (g *RecurringIssuer) Schedule(ctx context.Context, interval time.Duration, logger log.Logger) {
+	RunEvery(ctx, interval, func(ctx context.Context) {
+		issued, err := g.Issue(ctx, logger)
+		if err != nil {
+			logger.Log("recurring", "failed", "err", err)
+			return
+		}
+		logger.Log("recurring", "issued", "count", issued)
+	})
+}
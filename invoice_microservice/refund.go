@@ -0,0 +1,214 @@
+package invoice_microservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/xid"
+)
+
+var (
+	ErrNotRefundable  = errors.New("only paid or partially paid invoices can be refunded")
+	ErrRefundTooLarge = errors.New("refund exceeds the amount left to refund on the invoice")
+	ErrNotCancellable = errors.New("only unpaid invoices can be cancelled, paid invoices are refunded")
+)
+
+// CreditNote is the document issued for each refund of an invoice.
+type CreditNote struct {
+	ID            string  `json:"credit_note_id" db:"credit_note_id"`
+	InvoiceID     string  `json:"invoice_id" db:"invoice_id"`
+	Amount        float64 `json:"credit_note_amount" db:"credit_note_amount"`
+	Reason        string  `json:"credit_note_reason" db:"credit_note_reason"`
+	TransactionID string  `json:"transaction_id" db:"transaction_id"`
+	Date          string  `json:"credit_note_date" db:"credit_note_date"`
+}
+
+// RefundInvoice sends amount back from the receiver to the payer of a paid or partially paid invoice
+// and issues the matching credit note. A zero amount refunds everything that has not been refunded yet.
+// A partially paid invoice is closed by its refund, what was left to pay is no longer collected and
+// is cancelled by a credit note without transaction, as CancelInvoice does.
+func (s *invoiceService) RefundInvoice(ctx context.Context, id string, amount float64, reason string) (CreditNote, error) {
+	if id == "" {
+		return CreditNote{}, ErrNotAnId
+	}
+	if amount < 0 {
+		return CreditNote{}, ErrInvalidAmount
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return CreditNote{}, err
+	}
+	defer tx.Rollback()
+
+	// La facture reste verrouillée jusqu'à la fin de la transaction, deux remboursements concurrents
+	// ne peuvent donc pas dépasser le montant payé
+	invoice := Invoice{}
+	if err := tx.Get(&invoice, "SELECT * FROM invoice WHERE invoice_id=$1 FOR UPDATE", id); err != nil {
+		if err == sql.ErrNoRows {
+			return CreditNote{}, ErrNotFound
+		}
+		return CreditNote{}, err
+	}
+	if invoice.State != PAID && invoice.State != PARTIALLY_PAID && invoice.State != PARTIALLY_REFUNDED {
+		return CreditNote{}, ErrNotRefundable
+	}
+
+	// Seuls les avoirs de remboursement ont rendu de l'argent, ceux d'annulation n'ont pas de transaction
+	refunded := float64(0.0)
+	if err := tx.Get(&refunded, "SELECT COALESCE(SUM(credit_note_amount), 0) FROM credit_note WHERE invoice_id=$1 AND transaction_id <> ''", id); err != nil {
+		return CreditNote{}, err
+	}
+
+	left := roundCents(invoice.PaidAmount - refunded)
+	if amount == 0 {
+		amount = left
+	}
+	amount = roundCents(amount)
+	if amount > left {
+		return CreditNote{}, ErrRefundTooLarge
+	}
+
+	transactionID, err := postTransfer(tx, invoice.AccountReceiverId, invoice.AccountPayerId, amount, invoice.ID, "Avoir facture "+invoice.ID)
+	if err != nil {
+		return CreditNote{}, err
+	}
+
+	note := CreditNote{
+		ID:            xid.New().String(),
+		InvoiceID:     invoice.ID,
+		Amount:        amount,
+		Reason:        reason,
+		TransactionID: transactionID,
+	}
+	_, err = tx.Exec("INSERT INTO credit_note (credit_note_id, invoice_id, credit_note_amount, credit_note_reason, transaction_id) VALUES ($1, $2, $3, $4, $5)",
+		note.ID, note.InvoiceID, note.Amount, note.Reason, note.TransactionID)
+	if err != nil {
+		return CreditNote{}, err
+	}
+
+	state := PARTIALLY_REFUNDED
+	if amount == left {
+		state = REFUNDED
+	}
+	if _, err := tx.Exec("UPDATE invoice SET invoice_state = $1 WHERE invoice_id=$2", state, invoice.ID); err != nil {
+		return CreditNote{}, err
+	}
+	if invoice.State == PARTIALLY_PAID {
+		if remaining := invoice.Remaining(); remaining > 0 {
+			_, err := tx.Exec("INSERT INTO credit_note (credit_note_id, invoice_id, credit_note_amount, credit_note_reason, transaction_id) VALUES ($1, $2, $3, $4, '')",
+				xid.New().String(), invoice.ID, remaining, reason)
+			if err != nil {
+				return CreditNote{}, err
+			}
+		}
+		if err := cancelCollection(tx, invoice.ID, "invoice refunded"); err != nil {
+			return CreditNote{}, err
+		}
+	}
+
+	if err := tx.Get(&note.Date, "SELECT credit_note_date FROM credit_note WHERE credit_note_id=$1", note.ID); err != nil {
+		return CreditNote{}, err
+	}
+
+	invoice.State = state
+	if err := enqueueEvents(tx, NewEvent(InvoiceRefunded, invoice, amount)); err != nil {
+		return CreditNote{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return CreditNote{}, err
+	}
+
+	return note, nil
+}
+
+// CancelInvoice cancels an invoice that was not paid and issues the credit note that cancels its
+// amount. Unlike a refund no money is moved, the credit note has no transaction.
+func (s *invoiceService) CancelInvoice(ctx context.Context, id string, reason string) (CreditNote, error) {
+	if id == "" {
+		return CreditNote{}, ErrNotAnId
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return CreditNote{}, err
+	}
+	defer tx.Rollback()
+
+	invoice := Invoice{}
+	if err := tx.Get(&invoice, "SELECT * FROM invoice WHERE invoice_id=$1 FOR UPDATE", id); err != nil {
+		if err == sql.ErrNoRows {
+			return CreditNote{}, ErrNotFound
+		}
+		return CreditNote{}, err
+	}
+	if !payable(invoice.State) || invoice.PaidAmount > 0 {
+		return CreditNote{}, ErrNotCancellable
+	}
+
+	note := CreditNote{
+		ID:        xid.New().String(),
+		InvoiceID: invoice.ID,
+		Amount:    invoice.Amount,
+		Reason:    reason,
+	}
+	err = tx.Get(&note.Date, `INSERT INTO credit_note (credit_note_id, invoice_id, credit_note_amount, credit_note_reason, transaction_id) VALUES ($1, $2, $3, $4, '')
+		RETURNING credit_note_date`, note.ID, note.InvoiceID, note.Amount, note.Reason)
+	if err != nil {
+		return CreditNote{}, err
+	}
+
+	if _, err := tx.Exec("UPDATE invoice SET invoice_state = $1 WHERE invoice_id=$2", CANCELLED, invoice.ID); err != nil {
+		return CreditNote{}, err
+	}
+	if err := cancelCollection(tx, invoice.ID, "invoice cancelled"); err != nil {
+		return CreditNote{}, err
+	}
+
+	invoice.State = CANCELLED
+	if err := enqueueEvents(tx, NewEvent(InvoiceCancelled, invoice, 0)); err != nil {
+		return CreditNote{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return CreditNote{}, err
+	}
+	return note, nil
+}
+
+// cancelCollection cancels inside tx the pending installments and scheduled payments of an invoice
+// that will not be paid anymore.
+func cancelCollection(tx *sqlx.Tx, invoiceID string, reason string) error {
+	if _, err := tx.Exec("UPDATE installment SET installment_state = $1 WHERE invoice_id=$2 AND installment_state = $3", CANCELLED, invoiceID, PENDING); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE scheduled_payment SET scheduled_payment_state = $1, last_error = $2 WHERE invoice_id=$3 AND scheduled_payment_state = $4",
+		SCHEDULED_PAYMENT_CANCELLED, reason, invoiceID, SCHEDULED_PAYMENT_SCHEDULED)
+	return err
+}
+
+func (s *invoiceService) GetCreditNotes(ctx context.Context, invoiceID string) ([]CreditNote, error) {
+	if invoiceID == "" {
+		return nil, ErrNotAnId
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	notes := make([]CreditNote, 0)
+	err := db.Select(&notes, "SELECT * FROM credit_note WHERE invoice_id=$1 ORDER BY credit_note_date, credit_note_id", invoiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return notes, nil
+}
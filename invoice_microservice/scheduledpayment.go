@@ -0,0 +1,298 @@
+package invoice_microservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/xid"
+)
+
+// États d'un paiement programmé
+const (
+	SCHEDULED_PAYMENT_SCHEDULED = "SCHEDULED"
+	SCHEDULED_PAYMENT_PAID      = "PAID"
+	SCHEDULED_PAYMENT_FAILED    = "FAILED"
+	SCHEDULED_PAYMENT_CANCELLED = "CANCELLED"
+)
+
+var (
+	ErrNotPayer                  = errors.New("only the payer of the invoice can perform this operation")
+	ErrInvalidPaymentDate        = errors.New("payment date must be a date (2006-01-02) from today")
+	ErrPaymentAlreadyScheduled   = errors.New("a payment of the invoice is already scheduled")
+	ErrScheduledPaymentNotFound  = errors.New("scheduled payment not found")
+	ErrScheduledPaymentCompleted = errors.New("scheduled payment is already paid, failed or cancelled")
+	ErrAboveScheduledAmount      = errors.New("invoice amount is above the maximum amount of the scheduled payment")
+)
+
+const scheduledPaymentColumns = `scheduled_payment_id, invoice_id, payer_id, scheduled_date::text AS scheduled_date, scheduled_payment_state,
+	attempts, last_error, COALESCE(next_attempt_at::date::text, '') AS next_attempt_at, created_at, COALESCE(paid_at::text, '') AS paid_at,
+	COALESCE(max_amount, 0) AS max_amount`
+
+// ScheduledPayment pays the whole invoice on the chosen date, with PayInvoice. A payment scheduled
+// by a mandate fails if the invoice then costs more than MaxAmount, the amount the mandate accepted.
+type ScheduledPayment struct {
+	ID          string  `json:"scheduled_payment_id" db:"scheduled_payment_id"`
+	InvoiceID   string  `json:"invoice_id" db:"invoice_id"`
+	PayerID     string  `json:"payer_id" db:"payer_id"`
+	Date        string  `json:"scheduled_date" db:"scheduled_date"`
+	State       string  `json:"state" db:"scheduled_payment_state"`
+	Attempts    int     `json:"attempts" db:"attempts"`
+	LastError   string  `json:"last_error,omitempty" db:"last_error"`
+	NextAttempt string  `json:"next_attempt,omitempty" db:"next_attempt_at"` // date du prochain essai
+	CreatedAt   string  `json:"created_at" db:"created_at"`
+	PaidAt      string  `json:"paid_at,omitempty" db:"paid_at"`
+	MaxAmount   float64 `json:"max_amount,omitempty" db:"max_amount"` // 0 sans plafond
+}
+
+// SchedulePayment schedules the payment of the invoice by its payer on the given date, on its
+// expiration date when date is empty. An invoice has at most one scheduled payment at a time.
+func (s *invoiceService) SchedulePayment(ctx context.Context, invoiceID string, payerID string, date string) (ScheduledPayment, error) {
+	if invoiceID == "" || payerID == "" {
+		return ScheduledPayment{}, ErrNotAnId
+	}
+
+	invoice, err := s.Read(ctx, invoiceID)
+	if err != nil || (invoice == Invoice{}) {
+		return ScheduledPayment{}, ErrNotFound
+	}
+	if invoice.AccountPayerId != payerID {
+		return ScheduledPayment{}, ErrNotPayer
+	}
+	if !payable(invoice.State) {
+		return ScheduledPayment{}, ErrAlreadyPaid
+	}
+
+	if date == "" {
+		date = dateOnly(invoice.ExpirationDate)
+	}
+	day, err := time.Parse("2006-01-02", date)
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if err != nil || day.Before(today) {
+		return ScheduledPayment{}, ErrInvalidPaymentDate
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	payment := ScheduledPayment{ID: xid.New().String()}
+	if err := insertScheduledPayment(db, payment.ID, invoiceID, payerID, date, 0); err != nil {
+		return ScheduledPayment{}, err
+	}
+
+	if err := db.Get(&payment, "SELECT "+scheduledPaymentColumns+" FROM scheduled_payment WHERE scheduled_payment_id=$1", payment.ID); err != nil {
+		return ScheduledPayment{}, err
+	}
+	return payment, nil
+}
+
+// insertScheduledPayment schedules the payment of the invoice on the given date, of at most maxAmount
+// when it is not 0.
+func insertScheduledPayment(db sqlx.Execer, id string, invoiceID string, payerID string, date string, maxAmount float64) error {
+	var max interface{}
+	if maxAmount > 0 {
+		max = maxAmount
+	}
+	res, err := db.Exec(`INSERT INTO scheduled_payment (scheduled_payment_id, invoice_id, payer_id, scheduled_date, scheduled_payment_state, next_attempt_at, max_amount)
+		VALUES ($1, $2, $3, $4, $5, $4::date, $6) ON CONFLICT (invoice_id) WHERE scheduled_payment_state = 'SCHEDULED' DO NOTHING`,
+		id, invoiceID, payerID, date, SCHEDULED_PAYMENT_SCHEDULED, max)
+	if err != nil {
+		return err
+	}
+	if inserted, _ := res.RowsAffected(); inserted == 0 {
+		return ErrPaymentAlreadyScheduled
+	}
+	return nil
+}
+
+// GetScheduledPayments returns the scheduled payments of the given payer, the most recent first.
+func (s *invoiceService) GetScheduledPayments(ctx context.Context, payerID string) ([]ScheduledPayment, error) {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	payments := make([]ScheduledPayment, 0)
+	err := db.Select(&payments, "SELECT "+scheduledPaymentColumns+" FROM scheduled_payment WHERE payer_id=$1 ORDER BY scheduled_date DESC, created_at DESC", payerID)
+	if err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+// CancelScheduledPayment cancels a payment that has not been made yet.
+func (s *invoiceService) CancelScheduledPayment(ctx context.Context, id string) (ScheduledPayment, error) {
+	if id == "" {
+		return ScheduledPayment{}, ErrNotAnId
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	payment := ScheduledPayment{}
+	err := db.Get(&payment, "UPDATE scheduled_payment SET scheduled_payment_state = $1 WHERE scheduled_payment_id=$2 AND scheduled_payment_state = $3 RETURNING "+scheduledPaymentColumns,
+		SCHEDULED_PAYMENT_CANCELLED, id, SCHEDULED_PAYMENT_SCHEDULED)
+	if err == sql.ErrNoRows {
+		exists := 0
+		if err := db.Get(&exists, "SELECT COUNT(*) FROM scheduled_payment WHERE scheduled_payment_id=$1", id); err != nil {
+			return ScheduledPayment{}, err
+		}
+		if exists == 0 {
+			return ScheduledPayment{}, ErrScheduledPaymentNotFound
+		}
+		return ScheduledPayment{}, ErrScheduledPaymentCompleted
+	}
+	if err != nil {
+		return ScheduledPayment{}, err
+	}
+	return payment, nil
+}
+
+// PaymentScheduler makes the scheduled payments that reached their date. A payment that fails
+// because the payer cannot cover it is attempted again every RetryDelay, until MaxAttempts.
+type PaymentScheduler struct {
+	DbInfos       DbConnexionInfo
+	Service       InvoiceService
+	Notifications *Notifications // nil si les emails ne sont pas configurés
+	MaxAttempts   int
+	RetryDelay    time.Duration
+}
+
+func NewPaymentScheduler(dbinfos DbConnexionInfo, s InvoiceService, notifications *Notifications) *PaymentScheduler {
+	return &PaymentScheduler{
+		DbInfos:       dbinfos,
+		Service:       s,
+		Notifications: notifications,
+		MaxAttempts:   3,
+		RetryDelay:    24 * time.Hour,
+	}
+}
+
+// Run makes every due payment and returns the number of invoices paid.
+func (p *PaymentScheduler) Run(ctx context.Context, logger log.Logger) (int, error) {
+	db := GetDbConnexion(p.DbInfos)
+	ids := make([]string, 0)
+	err := db.Select(&ids, "SELECT scheduled_payment_id FROM scheduled_payment WHERE scheduled_payment_state = $1 AND next_attempt_at <= now() ORDER BY next_attempt_at", SCHEDULED_PAYMENT_SCHEDULED)
+	db.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	paid := 0
+	for _, id := range ids {
+		payment, err := p.pay(ctx, id)
+		if err != nil {
+			logger.Log("scheduled_payment", id, "err", err)
+			continue
+		}
+		if payment.State == SCHEDULED_PAYMENT_PAID {
+			paid++
+		}
+	}
+	return paid, nil
+}
+
+// retryable returns true if the payment can succeed later.
+func (p *PaymentScheduler) retryable(err error) bool {
+	switch err {
+	case ErrNotFound, ErrAccountNotFound, ErrSameAccount, ErrAlreadyPaid, ErrAboveScheduledAmount:
+		return false
+	default:
+		return true
+	}
+}
+
+// pay makes the scheduled payment. The row stays locked during the payment so it is made once, and
+// PayInvoice refuses an invoice already paid if the outcome could not be saved.
+func (p *PaymentScheduler) pay(ctx context.Context, id string) (ScheduledPayment, error) {
+	db := GetDbConnexion(p.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return ScheduledPayment{}, err
+	}
+	defer tx.Rollback()
+
+	payment := ScheduledPayment{}
+	err = tx.Get(&payment, "SELECT "+scheduledPaymentColumns+" FROM scheduled_payment WHERE scheduled_payment_id=$1 AND scheduled_payment_state = $2 AND next_attempt_at <= now() FOR UPDATE SKIP LOCKED", id, SCHEDULED_PAYMENT_SCHEDULED)
+	if err == sql.ErrNoRows {
+		return ScheduledPayment{}, nil
+	}
+	if err != nil {
+		return ScheduledPayment{}, err
+	}
+
+	payment.Attempts++
+	payErr := p.checkMaxAmount(ctx, payment)
+	if payErr == nil {
+		_, payErr = p.Service.PayInvoice(ctx, payment.InvoiceID)
+	}
+	switch {
+	case payErr == nil:
+		payment.State = SCHEDULED_PAYMENT_PAID
+		payment.LastError = ""
+		_, err = tx.Exec("UPDATE scheduled_payment SET scheduled_payment_state = $1, attempts = $2, last_error = '', paid_at = now() WHERE scheduled_payment_id=$3",
+			payment.State, payment.Attempts, payment.ID)
+	case payErr == ErrAlreadyPaid:
+		// La facture a été payée autrement
+		payment.State = SCHEDULED_PAYMENT_CANCELLED
+		payment.LastError = payErr.Error()
+		_, err = tx.Exec("UPDATE scheduled_payment SET scheduled_payment_state = $1, attempts = $2, last_error = $3 WHERE scheduled_payment_id=$4",
+			payment.State, payment.Attempts, payment.LastError, payment.ID)
+	default:
+		payment.LastError = payErr.Error()
+		next := time.Now().Add(p.RetryDelay)
+		payment.NextAttempt = next.Format("2006-01-02")
+		if !p.retryable(payErr) || payment.Attempts >= p.MaxAttempts {
+			payment.State = SCHEDULED_PAYMENT_FAILED
+			payment.NextAttempt = ""
+		}
+		_, err = tx.Exec("UPDATE scheduled_payment SET scheduled_payment_state = $1, attempts = $2, last_error = $3, next_attempt_at = $4 WHERE scheduled_payment_id=$5",
+			payment.State, payment.Attempts, payment.LastError, next, payment.ID)
+	}
+	if err != nil {
+		return ScheduledPayment{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return ScheduledPayment{}, err
+	}
+
+	// Un paiement réussi est annoncé par l'email de paiement de la facture
+	if payErr != nil && payErr != ErrAlreadyPaid && p.Notifications != nil {
+		if invoice, err := p.Service.Read(ctx, payment.InvoiceID); err == nil {
+			if err := p.Notifications.ScheduledPaymentFailed(ctx, payment, invoice); err != nil {
+				return payment, err
+			}
+		}
+	}
+	return payment, nil
+}
+
+// checkMaxAmount refuses the payment if the invoice costs more than the maximum amount of the payment,
+// after late fees for instance.
+func (p *PaymentScheduler) checkMaxAmount(ctx context.Context, payment ScheduledPayment) error {
+	if payment.MaxAmount <= 0 {
+		return nil
+	}
+	invoice, err := p.Service.Read(ctx, payment.InvoiceID)
+	if err != nil {
+		return err
+	}
+	if roundCents(invoice.Payable(time.Now())) > roundCents(payment.MaxAmount) {
+		return ErrAboveScheduledAmount
+	}
+	return nil
+}
+
+func (p *PaymentScheduler) Schedule(ctx context.Context, interval time.Duration, logger log.Logger) {
+	RunEvery(ctx, interval, func(ctx context.Context) {
+		paid, err := p.Run(ctx, logger)
+		if err != nil {
+			logger.Log("scheduled_payments", "failed", "err", err)
+			return
+		}
+		logger.Log("scheduled_payments", "paid", "count", paid)
+	})
+}
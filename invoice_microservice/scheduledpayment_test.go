@@ -0,0 +1,21 @@
+package invoice_microservice
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestScheduledPaymentRetry(t *testing.T) {
+	p := NewPaymentScheduler(DbConnexionInfo{}, nil, nil)
+
+	for _, err := range []error{ErrInsufficientBalance, ErrAccountQuarantined, errors.New("connection reset")} {
+		if !p.retryable(err) {
+			t.Errorf("Expected %v to be attempted again", err)
+		}
+	}
+	for _, err := range []error{ErrNotFound, ErrAccountNotFound, ErrSameAccount, ErrAlreadyPaid} {
+		if p.retryable(err) {
+			t.Errorf("Expected %v to fail the payment", err)
+		}
+	}
+}
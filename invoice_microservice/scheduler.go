@@ -0,0 +1,22 @@
+package invoice_microservice
+
+import (
+	"context"
+	"time"
+)
+
+// RunEvery calls job every interval until ctx is done. The runs never overlap, a run that takes
+// longer than the interval delays the next one.
+func RunEvery(ctx context.Context, interval time.Duration, job func(ctx context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			job(ctx)
+		}
+	}
+}
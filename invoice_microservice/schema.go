@@ -0,0 +1,347 @@
+package invoice_microservice
+
+// Les tables invoice et account sont créées par le microservice des comptes,
+// on ne crée ici que les tables propres au microservice des factures.
+var schema = []string{
+	`ALTER TABLE invoice ADD COLUMN IF NOT EXISTS invoice_paid_amount NUMERIC(15, 2) NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS ledger_entry (
+		entry_id VARCHAR(20) PRIMARY KEY,
+		transaction_id VARCHAR(20) NOT NULL,
+		client_id VARCHAR NOT NULL,
+		invoice_id VARCHAR,
+		entry_type VARCHAR(6) NOT NULL CHECK (entry_type IN ('DEBIT', 'CREDIT')),
+		entry_amount NUMERIC(15, 2) NOT NULL CHECK (entry_amount > 0),
+		entry_label VARCHAR NOT NULL DEFAULT '',
+		entry_date TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS ledger_entry_client_idx ON ledger_entry (client_id, entry_date)`,
+	`CREATE INDEX IF NOT EXISTS ledger_entry_transaction_idx ON ledger_entry (transaction_id)`,
+	`CREATE INDEX IF NOT EXISTS ledger_entry_invoice_idx ON ledger_entry (invoice_id)`,
+	`CREATE TABLE IF NOT EXISTS reconciliation_checkpoint (
+		client_id VARCHAR PRIMARY KEY,
+		balance NUMERIC(15, 2) NOT NULL,
+		ledger_total NUMERIC(15, 2) NOT NULL,
+		checkpoint_date TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS account_quarantine (
+		client_id VARCHAR PRIMARY KEY,
+		quarantine_reason VARCHAR NOT NULL,
+		quarantine_date TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS credit_note (
+		credit_note_id VARCHAR(20) PRIMARY KEY,
+		invoice_id VARCHAR NOT NULL,
+		credit_note_amount NUMERIC(15, 2) NOT NULL CHECK (credit_note_amount > 0),
+		credit_note_reason VARCHAR NOT NULL DEFAULT '',
+		transaction_id VARCHAR(20) NOT NULL,
+		credit_note_date TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS credit_note_invoice_idx ON credit_note (invoice_id)`,
+	`CREATE TABLE IF NOT EXISTS installment (
+		installment_id VARCHAR(20) PRIMARY KEY,
+		invoice_id VARCHAR NOT NULL,
+		installment_number INTEGER NOT NULL,
+		installment_due_date DATE NOT NULL,
+		installment_amount NUMERIC(15, 2) NOT NULL CHECK (installment_amount > 0),
+		installment_state INTEGER NOT NULL DEFAULT 0,
+		installment_paid_date TIMESTAMPTZ,
+		UNIQUE (invoice_id, installment_number)
+	)`,
+	`CREATE INDEX IF NOT EXISTS installment_due_idx ON installment (installment_state, installment_due_date)`,
+	`CREATE TABLE IF NOT EXISTS invoice_line_item (
+		item_id VARCHAR(20) PRIMARY KEY,
+		invoice_id VARCHAR NOT NULL,
+		item_position INTEGER NOT NULL,
+		item_description VARCHAR NOT NULL,
+		item_quantity NUMERIC(15, 3) NOT NULL CHECK (item_quantity > 0),
+		item_unit_price NUMERIC(15, 2) NOT NULL CHECK (item_unit_price >= 0),
+		item_tax_rate NUMERIC(5, 2) NOT NULL DEFAULT 0,
+		item_discount NUMERIC(5, 2) NOT NULL DEFAULT 0,
+		item_total NUMERIC(15, 2) NOT NULL,
+		UNIQUE (invoice_id, item_position)
+	)`,
+	`ALTER TABLE invoice_line_item ADD COLUMN IF NOT EXISTS item_net_amount NUMERIC(15, 2) NOT NULL DEFAULT 0`,
+	`ALTER TABLE invoice_line_item ADD COLUMN IF NOT EXISTS item_tax_amount NUMERIC(15, 2) NOT NULL DEFAULT 0`,
+	`ALTER TABLE invoice ADD COLUMN IF NOT EXISTS invoice_tax_jurisdiction VARCHAR(8) NOT NULL DEFAULT 'FR'`,
+	`CREATE TABLE IF NOT EXISTS invoice_tax_breakdown (
+		invoice_id VARCHAR NOT NULL,
+		tax_rate NUMERIC(5, 2) NOT NULL,
+		net_amount NUMERIC(15, 2) NOT NULL,
+		tax_amount NUMERIC(15, 2) NOT NULL,
+		gross_amount NUMERIC(15, 2) NOT NULL,
+		PRIMARY KEY (invoice_id, tax_rate)
+	)`,
+	`CREATE TABLE IF NOT EXISTS late_fee_policy (
+		issuer_id VARCHAR PRIMARY KEY,
+		fixed_fee NUMERIC(15, 2) NOT NULL DEFAULT 0,
+		annual_interest_rate NUMERIC(7, 4) NOT NULL DEFAULT 0,
+		max_fee NUMERIC(15, 2) NOT NULL DEFAULT 0,
+		grace_days INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS invoice_late_fee (
+		invoice_id VARCHAR NOT NULL,
+		fee_type VARCHAR(16) NOT NULL,
+		fee_amount NUMERIC(15, 2) NOT NULL,
+		days_late INTEGER NOT NULL,
+		fee_date TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	// Une ligne par pénalité ajoutée : la pénalité fixe une fois, les intérêts à chaque échéance
+	`ALTER TABLE invoice_late_fee DROP CONSTRAINT IF EXISTS invoice_late_fee_pkey`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS invoice_late_fee_accrual_idx ON invoice_late_fee (invoice_id, fee_type, days_late)`,
+	`ALTER TABLE invoice ADD COLUMN IF NOT EXISTS invoice_discount_rate NUMERIC(5, 2) NOT NULL DEFAULT 0`,
+	`ALTER TABLE invoice ADD COLUMN IF NOT EXISTS invoice_discount_deadline VARCHAR(10) NOT NULL DEFAULT ''`,
+	`ALTER TABLE invoice ADD COLUMN IF NOT EXISTS invoice_discount_amount NUMERIC(15, 2) NOT NULL DEFAULT 0`,
+	`ALTER TABLE invoice ADD COLUMN IF NOT EXISTS invoice_created_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	`ALTER TABLE invoice ADD COLUMN IF NOT EXISTS invoice_number VARCHAR(64) NOT NULL DEFAULT ''`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS invoice_number_idx ON invoice (account_invoice_receiver_id, invoice_number) WHERE invoice_number <> ''`,
+	`CREATE TABLE IF NOT EXISTS numbering_policy (
+		issuer_id VARCHAR PRIMARY KEY,
+		prefix VARCHAR(32) NOT NULL DEFAULT '',
+		format VARCHAR(64) NOT NULL,
+		padding INTEGER NOT NULL,
+		yearly_reset BOOLEAN NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS invoice_sequence (
+		issuer_id VARCHAR NOT NULL,
+		sequence_year INTEGER NOT NULL,
+		last_number INTEGER NOT NULL,
+		PRIMARY KEY (issuer_id, sequence_year)
+	)`,
+	`CREATE TABLE IF NOT EXISTS event_outbox (
+		outbox_id BIGSERIAL PRIMARY KEY,
+		event_id VARCHAR NOT NULL UNIQUE,
+		event_type VARCHAR(64) NOT NULL,
+		invoice_id VARCHAR NOT NULL,
+		payload TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		sent_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS event_outbox_pending_idx ON event_outbox (outbox_id) WHERE sent_at IS NULL`,
+	`CREATE TABLE IF NOT EXISTS webhook (
+		webhook_id VARCHAR PRIMARY KEY,
+		client_id VARCHAR NOT NULL,
+		webhook_url TEXT NOT NULL,
+		event_types TEXT[] NOT NULL DEFAULT '{}',
+		webhook_secret VARCHAR NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhook_client_idx ON webhook (client_id)`,
+	`CREATE TABLE IF NOT EXISTS webhook_delivery (
+		delivery_id VARCHAR PRIMARY KEY,
+		webhook_id VARCHAR NOT NULL,
+		event_id VARCHAR NOT NULL,
+		event_type VARCHAR(64) NOT NULL,
+		payload TEXT NOT NULL,
+		delivery_state VARCHAR(16) NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_status_code INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		UNIQUE (webhook_id, event_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhook_delivery_pending_idx ON webhook_delivery (next_attempt_at) WHERE delivery_state = 'PENDING'`,
+	`CREATE TABLE IF NOT EXISTS webhook_attempt (
+		attempt_id BIGSERIAL PRIMARY KEY,
+		delivery_id VARCHAR NOT NULL,
+		attempt INTEGER NOT NULL,
+		status_code INTEGER NOT NULL,
+		attempt_error TEXT NOT NULL,
+		response TEXT NOT NULL,
+		duration_ms BIGINT NOT NULL,
+		attempted_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhook_attempt_delivery_idx ON webhook_attempt (delivery_id)`,
+	`CREATE TABLE IF NOT EXISTS notification_preference (
+		client_id VARCHAR PRIMARY KEY,
+		language VARCHAR(2) NOT NULL DEFAULT 'fr',
+		disabled BOOLEAN NOT NULL DEFAULT false
+	)`,
+	`CREATE TABLE IF NOT EXISTS notification (
+		notification_id VARCHAR PRIMARY KEY,
+		notification_key VARCHAR NOT NULL UNIQUE,
+		client_id VARCHAR NOT NULL,
+		invoice_id VARCHAR NOT NULL,
+		kind VARCHAR(16) NOT NULL,
+		recipient VARCHAR NOT NULL,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL,
+		notification_state VARCHAR(16) NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		sent_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS notification_pending_idx ON notification (next_attempt_at) WHERE notification_state = 'PENDING'`,
+	`CREATE TABLE IF NOT EXISTS recurring_invoice (
+		recurring_id VARCHAR PRIMARY KEY,
+		issuer_id VARCHAR NOT NULL,
+		payer_id VARCHAR NOT NULL,
+		amount NUMERIC(15, 2) NOT NULL CHECK (amount > 0),
+		tax_jurisdiction VARCHAR(8) NOT NULL DEFAULT '',
+		frequency VARCHAR(8) NOT NULL,
+		day_of_month INTEGER NOT NULL DEFAULT 0,
+		weekday VARCHAR(2) NOT NULL DEFAULT '',
+		rrule TEXT NOT NULL,
+		start_date DATE NOT NULL,
+		end_date DATE,
+		due_days INTEGER NOT NULL DEFAULT 0,
+		recurring_state VARCHAR(16) NOT NULL,
+		next_date DATE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS recurring_invoice_due_idx ON recurring_invoice (next_date) WHERE recurring_state = 'ACTIVE'`,
+	`CREATE TABLE IF NOT EXISTS recurring_invoice_run (
+		recurring_id VARCHAR NOT NULL,
+		occurrence_date DATE NOT NULL,
+		invoice_id VARCHAR NOT NULL DEFAULT '',
+		run_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (recurring_id, occurrence_date)
+	)`,
+	`ALTER TABLE recurring_invoice_run ADD COLUMN IF NOT EXISTS claimed_at TIMESTAMPTZ`,
+	`CREATE INDEX IF NOT EXISTS recurring_invoice_run_claimed_idx ON recurring_invoice_run (claimed_at) WHERE invoice_id = '' AND run_error = ''`,
+	`CREATE TABLE IF NOT EXISTS scheduled_payment (
+		scheduled_payment_id VARCHAR PRIMARY KEY,
+		invoice_id VARCHAR NOT NULL,
+		payer_id VARCHAR NOT NULL,
+		scheduled_date DATE NOT NULL,
+		scheduled_payment_state VARCHAR(16) NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		paid_at TIMESTAMPTZ
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS scheduled_payment_invoice_idx ON scheduled_payment (invoice_id) WHERE scheduled_payment_state = 'SCHEDULED'`,
+	`CREATE INDEX IF NOT EXISTS scheduled_payment_payer_idx ON scheduled_payment (payer_id)`,
+	// Montant accepté par le mandat qui a programmé le paiement
+	`ALTER TABLE scheduled_payment ADD COLUMN IF NOT EXISTS max_amount NUMERIC(15, 2)`,
+	`CREATE TABLE IF NOT EXISTS mandate (
+		mandate_id VARCHAR PRIMARY KEY,
+		issuer_id VARCHAR NOT NULL,
+		payer_id VARCHAR NOT NULL,
+		max_per_invoice NUMERIC(15, 2) NOT NULL CHECK (max_per_invoice > 0),
+		max_per_month NUMERIC(15, 2) NOT NULL CHECK (max_per_month >= max_per_invoice),
+		pay_on VARCHAR(8) NOT NULL,
+		valid_from DATE NOT NULL,
+		valid_until DATE,
+		mandate_state VARCHAR(16) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS mandate_active_idx ON mandate (issuer_id, payer_id) WHERE mandate_state = 'ACTIVE'`,
+	`CREATE TABLE IF NOT EXISTS mandate_payment (
+		mandate_payment_id VARCHAR PRIMARY KEY,
+		mandate_id VARCHAR NOT NULL,
+		invoice_id VARCHAR NOT NULL,
+		amount NUMERIC(15, 2) NOT NULL,
+		decision VARCHAR(16) NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		payment_date DATE NOT NULL,
+		scheduled_payment_id VARCHAR NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS mandate_payment_mandate_idx ON mandate_payment (mandate_id, payment_date)`,
+	`CREATE TABLE IF NOT EXISTS payer_group (
+		group_id VARCHAR PRIMARY KEY,
+		owner_id VARCHAR NOT NULL,
+		group_name VARCHAR NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS payer_group_member (
+		group_id VARCHAR NOT NULL,
+		position INTEGER NOT NULL,
+		mail_adress VARCHAR NOT NULL,
+		PRIMARY KEY (group_id, position)
+	)`,
+	`CREATE TABLE IF NOT EXISTS bulk_invoice_job (
+		job_id VARCHAR PRIMARY KEY,
+		issuer_id VARCHAR NOT NULL,
+		group_id VARCHAR NOT NULL DEFAULT '',
+		amount NUMERIC(15, 2) NOT NULL CHECK (amount > 0),
+		expiration_date DATE NOT NULL,
+		tax_jurisdiction VARCHAR(8) NOT NULL DEFAULT '',
+		job_state VARCHAR(16) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		finished_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS bulk_invoice_job_issuer_idx ON bulk_invoice_job (issuer_id)`,
+	`CREATE TABLE IF NOT EXISTS bulk_invoice_item (
+		job_id VARCHAR NOT NULL,
+		position INTEGER NOT NULL,
+		payer_email VARCHAR NOT NULL,
+		item_state VARCHAR(16) NOT NULL,
+		invoice_id VARCHAR NOT NULL DEFAULT '',
+		item_error TEXT NOT NULL DEFAULT '',
+		claimed_at TIMESTAMPTZ,
+		PRIMARY KEY (job_id, position)
+	)`,
+	`CREATE INDEX IF NOT EXISTS bulk_invoice_item_processing_idx ON bulk_invoice_item (claimed_at) WHERE item_state = 'PROCESSING'`,
+	// Documents UBL importés, un document n'est importé qu'une fois par fournisseur
+	`CREATE TABLE IF NOT EXISTS ubl_import (
+		issuer_id VARCHAR NOT NULL,
+		external_id VARCHAR NOT NULL,
+		invoice_id VARCHAR NOT NULL,
+		imported_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (issuer_id, external_id)
+	)`,
+	// Ouverture du grand livre, faite une seule fois : les factures payées avant le suivi des paiements partiels
+	// l'ont été en totalité, les factures payées avant le grand livre reçoivent leurs écritures,
+	// et le solde de chaque compte qu'elles n'expliquent pas est repris contre le compte d'ouverture, pour que
+	// la réconciliation retrouve chaque solde à partir des écritures. Les points de contrôle existants
+	// comptent les écritures d'ouverture pour ne pas les voir comme des mouvements.
+	`CREATE TABLE IF NOT EXISTS ledger_opening (
+		opened_at TIMESTAMPTZ NOT NULL
+	)`,
+	`DO $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM ledger_opening) THEN
+			RETURN;
+		END IF;
+
+		-- Fait une seule fois : une facture soldée ensuite par son seul escompte est payée sans montant payé
+		UPDATE invoice SET invoice_paid_amount = invoice_amount WHERE invoice_state IN (1, 3, 4) AND invoice_paid_amount = 0;
+
+		INSERT INTO ledger_entry (entry_id, transaction_id, client_id, invoice_id, entry_type, entry_amount, entry_label, entry_date)
+		SELECT left(e.prefix || md5(i.invoice_id), 20), left('ot' || md5(i.invoice_id), 20), e.client_id, i.invoice_id, e.entry_type,
+			i.invoice_paid_amount, 'Reprise du paiement de la facture', i.invoice_created_at
+		FROM invoice i CROSS JOIN LATERAL (VALUES ('od', i.account_invoice_payer_id, 'DEBIT'), ('oc', i.account_invoice_receiver_id, 'CREDIT'))
+			AS e (prefix, client_id, entry_type)
+		WHERE i.invoice_paid_amount > 0 AND NOT EXISTS (SELECT 1 FROM ledger_entry l WHERE l.invoice_id = i.invoice_id);
+
+		INSERT INTO ledger_entry (entry_id, transaction_id, client_id, entry_type, entry_amount, entry_label)
+		SELECT left(e.prefix || md5(b.client_id), 20), left('ob' || md5(b.client_id), 20), e.client_id, e.entry_type, abs(b.opening), 'Solde d''ouverture'
+		FROM (SELECT a.client_id, a.account_amount - COALESCE(SUM(CASE WHEN l.entry_type = 'CREDIT' THEN l.entry_amount ELSE -l.entry_amount END), 0) AS opening
+			FROM account a LEFT JOIN ledger_entry l ON l.client_id = a.client_id GROUP BY a.client_id, a.account_amount) b
+		CROSS JOIN LATERAL (VALUES
+			('oa', b.client_id, CASE WHEN b.opening > 0 THEN 'CREDIT' ELSE 'DEBIT' END),
+			('oe', 'OPENING_BALANCE', CASE WHEN b.opening > 0 THEN 'DEBIT' ELSE 'CREDIT' END)) AS e (prefix, client_id, entry_type)
+		WHERE b.opening <> 0;
+
+		UPDATE reconciliation_checkpoint c SET ledger_total = c.ledger_total + o.net
+		FROM (SELECT client_id, SUM(CASE WHEN entry_type = 'CREDIT' THEN entry_amount ELSE -entry_amount END) AS net
+			FROM ledger_entry WHERE entry_id LIKE 'o%' AND transaction_id LIKE 'o%' AND entry_label IN ('Reprise du paiement de la facture', 'Solde d''ouverture')
+			GROUP BY client_id) o
+		WHERE o.client_id = c.client_id;
+
+		INSERT INTO ledger_opening (opened_at) VALUES (now());
+	END
+	$$`,
+}
+
+// CreateSchema creates the tables used by the service when they do not exist yet.
+func CreateSchema(info DbConnexionInfo) error {
+	db := GetDbConnexion(info)
+	defer db.Close()
+
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,21 +2,74 @@ package invoice_microservice
 
 import (
 	"context"
+	"database/sql"
 	"errors"
-	"fmt"
+	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/rs/xid"
 )
 
 type InvoiceService interface {
-	Create(ctx context.Context, invoice Invoice) (Invoice, error)
+	Create(ctx context.Context, invoice Invoice, items ...LineItem) (Invoice, error)
 	Read(ctx context.Context, id string) (Invoice, error)
-	Update(ctx context.Context, id string, invoice Invoice) (Invoice, error)
+	Update(ctx context.Context, id string, invoice Invoice, items ...LineItem) (Invoice, error)
 	Delete(ctx context.Context, id string) error
 	GetInvoiceList(ctx context.Context, id string) ([]Invoice, error)
 	GetIdFromMail(ctx context.Context, mail string) (string, error)
 	PayInvoice(ctx context.Context, id string) (bool, error)
 	GetAccountInformation(ctx context.Context, id string) (AccountInfo, error)
+	GetAccountsInformation(ctx context.Context, ids []string) (map[string]AccountInfo, error)
+	GetLedgerEntries(ctx context.Context, clientID string) ([]LedgerEntry, error)
+	RefundInvoice(ctx context.Context, id string, amount float64, reason string) (CreditNote, error)
+	CancelInvoice(ctx context.Context, id string, reason string) (CreditNote, error)
+	GetCreditNotes(ctx context.Context, invoiceID string) ([]CreditNote, error)
+	PayInvoicePartially(ctx context.Context, id string, amount float64) (Invoice, error)
+	SetInstallmentPlan(ctx context.Context, invoiceID string, issuerID string, installments []Installment) ([]Installment, error)
+	GetInstallments(ctx context.Context, invoiceID string) ([]Installment, error)
+	PayInstallment(ctx context.Context, installmentID string) (Installment, error)
+	GetLineItems(ctx context.Context, invoiceID string) ([]LineItem, error)
+	GetTaxBreakdown(ctx context.Context, invoiceID string) ([]TaxBreakdown, error)
+	SetLateFeePolicy(ctx context.Context, policy LateFeePolicy) (LateFeePolicy, error)
+	GetLateFeePolicy(ctx context.Context, issuerID string) (LateFeePolicy, error)
+	GetLateFees(ctx context.Context, invoiceID string) ([]LateFee, error)
+	GetInvoiceDetails(ctx context.Context, invoiceIDs []string) (map[string]InvoiceDetails, error)
+	WalkInvoices(ctx context.Context, clientID string, fn func(Invoice) error) error
+	CreateInvoices(ctx context.Context, invoices []Invoice, atomic bool) ([]CreateResult, error)
+	ImportUBL(ctx context.Context, issuerID string, document []byte) (Invoice, bool, error)
+	GetFECEntries(ctx context.Context, issuerID string, from time.Time, to time.Time) ([]FECLine, error)
+	SetNumberingPolicy(ctx context.Context, policy NumberingPolicy) (NumberingPolicy, error)
+	GetNumberingPolicy(ctx context.Context, issuerID string) (NumberingPolicy, error)
+	ExpireInvoices(ctx context.Context) ([]Invoice, error)
+	CreateWebhook(ctx context.Context, webhook WebhookSubscription) (WebhookSubscription, error)
+	GetWebhooks(ctx context.Context, clientID string) ([]WebhookSubscription, error)
+	DeleteWebhook(ctx context.Context, webhookID string) error
+	GetWebhookDeliveries(ctx context.Context, webhookID string) ([]WebhookDelivery, error)
+	RedeliverWebhook(ctx context.Context, deliveryID string) (WebhookDelivery, error)
+	SetNotificationPreference(ctx context.Context, preference NotificationPreference) (NotificationPreference, error)
+	GetNotificationPreference(ctx context.Context, clientID string) (NotificationPreference, error)
+	CreateRecurringInvoice(ctx context.Context, recurring RecurringInvoice) (RecurringInvoice, error)
+	GetRecurringInvoice(ctx context.Context, id string) (RecurringInvoice, error)
+	GetRecurringInvoices(ctx context.Context, issuerID string) ([]RecurringInvoice, error)
+	SetRecurringInvoiceState(ctx context.Context, id string, state string) (RecurringInvoice, error)
+	GetRecurringRuns(ctx context.Context, id string) ([]RecurringRun, error)
+	SchedulePayment(ctx context.Context, invoiceID string, payerID string, date string) (ScheduledPayment, error)
+	GetScheduledPayments(ctx context.Context, payerID string) ([]ScheduledPayment, error)
+	CancelScheduledPayment(ctx context.Context, id string) (ScheduledPayment, error)
+	CreateMandate(ctx context.Context, mandate Mandate) (Mandate, error)
+	GetMandates(ctx context.Context, clientID string) ([]Mandate, error)
+	RevokeMandate(ctx context.Context, id string) (Mandate, error)
+	GetMandatePayments(ctx context.Context, mandateID string) ([]MandatePayment, error)
+	PayInvoices(ctx context.Context, payerID string, ids []string, mode string) (BatchPayment, error)
+	CreatePayerGroup(ctx context.Context, group PayerGroup) (PayerGroup, error)
+	GetPayerGroups(ctx context.Context, ownerID string) ([]PayerGroup, error)
+	CreateBulkInvoiceJob(ctx context.Context, job BulkInvoiceJob, emails []string) (BulkInvoiceJob, error)
+	GetBulkInvoiceJob(ctx context.Context, id string) (BulkInvoiceJob, error)
+	GetBulkInvoiceJobs(ctx context.Context, issuerID string) ([]BulkInvoiceJob, error)
+	GetBulkInvoiceItems(ctx context.Context, id string, state string) ([]BulkInvoiceItem, error)
+	CancelBulkInvoiceJob(ctx context.Context, id string) (BulkInvoiceJob, error)
 }
 
 var (
@@ -30,23 +83,58 @@ var (
 	ErrInconsistentIDs     = errors.New("could not access database")
 	ErrInsufficientBalance = errors.New("payer's balance is to low to pay invoice")
 	ErrAccountNotFound     = errors.New("requested account was not found")
+	ErrAlreadyPaid         = errors.New("invoice is already paid")
+	ErrNotDeletable        = errors.New("invoice has a number or payments, cancel it with a credit note instead")
+	ErrNotEditable         = errors.New("invoice has a number or payments and cannot be changed anymore")
 )
 
 type invoiceService struct {
-	DbInfos DbConnexionInfo
+	DbInfos          DbConnexionInfo
+	taxJurisdictions map[string]TaxJurisdiction
+	logger           log.Logger
 }
 
-func NewInvoiceService(dbinfos DbConnexionInfo) InvoiceService {
-	return &invoiceService{
+type ServiceOption func(*invoiceService)
+
+// WithTaxJurisdictions replaces the default tax jurisdictions (France).
+func WithTaxJurisdictions(jurisdictions ...TaxJurisdiction) ServiceOption {
+	return func(s *invoiceService) {
+		s.taxJurisdictions = make(map[string]TaxJurisdiction)
+		for _, j := range jurisdictions {
+			s.taxJurisdictions[j.Code] = j
+		}
+	}
+}
+
+// WithLogger logs the errors of the work done after an operation succeeded, like the payment by a mandate.
+func WithLogger(logger log.Logger) ServiceOption {
+	return func(s *invoiceService) {
+		s.logger = logger
+	}
+}
+
+func NewInvoiceService(dbinfos DbConnexionInfo, opts ...ServiceOption) InvoiceService {
+	s := &invoiceService{
 		DbInfos: dbinfos,
+		logger:  log.NewNopLogger(),
+	}
+	WithTaxJurisdictions(DefaultTaxJurisdictions()...)(s)
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 func (s *invoiceService) GetInvoiceList(ctx context.Context, id string) ([]Invoice, error) {
 	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
 
 	invoices := make([]Invoice, 0)
 	rows, err := db.Queryx("SELECT * FROM invoice WHERE account_invoice_payer_id=$1 OR account_invoice_receiver_id=$1", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var i Invoice
@@ -57,14 +145,11 @@ func (s *invoiceService) GetInvoiceList(ctx context.Context, id string) ([]Invoi
 		invoices = append(invoices, i)
 	}
 
-	if err != nil {
-		return nil, err
-	}
-
-	return invoices, err
+	return invoices, rows.Err()
 }
 
-func (s *invoiceService) Create(ctx context.Context, invoice Invoice) (Invoice, error) {
+// Create inserts the invoice. When line items are given the amount of the invoice is computed from them.
+func (s *invoiceService) Create(ctx context.Context, invoice Invoice, items ...LineItem) (Invoice, error) {
 	if (invoice == Invoice{}) {
 		return Invoice{}, ErrNoTransfer
 	}
@@ -73,15 +158,63 @@ func (s *invoiceService) Create(ctx context.Context, invoice Invoice) (Invoice,
 		return Invoice{}, ErrAlreadyExist
 	}
 
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return Invoice{}, err
+	}
+	defer tx.Rollback()
+
+	invoice, err = s.insertInvoice(tx, invoice, items)
+	if err != nil {
+		return Invoice{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Invoice{}, err
+	}
+
+	// Paiement automatique si le payeur a donné un mandat à l'émetteur
+	if err := s.applyMandate(ctx, invoice); err != nil {
+		s.logger.Log("mandate", invoice.ID, "err", err)
+	}
+
+	inserted, _ := s.Read(ctx, invoice.ID)
+
+	return inserted, nil
+}
+
+// insertInvoice writes a new invoice and its line items inside tx and returns it with its ID and its
+// number. The amount is computed from the line items when there are some.
+func (s *invoiceService) insertInvoice(tx *sqlx.Tx, invoice Invoice, items []LineItem) (Invoice, error) {
+	jurisdiction, err := s.taxJurisdiction(invoice.TaxJurisdiction)
+	if err != nil {
+		return Invoice{}, err
+	}
+	computation, err := jurisdiction.Compute(items)
+	if err != nil {
+		return Invoice{}, err
+	}
+	if len(items) > 0 {
+		invoice.Amount = computation.Gross
+	}
+	invoice.TaxJurisdiction = jurisdiction.Code
+
 	// Génération d'un UUID
-	id := xid.New()
+	invoice.ID = xid.New().String()
 
-	db := GetDbConnexion(s.DbInfos)
-	tx := db.MustBegin()
-	res := tx.MustExec("INSERT INTO invoice VALUES('" + id.String() + "','" + fmt.Sprint(invoice.Amount) + "','" + fmt.Sprint(invoice.State) + "','" + invoice.ExpirationDate + "','" + invoice.AccountPayerId + "','" + invoice.AccountReceiverId + "')")
-	tx.Commit()
-	db.Close()
+	// Le numéro est pris dans la transaction de création pour que la séquence n'ait pas de trou
+	invoice.Number, err = allocateInvoiceNumber(tx, invoice.AccountReceiverId, time.Now())
+	if err != nil {
+		return Invoice{}, err
+	}
 
+	res, err := tx.Exec("INSERT INTO invoice (invoice_id, invoice_amount, invoice_state, invoice_expiration_date, account_invoice_payer_id, account_invoice_receiver_id, invoice_tax_jurisdiction, invoice_discount_rate, invoice_discount_deadline, invoice_number) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		invoice.ID, invoice.Amount, invoice.State, invoice.ExpirationDate, invoice.AccountPayerId, invoice.AccountReceiverId, invoice.TaxJurisdiction, invoice.DiscountRate, invoice.DiscountDeadline, invoice.Number)
+	if err != nil {
+		return Invoice{}, err
+	}
 	if nRows, err := res.RowsAffected(); nRows != 1 || err != nil {
 		if err != nil {
 			return Invoice{}, err
@@ -89,14 +222,18 @@ func (s *invoiceService) Create(ctx context.Context, invoice Invoice) (Invoice,
 		return Invoice{}, ErrNoInsert
 	}
 
-	invoice.ID = id.String()
-	inserted, _ := s.Read(ctx, invoice.ID)
-
-	return inserted, nil
+	if err := saveTaxComputation(tx, invoice.ID, computation); err != nil {
+		return Invoice{}, err
+	}
+	if err := enqueueEvents(tx, NewEvent(InvoiceCreated, invoice, 0)); err != nil {
+		return Invoice{}, err
+	}
+	return invoice, nil
 }
 
 func (s *invoiceService) Read(ctx context.Context, id string) (Invoice, error) {
 	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
 
 	Res := Invoice{}
 	err := db.Get(&Res, "SELECT * FROM invoice WHERE invoice_id=$1", id)
@@ -108,52 +245,163 @@ func (s *invoiceService) Read(ctx context.Context, id string) (Invoice, error) {
 	return Res, nil
 }
 
-func (s *invoiceService) Update(ctx context.Context, id string, invoice Invoice) (Invoice, error) {
+// Update replaces the invoice. Given line items replace the previous ones, and as long as the invoice
+// has line items its amount is computed from them. As for Delete, an invoice that has a number or
+// payments cannot be changed anymore.
+func (s *invoiceService) Update(ctx context.Context, id string, invoice Invoice, items ...LineItem) (Invoice, error) {
 	if (invoice == Invoice{}) {
 		return Invoice{}, ErrNoTransfer
 	}
 
-	if testID, _ := s.Read(ctx, id); (testID == Invoice{}) {
-		return Invoice{}, ErrNotFound
+	jurisdiction, err := s.taxJurisdiction(invoice.TaxJurisdiction)
+	if err != nil {
+		return Invoice{}, err
 	}
 
 	db := GetDbConnexion(s.DbInfos)
-	tx := db.MustBegin()
-	res := tx.MustExec("UPDATE invoice SET invoice_amount = '"+fmt.Sprint(invoice.Amount)+"', invoice_state ='"+fmt.Sprint(invoice.State)+"', invoice_expiration_date = '"+invoice.ExpirationDate+"', account_invoice_payer_id = '"+invoice.AccountPayerId+"', account_invoice_receiver_id = '"+invoice.AccountReceiverId+"' WHERE invoice_id=$1", id)
-	tx.Commit()
-	db.Close()
+	defer db.Close()
 
+	tx, err := db.Beginx()
+	if err != nil {
+		return Invoice{}, err
+	}
+	defer tx.Rollback()
+
+	previous := Invoice{}
+	if err := tx.Get(&previous, "SELECT * FROM invoice WHERE invoice_id=$1 FOR UPDATE", id); err != nil {
+		if err == sql.ErrNoRows {
+			return Invoice{}, ErrNotFound
+		}
+		return Invoice{}, err
+	}
+	if previous.Number != "" || previous.PaidAmount > 0 {
+		return Invoice{}, ErrNotEditable
+	}
+
+	if len(items) == 0 {
+		existing, err := s.GetLineItems(ctx, id)
+		if err != nil {
+			return Invoice{}, err
+		}
+		items = existing
+	}
+	computation, err := jurisdiction.Compute(items)
+	if err != nil {
+		return Invoice{}, err
+	}
+	if len(items) > 0 {
+		// Les pénalités de retard déjà appliquées restent dues
+		fees, err := s.GetLateFees(ctx, id)
+		if err != nil {
+			return Invoice{}, err
+		}
+		invoice.Amount = computation.Gross
+		for _, fee := range fees {
+			invoice.Amount = roundCents(invoice.Amount + fee.Amount)
+		}
+	}
+
+	res, err := tx.Exec("UPDATE invoice SET invoice_amount = $2, invoice_state = $3, invoice_expiration_date = $4, account_invoice_payer_id = $5, account_invoice_receiver_id = $6, invoice_tax_jurisdiction = $7 WHERE invoice_id=$1",
+		id, invoice.Amount, invoice.State, invoice.ExpirationDate, invoice.AccountPayerId, invoice.AccountReceiverId, jurisdiction.Code)
+	if err != nil {
+		return Invoice{}, err
+	}
 	if nRows, err := res.RowsAffected(); nRows != 1 || err != nil {
 		if err != nil {
 			return Invoice{}, err
 		}
-		return Invoice{}, ErrNoInsert
+		return Invoice{}, ErrNoUpdate
 	}
 
-	return s.Read(ctx, invoice.ID)
+	if err := saveTaxComputation(tx, id, computation); err != nil {
+		return Invoice{}, err
+	}
+
+	updated := Invoice{}
+	if err := tx.Get(&updated, "SELECT * FROM invoice WHERE invoice_id=$1", id); err != nil {
+		return Invoice{}, err
+	}
+	events := []Event{NewEvent(InvoiceUpdated, updated, 0)}
+	if updated.State == EXPIRED && previous.State != EXPIRED {
+		events = append(events, NewEvent(InvoiceExpired, updated, 0))
+	}
+	if err := enqueueEvents(tx, events...); err != nil {
+		return Invoice{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Invoice{}, err
+	}
+	return updated, nil
 }
 
+// Delete removes an invoice created by mistake. An invoice that has a number or payments is kept and
+// must be cancelled with CancelInvoice, so the numbering has no gap and its entries keep their invoice.
 func (s *invoiceService) Delete(ctx context.Context, id string) error {
-	if testID, _ := s.Read(ctx, id); (testID == Invoice{}) {
-		return ErrNotFound
-	}
 	db := GetDbConnexion(s.DbInfos)
-	tx := db.MustBegin()
-	res := tx.MustExec("DELETE FROM invoice WHERE invoice_id=$1", id)
+	defer db.Close()
 
-	if nRows, err := res.RowsAffected(); nRows != 1 || err != nil {
-		if err != nil {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	deleted := Invoice{}
+	if err := tx.Get(&deleted, "SELECT * FROM invoice WHERE invoice_id=$1 FOR UPDATE", id); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		return err
+	}
+	if deleted.Number != "" || deleted.PaidAmount > 0 {
+		return ErrNotDeletable
+	}
+
+	for _, table := range []string{"invoice_line_item", "invoice_tax_breakdown", "invoice_late_fee", "installment", "scheduled_payment", "invoice"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE invoice_id=$1", id); err != nil {
 			return err
 		}
 	}
-	tx.Commit()
-	db.Close()
+	if err := enqueueEvents(tx, NewEvent(InvoiceDeleted, deleted, 0)); err != nil {
+		return err
+	}
 
-	return nil
+	return tx.Commit()
+}
+
+// ExpireInvoices marks EXPIRED the pending invoices whose expiration date is over and returns them.
+func (s *invoiceService) ExpireInvoices(ctx context.Context) ([]Invoice, error) {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	expired := make([]Invoice, 0)
+	err = tx.Select(&expired, "UPDATE invoice SET invoice_state = $1 WHERE invoice_state = $2 AND invoice_expiration_date::date < CURRENT_DATE RETURNING *", EXPIRED, PENDING)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range expired {
+		if err := enqueueEvents(tx, NewEvent(InvoiceExpired, i, 0)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return expired, nil
 }
 
 func (s *invoiceService) GetIdFromMail(ctx context.Context, mail string) (string, error) {
 	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
 
 	res := ""
 	err := db.Get(&res, "SELECT client_id FROM account WHERE mail_adress=$1", mail)
@@ -176,66 +424,44 @@ func (s *invoiceService) PayInvoice(ctx context.Context, id string) (bool, error
 		return false, ErrNotFound
 	}
 
-	db := GetDbConnexion(s.DbInfos)
-
-	// Dans un premier temps on récupère le solde du payeur
-	payerBalance := float64(0.0)
-
-	errPB := db.Get(&payerBalance, "SELECT account_amount FROM account WHERE client_id=$1", InvoiceToPay.AccountPayerId)
+	if !payable(InvoiceToPay.State) {
+		return false, ErrAlreadyPaid
+	}
 
-	// On récupère ensuite le solde du receveur
-	receiverBalance := float64(0.0)
-	errRB := db.Get(&receiverBalance, "SELECT account_amount FROM account WHERE client_id=$1", InvoiceToPay.AccountReceiverId)
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
 
-	if errPB != nil {
-		fmt.Println("Payer balance error")
-		return false, ErrAccountNotFound
-	}
-	if errRB != nil {
-		fmt.Println("Reciever balance error")
-		return false, ErrAccountNotFound
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
 	}
+	defer tx.Rollback()
 
-	// On regarde si le payeur a les fonds pour payer la facture
-	if payerBalance < InvoiceToPay.Amount {
-		return false, ErrInsufficientBalance
+	// On paye tout ce qui reste, y compris les échéances pas encore payées
+	invoice, paid, err := payInvoiceAmount(tx, InvoiceToPay.ID, 0)
+	if err != nil {
+		return false, err
 	}
 
-	tx := db.MustBegin()
-	// On mets à jour le solde du payeur
-	newPayerBalance := payerBalance - InvoiceToPay.Amount
-	fmt.Print("Previous balance : " + fmt.Sprint(payerBalance) + " new balance : " + fmt.Sprint(newPayerBalance))
-	resPayer := tx.MustExec("UPDATE account SET account_amount = '"+fmt.Sprint(newPayerBalance)+"' WHERE client_id=$1", InvoiceToPay.AccountPayerId)
-
-	if rows, errUpdate := resPayer.RowsAffected(); rows != 1 {
-		tx.Rollback()
-		return false, errUpdate
+	if _, err := tx.Exec("UPDATE installment SET installment_state = $1, installment_paid_date = now() WHERE invoice_id=$2 AND installment_state = $3", PAID, InvoiceToPay.ID, PENDING); err != nil {
+		return false, err
 	}
 
-	// On mets à jour le solde du receveur
-	newReceiverBalance := receiverBalance + InvoiceToPay.Amount
-	fmt.Print("Previous balance : " + fmt.Sprint(receiverBalance) + " new balance : " + fmt.Sprint(newReceiverBalance))
-	resReciever := tx.MustExec("UPDATE account SET account_amount = '"+fmt.Sprint(newReceiverBalance)+"' WHERE client_id=$1", InvoiceToPay.AccountReceiverId)
-	if rows, errUpdate := resReciever.RowsAffected(); rows != 1 {
-		tx.Rollback()
-		return false, errUpdate
+	// L'événement est écrit dans la même transaction que le paiement
+	if err := enqueueEvents(tx, paymentEvent(invoice, paid)); err != nil {
+		return false, err
 	}
 
-	//On change l'état de la facture a payer
-	resInvoice := tx.MustExec("UPDATE invoice SET invoice_state = '"+fmt.Sprint(PAID)+"' WHERE invoice_id=$1", InvoiceToPay.ID)
-	if rows, errUpdate := resInvoice.RowsAffected(); rows != 1 {
-		tx.Rollback()
-		return false, errUpdate
+	if err := tx.Commit(); err != nil {
+		return false, err
 	}
 
-	tx.Commit()
-	db.Close()
-
 	return true, nil
 }
 
 func (s *invoiceService) GetAccountInformation(ctx context.Context, id string) (AccountInfo, error) {
 	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
 
 	res := AccountInfo{}
 	err := db.Get(&res, "SELECT name, surname, mail_adress, phone_number, account_amount FROM account where client_id=$1", id)
@@ -245,3 +471,97 @@ func (s *invoiceService) GetAccountInformation(ctx context.Context, id string) (
 	}
 	return res, err
 }
+
+// GetAccountsInformation returns the accounts keyed by client ID with a single query. It fails with
+// sql.ErrNoRows if one of them does not exist, like GetAccountInformation.
+func (s *invoiceService) GetAccountsInformation(ctx context.Context, ids []string) (map[string]AccountInfo, error) {
+	accounts := make(map[string]AccountInfo, len(ids))
+	if len(ids) == 0 {
+		return accounts, nil
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	rows := []struct {
+		ClientID string `db:"client_id"`
+		AccountInfo
+	}{}
+	err := db.Select(&rows, "SELECT client_id, name, surname, mail_adress, phone_number, account_amount FROM account WHERE client_id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		accounts[r.ClientID] = r.AccountInfo
+	}
+
+	for _, id := range ids {
+		if _, ok := accounts[id]; !ok {
+			return nil, sql.ErrNoRows
+		}
+	}
+	return accounts, nil
+}
+
+// InvoiceDetails holds what GetLineItems, GetTaxBreakdown and GetLateFees return for an invoice.
+type InvoiceDetails struct {
+	Items    []LineItem
+	Taxes    []TaxBreakdown
+	LateFees []LateFee
+}
+
+// GetInvoiceDetails returns the details of several invoices keyed by invoice ID, with one query per
+// table whatever the number of invoices.
+func (s *invoiceService) GetInvoiceDetails(ctx context.Context, invoiceIDs []string) (map[string]InvoiceDetails, error) {
+	details := make(map[string]InvoiceDetails, len(invoiceIDs))
+	for _, id := range invoiceIDs {
+		details[id] = InvoiceDetails{make([]LineItem, 0), make([]TaxBreakdown, 0), make([]LateFee, 0)}
+	}
+	if len(invoiceIDs) == 0 {
+		return details, nil
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+	ids := pq.Array(invoiceIDs)
+
+	items := make([]LineItem, 0)
+	if err := db.Select(&items, "SELECT * FROM invoice_line_item WHERE invoice_id = ANY($1) ORDER BY invoice_id, item_position", ids); err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		d := details[item.InvoiceID]
+		d.Items = append(d.Items, item)
+		details[item.InvoiceID] = d
+	}
+
+	taxes := []struct {
+		InvoiceID string `db:"invoice_id"`
+		TaxBreakdown
+	}{}
+	err := db.Select(&taxes, `SELECT invoice_id, tax_rate, net_amount, tax_amount, gross_amount FROM invoice_tax_breakdown
+		WHERE invoice_id = ANY($1) ORDER BY invoice_id, tax_rate DESC`, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range taxes {
+		d := details[t.InvoiceID]
+		d.Taxes = append(d.Taxes, t.TaxBreakdown)
+		details[t.InvoiceID] = d
+	}
+
+	fees := make([]LateFee, 0)
+	// Même agrégation que GetLateFees
+	err = db.Select(&fees, `SELECT invoice_id, fee_type, SUM(fee_amount) AS fee_amount, MAX(days_late) AS days_late, MAX(fee_date)::text AS fee_date
+		FROM invoice_late_fee WHERE invoice_id = ANY($1) GROUP BY invoice_id, fee_type ORDER BY invoice_id, fee_type`, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fees {
+		d := details[f.InvoiceID]
+		d.LateFees = append(d.LateFees, f)
+		details[f.InvoiceID] = d
+	}
+
+	return details, nil
+}
@@ -23,21 +23,21 @@ func NewTestData() TestData {
 	s := NewInvoiceService(info)
 
 	mockInvoice := Invoice{
-		"gqC1e8X9dovX1bHFLvYcmwZVnarm4xXKv7k4Y5P2wEPiLGKJlXSLrFTvW45oBBayrWGP2GF7G4FwKnFw8xD49ejLZloom2VnoryBWCp6cVw6JaV4JY9fdB2JyB7XvKihLgazckRj9BRZBhFUUJI1PR2tQdwm3uoikvaRE87rSSxBwJP6EQhNiXKPj9ruWLBZ249c52dQYGwya7eNkW9woSQXXzV4pmnlclxPR3Z7t87RkRRVGWMdh4vvwSNMvId",
-		666.66,
-		2,
-		"2021-04-29T00:00:00Z",
-		"sIowRDsqanK3vj0jfRVn1i8yLrmJfu93qDDlZwkeHFl4td0W2czjJbutqwibI8iaQJ7skSHtLpWHUtfN7gFQ0f40e6J1Fie4LeuRrmLHkxfpr6bv5VOYpwGvDyoux7Zus0fw2R2IRWEr3CqKtrohdX8t9pf37I17WoSVFg83hrb18BoKD3h989i3I36GAjXGLyEWbj6RsD6lt5TEQOjwJEZDZTeBOUOq0fNOUFmEW47cEgQ2R4DvIj5AN2iPDsv",
-		"fErnq0RHXlGBI6DuQ88O3T6BCIizTwgt1YtNte1lAUE1uqoJOVDxHUihPSTTf57GVORuB8XFT1f8lUASGP8p0Fzj69wGDOv1tzsnwSlHbPp4M2fggbiNItk0w10E7Ro3sZ0V77osOzXU43pLHZ53gFLDOrG8NVzUTr0FM33ySDa5f53KTJ7AUfTujnbiVwiwIWWCS10YBOKcMqGvJ5s48AkThnzqfSCIRM2Omh0xeJvn4RSYSROfsi8ol3iqbPa",
+		ID:                "gqC1e8X9dovX1bHFLvYcmwZVnarm4xXKv7k4Y5P2wEPiLGKJlXSLrFTvW45oBBayrWGP2GF7G4FwKnFw8xD49ejLZloom2VnoryBWCp6cVw6JaV4JY9fdB2JyB7XvKihLgazckRj9BRZBhFUUJI1PR2tQdwm3uoikvaRE87rSSxBwJP6EQhNiXKPj9ruWLBZ249c52dQYGwya7eNkW9woSQXXzV4pmnlclxPR3Z7t87RkRRVGWMdh4vvwSNMvId",
+		Amount:            666.66,
+		State:             2,
+		ExpirationDate:    "2021-04-29T00:00:00Z",
+		AccountPayerId:    "sIowRDsqanK3vj0jfRVn1i8yLrmJfu93qDDlZwkeHFl4td0W2czjJbutqwibI8iaQJ7skSHtLpWHUtfN7gFQ0f40e6J1Fie4LeuRrmLHkxfpr6bv5VOYpwGvDyoux7Zus0fw2R2IRWEr3CqKtrohdX8t9pf37I17WoSVFg83hrb18BoKD3h989i3I36GAjXGLyEWbj6RsD6lt5TEQOjwJEZDZTeBOUOq0fNOUFmEW47cEgQ2R4DvIj5AN2iPDsv",
+		AccountReceiverId: "fErnq0RHXlGBI6DuQ88O3T6BCIizTwgt1YtNte1lAUE1uqoJOVDxHUihPSTTf57GVORuB8XFT1f8lUASGP8p0Fzj69wGDOv1tzsnwSlHbPp4M2fggbiNItk0w10E7Ro3sZ0V77osOzXU43pLHZ53gFLDOrG8NVzUTr0FM33ySDa5f53KTJ7AUfTujnbiVwiwIWWCS10YBOKcMqGvJ5s48AkThnzqfSCIRM2Omh0xeJvn4RSYSROfsi8ol3iqbPa",
 	}
 
 	otherInvoice := Invoice{
-		"gqC1e8X9dovX1bHFLvYcmwZVnarm4xXKv7k4Y5P2wEPiLGKJlXSLrFTvW45oBBayrWGP2GF7G4FwKnFw8xD49ejLZloom2VnoryBWCp6cVw6JaV4JY9fdB2JyB7XvKihLgazckRj9BRZBhFUUJI1PR2tQdwm3uoikvaRE87rSSxBwJP6EQhNiXKPj9ruWLBZ249c52dQYGwya7eNkW9woSQXXzV4pmnlclxPR3Z7t87RkRRVGWMdh4vvwSNMvId",
-		50000.01,
-		1,
-		"2021-04-29T00:00:00Z",
-		"7xZnb9WK362TUHQkkLyCAnaaLiF5b55OQX77nRyh4kUGuFq17z3Cn4LKfKN2sD108L79knYWu8O5VvMpq5ei5beoZsOJq0qtj2fBl7R1kc6UdNHAcDAnpWvklEyhk9u39hGzDUx7dqCX9Rd1mEDMvhrFq5Dt5DDzAUWI6Sr1z9LVVSeu4T8gOZSt9EFxAX4OWLxAVKK6PNv3D77SOYunRk5CUggH9GYWjDJ8O1C2lUICOKjDd4QRyyK7Ovcs9Dh",
-		"fErnq0RHXlGBI6DuQ88O3T6BCIizTwgt1YtNte1lAUE1uqoJOVDxHUihPSTTf57GVORuB8XFT1f8lUASGP8p0Fzj69wGDOv1tzsnwSlHbPp4M2fggbiNItk0w10E7Ro3sZ0V77osOzXU43pLHZ53gFLDOrG8NVzUTr0FM33ySDa5f53KTJ7AUfTujnbiVwiwIWWCS10YBOKcMqGvJ5s48AkThnzqfSCIRM2Omh0xeJvn4RSYSROfsi8ol3iqbPa",
+		ID:                "gqC1e8X9dovX1bHFLvYcmwZVnarm4xXKv7k4Y5P2wEPiLGKJlXSLrFTvW45oBBayrWGP2GF7G4FwKnFw8xD49ejLZloom2VnoryBWCp6cVw6JaV4JY9fdB2JyB7XvKihLgazckRj9BRZBhFUUJI1PR2tQdwm3uoikvaRE87rSSxBwJP6EQhNiXKPj9ruWLBZ249c52dQYGwya7eNkW9woSQXXzV4pmnlclxPR3Z7t87RkRRVGWMdh4vvwSNMvId",
+		Amount:            50000.01,
+		State:             1,
+		ExpirationDate:    "2021-04-29T00:00:00Z",
+		AccountPayerId:    "7xZnb9WK362TUHQkkLyCAnaaLiF5b55OQX77nRyh4kUGuFq17z3Cn4LKfKN2sD108L79knYWu8O5VvMpq5ei5beoZsOJq0qtj2fBl7R1kc6UdNHAcDAnpWvklEyhk9u39hGzDUx7dqCX9Rd1mEDMvhrFq5Dt5DDzAUWI6Sr1z9LVVSeu4T8gOZSt9EFxAX4OWLxAVKK6PNv3D77SOYunRk5CUggH9GYWjDJ8O1C2lUICOKjDd4QRyyK7Ovcs9Dh",
+		AccountReceiverId: "fErnq0RHXlGBI6DuQ88O3T6BCIizTwgt1YtNte1lAUE1uqoJOVDxHUihPSTTf57GVORuB8XFT1f8lUASGP8p0Fzj69wGDOv1tzsnwSlHbPp4M2fggbiNItk0w10E7Ro3sZ0V77osOzXU43pLHZ53gFLDOrG8NVzUTr0FM33ySDa5f53KTJ7AUfTujnbiVwiwIWWCS10YBOKcMqGvJ5s48AkThnzqfSCIRM2Omh0xeJvn4RSYSROfsi8ol3iqbPa",
 	}
 
 	return TestData{
@@ -0,0 +1,124 @@
+package invoice_microservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// SMTPNotifier sends the notifications through an SMTP server.
+type SMTPNotifier struct {
+	Addr string // host:port
+	From string
+	Auth smtp.Auth // nil si le serveur n'en demande pas
+	// Durée maximale de l'envoi d'un email, connexion comprise
+	Timeout time.Duration
+}
+
+// NewSMTPNotifier authenticates with PLAIN when a username is given.
+func NewSMTPNotifier(addr string, from string, username string, password string) *SMTPNotifier {
+	n := &SMTPNotifier{Addr: addr, From: from, Timeout: 30 * time.Second}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		n.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return n
+}
+
+// message builds the email, encoded in UTF-8 quoted-printable.
+func (n *SMTPNotifier) message(notification Notification, now time.Time) ([]byte, error) {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", notification.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", notification.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@invoice-microservice>\r\n", xid.New().String())
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	// Le writer remplace les fins de ligne par CRLF
+	w := quotedprintable.NewWriter(&msg)
+	if _, err := w.Write([]byte(notification.Body)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// Notify sends the email as smtp.SendMail does, but gives up after Timeout or when ctx is done.
+func (n *SMTPNotifier) Notify(ctx context.Context, notification Notification) error {
+	msg, err := n.message(notification, time.Now())
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(n.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn, err := (&net.Dialer{Deadline: deadline}).DialContext(ctx, "tcp", n.Addr)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline)
+
+	// La connexion est fermée si ctx se termine pendant l'envoi
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	host, _, _ := net.SplitHostPort(n.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(n.Auth); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.Mail(n.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(notification.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
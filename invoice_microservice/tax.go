@@ -0,0 +1,175 @@
+package invoice_microservice
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sort"
+	"strconv"
+)
+
+const (
+	DefaultTaxJurisdiction = "FR"
+)
+
+var (
+	ErrUnknownTaxRate         = errors.New("tax rate is not allowed in the jurisdiction of the invoice")
+	ErrUnknownTaxJurisdiction = errors.New("unknown tax jurisdiction")
+)
+
+// TaxJurisdiction lists the tax rates, in percent, allowed on the invoices of a jurisdiction.
+type TaxJurisdiction struct {
+	Code  string
+	Rates []float64
+}
+
+func DefaultTaxJurisdictions() []TaxJurisdiction {
+	return []TaxJurisdiction{
+		{Code: "FR", Rates: []float64{20, 10, 5.5, 2.1, 0}},
+	}
+}
+
+// TaxBreakdown is the subtotal of an invoice for one tax rate.
+type TaxBreakdown struct {
+	Rate  float64 `json:"tax_rate" db:"tax_rate"`
+	Net   float64 `json:"net_amount" db:"net_amount"`
+	Tax   float64 `json:"tax_amount" db:"tax_amount"`
+	Gross float64 `json:"gross_amount" db:"gross_amount"`
+}
+
+type TaxComputation struct {
+	Items     []LineItem     `json:"items"`
+	Breakdown []TaxBreakdown `json:"tax_breakdown"`
+	Net       float64        `json:"net_amount"`
+	Tax       float64        `json:"tax_amount"`
+	Gross     float64        `json:"gross_amount"`
+}
+
+func (j TaxJurisdiction) allows(rate float64) bool {
+	for _, r := range j.Rates {
+		if r == rate {
+			return true
+		}
+	}
+	return false
+}
+
+// Compute computes the net, tax and gross amounts of each line and of the invoice. Every amount is
+// rounded to the cent, half away from zero. Like on French invoices the tax of the invoice is computed
+// once per rate on the net subtotal of the rate, so the tax of the lines may differ by a few cents
+// from the tax of the invoice.
+func (j TaxJurisdiction) Compute(items []LineItem) (TaxComputation, error) {
+	computation := TaxComputation{
+		Items:     make([]LineItem, len(items)),
+		Breakdown: make([]TaxBreakdown, 0),
+	}
+
+	subtotals := make(map[float64]*big.Rat)
+	hundred := big.NewRat(100, 1)
+
+	for n, item := range items {
+		if err := item.validate(); err != nil {
+			return TaxComputation{}, err
+		}
+		if !j.allows(item.TaxRate) {
+			return TaxComputation{}, ErrUnknownTaxRate
+		}
+
+		// net = quantité x prix unitaire x (100 - remise) / 100
+		net := new(big.Rat).Mul(decimal(item.Quantity), decimal(item.UnitPrice))
+		net.Mul(net, new(big.Rat).Sub(hundred, decimal(item.Discount)))
+		net.Quo(net, hundred)
+		net = roundRatCents(net)
+
+		tax := roundRatCents(new(big.Rat).Quo(new(big.Rat).Mul(net, decimal(item.TaxRate)), hundred))
+
+		item.Position = n + 1
+		item.Net = ratToFloat(net)
+		item.Tax = ratToFloat(tax)
+		item.Total = ratToFloat(new(big.Rat).Add(net, tax))
+		computation.Items[n] = item
+
+		if _, ok := subtotals[item.TaxRate]; !ok {
+			subtotals[item.TaxRate] = new(big.Rat)
+		}
+		subtotals[item.TaxRate].Add(subtotals[item.TaxRate], net)
+	}
+
+	net, tax := new(big.Rat), new(big.Rat)
+	for rate, subtotal := range subtotals {
+		rateTax := roundRatCents(new(big.Rat).Quo(new(big.Rat).Mul(subtotal, decimal(rate)), hundred))
+		computation.Breakdown = append(computation.Breakdown, TaxBreakdown{
+			Rate:  rate,
+			Net:   ratToFloat(subtotal),
+			Tax:   ratToFloat(rateTax),
+			Gross: ratToFloat(new(big.Rat).Add(subtotal, rateTax)),
+		})
+		net.Add(net, subtotal)
+		tax.Add(tax, rateTax)
+	}
+	sort.Slice(computation.Breakdown, func(a, b int) bool {
+		return computation.Breakdown[a].Rate > computation.Breakdown[b].Rate
+	})
+
+	computation.Net = ratToFloat(net)
+	computation.Tax = ratToFloat(tax)
+	computation.Gross = ratToFloat(new(big.Rat).Add(net, tax))
+
+	return computation, nil
+}
+
+// decimal converts an amount to the decimal number it was written as, 0.1 is exactly 1/10.
+func decimal(amount float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(amount, 'f', -1, 64))
+	return r
+}
+
+// roundRatCents rounds to the cent, half away from zero.
+func roundRatCents(r *big.Rat) *big.Rat {
+	cents := new(big.Rat).Mul(r, big.NewRat(100, 1))
+	num, den := new(big.Int).Set(cents.Num()), cents.Denom()
+
+	negative := num.Sign() < 0
+	num.Abs(num)
+	// (2 x num + den) / (2 x den) arrondit à l'entier le plus proche, 0.5 vers le haut
+	num.Mul(num, big.NewInt(2)).Add(num, den)
+	q := num.Quo(num, new(big.Int).Mul(den, big.NewInt(2)))
+	if negative {
+		q.Neg(q)
+	}
+
+	return new(big.Rat).SetFrac(q, big.NewInt(100))
+}
+
+func ratToFloat(r *big.Rat) float64 {
+	f, _ := r.Float64()
+	return f
+}
+
+func (s *invoiceService) taxJurisdiction(code string) (TaxJurisdiction, error) {
+	if code == "" {
+		code = DefaultTaxJurisdiction
+	}
+	j, ok := s.taxJurisdictions[code]
+	if !ok {
+		return TaxJurisdiction{}, ErrUnknownTaxJurisdiction
+	}
+	return j, nil
+}
+
+func (s *invoiceService) GetTaxBreakdown(ctx context.Context, invoiceID string) ([]TaxBreakdown, error) {
+	if invoiceID == "" {
+		return nil, ErrNotAnId
+	}
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	breakdown := make([]TaxBreakdown, 0)
+	err := db.Select(&breakdown, "SELECT tax_rate, net_amount, tax_amount, gross_amount FROM invoice_tax_breakdown WHERE invoice_id=$1 ORDER BY tax_rate DESC", invoiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return breakdown, nil
+}
@@ -0,0 +1,69 @@
+package invoice_microservice
+
+import "testing"
+
+func TestTaxComputation(t *testing.T) {
+	fr := DefaultTaxJurisdictions()[0]
+
+	computation, err := fr.Compute([]LineItem{
+		{Description: "Loyer", Quantity: 1, UnitPrice: 650},
+		{Description: "Ménage", Quantity: 3, UnitPrice: 33.33, TaxRate: 20, Discount: 10},
+		{Description: "Repas", Quantity: 1, UnitPrice: 0.05, TaxRate: 10},
+		{Description: "Repas", Quantity: 1, UnitPrice: 0.05, TaxRate: 10},
+		{Description: "Livre", Quantity: 2, UnitPrice: 10.05, TaxRate: 5.5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 3 x 33.33 = 99.99, -10% = 89.991 arrondi à 89.99, TVA 20% = 17.998 arrondie à 18.00
+	cleaning := computation.Items[1]
+	if cleaning.Net != 89.99 || cleaning.Tax != 18 || cleaning.Total != 107.99 || cleaning.Position != 2 {
+		t.Errorf("Unexpected amounts for the second line : %+v", cleaning)
+	}
+
+	// 0.05 x 10% = 0.005 arrondi à 0.01 sur chaque ligne, mais la TVA à 10% est calculée sur 0.10 : 0.01
+	if computation.Items[2].Tax != 0.01 {
+		t.Errorf("Half cents should be rounded away from zero, got %v", computation.Items[2].Tax)
+	}
+
+	expected := []TaxBreakdown{
+		{Rate: 20, Net: 89.99, Tax: 18, Gross: 107.99},
+		{Rate: 10, Net: 0.1, Tax: 0.01, Gross: 0.11},
+		{Rate: 5.5, Net: 20.1, Tax: 1.11, Gross: 21.21},
+		{Rate: 0, Net: 650, Tax: 0, Gross: 650},
+	}
+	if len(computation.Breakdown) != len(expected) {
+		t.Fatalf("Expected %d tax rates, got %+v", len(expected), computation.Breakdown)
+	}
+	for n, b := range expected {
+		if computation.Breakdown[n] != b {
+			t.Errorf("Expected %+v, got %+v", b, computation.Breakdown[n])
+		}
+	}
+
+	if computation.Net != 760.19 || computation.Tax != 19.12 || computation.Gross != 779.31 {
+		t.Errorf("Unexpected invoice totals : %v %v %v", computation.Net, computation.Tax, computation.Gross)
+	}
+
+	if _, err := fr.Compute([]LineItem{{Description: "Loyer", Quantity: 1, UnitPrice: 650, TaxRate: 19.6}}); err != ErrUnknownTaxRate {
+		t.Errorf("Passed a rate that does not exist in France, should have raised an error")
+	}
+}
+
+func TestRoundCents(t *testing.T) {
+	cases := map[float64]float64{
+		1.005:   1.01,
+		2.675:   2.68,
+		-1.005:  -1.01,
+		0.125:   0.13,
+		0.124:   0.12,
+		666.66:  666.66,
+		1.00499: 1,
+	}
+	for amount, expected := range cases {
+		if got := roundCents(amount); got != expected {
+			t.Errorf("roundCents(%v) : expected %v, got %v", amount, expected, got)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package invoice_microservice
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	ErrNoClientCA          = errors.New("no certificate could be read from the client CA file")
+	ErrNoPeerCertificate   = errors.New("a client certificate is required")
+	ErrPeerNotAllowed      = errors.New("client certificate is not allowed to perform this operation")
+	ErrIncompleteTLSConfig = errors.New("TLS certificate and key files are both required")
+)
+
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// Si ClientCAFile est renseigné les clients doivent présenter un certificat signé par cette CA (mTLS)
+	ClientCAFile string
+	// Intervalle minimal entre deux vérifications des fichiers du certificat
+	ReloadInterval time.Duration
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// certReloader serves the certificate found on disk and reloads it when the files change,
+// so a renewed certificate is picked up without restarting the service.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+	logger   log.Logger
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration, logger log.Logger) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+		logger:   logger,
+	}
+	if err := r.reload(time.Now()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload(now time.Time) error {
+	modTime, err := lastModification(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.lastCheck = now
+	if r.cert != nil && !modTime.After(r.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastCheck) >= r.interval {
+		// En cas d'erreur (fichiers en cours d'écriture...) on garde l'ancien certificat
+		if err := r.reload(now); err != nil {
+			r.logger.Log("tls", "reload", "err", err)
+		}
+	}
+	return r.cert, nil
+}
+
+func lastModification(files ...string) (time.Time, error) {
+	last := time.Time{}
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// ServerTLSConfig builds the tls.Config of the server from the given configuration.
+func ServerTLSConfig(config TLSConfig, logger log.Logger) (*tls.Config, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, ErrIncompleteTLSConfig
+	}
+
+	reloader, err := newCertReloader(config.CertFile, config.KeyFile, config.ReloadInterval, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrNoClientCA
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// ListenAndServe serves the handler over TLS when the configuration has a certificate, over plain HTTP otherwise.
+func ListenAndServe(addr string, handler http.Handler, config TLSConfig, logger log.Logger) error {
+	if !config.Enabled() {
+		return http.ListenAndServe(addr, handler)
+	}
+
+	tlsConfig, err := ServerTLSConfig(config, logger)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	// Le certificat est fourni par GetCertificate
+	return server.ListenAndServeTLS("", "")
+}
+
+// PeerIdentity is the identity of a client authenticated by its certificate.
+type PeerIdentity struct {
+	CommonName   string
+	Organization []string
+	DNSNames     []string
+	Emails       []string
+	SerialNumber string
+}
+
+func peerIdentityToContext(ctx context.Context, r *http.Request) context.Context {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ctx
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	return context.WithValue(ctx, peerIdentityContextKey, PeerIdentity{
+		CommonName:   cert.Subject.CommonName,
+		Organization: cert.Subject.Organization,
+		DNSNames:     cert.DNSNames,
+		Emails:       cert.EmailAddresses,
+		SerialNumber: cert.SerialNumber.String(),
+	})
+}
+
+// PeerIdentityFromContext returns the identity of the client when it presented a verified certificate.
+func PeerIdentityFromContext(ctx context.Context) (PeerIdentity, bool) {
+	peer, ok := ctx.Value(peerIdentityContextKey).(PeerIdentity)
+	return peer, ok
+}
+
+// PeerAuthorizer decides if the authenticated peer may send the request, it returns ErrPeerNotAllowed otherwise.
+type PeerAuthorizer func(ctx context.Context, peer PeerIdentity, request interface{}) error
+
+func PeerAuthorizationMiddleware(authorize PeerAuthorizer) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			peer, ok := PeerIdentityFromContext(ctx)
+			if !ok {
+				return nil, ErrNoPeerCertificate
+			}
+			if err := authorize(ctx, peer, request); err != nil {
+				return nil, err
+			}
+			return next(ctx, request)
+		}
+	}
+}
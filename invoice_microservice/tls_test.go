@@ -0,0 +1,169 @@
+package invoice_microservice
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, serial int64, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return testCert{cert, key, der}
+}
+
+func (c testCert) write(t *testing.T, certFile, keyFile string) {
+	keyDer, _ := x509.MarshalECPrivateKey(c.key)
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile != "" {
+		if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (c testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invoice-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "Prix Banque CA", 1, nil)
+	server := newTestCert(t, "invoice-microservice", 2, &ca)
+	client := newTestCert(t, "transfer-microservice", 3, &ca)
+
+	config := TLSConfig{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	server.write(t, config.CertFile, config.KeyFile)
+	ca.write(t, config.ClientCAFile, "")
+
+	tlsConfig, err := ServerTLSConfig(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers := make(chan PeerIdentity, 1)
+	authorizer := func(ctx context.Context, peer PeerIdentity, request interface{}) error {
+		peers <- peer
+		return ErrPeerNotAllowed
+	}
+	handler := MakeHTTPHandler(NewInvoiceService(DbConnexionInfo{}), log.NewNopLogger(), WithPeerAuthorizer(authorizer))
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	url := "https://" + l.Addr().String() + "/invoices/pay"
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if resp, err := anonymous.Post(url, "application/json", nil); err == nil {
+		resp.Body.Close()
+		t.Errorf("Client without certificate should have been refused")
+	}
+
+	// Chaque client ouvre sa propre connexion, sans la garder ouverte entre deux requêtes
+	authenticatedClient := func() *http.Client {
+		return &http.Client{Transport: &http.Transport{DisableKeepAlives: true, TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{client.tlsCertificate()},
+		}}}
+	}
+	resp, err := authenticatedClient().Post(url, "application/json", strings.NewReader(`{"Iid": "1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Authorizer refused the peer, expected 403 got %d", resp.StatusCode)
+	}
+	if peer := <-peers; peer.CommonName != "transfer-microservice" {
+		t.Errorf("Peer identity was not exposed to the authorizer, got : " + peer.CommonName)
+	}
+
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Errorf("Expected server certificate 2, got %d", serial)
+	}
+
+	// Le certificat renouvelé doit être servi sans redémarrer
+	renewed := newTestCert(t, "invoice-microservice", 4, &ca)
+	renewed.write(t, config.CertFile, config.KeyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(config.CertFile, future, future)
+
+	resp, err = authenticatedClient().Post(url, "application/json", strings.NewReader(`{"Iid": "1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	<-peers
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 4 {
+		t.Errorf("Certificate should have been reloaded, got serial %d", serial)
+	}
+}
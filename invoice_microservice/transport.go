@@ -4,13 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"strconv"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/transport"
 	"github.com/gorilla/mux"
-	"github.com/rs/cors"
 
 	httptransport "github.com/go-kit/kit/transport/http"
 )
@@ -21,18 +21,145 @@ var (
 	ErrBadRouting = errors.New("inconsistent mapping between route and handler (programmer error)")
 )
 
-func MakeHTTPHandler(s InvoiceService, logger log.Logger) http.Handler {
+type contextKey int
+
+const (
+	remoteIPContextKey contextKey = iota
+	peerIdentityContextKey
+)
+
+type handlerConfig struct {
+	rateLimitStore  RateLimitStore
+	rateLimits      RateLimitConfig
+	cors            CORSConfig
+	securityHeaders SecurityHeadersConfig
+	peerAuthorizer  PeerAuthorizer
+	pdfRenderer     *PDFRenderer
+}
+
+type HandlerOption func(*handlerConfig)
+
+// WithRateLimits replaces the default rate limits and in-memory store.
+func WithRateLimits(store RateLimitStore, config RateLimitConfig) HandlerOption {
+	return func(c *handlerConfig) {
+		c.rateLimitStore = store
+		c.rateLimits = config
+	}
+}
+
+// WithCORS replaces the default CORS policy.
+func WithCORS(config CORSConfig) HandlerOption {
+	return func(c *handlerConfig) {
+		c.cors = config
+	}
+}
+
+// WithSecurityHeaders replaces the default security headers (HSTS, nosniff, frame-deny).
+func WithSecurityHeaders(config SecurityHeadersConfig) HandlerOption {
+	return func(c *handlerConfig) {
+		c.securityHeaders = config
+	}
+}
+
+// WithPeerAuthorizer requires a client certificate on every route and lets the authorizer
+// accept or refuse the request given the identity of the peer.
+func WithPeerAuthorizer(authorize PeerAuthorizer) HandlerOption {
+	return func(c *handlerConfig) {
+		c.peerAuthorizer = authorize
+	}
+}
+
+// WithPDFRenderer replaces the default templates of the invoice and receipt PDF documents.
+func WithPDFRenderer(renderer *PDFRenderer) HandlerOption {
+	return func(c *handlerConfig) {
+		c.pdfRenderer = renderer
+	}
+}
+
+func MakeHTTPHandler(s InvoiceService, logger log.Logger, opts ...HandlerOption) http.Handler {
+	config := handlerConfig{
+		rateLimitStore:  NewMemoryRateLimitStore(),
+		rateLimits:      DefaultRateLimitConfig(),
+		cors:            DefaultCORSConfig(),
+		securityHeaders: DefaultSecurityHeadersConfig(),
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
 	r := mux.NewRouter()
 	e := MakeInvoiceEndpoints(s)
+	if config.pdfRenderer != nil {
+		e.InvoicePDFEndpoint = MakeInvoicePDFEndpoint(s, config.pdfRenderer)
+		e.ReceiptPDFEndpoint = MakeReceiptPDFEndpoint(s, config.pdfRenderer)
+	}
+	e = e.withRateLimits(s, config.rateLimitStore, logger, config.rateLimits)
+	if config.peerAuthorizer != nil {
+		e = e.wrap(PeerAuthorizationMiddleware(config.peerAuthorizer))
+	}
 	options := []httptransport.ServerOption{
 		httptransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
 		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerBefore(func(ctx context.Context, r *http.Request) context.Context {
+			return context.WithValue(ctx, remoteIPContextKey, remoteIP(r, config.rateLimits.TrustForwardedFor))
+		}),
+		httptransport.ServerBefore(peerIdentityToContext),
 	}
 
 	// GET		/invoices/ 		returns the invoices given an account id and the created boolean
+	// GET		/invoices/{id}/details	returns the given invoice and its line items
 	// POST		/invoices/ 		creates an invoice with the given information
 	// DELETE 	/invoices/		deletes the invoice corresponding to the given ID
 	// POST		/invoices/pay	tries to process the payment of the given invoice
+	// GET		/clients/{id}/ledger	returns the ledger entries of the given account
+	// POST		/invoices/refund	refunds all or part of the given paid invoice
+	// GET		/invoices/{id}/credit-notes	returns the credit notes issued for the given invoice
+	// POST		/invoices/{id}/installments	splits the given invoice into installments
+	// GET		/invoices/{id}/installments	returns the installments of the given invoice
+	// POST		/installments/pay	pays the given installment
+	// POST		/clients/{id}/late-fee-policy	sets the late fees charged on the overdue invoices of the given issuer
+	// GET		/clients/{id}/late-fee-policy	returns the late fee policy of the given issuer
+	// POST		/clients/{id}/numbering-policy	sets how the invoices of the given issuer are numbered
+	// GET		/clients/{id}/numbering-policy	returns the numbering policy of the given issuer
+	// POST		/clients/{id}/notification-preferences	sets the language of the emails sent to the given client, or stops them
+	// GET		/clients/{id}/notification-preferences	returns the email preferences of the given client
+	// GET		/invoices/{id}/pdf	returns the given invoice as a PDF document
+	// GET		/invoices/{id}/receipt	returns the payment receipt of the given invoice as a PDF document
+	// GET		/clients/{id}/invoices.csv	exports the invoices of the given client as CSV
+	// POST		/invoices/import	issues the invoices of the CSV rows in the body
+	// GET		/invoices/{id}/ubl	returns the given invoice as an UBL 2.1 e-invoice
+	// GET		/invoices/{id}/cii	returns the given invoice as a CII (Factur-X XML) e-invoice
+	// GET		/invoices/{id}/factur-x	returns the given invoice as a PDF with its CII XML attached
+	// POST		/invoices/import/ubl	issues the invoice of the UBL 2.1 document in the body
+	// GET		/clients/{id}/fec	returns the accounting entries (FEC) of the given issuer over a period
+	// POST		/clients/{id}/webhooks	subscribes a webhook to the events of the invoices of the given client
+	// GET		/clients/{id}/webhooks	returns the webhooks of the given client
+	// DELETE	/webhooks/{id}	removes the given webhook
+	// GET		/webhooks/{id}/deliveries	returns the delivery log of the given webhook
+	// POST		/webhook-deliveries/{id}/redeliver	sends the given delivery again
+	// POST		/clients/{id}/recurring-invoices	creates a recurring invoice issued by the given client
+	// GET		/clients/{id}/recurring-invoices	returns the recurring invoices of the given issuer
+	// GET		/recurring-invoices/{id}	returns the given recurring invoice
+	// POST		/recurring-invoices/{id}/pause	stops issuing the invoices of the given recurring invoice
+	// POST		/recurring-invoices/{id}/resume	issues again the invoices of the given recurring invoice
+	// POST		/recurring-invoices/{id}/cancel	ends the given recurring invoice for good
+	// GET		/recurring-invoices/{id}/history	returns the invoices issued by the given recurring invoice
+	// POST		/invoices/{id}/schedule-payment	schedules the payment of the given invoice by its payer
+	// GET		/clients/{id}/scheduled-payments	returns the scheduled payments of the given payer
+	// DELETE	/scheduled-payments/{id}	cancels the given scheduled payment
+	// POST		/clients/{id}/mandates	lets an issuer be paid automatically by the given payer
+	// GET		/clients/{id}/mandates	returns the mandates given or received by the given client
+	// DELETE	/mandates/{id}	revokes the given mandate
+	// GET		/mandates/{id}/payments	returns the invoices paid, scheduled or rejected by the given mandate
+	// POST		/invoices/pay-batch	pays several invoices of a payer in a single transaction
+	// POST		/clients/{id}/groups	creates a group of payers of the given issuer
+	// GET		/clients/{id}/groups	returns the groups of payers of the given issuer
+	// POST		/clients/{id}/bulk-invoices	issues the same invoice to a list of payers or a group, in the background
+	// GET		/clients/{id}/bulk-invoices	returns the bulk issuances of the given issuer
+	// GET		/bulk-invoices/{id}	returns the progress of the given bulk issuance
+	// GET		/bulk-invoices/{id}/items	returns the invoices of the given bulk issuance, filtered with ?state=
+	// POST		/bulk-invoices/{id}/cancel	cancels the invoices of the given bulk issuance not created yet
+	// POST		/invoices/{id}/cancel	cancels the given unpaid invoice with a credit note
 
 	r.Methods("GET").Path("/invoices/{id}").Handler(httptransport.NewServer(
 		e.GetInvoiceListEndpoint,
@@ -41,6 +168,13 @@ func MakeHTTPHandler(s InvoiceService, logger log.Logger) http.Handler {
 		options...,
 	))
 
+	r.Methods("GET").Path("/invoices/{id}/details").Handler(httptransport.NewServer(
+		e.GetInvoiceEndpoint,
+		decodeGetInvoiceRequest,
+		encodeResponse,
+		options...,
+	))
+
 	r.Methods("POST").Path("/invoices/").Handler(httptransport.NewServer(
 		e.AddEndpoint,
 		decodeAddRequest,
@@ -62,18 +196,350 @@ func MakeHTTPHandler(s InvoiceService, logger log.Logger) http.Handler {
 		options...,
 	))
 
-	c := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"POST", "GET", "OPTIONS"},
-		//AllowedHeaders: []string{"Content-Type", "Accept", "Accept-Encoding", "Authorization"},
-		AllowedHeaders: []string{"*"},
-		// Enable Debugging for testing, consider disabling in production
-		Debug: true,
-	})
+	r.Methods("GET").Path("/clients/{id}/ledger").Handler(httptransport.NewServer(
+		e.GetLedgerEndpoint,
+		decodeLedgerRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/invoices/refund").Handler(httptransport.NewServer(
+		e.RefundEndpoint,
+		decodeRefundRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/invoices/{id}/credit-notes").Handler(httptransport.NewServer(
+		e.GetCreditNotesEndpoint,
+		decodeCreditNotesRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/invoices/{id}/installments").Handler(httptransport.NewServer(
+		e.SetInstallmentsEndpoint,
+		decodeSetInstallmentsRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/invoices/{id}/installments").Handler(httptransport.NewServer(
+		e.GetInstallmentsEndpoint,
+		decodeGetInstallmentsRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/installments/pay").Handler(httptransport.NewServer(
+		e.PayInstallmentEndpoint,
+		decodePayInstallmentRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/clients/{id}/late-fee-policy").Handler(httptransport.NewServer(
+		e.SetLateFeePolicyEndpoint,
+		decodeSetLateFeePolicyRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/clients/{id}/late-fee-policy").Handler(httptransport.NewServer(
+		e.GetLateFeePolicyEndpoint,
+		decodeGetLateFeePolicyRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/clients/{id}/numbering-policy").Handler(httptransport.NewServer(
+		e.SetNumberingEndpoint,
+		decodeSetNumberingPolicyRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/clients/{id}/numbering-policy").Handler(httptransport.NewServer(
+		e.GetNumberingEndpoint,
+		decodeGetNumberingPolicyRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/clients/{id}/notification-preferences").Handler(httptransport.NewServer(
+		e.SetPreferenceEndpoint,
+		decodeSetNotificationPreferenceRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/clients/{id}/notification-preferences").Handler(httptransport.NewServer(
+		e.GetPreferenceEndpoint,
+		decodeGetNotificationPreferenceRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/invoices/{id}/pdf").Handler(httptransport.NewServer(
+		e.InvoicePDFEndpoint,
+		decodeInvoiceDocumentRequest,
+		encodeDocumentResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/invoices/{id}/receipt").Handler(httptransport.NewServer(
+		e.ReceiptPDFEndpoint,
+		decodeInvoiceDocumentRequest,
+		encodeDocumentResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/clients/{id}/invoices.csv").Handler(httptransport.NewServer(
+		e.ExportCSVEndpoint,
+		decodeExportCSVRequest,
+		encodeCSVResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/invoices/import").Handler(httptransport.NewServer(
+		e.ImportCSVEndpoint,
+		decodeImportCSVRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/invoices/{id}/ubl").Handler(httptransport.NewServer(
+		e.UBLEndpoint,
+		decodeInvoiceDocumentRequest,
+		encodeDocumentResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/invoices/{id}/cii").Handler(httptransport.NewServer(
+		e.CIIEndpoint,
+		decodeInvoiceDocumentRequest,
+		encodeDocumentResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/invoices/{id}/factur-x").Handler(httptransport.NewServer(
+		e.FacturXEndpoint,
+		decodeInvoiceDocumentRequest,
+		encodeDocumentResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/invoices/import/ubl").Handler(httptransport.NewServer(
+		e.ImportUBLEndpoint,
+		decodeImportUBLRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/clients/{id}/fec").Handler(httptransport.NewServer(
+		e.FECEndpoint,
+		decodeFECRequest,
+		encodeDocumentResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/clients/{id}/webhooks").Handler(httptransport.NewServer(
+		e.CreateWebhookEndpoint,
+		decodeCreateWebhookRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/clients/{id}/webhooks").Handler(httptransport.NewServer(
+		e.GetWebhooksEndpoint,
+		decodeGetWebhooksRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("DELETE").Path("/webhooks/{id}").Handler(httptransport.NewServer(
+		e.DeleteWebhookEndpoint,
+		decodeWebhookRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/webhooks/{id}/deliveries").Handler(httptransport.NewServer(
+		e.DeliveriesEndpoint,
+		decodeWebhookRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/webhook-deliveries/{id}/redeliver").Handler(httptransport.NewServer(
+		e.RedeliverEndpoint,
+		decodeRedeliverWebhookRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/clients/{id}/recurring-invoices").Handler(httptransport.NewServer(
+		e.CreateRecurringEndpoint,
+		decodeCreateRecurringInvoiceRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/clients/{id}/recurring-invoices").Handler(httptransport.NewServer(
+		e.GetRecurringListEndpoint,
+		decodeGetRecurringInvoicesRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/recurring-invoices/{id}").Handler(httptransport.NewServer(
+		e.GetRecurringEndpoint,
+		decodeRecurringInvoiceRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/recurring-invoices/{id}/pause").Handler(httptransport.NewServer(
+		e.PauseRecurringEndpoint,
+		decodeRecurringInvoiceRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/recurring-invoices/{id}/resume").Handler(httptransport.NewServer(
+		e.ResumeRecurringEndpoint,
+		decodeRecurringInvoiceRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/recurring-invoices/{id}/cancel").Handler(httptransport.NewServer(
+		e.CancelRecurringEndpoint,
+		decodeRecurringInvoiceRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/recurring-invoices/{id}/history").Handler(httptransport.NewServer(
+		e.RecurringRunsEndpoint,
+		decodeRecurringInvoiceRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/invoices/{id}/schedule-payment").Handler(httptransport.NewServer(
+		e.SchedulePaymentEndpoint,
+		decodeSchedulePaymentRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/clients/{id}/scheduled-payments").Handler(httptransport.NewServer(
+		e.ListSchedulesEndpoint,
+		decodeGetScheduledPaymentsRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("DELETE").Path("/scheduled-payments/{id}").Handler(httptransport.NewServer(
+		e.CancelPaymentEndpoint,
+		decodeCancelScheduledPaymentRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/clients/{id}/mandates").Handler(httptransport.NewServer(
+		e.CreateMandateEndpoint,
+		decodeCreateMandateRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/clients/{id}/mandates").Handler(httptransport.NewServer(
+		e.GetMandatesEndpoint,
+		decodeGetMandatesRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("DELETE").Path("/mandates/{id}").Handler(httptransport.NewServer(
+		e.RevokeMandateEndpoint,
+		decodeMandateRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/mandates/{id}/payments").Handler(httptransport.NewServer(
+		e.MandatePaymentsEndpoint,
+		decodeMandateRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/invoices/pay-batch").Handler(httptransport.NewServer(
+		e.BatchPaymentEndpoint,
+		decodeBatchPaymentRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/clients/{id}/groups").Handler(httptransport.NewServer(
+		e.CreateGroupEndpoint,
+		decodeCreatePayerGroupRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/clients/{id}/groups").Handler(httptransport.NewServer(
+		e.GetGroupsEndpoint,
+		decodeGetPayerGroupsRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/clients/{id}/bulk-invoices").Handler(httptransport.NewServer(
+		e.CreateBulkJobEndpoint,
+		decodeCreateBulkJobRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/clients/{id}/bulk-invoices").Handler(httptransport.NewServer(
+		e.GetBulkJobsEndpoint,
+		decodeGetBulkInvoiceJobsRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/bulk-invoices/{id}").Handler(httptransport.NewServer(
+		e.GetBulkJobEndpoint,
+		decodeBulkInvoiceJobRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("GET").Path("/bulk-invoices/{id}/items").Handler(httptransport.NewServer(
+		e.BulkJobItemsEndpoint,
+		decodeBulkInvoiceJobRequest,
+		encodeResponse,
+		options...,
+	))
+
+	r.Methods("POST").Path("/bulk-invoices/{id}/cancel").Handler(httptransport.NewServer(
+		e.CancelBulkJobEndpoint,
+		decodeBulkInvoiceJobRequest,
+		encodeResponse,
+		options...,
+	))
 
-	handler := c.Handler(r)
+	r.Methods("POST").Path("/invoices/{id}/cancel").Handler(httptransport.NewServer(
+		e.CancelInvoiceEndpoint,
+		decodeCancelInvoiceRequest,
+		encodeResponse,
+		options...,
+	))
 
-	return handler
+	return securityHeadersHandler(config.securityHeaders, corsHandler(config.cors, r))
 }
 
 func decodeInvoiceListRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
@@ -90,6 +556,15 @@ func decodeInvoiceListRequest(_ context.Context, r *http.Request) (request inter
 	return req, nil
 }
 
+func decodeGetInvoiceRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return GetInvoiceRequest{idparam}, nil
+}
+
 func decodeAddRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
 	var req AddRequest
 	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
@@ -114,42 +589,491 @@ func decodeDeleteRequest(_ context.Context, r *http.Request) (request interface{
 	return req, nil
 }
 
-type errorer interface {
-	error() error
+func decodeLedgerRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return GetLedgerRequest{idparam}, nil
 }
 
-func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-	if e, ok := response.(errorer); ok && e.error() != nil {
-		// Not a Go kit transport error, but a business-logic error.
-		// Provide those as HTTP errors.
-		encodeError(ctx, e.error(), w)
-		return nil
+func decodeRefundRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req RefundRequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, e
 	}
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	return json.NewEncoder(w).Encode(response)
+	return req, nil
 }
 
-func encodeError(_ context.Context, err error, w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-	if err == nil {
-		panic("encodeError with nil error")
+func decodeCreditNotesRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
 	}
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(codeFrom(err))
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": err.Error(),
-	})
+	return GetCreditNotesRequest{idparam}, nil
 }
 
-func codeFrom(err error) int {
+func decodeSetInstallmentsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var req SetInstallmentPlanRequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, e
+	}
+	req.Iid = idparam
+	return req, nil
+}
+
+func decodeGetInstallmentsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return GetInstallmentsRequest{idparam}, nil
+}
+
+func decodePayInstallmentRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req InstallmentPaymentRequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, e
+	}
+	return req, nil
+}
+
+func decodeSetLateFeePolicyRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var policy LateFeePolicy
+	if e := json.NewDecoder(r.Body).Decode(&policy); e != nil {
+		return nil, e
+	}
+	policy.IssuerID = idparam
+	return SetLateFeePolicyRequest{policy}, nil
+}
+
+func decodeGetLateFeePolicyRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return GetLateFeePolicyRequest{idparam}, nil
+}
+
+func decodeInvoiceDocumentRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return GetInvoiceDocumentRequest{idparam}, nil
+}
+
+func decodeExportCSVRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	createdBy, _ := strconv.ParseBool(r.URL.Query().Get("CreatedBy"))
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return ExportCSVRequest{idparam, createdBy}, nil
+}
+
+// Taille maximale d'un fichier importé
+const maxImportSize = 10 << 20
+
+func decodeImportCSVRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxImportSize))
+	if err != nil {
+		return nil, err
+	}
+	return ImportCSVRequest{
+		Uid:  r.URL.Query().Get("Uid"),
+		Mode: r.URL.Query().Get("Mode"),
+		CSV:  body,
+	}, nil
+}
+
+func decodeImportUBLRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxImportSize))
+	if err != nil {
+		return nil, err
+	}
+	return ImportUBLRequest{r.URL.Query().Get("Uid"), body}, nil
+}
+
+func decodeSetNumberingPolicyRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var policy NumberingPolicy
+	if e := json.NewDecoder(r.Body).Decode(&policy); e != nil {
+		return nil, e
+	}
+	policy.IssuerID = idparam
+	return SetNumberingPolicyRequest{policy}, nil
+}
+
+func decodeGetNumberingPolicyRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return GetNumberingPolicyRequest{idparam}, nil
+}
+
+func decodeSetNotificationPreferenceRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var preference NotificationPreference
+	if e := json.NewDecoder(r.Body).Decode(&preference); e != nil {
+		return nil, e
+	}
+	preference.ClientID = idparam
+	return SetNotificationPreferenceRequest{preference}, nil
+}
+
+func decodeGetNotificationPreferenceRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return GetNotificationPreferenceRequest{idparam}, nil
+}
+
+func decodeFECRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return FECRequest{idparam, r.URL.Query().Get("from"), r.URL.Query().Get("to")}, nil
+}
+
+func decodeCreateWebhookRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var webhook WebhookSubscription
+	if e := json.NewDecoder(r.Body).Decode(&webhook); e != nil {
+		return nil, e
+	}
+	webhook.ClientID = idparam
+	return CreateWebhookRequest{webhook}, nil
+}
+
+func decodeGetWebhooksRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return GetWebhooksRequest{idparam}, nil
+}
+
+func decodeWebhookRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return WebhookRequest{idparam}, nil
+}
+
+func decodeRedeliverWebhookRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return RedeliverWebhookRequest{idparam}, nil
+}
+
+func decodeCreateRecurringInvoiceRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var body struct {
+		EmailClient string `json:"email_client"`
+		RecurringInvoice
+	}
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		return nil, e
+	}
+	body.RecurringInvoice.IssuerID = idparam
+	return CreateRecurringInvoiceRequest{body.EmailClient, body.RecurringInvoice}, nil
+}
+
+func decodeGetRecurringInvoicesRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return GetRecurringInvoicesRequest{idparam}, nil
+}
+
+func decodeRecurringInvoiceRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return RecurringInvoiceRequest{idparam}, nil
+}
+
+func decodeSchedulePaymentRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var req SchedulePaymentRequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, e
+	}
+	req.Iid = idparam
+	return req, nil
+}
+
+func decodeGetScheduledPaymentsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return GetScheduledPaymentsRequest{idparam}, nil
+}
+
+func decodeCancelScheduledPaymentRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return CancelScheduledPaymentRequest{idparam}, nil
+}
+
+func decodeCreateMandateRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var body struct {
+		EmailIssuer string `json:"issuer_email"`
+		Mandate
+	}
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		return nil, e
+	}
+	body.Mandate.PayerID = idparam
+	return CreateMandateRequest{body.EmailIssuer, body.Mandate}, nil
+}
+
+func decodeGetMandatesRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return GetMandatesRequest{idparam}, nil
+}
+
+func decodeMandateRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return MandateRequest{idparam}, nil
+}
+
+func decodeBatchPaymentRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req BatchPaymentRequest
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		return nil, e
+	}
+	return req, nil
+}
+
+func decodeCreatePayerGroupRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var group PayerGroup
+	if e := json.NewDecoder(r.Body).Decode(&group); e != nil {
+		return nil, e
+	}
+	group.OwnerID = idparam
+	return CreatePayerGroupRequest{group}, nil
+}
+
+func decodeGetPayerGroupsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return GetPayerGroupsRequest{idparam}, nil
+}
+
+func decodeCreateBulkJobRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	var body struct {
+		Emails []string `json:"emails"`
+		BulkInvoiceJob
+	}
+	if e := json.NewDecoder(r.Body).Decode(&body); e != nil {
+		return nil, e
+	}
+	return CreateBulkJobRequest{idparam, body.Emails, body.BulkInvoiceJob}, nil
+}
+
+func decodeGetBulkInvoiceJobsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return GetBulkInvoiceJobsRequest{idparam}, nil
+}
+
+func decodeBulkInvoiceJobRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	return BulkInvoiceJobRequest{idparam, r.URL.Query().Get("state")}, nil
+}
+
+func decodeCancelInvoiceRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	idparam, ok := vars["id"]
+	if !ok {
+		return nil, ErrBadRouting
+	}
+	// La raison de l'annulation est optionnelle
+	req := CancelInvoiceRequest{}
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil && e != io.EOF {
+		return nil, e
+	}
+	req.Iid = idparam
+	return req, nil
+}
+
+type errorer interface {
+	error() error
+}
+
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		// Not a Go kit transport error, but a business-logic error.
+		// Provide those as HTTP errors.
+		encodeError(ctx, e.error(), w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if sc, ok := response.(httptransport.StatusCoder); ok {
+		w.WriteHeader(sc.StatusCode())
+	}
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodeCSVResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	csv := response.(CSVResponse)
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+csv.Filename+`"`)
+	return csv.write(flushWriter{w})
+}
+
+// flushWriter sends each write to the client right away.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+func encodeDocumentResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	doc := response.(DocumentResponse)
+	w.Header().Set("Content-Type", doc.ContentType)
+	w.Header().Set("Content-Disposition", `inline; filename="`+doc.Filename+`"`)
+	_, err := w.Write(doc.Content)
+	return err
+}
+
+func encodeError(_ context.Context, err error, w http.ResponseWriter) {
+	if err == nil {
+		panic("encodeError with nil error")
+	}
+	if h, ok := err.(httptransport.Headerer); ok {
+		for k, values := range h.Headers() {
+			for _, v := range values {
+				w.Header().Add(k, v)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(codeFrom(err))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": err.Error(),
+	})
+}
+
+func codeFrom(err error) int {
+	if sc, ok := err.(httptransport.StatusCoder); ok {
+		return sc.StatusCode()
+	}
 	switch err {
 	case ErrNotFound:
 		return http.StatusNotFound
+	case ErrInstallmentNotFound, ErrNoLateFeePolicy, ErrWebhookNotFound, ErrDeliveryNotFound, ErrRecurringNotFound, ErrScheduledPaymentNotFound, ErrMandateNotFound, ErrGroupNotFound, ErrBulkJobNotFound:
+		return http.StatusNotFound
+	case ErrNotIssuer, ErrNotPayer:
+		return http.StatusForbidden
+	case ErrInsufficientBalance:
+		return http.StatusPaymentRequired
+	case ErrAlreadyPaid, ErrAccountQuarantined, ErrNotRefundable, ErrInstallmentPlanExists, ErrInstallmentAlreadyPaid, ErrPayByInstallments, ErrNoPayment, ErrRecurringInactive, ErrPaymentAlreadyScheduled, ErrScheduledPaymentCompleted, ErrMandateExists, ErrMandateAlreadyRevoked, ErrBulkJobFinished, ErrNotDeletable, ErrNotEditable, ErrNotCancellable, ErrNumberingPolicyInUse:
+		return http.StatusConflict
+	case ErrInvalidAmount, ErrInvalidLineItem, ErrUnknownTaxRate, ErrUnknownTaxJurisdiction, ErrSameAccount, ErrRefundTooLarge, ErrPaymentTooLarge, ErrInstallmentsDontAddUp, ErrInvalidInstallmentDates, ErrInvalidLateFeePolicy, ErrInvalidDiscountTerms, ErrInvalidImportMode, ErrInvalidPeriod, ErrInvalidNumberingPolicy, ErrInvalidWebhook, ErrWebhookPrivateHost, ErrUnknownLanguage, ErrInvalidRecurrence, ErrInvalidPaymentDate, ErrInvalidMandate, ErrInvalidBatch, ErrInvalidGroup, ErrInvalidBulkJob:
+		return http.StatusBadRequest
+	case ErrNoPeerCertificate:
+		return http.StatusUnauthorized
+	case ErrPeerNotAllowed:
+		return http.StatusForbidden
 	case ErrNotAnId, ErrNotFound:
 		return http.StatusBadRequest
 	default:
@@ -0,0 +1,546 @@
+package invoice_microservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/rs/xid"
+)
+
+// États d'une livraison de webhook
+const (
+	DELIVERY_PENDING   = "PENDING"
+	DELIVERY_DELIVERED = "DELIVERED"
+	DELIVERY_FAILED    = "FAILED"
+)
+
+// En-têtes des requêtes envoyées aux webhooks
+const (
+	WebhookIDHeader        = "X-Webhook-Id"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	webhookColumns  = "webhook_id, client_id, webhook_url, event_types, webhook_secret, created_at"
+	deliveryColumns = "delivery_id, webhook_id, event_id, event_type, payload, delivery_state, attempts, last_status_code, last_error, next_attempt_at, created_at"
+
+	// Corps de réponse gardé dans le journal des livraisons
+	maxWebhookResponse = 1024
+)
+
+var (
+	ErrInvalidWebhook       = errors.New("webhook url must be an absolute https url and event types must be invoice event types")
+	ErrWebhookPrivateHost   = errors.New("webhook host must resolve to public addresses only")
+	ErrWebhookNotFound      = errors.New("no webhook with this id")
+	ErrDeliveryNotFound     = errors.New("no webhook delivery with this id")
+	ErrInvalidWebhookSecret = errors.New("webhook signature does not match")
+)
+
+// WebhookSubscription sends the events of the invoices a client issued or received to its URL. An
+// empty EventTypes subscribes to every event. The secret is only returned when the webhook is created.
+type WebhookSubscription struct {
+	ID         string         `json:"webhook_id" db:"webhook_id"`
+	ClientID   string         `json:"client_id" db:"client_id"`
+	URL        string         `json:"url" db:"webhook_url"`
+	EventTypes pq.StringArray `json:"event_types" db:"event_types"`
+	Secret     string         `json:"secret,omitempty" db:"webhook_secret"`
+	CreatedAt  time.Time      `json:"created_at" db:"created_at"`
+}
+
+func (w WebhookSubscription) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return ErrInvalidWebhook
+	}
+	for _, t := range w.EventTypes {
+		switch t {
+		case InvoiceCreated, InvoiceUpdated, InvoicePaid, InvoicePartiallyPaid, InvoiceRefunded, InvoiceExpired, InvoiceDeleted, InvoiceCancelled:
+		default:
+			return ErrInvalidWebhook
+		}
+	}
+	return nil
+}
+
+// Réseaux privés (RFC 1918, adresses partagées RFC 6598, adresses locales IPv6 RFC 4193)
+var privateNetworks = func() []*net.IPNet {
+	networks := make([]*net.IPNet, 0)
+	for _, cidr := range []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// publicIP returns false for the addresses of the private networks, the loopback, link-local and
+// unspecified addresses, a webhook cannot be used to reach the internal services.
+func publicIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWebhookHost resolves the host of the webhook and refuses it if one of its addresses is not public.
+func checkWebhookHost(ctx context.Context, webhookURL string) error {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return ErrInvalidWebhook
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return ErrWebhookPrivateHost
+	}
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return ErrWebhookPrivateHost
+		}
+	}
+	return nil
+}
+
+// publicDialControl refuses the connections to an address that is not public. It is checked on the
+// address actually dialed, the host may resolve to another address than when the webhook was created.
+func publicDialControl(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicIP(net.ParseIP(host)) {
+		return ErrWebhookPrivateHost
+	}
+	return nil
+}
+
+// newWebhookClient returns the client of the dispatcher : it only connects to public addresses,
+// without proxy, and does not follow redirects.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: publicDialControl}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Matches returns true if the event concerns the client of the webhook and is one of its event types.
+func (w WebhookSubscription) Matches(event Event) bool {
+	if event.Invoice.PayerID != w.ClientID && event.Invoice.ReceiverID != w.ClientID {
+		return false
+	}
+	if len(w.EventTypes) == 0 {
+		return true
+	}
+	for _, t := range w.EventTypes {
+		if t == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is an event to send to a webhook, with the attempts made so far.
+type WebhookDelivery struct {
+	ID             string           `json:"delivery_id" db:"delivery_id"`
+	WebhookID      string           `json:"webhook_id" db:"webhook_id"`
+	EventID        string           `json:"event_id" db:"event_id"`
+	EventType      string           `json:"event_type" db:"event_type"`
+	Payload        string           `json:"payload" db:"payload"`
+	State          string           `json:"state" db:"delivery_state"`
+	Attempts       int              `json:"attempts" db:"attempts"`
+	LastStatusCode int              `json:"last_status_code" db:"last_status_code"`
+	LastError      string           `json:"last_error" db:"last_error"`
+	NextAttemptAt  time.Time        `json:"next_attempt_at" db:"next_attempt_at"`
+	CreatedAt      time.Time        `json:"created_at" db:"created_at"`
+	History        []WebhookAttempt `json:"history"`
+}
+
+type WebhookAttempt struct {
+	DeliveryID string    `json:"-" db:"delivery_id"`
+	Number     int       `json:"attempt" db:"attempt"`
+	StatusCode int       `json:"status_code" db:"status_code"`
+	Error      string    `json:"error" db:"attempt_error"`
+	Response   string    `json:"response" db:"response"`
+	Duration   int64     `json:"duration_ms" db:"duration_ms"`
+	Date       time.Time `json:"date" db:"attempted_at"`
+}
+
+// SignWebhook returns the signature of the body sent at timestamp : the hex encoded HMAC-SHA256 of
+// "<timestamp>.<body>" with the secret of the webhook.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks the signature of a request received by a webhook, the receivers should also
+// refuse the timestamps that are too old to prevent replays.
+func VerifyWebhook(secret string, header http.Header, body []byte) error {
+	timestamp, err := strconv.ParseInt(header.Get(WebhookTimestampHeader), 10, 64)
+	if err != nil {
+		return ErrInvalidWebhookSecret
+	}
+	if !hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(header.Get(WebhookSignatureHeader))) {
+		return ErrInvalidWebhookSecret
+	}
+	return nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+func (s *invoiceService) CreateWebhook(ctx context.Context, webhook WebhookSubscription) (WebhookSubscription, error) {
+	if webhook.ClientID == "" {
+		return WebhookSubscription{}, ErrNotAnId
+	}
+	if err := webhook.validate(); err != nil {
+		return WebhookSubscription{}, err
+	}
+	if err := checkWebhookHost(ctx, webhook.URL); err != nil {
+		return WebhookSubscription{}, err
+	}
+	if webhook.EventTypes == nil {
+		webhook.EventTypes = pq.StringArray{}
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	webhook.ID = xid.New().String()
+	webhook.Secret = secret
+
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	err = db.Get(&webhook.CreatedAt, "INSERT INTO webhook (webhook_id, client_id, webhook_url, event_types, webhook_secret) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+		webhook.ID, webhook.ClientID, webhook.URL, webhook.EventTypes, webhook.Secret)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	return webhook, nil
+}
+
+func (s *invoiceService) GetWebhooks(ctx context.Context, clientID string) ([]WebhookSubscription, error) {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	webhooks := make([]WebhookSubscription, 0)
+	if err := db.Select(&webhooks, "SELECT "+webhookColumns+" FROM webhook WHERE client_id=$1 ORDER BY created_at", clientID); err != nil {
+		return nil, err
+	}
+	for n := range webhooks {
+		webhooks[n].Secret = ""
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook removes the webhook, the deliveries still pending are dropped.
+func (s *invoiceService) DeleteWebhook(ctx context.Context, webhookID string) error {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM webhook WHERE webhook_id=$1", webhookID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		if err != nil {
+			return err
+		}
+		return ErrWebhookNotFound
+	}
+	if _, err := tx.Exec("UPDATE webhook_delivery SET delivery_state = $1, last_error = 'webhook deleted' WHERE webhook_id=$2 AND delivery_state = $3", DELIVERY_FAILED, webhookID, DELIVERY_PENDING); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetWebhookDeliveries returns the delivery log of the webhook, latest first, with the attempts of each delivery.
+func (s *invoiceService) GetWebhookDeliveries(ctx context.Context, webhookID string) ([]WebhookDelivery, error) {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+	if err := db.Select(&deliveries, "SELECT "+deliveryColumns+" FROM webhook_delivery WHERE webhook_id=$1 ORDER BY created_at DESC, delivery_id", webhookID); err != nil {
+		return nil, err
+	}
+
+	attempts := make([]WebhookAttempt, 0)
+	err := db.Select(&attempts, `SELECT a.delivery_id, a.attempt, a.status_code, a.attempt_error, a.response, a.duration_ms, a.attempted_at
+		FROM webhook_attempt a JOIN webhook_delivery d ON d.delivery_id = a.delivery_id WHERE d.webhook_id=$1 ORDER BY a.attempt_id`, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	byDelivery := make(map[string][]WebhookAttempt)
+	for _, a := range attempts {
+		byDelivery[a.DeliveryID] = append(byDelivery[a.DeliveryID], a)
+	}
+	for n := range deliveries {
+		deliveries[n].History = byDelivery[deliveries[n].ID]
+		if deliveries[n].History == nil {
+			deliveries[n].History = make([]WebhookAttempt, 0)
+		}
+	}
+	return deliveries, nil
+}
+
+// RedeliverWebhook sends the delivery again on the next run of the dispatcher, with a new series of
+// attempts, whatever its state.
+func (s *invoiceService) RedeliverWebhook(ctx context.Context, deliveryID string) (WebhookDelivery, error) {
+	db := GetDbConnexion(s.DbInfos)
+	defer db.Close()
+
+	delivery := WebhookDelivery{}
+	err := db.Get(&delivery, `UPDATE webhook_delivery d SET delivery_state = $1, attempts = 0, next_attempt_at = now()
+		FROM webhook w WHERE w.webhook_id = d.webhook_id AND d.delivery_id=$2 RETURNING `+prefixColumns("d", deliveryColumns), DELIVERY_PENDING, deliveryID)
+	if err == sql.ErrNoRows {
+		return WebhookDelivery{}, ErrDeliveryNotFound
+	}
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	return delivery, nil
+}
+
+// prefixColumns qualifies each column of the list with the table alias.
+func prefixColumns(alias string, columns string) string {
+	qualified := strings.Split(columns, ", ")
+	for n, c := range qualified {
+		qualified[n] = alias + "." + c
+	}
+	return strings.Join(qualified, ", ")
+}
+
+// WebhookPublisher queues a delivery of the event for each webhook it matches. It is given to the
+// OutboxRelay, an event relayed twice is only queued once per webhook.
+type WebhookPublisher struct {
+	DbInfos DbConnexionInfo
+}
+
+func NewWebhookPublisher(dbinfos DbConnexionInfo) *WebhookPublisher {
+	return &WebhookPublisher{DbInfos: dbinfos}
+}
+
+func (p *WebhookPublisher) Publish(ctx context.Context, event Event) error {
+	db := GetDbConnexion(p.DbInfos)
+	defer db.Close()
+
+	webhooks := make([]WebhookSubscription, 0)
+	err := db.Select(&webhooks, "SELECT "+webhookColumns+" FROM webhook WHERE client_id IN ($1, $2)", event.Invoice.PayerID, event.Invoice.ReceiverID)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	for _, w := range webhooks {
+		if !w.Matches(event) {
+			continue
+		}
+		_, err := db.Exec(`INSERT INTO webhook_delivery (delivery_id, webhook_id, event_id, event_type, payload, delivery_state) VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (webhook_id, event_id) DO NOTHING`, xid.New().String(), w.ID, event.ID, event.Type, string(payload), DELIVERY_PENDING)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WebhookDispatcher sends the pending deliveries to the webhooks.
+type WebhookDispatcher struct {
+	DbInfos DbConnexionInfo
+	Client  *http.Client
+	// Une livraison est abandonnée après MaxAttempts échecs
+	MaxAttempts int
+	BatchSize   int
+	// Une livraison réservée par un dispatcher n'est pas envoyée par un autre avant ce délai
+	Lease time.Duration
+}
+
+func NewWebhookDispatcher(dbinfos DbConnexionInfo) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		DbInfos:     dbinfos,
+		Client:      newWebhookClient(10 * time.Second),
+		MaxAttempts: 8,
+		BatchSize:   50,
+		Lease:       time.Minute,
+	}
+}
+
+// webhookResult is the outcome of an attempt.
+type webhookResult struct {
+	StatusCode int
+	Response   string
+	Err        error
+	Duration   time.Duration
+}
+
+func (r webhookResult) ok() bool {
+	return r.Err == nil && r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+func (r webhookResult) error() string {
+	if r.Err != nil {
+		return r.Err.Error()
+	}
+	if !r.ok() {
+		return fmt.Sprintf("webhook answered %d", r.StatusCode)
+	}
+	return ""
+}
+
+// send posts the payload of the delivery, signed with the secret of the webhook.
+func (d *WebhookDispatcher) send(ctx context.Context, webhook WebhookSubscription, delivery WebhookDelivery) webhookResult {
+	start := time.Now()
+	timestamp := start.Unix()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", webhook.URL, bytes.NewReader([]byte(delivery.Payload)))
+	if err != nil {
+		return webhookResult{Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("User-Agent", "invoice-microservice-webhook")
+	req.Header.Set(WebhookIDHeader, delivery.ID)
+	req.Header.Set(WebhookEventHeader, delivery.EventType)
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(webhook.Secret, timestamp, []byte(delivery.Payload)))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return webhookResult{Err: err, Duration: time.Since(start)}
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+	return webhookResult{StatusCode: resp.StatusCode, Response: string(body), Duration: time.Since(start)}
+}
+
+// Dispatch sends the deliveries that are due and returns the number delivered. A failed delivery is
+// retried with an exponential backoff until MaxAttempts, then it is FAILED and can only be redelivered
+// by hand. Several dispatchers can run at once : the deliveries are reserved for Lease before being
+// sent, no transaction stays open during the requests and the outcome of each one is saved on its own.
+func (d *WebhookDispatcher) Dispatch(ctx context.Context) (int, error) {
+	db := GetDbConnexion(d.DbInfos)
+	defer db.Close()
+
+	rows := make([]struct {
+		WebhookDelivery
+		URL    string `db:"webhook_url"`
+		Secret string `db:"webhook_secret"`
+	}, 0)
+	err := db.Select(&rows, `UPDATE webhook_delivery d SET next_attempt_at = $3
+		FROM webhook w WHERE w.webhook_id = d.webhook_id AND d.delivery_id IN (
+			SELECT delivery_id FROM webhook_delivery WHERE delivery_state = $1 AND next_attempt_at <= now()
+			ORDER BY next_attempt_at, created_at LIMIT $2 FOR UPDATE SKIP LOCKED)
+		RETURNING `+prefixColumns("d", deliveryColumns)+`, w.webhook_url, w.webhook_secret`, DELIVERY_PENDING, d.BatchSize, time.Now().Add(d.Lease))
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, row := range rows {
+		delivery := row.WebhookDelivery
+		result := d.send(ctx, WebhookSubscription{ID: delivery.WebhookID, URL: row.URL, Secret: row.Secret}, delivery)
+		delivery.Attempts++
+
+		state := DELIVERY_PENDING
+		switch {
+		case result.ok():
+			state = DELIVERY_DELIVERED
+			delivered++
+		case delivery.Attempts >= d.MaxAttempts:
+			state = DELIVERY_FAILED
+		}
+
+		if err := d.record(db, delivery, state, result); err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+// record saves the outcome of an attempt, unless the delivery was dropped meanwhile.
+func (d *WebhookDispatcher) record(db *sqlx.DB, delivery WebhookDelivery, state string, result webhookResult) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE webhook_delivery SET delivery_state = $1, attempts = $2, last_status_code = $3, last_error = $4, next_attempt_at = $5 WHERE delivery_id=$6 AND delivery_state = $7",
+		state, delivery.Attempts, result.StatusCode, result.error(), time.Now().Add(retryBackoff(delivery.Attempts)), delivery.ID, DELIVERY_PENDING)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	_, err = tx.Exec("INSERT INTO webhook_attempt (delivery_id, attempt, status_code, attempt_error, response, duration_ms) VALUES ($1, $2, $3, $4, $5, $6)",
+		delivery.ID, delivery.Attempts, result.StatusCode, result.error(), result.Response, result.Duration.Milliseconds())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Schedule dispatches the deliveries every interval until ctx is done.
+func (d *WebhookDispatcher) Schedule(ctx context.Context, interval time.Duration, logger log.Logger) {
+	RunEvery(ctx, interval, func(ctx context.Context) {
+		delivered, err := d.Dispatch(ctx)
+		if err != nil {
+			logger.Log("webhooks", "failed", "err", err)
+			return
+		}
+		if delivered > 0 {
+			logger.Log("webhooks", "delivered", "count", delivered)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package invoice_microservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"type":"InvoicePaid"}`)
+	header := http.Header{}
+	header.Set(WebhookTimestampHeader, "1618000000")
+	header.Set(WebhookSignatureHeader, SignWebhook("secret", 1618000000, body))
+
+	if err := VerifyWebhook("secret", header, body); err != nil {
+		t.Errorf("Expected the signature to match, got %v", err)
+	}
+	if err := VerifyWebhook("other", header, body); err != ErrInvalidWebhookSecret {
+		t.Errorf("Expected another secret to fail, got %v", err)
+	}
+	if err := VerifyWebhook("secret", header, []byte(`{"type":"InvoiceExpired"}`)); err != ErrInvalidWebhookSecret {
+		t.Errorf("Expected another body to fail, got %v", err)
+	}
+	header.Set(WebhookTimestampHeader, "1618000001")
+	if err := VerifyWebhook("secret", header, body); err != ErrInvalidWebhookSecret {
+		t.Errorf("Expected another timestamp to fail, got %v", err)
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	event := NewEvent(InvoicePaid, Invoice{ID: "a", AccountPayerId: "paul", AccountReceiverId: "anne"}, 10)
+
+	cases := []struct {
+		webhook WebhookSubscription
+		matches bool
+	}{
+		{WebhookSubscription{ClientID: "anne"}, true},
+		{WebhookSubscription{ClientID: "paul", EventTypes: []string{InvoicePaid, InvoiceExpired}}, true},
+		{WebhookSubscription{ClientID: "paul", EventTypes: []string{InvoiceExpired}}, false},
+		{WebhookSubscription{ClientID: "jean"}, false},
+	}
+	for _, c := range cases {
+		if c.webhook.Matches(event) != c.matches {
+			t.Errorf("Expected %+v to match %v", c.webhook, c.matches)
+		}
+	}
+
+	for _, u := range []string{"ftp://example.com", "http://example.com/hook", "https:///hook"} {
+		if err := (WebhookSubscription{URL: u}).validate(); err != ErrInvalidWebhook {
+			t.Errorf("Expected ErrInvalidWebhook for %s, got %v", u, err)
+		}
+	}
+	if err := (WebhookSubscription{URL: "https://example.com/hook"}).validate(); err != nil {
+		t.Errorf("Expected a valid webhook, got %v", err)
+	}
+	if err := (WebhookSubscription{URL: "https://example.com/hook", EventTypes: []string{"InvoiceSent"}}).validate(); err != ErrInvalidWebhook {
+		t.Errorf("Expected ErrInvalidWebhook, got %v", err)
+	}
+}
+
+func TestWebhookPublicAddress(t *testing.T) {
+	cases := map[string]bool{
+		"93.184.216.34":   true,
+		"2606:2800::1":    true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.20.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fd00::1":         false,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": false,
+	}
+	for addr, public := range cases {
+		if publicIP(net.ParseIP(addr)) != public {
+			t.Errorf("Expected %s public %v", addr, public)
+		}
+	}
+
+	if err := checkWebhookHost(context.Background(), "https://127.0.0.1/hook"); err != ErrWebhookPrivateHost {
+		t.Errorf("Expected a loopback host to be refused, got %v", err)
+	}
+
+	// Le client du dispatcher refuse de se connecter à une adresse privée et ne suit pas les redirections
+	redirected := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/internal" {
+			redirected = true
+		}
+		http.Redirect(w, r, "/internal", http.StatusFound)
+	}))
+	defer target.Close()
+
+	d := NewWebhookDispatcher(DbConnexionInfo{})
+	result := d.send(context.Background(), WebhookSubscription{URL: target.URL}, WebhookDelivery{})
+	if result.ok() || !errors.Is(result.Err, ErrWebhookPrivateHost) {
+		t.Errorf("Expected the private address to be refused, got %+v", result)
+	}
+
+	d.Client.Transport = target.Client().Transport
+	result = d.send(context.Background(), WebhookSubscription{URL: target.URL}, WebhookDelivery{})
+	if redirected || result.StatusCode != http.StatusFound {
+		t.Errorf("Expected the redirection not to be followed, got %+v", result)
+	}
+}
+
+func TestWebhookSend(t *testing.T) {
+	event := NewEvent(InvoicePaid, Invoice{ID: "a", AccountPayerId: "paul", AccountReceiverId: "anne"}, 10)
+	payload, _ := json.Marshal(event)
+	webhook := WebhookSubscription{ID: "w", ClientID: "anne", Secret: "whsec_test"}
+	delivery := WebhookDelivery{ID: "d", WebhookID: "w", EventID: event.ID, EventType: event.Type, Payload: string(payload)}
+
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		if err := VerifyWebhook(webhook.Secret, r.Header, body); err != nil {
+			t.Errorf("Invalid signature : %v", err)
+		}
+		if ts, _ := strconv.ParseInt(r.Header.Get(WebhookTimestampHeader), 10, 64); time.Since(time.Unix(ts, 0)) > time.Minute {
+			t.Errorf("Unexpected timestamp %d", ts)
+		}
+		if r.Header.Get(WebhookEventHeader) != InvoicePaid || r.Header.Get(WebhookIDHeader) != "d" {
+			t.Errorf("Unexpected headers %v", r.Header)
+		}
+
+		var received Event
+		if err := json.Unmarshal(body, &received); err != nil || received.ID != event.ID {
+			t.Errorf("Unexpected body %s", body)
+		}
+
+		// Le premier envoi échoue, le suivant est accepté
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "try later")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+	webhook.URL = receiver.URL
+
+	d := NewWebhookDispatcher(DbConnexionInfo{})
+	d.Client = receiver.Client()
+
+	result := d.send(context.Background(), webhook, delivery)
+	if result.ok() || result.StatusCode != http.StatusServiceUnavailable || result.Response != "try later" || result.error() != "webhook answered 503" {
+		t.Errorf("Expected the first attempt to fail, got %+v", result)
+	}
+
+	result = d.send(context.Background(), webhook, delivery)
+	if !result.ok() || result.error() != "" {
+		t.Errorf("Expected the second attempt to succeed, got %+v", result)
+	}
+
+	receiver.Close()
+	if result := d.send(context.Background(), webhook, delivery); result.ok() || result.Err == nil {
+		t.Errorf("Expected an unreachable webhook to fail, got %+v", result)
+	}
+}
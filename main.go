@@ -1,8 +1,9 @@
 package main
 
 import (
-	"net/http"
+	"context"
 	"os"
+	"time"
 
 	invoiceService "github.com/PP-Groupe-6/invoice-microservice/invoice_microservice"
 	"github.com/go-kit/kit/log"
@@ -17,7 +18,13 @@ func main() {
 		Password: "dev",
 	}
 
-	service := invoiceService.NewInvoiceService(info)
+	if err := invoiceService.CreateSchema(info); err != nil {
+		panic(err)
+	}
+
+	if runCommand(info, os.Args[1:]) {
+		return
+	}
 
 	var logger log.Logger
 	{
@@ -26,7 +33,90 @@ func main() {
 		logger = log.With(logger, "caller", log.DefaultCaller)
 	}
 
-	err := http.ListenAndServe(":8002", invoiceService.MakeHTTPHandler(service, logger))
+	// Les événements sont publiés sur NATS si un serveur est configuré, dans les logs sinon
+	var publisher invoiceService.Publisher = invoiceService.NewLogPublisher(logger)
+	if url := os.Getenv("INVOICE_NATS_URL"); url != "" {
+		nats, err := invoiceService.ConnectNATS(url, os.Getenv("INVOICE_NATS_SUBJECT_PREFIX"))
+		if err != nil {
+			panic(err)
+		}
+		defer nats.Close()
+		publisher = nats
+	}
+
+	service := invoiceService.NewInvoiceService(info, invoiceService.WithLogger(logger))
+
+	publishers := invoiceService.Publishers{publisher, invoiceService.NewWebhookPublisher(info)}
+
+	// Emails aux payeurs si un serveur SMTP est configuré
+	var notifications *invoiceService.Notifications
+	if addr := os.Getenv("INVOICE_SMTP_ADDR"); addr != "" {
+		smtp := invoiceService.NewSMTPNotifier(addr, os.Getenv("INVOICE_SMTP_FROM"), os.Getenv("INVOICE_SMTP_USERNAME"), os.Getenv("INVOICE_SMTP_PASSWORD"))
+		notifications = invoiceService.NewNotifications(info, service, smtp)
+		publishers = append(publishers, notifications)
+		go notifications.Schedule(context.Background(), 10*time.Second, logger)
+	}
+
+	// Origines autorisées à appeler le service depuis un navigateur, séparées par des virgules, aucune par défaut
+	cors := invoiceService.DefaultCORSConfig()
+	cors.AllowedOrigins = invoiceService.ParseCORSOrigins(os.Getenv("INVOICE_CORS_ALLOWED_ORIGINS"))
+	if err := cors.Validate(); err != nil {
+		panic(err)
+	}
+
+	// Limites de débit par défaut, remplaçables par les variables INVOICE_RATELIMIT_*
+	limits := invoiceService.DefaultRateLimitConfig()
+	if err := limits.LoadEnv(os.Getenv); err != nil {
+		panic(err)
+	}
+
+	handler := invoiceService.MakeHTTPHandler(service, logger,
+		invoiceService.WithRateLimits(invoiceService.NewMemoryRateLimitStore(), limits),
+		invoiceService.WithCORS(cors),
+		invoiceService.WithSecurityHeaders(invoiceService.DefaultSecurityHeadersConfig()),
+	)
+
+	// Réconciliation quotidienne des soldes, sans mise en quarantaine automatique
+	go invoiceService.NewReconciler(info).Schedule(context.Background(), 24*time.Hour, false, logger)
+
+	// Prélèvement des échéances arrivées à terme
+	go invoiceService.NewInstallmentCollector(info, service).Schedule(context.Background(), time.Hour, logger)
+
+	// Pénalités de retard sur les factures échues
+	go invoiceService.NewLateFeeApplier(info).Schedule(context.Background(), 24*time.Hour, logger)
+
+	// Publication des événements écrits dans l'outbox, les événements sont aussi mis en file pour les webhooks et les emails
+	relay := invoiceService.NewOutboxRelay(info, publishers)
+	go relay.Schedule(context.Background(), time.Second, logger)
+
+	// Envoi des webhooks
+	go invoiceService.NewWebhookDispatcher(info).Schedule(context.Background(), time.Second, logger)
+
+	// Paiements programmés par les payeurs
+	go invoiceService.NewPaymentScheduler(info, service, notifications).Schedule(context.Background(), time.Minute, logger)
+
+	// Émission des factures récurrentes
+	go invoiceService.NewRecurringIssuer(info, service).Schedule(context.Background(), time.Hour, logger)
+
+	// Émissions groupées de factures
+	go invoiceService.NewBulkInvoicer(info, service).Schedule(context.Background(), 5*time.Second, logger)
+
+	// Passage à l'état EXPIRED des factures échues
+	go invoiceService.RunEvery(context.Background(), time.Hour, func(ctx context.Context) {
+		if _, err := service.ExpireInvoices(ctx); err != nil {
+			logger.Log("expire", "failed", "err", err)
+		}
+	})
+
+	// Sans certificat le service est servi en HTTP
+	tls := invoiceService.TLSConfig{
+		CertFile:       os.Getenv("INVOICE_TLS_CERT_FILE"),
+		KeyFile:        os.Getenv("INVOICE_TLS_KEY_FILE"),
+		ClientCAFile:   os.Getenv("INVOICE_TLS_CLIENT_CA_FILE"),
+		ReloadInterval: time.Minute,
+	}
+
+	err := invoiceService.ListenAndServe(":8002", handler, tls, logger)
 	if err != nil {
 		panic(err)
 	}